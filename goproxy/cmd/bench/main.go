@@ -0,0 +1,315 @@
+// Command bench fires synthetic chat completion traffic at a running proxy
+// and reports throughput, latency percentiles and memory, so regressions in
+// the proxy path show up as numbers.
+//
+//	go run ./cmd/bench -url http://localhost:8080 -duration 30s -concurrency 20 -cached 0.5 -stream 0.2
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+type options struct {
+	url         string
+	path        string
+	key         string
+	model       string
+	duration    time.Duration
+	concurrency int
+	rate        float64
+	cached      float64
+	stream      float64
+	size        int
+	pid         int
+}
+
+// Request kinds in the traffic mix
+const (
+	kindCached   = "cached"
+	kindUncached = "uncached"
+	kindStream   = "stream"
+)
+
+type sample struct {
+	kind      string
+	latency   time.Duration
+	firstByte time.Duration
+	status    int
+	cacheHit  bool
+	err       bool
+}
+
+func main() {
+	var opts options
+	flag.StringVar(&opts.url, "url", "http://localhost:8080", "proxy base URL")
+	flag.StringVar(&opts.path, "path", "/v1/chat/completions", "endpoint to send chat completions to")
+	flag.StringVar(&opts.key, "key", os.Getenv("OPENAI_API_KEY"), "API key sent as a bearer token")
+	flag.StringVar(&opts.model, "model", "gpt-4o-mini", "model requested")
+	flag.DurationVar(&opts.duration, "duration", 30*time.Second, "how long to send traffic")
+	flag.IntVar(&opts.concurrency, "concurrency", 10, "concurrent workers")
+	flag.Float64Var(&opts.rate, "rate", 0, "requests per second across all workers, 0 for as fast as possible")
+	flag.Float64Var(&opts.cached, "cached", 0.5, "fraction of non-streaming requests that repeat a cacheable body")
+	flag.Float64Var(&opts.stream, "stream", 0.2, "fraction of requests made with stream: true")
+	flag.IntVar(&opts.size, "size", 0, "pad each request's message to this many bytes, to measure large payloads")
+	flag.IntVar(&opts.pid, "pid", 0, "proxy process ID, to sample its resident memory (Linux only)")
+	flag.Parse()
+
+	if opts.concurrency < 1 {
+		log.Fatalf("concurrency must be at least 1")
+	}
+
+	log.Printf("Sending traffic to %s%s for %v with %d workers (%.0f%% cached, %.0f%% streaming)",
+		opts.url, opts.path, opts.duration, opts.concurrency, opts.cached*100, opts.stream*100)
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.duration)
+	defer cancel()
+
+	var limiter *rate.Limiter
+	if opts.rate > 0 {
+		limiter = rate.NewLimiter(rate.Limit(opts.rate), 1)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost: opts.concurrency,
+			DisableCompression:  true,
+		},
+	}
+
+	memory := newMemorySampler(opts.pid)
+	go memory.run(ctx)
+
+	var (
+		mutex   sync.Mutex
+		samples []sample
+		sent    atomic.Int64
+		wg      sync.WaitGroup
+	)
+	start := time.Now()
+	for worker := 0; worker < opts.concurrency; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(time.Now().UnixNano() + int64(worker)))
+			for ctx.Err() == nil {
+				if limiter != nil && limiter.Wait(ctx) != nil {
+					return
+				}
+				result := send(ctx, client, opts, random, sent.Add(1))
+				if ctx.Err() != nil && result.err {
+					// Cut off by the end of the run rather than a real failure
+					return
+				}
+				mutex.Lock()
+				samples = append(samples, result)
+				mutex.Unlock()
+			}
+		}(worker)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	report(os.Stdout, samples, elapsed, memory)
+}
+
+// send makes one request of a randomly chosen kind
+func send(ctx context.Context, client *http.Client, opts options, random *rand.Rand, n int64) sample {
+	body := map[string]interface{}{
+		"model": opts.model,
+	}
+	kind := kindUncached
+	content := "Benchmark request " + strconv.FormatInt(n, 10) + " " + strconv.FormatInt(random.Int63(), 36)
+	switch {
+	case random.Float64() < opts.stream:
+		kind = kindStream
+		body["stream"] = true
+	case random.Float64() < opts.cached:
+		kind = kindCached
+		content = "Benchmark request for the cache"
+	}
+	if len(content) < opts.size {
+		content += strings.Repeat(" pad", (opts.size-len(content))/4)
+	}
+	body["messages"] = []map[string]string{{"role": "user", "content": content}}
+	encoded, _ := json.Marshal(body)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, opts.url+opts.path, strings.NewReader(string(encoded)))
+	if err != nil {
+		return sample{kind: kind, err: true}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if opts.key != "" {
+		req.Header.Set("Authorization", "Bearer "+opts.key)
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return sample{kind: kind, latency: time.Since(start), err: true}
+	}
+	defer resp.Body.Close()
+
+	result := sample{
+		kind:     kind,
+		status:   resp.StatusCode,
+		cacheHit: resp.Header.Get("X-Cache") == "HIT",
+	}
+	reader := bufio.NewReader(resp.Body)
+	if _, err := reader.Peek(1); err == nil {
+		result.firstByte = time.Since(start)
+	}
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		result.err = true
+	}
+	result.latency = time.Since(start)
+	if result.firstByte == 0 {
+		result.firstByte = result.latency
+	}
+	return result
+}
+
+func report(w io.Writer, samples []sample, elapsed time.Duration, memory *memorySampler) {
+	statuses := make(map[int]int)
+	var errors, hits int
+	for _, s := range samples {
+		if s.err {
+			errors++
+		} else {
+			statuses[s.status]++
+		}
+		if s.cacheHit {
+			hits++
+		}
+	}
+
+	fmt.Fprintf(w, "\nRequests:   %d in %v (%.1f req/s)\n", len(samples), elapsed.Round(time.Millisecond), float64(len(samples))/elapsed.Seconds())
+	fmt.Fprintf(w, "Errors:     %d\n", errors)
+	fmt.Fprintf(w, "Cache hits: %d\n", hits)
+
+	codes := make([]int, 0, len(statuses))
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	parts := make([]string, 0, len(codes))
+	for _, code := range codes {
+		parts = append(parts, fmt.Sprintf("%d x%d", code, statuses[code]))
+	}
+	fmt.Fprintf(w, "Statuses:   %s\n\n", strings.Join(parts, ", "))
+
+	fmt.Fprintf(w, "%-10s %8s %10s %10s %10s %10s %10s\n", "kind", "count", "p50", "p90", "p99", "max", "ttfb p50")
+	for _, kind := range []string{kindCached, kindUncached, kindStream, ""} {
+		var latencies, firstBytes []time.Duration
+		for _, s := range samples {
+			if s.err || (kind != "" && s.kind != kind) {
+				continue
+			}
+			latencies = append(latencies, s.latency)
+			firstBytes = append(firstBytes, s.firstByte)
+		}
+		label := kind
+		if label == "" {
+			label = "all"
+		}
+		if len(latencies) == 0 {
+			fmt.Fprintf(w, "%-10s %8d\n", label, 0)
+			continue
+		}
+		fmt.Fprintf(w, "%-10s %8d %10v %10v %10v %10v %10v\n", label, len(latencies),
+			percentile(latencies, 50), percentile(latencies, 90), percentile(latencies, 99),
+			percentile(latencies, 100), percentile(firstBytes, 50))
+	}
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	fmt.Fprintf(w, "\nBench heap: %.1f MB in use, %d GCs\n", float64(stats.HeapInuse)/1e6, stats.NumGC)
+	if peak, last, ok := memory.result(); ok {
+		fmt.Fprintf(w, "Proxy RSS:  %.1f MB peak, %.1f MB at end\n", float64(peak)/1e6, float64(last)/1e6)
+	}
+}
+
+func percentile(values []time.Duration, p int) time.Duration {
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	index := (len(values)*p + 99) / 100
+	if index > 0 {
+		index--
+	}
+	return values[index].Round(10 * time.Microsecond)
+}
+
+// memorySampler polls the proxy's resident set size from /proc while the
+// benchmark runs
+type memorySampler struct {
+	pid   int
+	mutex sync.Mutex
+	peak  int64
+	last  int64
+}
+
+func newMemorySampler(pid int) *memorySampler {
+	return &memorySampler{pid: pid}
+}
+
+func (m *memorySampler) run(ctx context.Context) {
+	if m.pid == 0 {
+		return
+	}
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		m.sample()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *memorySampler) sample() {
+	status, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", m.pid))
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		value, found := strings.CutPrefix(line, "VmRSS:")
+		if !found {
+			continue
+		}
+		kb, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(value), " kB"), 10, 64)
+		if err != nil {
+			return
+		}
+		m.mutex.Lock()
+		m.last = kb * 1024
+		if m.last > m.peak {
+			m.peak = m.last
+		}
+		m.mutex.Unlock()
+		return
+	}
+}
+
+func (m *memorySampler) result() (int64, int64, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.peak, m.last, m.peak > 0
+}
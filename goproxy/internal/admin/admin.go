@@ -0,0 +1,20 @@
+package admin
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed ui
+var uiFiles embed.FS
+
+// UIHandler serves the embedded dashboard. The page itself carries no data;
+// it calls the admin APIs with the token the operator enters in the browser.
+func UIHandler() http.Handler {
+	files, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServer(http.FS(files))
+}
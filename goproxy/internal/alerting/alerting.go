@@ -0,0 +1,241 @@
+package alerting
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"goproxyai/internal/billing"
+	"goproxyai/internal/clock"
+	"goproxyai/internal/tenant"
+	"goproxyai/internal/usage"
+)
+
+const (
+	MetricRequests = "requests"
+	MetricTokens   = "tokens"
+	MetricCost     = "cost_usd"
+
+	WindowDay   = "day"
+	WindowMonth = "month"
+)
+
+type SMTPConfig struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+// Notification is the payload delivered to tenant webhooks
+type Notification struct {
+	Tenant    string    `json:"tenant"`
+	AlertID   string    `json:"alert_id"`
+	Metric    string    `json:"metric"`
+	Window    string    `json:"window"`
+	Period    string    `json:"period"`
+	Threshold float64   `json:"threshold"`
+	Value     float64   `json:"value"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type Evaluator struct {
+	tenants    *tenant.Registry
+	tracker    *usage.Tracker
+	pricing    *billing.Pricing
+	smtp       SMTPConfig
+	httpClient *http.Client
+	logger     *log.Logger
+
+	// fired remembers the period each alert last fired in, so a threshold
+	// only notifies once per day or month
+	fired map[string]string
+	mutex sync.Mutex
+}
+
+func NewEvaluator(tenants *tenant.Registry, tracker *usage.Tracker, pricing *billing.Pricing, smtpConfig SMTPConfig, logger *log.Logger) *Evaluator {
+	return &Evaluator{
+		tenants:    tenants,
+		tracker:    tracker,
+		pricing:    pricing,
+		smtp:       smtpConfig,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		logger:     logger,
+		fired:      make(map[string]string),
+	}
+}
+
+// Validate checks an alert definition before it is registered
+func (e *Evaluator) Validate(alert tenant.Alert) error {
+	switch alert.Metric {
+	case MetricRequests, MetricTokens, MetricCost:
+	default:
+		return fmt.Errorf("metric must be one of %s, %s, %s", MetricRequests, MetricTokens, MetricCost)
+	}
+
+	switch alert.Window {
+	case WindowDay, WindowMonth:
+	default:
+		return fmt.Errorf("window must be %s or %s", WindowDay, WindowMonth)
+	}
+
+	if alert.Threshold <= 0 {
+		return fmt.Errorf("threshold must be positive")
+	}
+
+	if alert.Webhook == "" && alert.Email == "" {
+		return fmt.Errorf("a webhook or email target is required")
+	}
+	if alert.Webhook != "" && !strings.HasPrefix(alert.Webhook, "http://") && !strings.HasPrefix(alert.Webhook, "https://") {
+		return fmt.Errorf("webhook must be an http(s) URL")
+	}
+	if alert.Email != "" {
+		if e.smtp.Addr == "" {
+			return fmt.Errorf("email alerts require SMTP_ADDR to be configured")
+		}
+		if address, err := mail.ParseAddress(alert.Email); err != nil || address.Address != alert.Email {
+			return fmt.Errorf("email must be a plain address like team@example.com")
+		}
+	}
+
+	return nil
+}
+
+func (e *Evaluator) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			e.Evaluate()
+		}
+	}()
+}
+
+func (e *Evaluator) Evaluate() {
+	now := clock.Now().UTC()
+
+	for _, t := range e.tenants.Tenants() {
+		for _, alert := range t.Alerts {
+			from, period := windowStart(alert.Window, now)
+			value := e.measure(t.ID, alert.Metric, from, now)
+			if value < alert.Threshold || !e.markFired(alert.ID, period) {
+				continue
+			}
+
+			notification := Notification{
+				Tenant:    t.ID,
+				AlertID:   alert.ID,
+				Metric:    alert.Metric,
+				Window:    alert.Window,
+				Period:    period,
+				Threshold: alert.Threshold,
+				Value:     value,
+				Timestamp: now,
+			}
+			e.logger.Printf("Tenant %s crossed %s threshold %.2f (%.2f) for %s", t.ID, alert.Metric, alert.Threshold, value, period)
+			e.notify(alert, notification)
+		}
+	}
+}
+
+func (e *Evaluator) markFired(alertID, period string) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.fired[alertID] == period {
+		return false
+	}
+	e.fired[alertID] = period
+	return true
+}
+
+func windowStart(window string, now time.Time) (time.Time, string) {
+	if window == WindowMonth {
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC), now.Format("2006-01")
+	}
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC), now.Format("2006-01-02")
+}
+
+func (e *Evaluator) measure(tenantID, metric string, from, to time.Time) float64 {
+	switch metric {
+	case MetricRequests:
+		return float64(e.tracker.TenantTotals(tenantID, from, to).Requests)
+	case MetricTokens:
+		return float64(e.tracker.TenantTotals(tenantID, from, to).TotalTokens)
+	case MetricCost:
+		var cost float64
+		for model, totals := range e.tracker.TenantModelTotals(from, to)[tenantID] {
+			modelCost, _ := e.pricing.Cost(model, totals.PromptTokens, totals.CompletionTokens)
+			cost += modelCost
+		}
+		return cost
+	}
+	return 0
+}
+
+func (e *Evaluator) notify(alert tenant.Alert, notification Notification) {
+	if alert.Webhook != "" {
+		if err := e.sendWebhook(alert.Webhook, notification); err != nil {
+			e.logger.Printf("Failed to deliver alert %s to webhook: %v", alert.ID, err)
+		}
+	}
+	if alert.Email != "" {
+		if err := e.sendEmail(alert.Email, notification); err != nil {
+			e.logger.Printf("Failed to deliver alert %s by email: %v", alert.ID, err)
+		}
+	}
+}
+
+func (e *Evaluator) sendWebhook(url string, notification Notification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (e *Evaluator) sendEmail(to string, notification Notification) error {
+	subject := fmt.Sprintf("[goproxyai] %s usage alert for %s", notification.Tenant, notification.Period)
+	body := fmt.Sprintf("Tenant %s has reached %.2f %s this %s (threshold %.2f).\r\n",
+		notification.Tenant, notification.Value, notification.Metric, notification.Window, notification.Threshold)
+	message := "From: " + e.smtp.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"\r\n" + body
+
+	var auth smtp.Auth
+	if e.smtp.Username != "" {
+		host := strings.Split(e.smtp.Addr, ":")[0]
+		auth = smtp.PlainAuth("", e.smtp.Username, e.smtp.Password, host)
+	}
+
+	return smtp.SendMail(e.smtp.Addr, auth, e.smtp.From, []string{to}, []byte(message))
+}
@@ -0,0 +1,157 @@
+// Package authz asks an external authorization service whether to let a
+// request through, in the style of Envoy's ext_authz. Requests are posted as
+// {"input": {...}}, the shape OPA's data API expects, so a policy engine can
+// be pointed at directly.
+package authz
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+
+	"goproxyai/internal/clock"
+)
+
+// Largest verdict read back from the service
+const maxVerdictBytes = 64 * 1024
+
+// Input describes the request being authorized
+type Input struct {
+	KeyID  string `json:"key_id"`
+	Tenant string `json:"tenant,omitempty"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Model  string `json:"model,omitempty"`
+	User   string `json:"user,omitempty"`
+}
+
+// Decision is the service's verdict. A denial may carry the status and
+// reason to answer with; an allowed request may be annotated with headers
+// to add when it's forwarded upstream.
+type Decision struct {
+	Allow   bool              `json:"allow"`
+	Status  int               `json:"status,omitempty"`
+	Reason  string            `json:"reason,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+type cachedDecision struct {
+	decision  Decision
+	timestamp time.Time
+}
+
+// Client calls the authorization service, remembering each verdict for the
+// cache TTL
+type Client struct {
+	url        string
+	httpClient *http.Client
+	ttl        time.Duration
+	decisions  *cache.Cache
+}
+
+// New returns a client for the service at url. A cacheTTL of 0 asks the
+// service about every request.
+func New(url string, timeout, cacheTTL time.Duration) (*Client, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("invalid authorization service URL %q", url)
+	}
+	client := &Client{
+		url:        url,
+		httpClient: &http.Client{Timeout: timeout},
+		ttl:        cacheTTL,
+	}
+	if cacheTTL > 0 {
+		cleanupInterval := cacheTTL
+		if cleanupInterval < time.Minute {
+			cleanupInterval = time.Minute
+		}
+		client.decisions = cache.New(cacheTTL, cleanupInterval)
+	}
+	return client, nil
+}
+
+// Check returns the verdict for input, from the cache when there's a recent
+// one. Whether the service couldn't be reached or answered with something
+// other than a verdict, the error is returned and nothing is cached.
+func (c *Client) Check(ctx context.Context, input Input) (Decision, error) {
+	key := cacheKey(input)
+	if c.decisions != nil {
+		if item, found := c.decisions.Get(key); found {
+			// The store expires entries by the system clock; this catches
+			// those a fake clock has moved past their TTL first
+			if cached := item.(*cachedDecision); clock.Since(cached.timestamp) < c.ttl {
+				return cached.decision, nil
+			}
+		}
+	}
+
+	decision, err := c.ask(ctx, input)
+	if err != nil {
+		return Decision{}, err
+	}
+	if c.decisions != nil {
+		c.decisions.SetDefault(key, &cachedDecision{decision: decision, timestamp: clock.Now()})
+	}
+	return decision, nil
+}
+
+func (c *Client) ask(ctx context.Context, input Input) (Decision, error) {
+	body, err := json.Marshal(map[string]Input{"input": input})
+	if err != nil {
+		return Decision{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return Decision{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return Decision{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Decision{}, fmt.Errorf("authorization service returned %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxVerdictBytes))
+	if err != nil {
+		return Decision{}, err
+	}
+	return parseDecision(data)
+}
+
+// parseDecision reads a verdict given as a decision object, or as OPA
+// wraps it: {"result": {...}}, or {"result": true} for a bare allow rule
+func parseDecision(data []byte) (Decision, error) {
+	var wrapped struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(data, &wrapped); err != nil {
+		return Decision{}, fmt.Errorf("invalid authorization verdict: %w", err)
+	}
+	if len(wrapped.Result) > 0 {
+		data = wrapped.Result
+	}
+
+	var allow bool
+	if err := json.Unmarshal(data, &allow); err == nil {
+		return Decision{Allow: allow}, nil
+	}
+	var decision Decision
+	if err := json.Unmarshal(data, &decision); err != nil {
+		return Decision{}, fmt.Errorf("invalid authorization verdict: %w", err)
+	}
+	return decision, nil
+}
+
+func cacheKey(input Input) string {
+	return strings.Join([]string{input.KeyID, input.Tenant, input.Method, input.Path, input.Model, input.User}, "\x00")
+}
@@ -0,0 +1,314 @@
+package batching
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"goproxyai/internal/proxy"
+)
+
+// Headers that decide which upstream account a request is billed to, so
+// only requests that agree on them may share a call
+var accountHeaders = []string{
+	"Authorization",
+	"Openai-Organization",
+	"Openai-Project",
+}
+
+// EmbeddingBatcher coalesces single-input embedding requests that arrive
+// within a short window into one upstream call, then splits the vectors
+// back out per caller
+type EmbeddingBatcher struct {
+	client    *proxy.Client
+	window    time.Duration
+	maxInputs int
+	timeout   time.Duration
+
+	mutex   sync.Mutex
+	pending map[string]*batch
+}
+
+type batch struct {
+	upstream string
+	headers  http.Header
+	fields   map[string]json.RawMessage
+	inputs   []string
+	waiters  []chan result
+	timer    *time.Timer
+}
+
+type result struct {
+	resp *proxy.ProxyResponse
+	err  error
+}
+
+func NewEmbeddingBatcher(client *proxy.Client, window time.Duration, maxInputs int, timeout time.Duration) *EmbeddingBatcher {
+	if maxInputs < 1 {
+		maxInputs = 1
+	}
+	return &EmbeddingBatcher{
+		client:    client,
+		window:    window,
+		maxInputs: maxInputs,
+		timeout:   timeout,
+		pending:   make(map[string]*batch),
+	}
+}
+
+// Forward sends an embeddings request upstream, joining it to a batch when
+// it has a single text input. Other requests are forwarded as they are.
+func (b *EmbeddingBatcher) Forward(ctx context.Context, req *proxy.ProxyRequest) (*proxy.ProxyResponse, error) {
+	fields, input, ok := singleInput(req.Body)
+	if !ok {
+		return b.client.Forward(ctx, req)
+	}
+
+	upstream, _ := proxy.Upstream(ctx)
+	key, err := batchKey(upstream, req.Headers, fields)
+	if err != nil {
+		return b.client.Forward(ctx, req)
+	}
+
+	done := make(chan result, 1)
+	b.mutex.Lock()
+	pending, exists := b.pending[key]
+	if !exists {
+		pending = &batch{upstream: upstream, headers: req.Headers, fields: fields}
+		b.pending[key] = pending
+		pending.timer = time.AfterFunc(b.window, func() { b.flush(key, pending) })
+	}
+	pending.inputs = append(pending.inputs, input)
+	pending.waiters = append(pending.waiters, done)
+	sendNow := false
+	if len(pending.inputs) >= b.maxInputs {
+		// Full batches go out right away unless the timer beat us to it
+		delete(b.pending, key)
+		sendNow = pending.timer.Stop()
+	}
+	b.mutex.Unlock()
+
+	if sendNow {
+		go b.deliver(pending)
+	}
+
+	// The batch carries on for the other callers if this one gives up
+	select {
+	case res := <-done:
+		return res.resp, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (b *EmbeddingBatcher) flush(key string, pending *batch) {
+	b.mutex.Lock()
+	if b.pending[key] == pending {
+		delete(b.pending, key)
+	}
+	b.mutex.Unlock()
+
+	b.deliver(pending)
+}
+
+func (b *EmbeddingBatcher) deliver(pending *batch) {
+	results := b.send(pending)
+	for i, waiter := range pending.waiters {
+		waiter <- results[i]
+	}
+}
+
+// send makes the batched upstream call and returns one result per input
+func (b *EmbeddingBatcher) send(pending *batch) []result {
+	results := make([]result, len(pending.inputs))
+	fail := func(err error) []result {
+		for i := range results {
+			results[i] = result{err: err}
+		}
+		return results
+	}
+
+	fields := make(map[string]json.RawMessage, len(pending.fields)+1)
+	for name, value := range pending.fields {
+		fields[name] = value
+	}
+	inputs, err := json.Marshal(pending.inputs)
+	if err != nil {
+		return fail(err)
+	}
+	fields["input"] = inputs
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return fail(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+	defer cancel()
+	if pending.upstream != "" {
+		ctx = proxy.WithUpstream(ctx, pending.upstream)
+	}
+	resp, err := b.client.Forward(ctx, &proxy.ProxyRequest{
+		Method:  http.MethodPost,
+		Path:    "/v1/embeddings",
+		Headers: pending.headers,
+		Body:    body,
+	})
+	if err != nil {
+		return fail(err)
+	}
+
+	// Errors apply to every caller alike
+	if resp.StatusCode != http.StatusOK || len(pending.inputs) == 1 {
+		for i := range results {
+			results[i] = result{resp: resp}
+		}
+		return results
+	}
+
+	split, err := splitResponse(resp.Body, pending.inputs)
+	if err != nil {
+		return fail(fmt.Errorf("splitting batched embeddings response: %w", err))
+	}
+
+	headers := make(map[string][]string, len(resp.Headers)+1)
+	for name, values := range resp.Headers {
+		if name != "Content-Length" {
+			headers[name] = values
+		}
+	}
+	headers["X-Coalesced"] = []string{strconv.Itoa(len(pending.inputs))}
+
+	for i, part := range split {
+		results[i] = result{resp: &proxy.ProxyResponse{
+			StatusCode: resp.StatusCode,
+			Headers:    headers,
+			Body:       part,
+		}}
+	}
+	return results
+}
+
+type embeddingsResponse struct {
+	Object string          `json:"object"`
+	Data   []embeddingData `json:"data"`
+	Model  string          `json:"model"`
+	Usage  *embeddingUsage `json:"usage,omitempty"`
+}
+
+type embeddingData struct {
+	Object    string          `json:"object"`
+	Index     int             `json:"index"`
+	Embedding json.RawMessage `json:"embedding"`
+}
+
+type embeddingUsage struct {
+	PromptTokens int `json:"prompt_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+// splitResponse turns a batched response into one single-input response
+// per caller. Upstream only reports usage for the whole batch, so it is
+// shared out in proportion to each input's length.
+func splitResponse(body []byte, inputs []string) ([][]byte, error) {
+	var batched embeddingsResponse
+	if err := json.Unmarshal(body, &batched); err != nil {
+		return nil, err
+	}
+
+	byIndex := make(map[int]embeddingData, len(batched.Data))
+	for _, data := range batched.Data {
+		byIndex[data.Index] = data
+	}
+
+	var totalChars int
+	for _, input := range inputs {
+		totalChars += len(input)
+	}
+
+	parts := make([][]byte, len(inputs))
+	var promptShared, totalShared int
+	for i, input := range inputs {
+		data, found := byIndex[i]
+		if !found {
+			return nil, fmt.Errorf("no embedding for input %d", i)
+		}
+		data.Index = 0
+
+		single := embeddingsResponse{
+			Object: batched.Object,
+			Data:   []embeddingData{data},
+			Model:  batched.Model,
+		}
+		if batched.Usage != nil {
+			usage := &embeddingUsage{}
+			if i == len(inputs)-1 {
+				usage.PromptTokens = batched.Usage.PromptTokens - promptShared
+				usage.TotalTokens = batched.Usage.TotalTokens - totalShared
+			} else if totalChars > 0 {
+				usage.PromptTokens = batched.Usage.PromptTokens * len(input) / totalChars
+				usage.TotalTokens = batched.Usage.TotalTokens * len(input) / totalChars
+			}
+			promptShared += usage.PromptTokens
+			totalShared += usage.TotalTokens
+			single.Usage = usage
+		}
+
+		encoded, err := json.Marshal(single)
+		if err != nil {
+			return nil, err
+		}
+		parts[i] = encoded
+	}
+	return parts, nil
+}
+
+// singleInput splits a request body into its input, when that is a single
+// string, and the remaining fields
+func singleInput(body []byte) (map[string]json.RawMessage, string, bool) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil || fields == nil {
+		return nil, "", false
+	}
+
+	raw, found := fields["input"]
+	if !found {
+		return nil, "", false
+	}
+	var input string
+	if err := json.Unmarshal(raw, &input); err != nil {
+		var inputs []string
+		if err := json.Unmarshal(raw, &inputs); err != nil || len(inputs) != 1 {
+			return nil, "", false
+		}
+		input = inputs[0]
+	}
+
+	delete(fields, "input")
+	return fields, input, true
+}
+
+// batchKey groups requests that can share an upstream call: the same
+// upstream and account, and identical parameters apart from the input
+func batchKey(upstream string, headers http.Header, fields map[string]json.RawMessage) (string, error) {
+	account := make(map[string][]string, len(accountHeaders))
+	for _, name := range accountHeaders {
+		account[name] = headers.Values(name)
+	}
+
+	keyBytes, err := json.Marshal(struct {
+		Upstream string                     `json:"upstream"`
+		Account  map[string][]string        `json:"account"`
+		Fields   map[string]json.RawMessage `json:"fields"`
+	}{upstream, account, fields})
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(keyBytes)
+	return hex.EncodeToString(hash[:]), nil
+}
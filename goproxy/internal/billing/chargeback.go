@@ -0,0 +1,189 @@
+package billing
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"goproxyai/internal/clock"
+	"goproxyai/internal/usage"
+)
+
+const monthLayout = "2006-01"
+
+type Report struct {
+	Month       string         `json:"month"`
+	GeneratedAt time.Time      `json:"generated_at"`
+	TotalCost   float64        `json:"total_cost_usd"`
+	Tenants     []TenantCharge `json:"tenants"`
+}
+
+type TenantCharge struct {
+	Tenant    string        `json:"tenant"`
+	TotalCost float64       `json:"total_cost_usd"`
+	Models    []ModelCharge `json:"models"`
+}
+
+type ModelCharge struct {
+	Model            string  `json:"model"`
+	Requests         int64   `json:"requests"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	Cost             float64 `json:"cost_usd"`
+	Priced           bool    `json:"priced"`
+}
+
+type Reporter struct {
+	tracker *usage.Tracker
+	pricing *Pricing
+	started time.Time // usage from before this wasn't recorded
+}
+
+func NewReporter(tracker *usage.Tracker, pricing *Pricing) *Reporter {
+	return &Reporter{
+		tracker: tracker,
+		pricing: pricing,
+		started: clock.Now().UTC(),
+	}
+}
+
+func ParseMonth(value string) (time.Time, error) {
+	return time.Parse(monthLayout, value)
+}
+
+// Chargeback builds the per-tenant cost breakdown for the calendar month
+// (UTC) containing the given time
+func (r *Reporter) Chargeback(month time.Time) *Report {
+	start := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 1, -1)
+
+	report := &Report{
+		Month:       start.Format(monthLayout),
+		GeneratedAt: clock.Now().UTC(),
+		Tenants:     []TenantCharge{},
+	}
+
+	for tenantID, byModel := range r.tracker.TenantModelTotals(start, end) {
+		if tenantID == "" {
+			tenantID = "unassigned"
+		}
+		charge := TenantCharge{Tenant: tenantID}
+
+		for model, totals := range byModel {
+			cost, priced := r.pricing.Cost(model, totals.PromptTokens, totals.CompletionTokens)
+			charge.Models = append(charge.Models, ModelCharge{
+				Model:            model,
+				Requests:         totals.Requests,
+				PromptTokens:     totals.PromptTokens,
+				CompletionTokens: totals.CompletionTokens,
+				Cost:             roundCents(cost),
+				Priced:           priced,
+			})
+			charge.TotalCost += cost
+		}
+		sort.Slice(charge.Models, func(i, j int) bool { return charge.Models[i].Model < charge.Models[j].Model })
+
+		report.TotalCost += charge.TotalCost
+		charge.TotalCost = roundCents(charge.TotalCost)
+		report.Tenants = append(report.Tenants, charge)
+	}
+	sort.Slice(report.Tenants, func(i, j int) bool { return report.Tenants[i].Tenant < report.Tenants[j].Tenant })
+	report.TotalCost = roundCents(report.TotalCost)
+
+	return report
+}
+
+// Costs are kept to a hundredth of a cent so small models don't round to zero
+func roundCents(value float64) float64 {
+	return math.Round(value*10000) / 10000
+}
+
+func (r *Report) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"month", "tenant", "model", "requests", "prompt_tokens", "completion_tokens", "cost_usd", "priced"}); err != nil {
+		return err
+	}
+
+	for _, tenantCharge := range r.Tenants {
+		for _, model := range tenantCharge.Models {
+			record := []string{
+				r.Month,
+				tenantCharge.Tenant,
+				model.Model,
+				strconv.FormatInt(model.Requests, 10),
+				strconv.FormatInt(model.PromptTokens, 10),
+				strconv.FormatInt(model.CompletionTokens, 10),
+				strconv.FormatFloat(model.Cost, 'f', 4, 64),
+				strconv.FormatBool(model.Priced),
+			}
+			if err := writer.Write(record); err != nil {
+				return err
+			}
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// StartSchedule writes the previous month's report to dir as JSON and CSV
+// once the month has rolled over. Existing report files are left alone so
+// restarts don't overwrite a report generated with more complete data, and
+// months the process wasn't running for from their start aren't written at
+// all, since usage from before it started is gone.
+func (r *Reporter) StartSchedule(dir string, interval time.Duration, logger *log.Logger) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := r.writePreviousMonth(dir); err != nil {
+				logger.Printf("Failed to write chargeback report: %v", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+func (r *Reporter) writePreviousMonth(dir string) error {
+	now := clock.Now().UTC()
+	previous := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, -1)
+	if r.started.After(time.Date(previous.Year(), previous.Month(), 1, 0, 0, 0, 0, time.UTC)) {
+		return nil
+	}
+	base := filepath.Join(dir, "chargeback-"+previous.Format(monthLayout))
+
+	if _, err := os.Stat(base + ".json"); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	report := r.Chargeback(previous)
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	csvFile, err := os.Create(base + ".csv")
+	if err != nil {
+		return err
+	}
+	defer csvFile.Close()
+	if err := report.WriteCSV(csvFile); err != nil {
+		return err
+	}
+
+	// The JSON file is written last since its presence marks the month done
+	return os.WriteFile(base+".json", data, 0o644)
+}
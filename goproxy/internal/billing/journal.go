@@ -0,0 +1,204 @@
+package billing
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const dayLayout = "2006-01-02"
+
+// Entries waiting to be written; Write blocks once this many are queued,
+// rather than dropping any
+const journalQueue = 4096
+
+// Entry is one request in the journal
+type Entry struct {
+	ID                string    `json:"id"`
+	Time              time.Time `json:"time"`
+	Completed         time.Time `json:"completed"`
+	Method            string    `json:"method"`
+	Path              string    `json:"path"`
+	Status            int       `json:"status"`
+	Cache             string    `json:"cache,omitempty"`
+	Tenant            string    `json:"tenant,omitempty"`
+	Key               string    `json:"key"`
+	User              string    `json:"user,omitempty"`
+	Model             string    `json:"model,omitempty"`
+	PromptTokens      int64     `json:"prompt_tokens"`
+	CompletionTokens  int64     `json:"completion_tokens"`
+	TotalTokens       int64     `json:"total_tokens"`
+	Cost              float64   `json:"cost_usd"`
+	Priced            bool      `json:"priced"`
+	UpstreamRequestID string    `json:"upstream_request_id,omitempty"`
+}
+
+// Journal appends an entry per request to a JSON lines file for each UTC
+// day in its directory, so proxy-side accounting can be reconciled against
+// the provider's invoice. Entries are written as they come and synced to
+// disk every interval, so a crash loses at most the last interval's.
+type Journal struct {
+	dir      string
+	interval time.Duration
+	entries  chan Entry
+	done     chan struct{}
+	logger   *log.Logger
+
+	// Held to write entries, and taken whole to close the journal
+	closing sync.RWMutex
+	closed  bool
+
+	day    string
+	file   *os.File
+	writer *bufio.Writer
+	dirty  bool
+}
+
+// OpenJournal starts a journal in dir, creating it if need be
+func OpenJournal(dir string, interval time.Duration, logger *log.Logger) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	j := &Journal{
+		dir:      dir,
+		interval: interval,
+		entries:  make(chan Entry, journalQueue),
+		done:     make(chan struct{}),
+		logger:   logger,
+	}
+	// Opening today's file up front reports an unwritable directory at
+	// startup rather than with the first request
+	if err := j.open(time.Now().UTC().Format(dayLayout)); err != nil {
+		return nil, err
+	}
+	go j.run()
+	return j, nil
+}
+
+// Write queues an entry to be journaled. Entries written once the journal
+// is closed are dropped.
+func (j *Journal) Write(entry Entry) {
+	j.closing.RLock()
+	defer j.closing.RUnlock()
+	if j.closed {
+		j.logger.Printf("Journal closed, dropped request %s", entry.ID)
+		return
+	}
+	j.entries <- entry
+}
+
+// Close writes and syncs the entries queued so far and closes the journal
+func (j *Journal) Close() error {
+	j.closing.Lock()
+	j.closed = true
+	close(j.entries)
+	j.closing.Unlock()
+	<-j.done
+	return j.file.Close()
+}
+
+func (j *Journal) run() {
+	defer close(j.done)
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case entry, ok := <-j.entries:
+			if !ok {
+				j.sync()
+				return
+			}
+			if err := j.append(entry); err != nil {
+				j.logger.Printf("Failed to journal request %s: %v", entry.ID, err)
+			}
+		case <-ticker.C:
+			j.sync()
+		}
+	}
+}
+
+// append writes an entry to the file of the day its request started
+func (j *Journal) append(entry Entry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if day := entry.Time.UTC().Format(dayLayout); day != j.day {
+		j.sync()
+		if err := j.file.Close(); err != nil {
+			j.logger.Printf("Failed to close journal %s: %v", j.file.Name(), err)
+		}
+		if err := j.open(day); err != nil {
+			return err
+		}
+	}
+	j.dirty = true
+	_, err = j.writer.Write(append(line, '\n'))
+	return err
+}
+
+// sync flushes written entries and has them reach the disk
+func (j *Journal) sync() {
+	if !j.dirty {
+		return
+	}
+	if err := j.writer.Flush(); err != nil {
+		j.logger.Printf("Failed to write journal %s: %v", j.file.Name(), err)
+		return
+	}
+	if err := j.file.Sync(); err != nil {
+		j.logger.Printf("Failed to sync journal %s: %v", j.file.Name(), err)
+		return
+	}
+	j.dirty = false
+}
+
+// open opens a day's file for appending. A line a crash cut short is
+// dropped first, so every line in the file is a whole entry.
+func (j *Journal) open(day string) error {
+	file, err := os.OpenFile(filepath.Join(j.dir, "requests-"+day+".jsonl"), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	end, err := completeLength(file)
+	if err == nil {
+		err = file.Truncate(end)
+	}
+	if err == nil {
+		_, err = file.Seek(end, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	j.day, j.file, j.writer = day, file, bufio.NewWriter(file)
+	return nil
+}
+
+// completeLength is the length of a file up to the end of its last line
+func completeLength(file *os.File) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	const chunk = 64 * 1024
+	for end := info.Size(); end > 0; {
+		start := max(end-chunk, 0)
+		buf := make([]byte, end-start)
+		if _, err := file.ReadAt(buf, start); err != nil {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+			return start + int64(i) + 1, nil
+		}
+		end = start
+	}
+	return 0, nil
+}
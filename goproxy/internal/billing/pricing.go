@@ -0,0 +1,89 @@
+package billing
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Price is the cost in USD per one million tokens
+type Price struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+}
+
+type Pricing struct {
+	prices map[string]Price
+}
+
+var defaultPrices = map[string]Price{
+	"gpt-4.1":                {Input: 2.00, Output: 8.00},
+	"gpt-4.1-mini":           {Input: 0.40, Output: 1.60},
+	"gpt-4.1-nano":           {Input: 0.10, Output: 0.40},
+	"gpt-4o":                 {Input: 2.50, Output: 10.00},
+	"gpt-4o-mini":            {Input: 0.15, Output: 0.60},
+	"gpt-4-turbo":            {Input: 10.00, Output: 30.00},
+	"gpt-4":                  {Input: 30.00, Output: 60.00},
+	"gpt-3.5-turbo":          {Input: 0.50, Output: 1.50},
+	"o1":                     {Input: 15.00, Output: 60.00},
+	"o1-mini":                {Input: 1.10, Output: 4.40},
+	"o3":                     {Input: 2.00, Output: 8.00},
+	"o3-mini":                {Input: 1.10, Output: 4.40},
+	"o4-mini":                {Input: 1.10, Output: 4.40},
+	"text-embedding-3-small": {Input: 0.02},
+	"text-embedding-3-large": {Input: 0.13},
+	"text-embedding-ada-002": {Input: 0.10},
+}
+
+// LoadPricing returns the built-in price table, overridden by entries from
+// a JSON file of the form {"model": {"input": 2.5, "output": 10}} if given
+func LoadPricing(path string) (*Pricing, error) {
+	prices := make(map[string]Price, len(defaultPrices))
+	for model, price := range defaultPrices {
+		prices[model] = price
+	}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var overrides map[string]Price
+		if err := json.Unmarshal(data, &overrides); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		for model, price := range overrides {
+			prices[model] = price
+		}
+	}
+
+	return &Pricing{prices: prices}, nil
+}
+
+// Lookup finds the price for a model, falling back to the longest known
+// prefix so dated snapshots like gpt-4o-2024-08-06 resolve to gpt-4o
+func (p *Pricing) Lookup(model string) (Price, bool) {
+	if price, exists := p.prices[model]; exists {
+		return price, true
+	}
+
+	var best string
+	for name := range p.prices {
+		if strings.HasPrefix(model, name+"-") && len(name) > len(best) {
+			best = name
+		}
+	}
+	if best == "" {
+		return Price{}, false
+	}
+	return p.prices[best], true
+}
+
+func (p *Pricing) Cost(model string, promptTokens, completionTokens int64) (float64, bool) {
+	price, ok := p.Lookup(model)
+	if !ok {
+		return 0, false
+	}
+	return (float64(promptTokens)*price.Input + float64(completionTokens)*price.Output) / 1e6, true
+}
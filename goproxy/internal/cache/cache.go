@@ -2,16 +2,42 @@ package cache
 
 import (
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
-	"encoding/json"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/patrickmn/go-cache"
+
+	"goproxyai/internal/clock"
 )
 
 type Cache struct {
 	store *cache.Cache
 	ttl   time.Duration
+
+	// maxSpeechBytes caps cached text-to-speech responses, 0 disables them
+	maxSpeechBytes int64
+	// maxEntryBytes caps every other cached response
+	maxEntryBytes int64
+
+	// shard keeps the entries other replicas own with them, when set
+	shard Shard
+
+	// trash holds what Clear last cleared, for Restore
+	trash trash[cache.Item]
+}
+
+// Shard spreads entries across the replicas of a cluster, so each keeps
+// the keys it owns rather than every replica keeping everything. Get and
+// Set report local when the entry is this replica's to keep, or its owner
+// can't be reached.
+type Shard interface {
+	Get(key string) (entry *CacheEntry, local bool)
+	Set(key string, entry *CacheEntry) (local bool)
 }
 
 type CacheEntry struct {
@@ -19,9 +45,25 @@ type CacheEntry struct {
 	Headers    map[string][]string `json:"headers"`
 	Body       []byte              `json:"body"`
 	Timestamp  time.Time           `json:"timestamp"`
+
+	// TTL keeps the entry for this long instead of the cache's TTL, when set
+	TTL time.Duration `json:"ttl,omitempty"`
+
+	// Tenant and User are who the response was for, so a deletion request
+	// reaches it
+	Tenant string `json:"tenant,omitempty"`
+	User   string `json:"user,omitempty"`
 }
 
-func New(ttl time.Duration, maxSizeMB int64) *Cache {
+// lifetime is how long the entry is kept in a cache with the given TTL
+func (e *CacheEntry) lifetime(ttl time.Duration) time.Duration {
+	if e.TTL > 0 {
+		return e.TTL
+	}
+	return ttl
+}
+
+func New(ttl time.Duration, maxSizeMB int64, maxSpeechKB int64, maxEntryKB int64) *Cache {
 	// Assuming average response size of 1KB, 1MB = ~1000 items
 	cleanupInterval := ttl / 2
 	if cleanupInterval < time.Minute {
@@ -29,61 +71,99 @@ func New(ttl time.Duration, maxSizeMB int64) *Cache {
 	}
 
 	return &Cache{
-		store: cache.New(ttl, cleanupInterval),
-		ttl:   ttl,
+		store:          cache.New(ttl, cleanupInterval),
+		ttl:            ttl,
+		maxSpeechBytes: maxSpeechKB * 1024,
+		maxEntryBytes:  maxEntryKB * 1024,
 	}
 }
 
-func (c *Cache) generateKey(method, path string, headers map[string]string, body []byte) string {
-	// Create a unique key based on method, path, relevant headers, and body
-	keyData := struct {
-		Method  string            `json:"method"`
-		Path    string            `json:"path"`
-		Headers map[string]string `json:"headers"`
-		Body    string            `json:"body"`
-	}{
-		Method:  method,
-		Path:    path,
-		Headers: c.filterCacheableHeaders(headers),
-		Body:    string(body),
-	}
-
-	keyBytes, _ := json.Marshal(keyData)
-	hash := sha256.Sum256(keyBytes)
-	return hex.EncodeToString(hash[:])
+// Headers that affect the response content, and so the cache key
+var keyHeaders = []string{
+	"Authorization",
+	"Content-Type",
+	"Accept",
+	"User-Agent",
+	"X-OpenAI-Organization",
 }
 
-func (c *Cache) filterCacheableHeaders(headers map[string]string) map[string]string {
-	// Only include headers that affect the response content
-	cacheableHeaders := make(map[string]string)
-
-	relevantHeaders := []string{
-		"Authorization",
-		"Content-Type",
-		"Accept",
-		"User-Agent",
-		"X-OpenAI-Organization",
-	}
-
-	for _, header := range relevantHeaders {
-		if value, exists := headers[header]; exists {
-			cacheableHeaders[header] = value
+// generateKey hashes the method, path, relevant headers and body straight
+// into SHA-256 without assembling them in memory first, so a large body is
+// never copied. Every field is length-prefixed so adjacent fields can't run
+// into each other.
+func (c *Cache) generateKey(method, path string, headers http.Header, body []byte) string {
+	digest := sha256.New()
+	writeKeyField(digest, method)
+	writeKeyField(digest, path)
+	for _, name := range keyHeaders {
+		values := headers.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+		writeKeyField(digest, name)
+		// Repeated headers are combined the way HTTP allows, so a single
+		// value keys the same as the combined form
+		length := 2 * (len(values) - 1)
+		for _, value := range values {
+			length += len(value)
+		}
+		writeKeyLength(digest, length)
+		for i, value := range values {
+			if i > 0 {
+				io.WriteString(digest, ", ")
+			}
+			io.WriteString(digest, value)
 		}
 	}
+	writeKeyLength(digest, len(body))
+	digest.Write(body)
 
-	return cacheableHeaders
+	var sum [sha256.Size]byte
+	return hex.EncodeToString(digest.Sum(sum[:0]))
 }
 
-func (c *Cache) Get(method, path string, headers map[string]string, body []byte) (*CacheEntry, bool) {
+func writeKeyField(digest hash.Hash, value string) {
+	writeKeyLength(digest, len(value))
+	io.WriteString(digest, value)
+}
+
+func writeKeyLength(digest hash.Hash, length int) {
+	var prefix [binary.MaxVarintLen64]byte
+	digest.Write(prefix[:binary.PutUvarint(prefix[:], uint64(length))])
+}
+
+func (c *Cache) Get(method, path string, headers http.Header, body []byte) (*CacheEntry, bool) {
 	// Only cache GET requests and certain POST requests
 	if !c.isCacheable(method, path) {
 		return nil, false
 	}
 
+	return c.lookup(method, path, headers, body)
+}
+
+// GetOptIn looks up a request the client asked to have cached, which may
+// be cached whatever its path
+func (c *Cache) GetOptIn(method, path string, headers http.Header, body []byte) (*CacheEntry, bool) {
+	return c.lookup(method, path, headers, body)
+}
+
+func (c *Cache) lookup(method, path string, headers http.Header, body []byte) (*CacheEntry, bool) {
 	key := c.generateKey(method, path, headers, body)
+	if c.shard != nil {
+		if entry, local := c.shard.Get(key); !local {
+			return entry, entry != nil && clock.Since(entry.Timestamp) < entry.lifetime(c.ttl)
+		}
+	}
+	return c.LookupKey(key)
+}
 
+// LookupKey looks an entry up by its key in this replica's store only, for
+// the replicas it's the owner for
+func (c *Cache) LookupKey(key string) (*CacheEntry, bool) {
 	if item, found := c.store.Get(key); found {
-		if entry, ok := item.(*CacheEntry); ok {
+		// The store expires entries by the system clock; this catches those
+		// a fake clock has moved past their TTL first
+		if entry, ok := item.(*CacheEntry); ok && clock.Since(entry.Timestamp) < entry.lifetime(c.ttl) {
 			return entry, true
 		}
 	}
@@ -91,24 +171,115 @@ func (c *Cache) Get(method, path string, headers map[string]string, body []byte)
 	return nil, false
 }
 
-func (c *Cache) Set(method, path string, headers map[string]string, body []byte, response *CacheEntry) {
+func (c *Cache) Set(method, path string, headers http.Header, body []byte, response *CacheEntry) {
 	// Only cache successful responses and certain error codes
-	if !c.isCacheable(method, path) || !c.isCacheableResponse(response.StatusCode) {
+	if !c.Cacheable(method, path, response.StatusCode) || int64(len(response.Body)) > c.EntryLimit(path) {
 		return
 	}
+	c.put(method, path, headers, body, response)
+}
 
+// SetOptIn caches the response to a request the client asked to have
+// cached, whatever its path, as long as it succeeded
+func (c *Cache) SetOptIn(method, path string, headers http.Header, body []byte, response *CacheEntry) {
+	if !OptInCacheable(response.StatusCode) || int64(len(response.Body)) > c.EntryLimit(path) {
+		return
+	}
+	c.put(method, path, headers, body, response)
+}
+
+// OptInCacheable reports whether a response with this status to a request
+// the client asked to have cached would be stored
+func OptInCacheable(statusCode int) bool {
+	return statusCode == 200 || statusCode == 201
+}
+
+// put stores an entry. Entries are kept decoded, so each client can be
+// sent one in whatever encoding it accepts; a body the proxy couldn't
+// decode is never kept.
+func (c *Cache) put(method, path string, headers http.Header, body []byte, response *CacheEntry) {
+	if http.Header(response.Headers).Get("Content-Encoding") != "" {
+		return
+	}
 	key := c.generateKey(method, path, headers, body)
-	response.Timestamp = time.Now()
+	response.Timestamp = clock.Now()
+	if c.shard != nil && !c.shard.Set(key, response) {
+		return
+	}
+	c.StoreKey(key, response)
+}
+
+// StoreKey keeps an entry by its key in this replica's store, as stamped
+// where it was answered
+func (c *Cache) StoreKey(key string, response *CacheEntry) {
+	lifetime := response.lifetime(c.ttl)
+	if lifetime > 0 {
+		// An entry from another replica has already lived some of it
+		if lifetime -= clock.Since(response.Timestamp); lifetime <= 0 {
+			return
+		}
+	}
+	c.store.Set(key, response, lifetime)
+}
 
-	c.store.Set(key, response, c.ttl)
+// Share places entries with the replicas that own their keys. It's set
+// before serving.
+func (c *Cache) Share(shard Shard) {
+	c.shard = shard
+}
+
+const speechPath = "/v1/audio/speech"
+
+// Cacheable reports whether a response with this status to the request
+// would be stored, so callers can decide whether to buffer it at all
+func (c *Cache) Cacheable(method, path string, statusCode int) bool {
+	return c.isCacheable(method, path) && c.isCacheableResponse(statusCode)
+}
+
+// EntryLimit is the largest response to path that may be cached, so
+// callers can stop buffering once a response grows past it
+func (c *Cache) EntryLimit(path string) int64 {
+	if path == speechPath {
+		return c.maxSpeechBytes
+	}
+	return c.maxEntryBytes
+}
+
+// Upload endpoints take multipart bodies that are streamed or spooled
+// rather than buffered, so they can't be hashed and are never cached. Batches,
+// assistants, threads and responses are stateful objects whose GETs are
+// polled for changes, as are vector stores while their files are indexed,
+// so they are never cached either.
+var uncacheablePrefixes = []string{
+	"/v1/files",
+	"/v1/audio/transcriptions",
+	"/v1/audio/translations",
+	"/v1/uploads",
+	"/v1/batches",
+	"/v1/assistants",
+	"/v1/threads",
+	"/v1/responses",
+	"/v1/vector_stores",
 }
 
 func (c *Cache) isCacheable(method, path string) bool {
+	for _, prefix := range uncacheablePrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return false
+		}
+	}
+
 	// Cache GET requests
 	if method == "GET" {
 		return true
 	}
 
+	// Speech synthesis is deterministic enough for identical inputs to be
+	// worth caching, but only when enabled since the responses are large
+	if method == "POST" && path == speechPath {
+		return c.maxSpeechBytes > 0
+	}
+
 	// Cache certain POST requests (like completions) for a short time
 	if method == "POST" {
 		cacheablePaths := []string{
@@ -132,15 +303,77 @@ func (c *Cache) isCacheableResponse(statusCode int) bool {
 	return statusCode == 200 || statusCode == 201 || statusCode == 400 || statusCode == 401
 }
 
+// ItemCount is how many responses are cached, including expired ones not
+// yet cleaned up
+func (c *Cache) ItemCount() int {
+	return c.store.ItemCount()
+}
+
 func (c *Cache) Stats() map[string]interface{} {
 	itemCount := c.store.ItemCount()
 
-	return map[string]interface{}{
+	stats := map[string]interface{}{
 		"item_count": itemCount,
 		"ttl":        c.ttl.String(),
 	}
+	if trashed := c.trash.stats(); trashed != nil {
+		stats["trash"] = trashed
+	}
+	return stats
+}
+
+// Delete drops the entries of a tenant, of an end user, or of a user within
+// a tenant when both are given, returning how many it dropped. Entries in
+// the trash are dropped too, so they can't be restored.
+func (c *Cache) Delete(tenant, user string) int {
+	match := func(item cache.Item) bool {
+		entry, ok := item.Object.(*CacheEntry)
+		return ok && (tenant == "" || entry.Tenant == tenant) && (user == "" || entry.User == user)
+	}
+	deleted := 0
+	for key, item := range c.store.Items() {
+		if match(item) {
+			c.store.Delete(key)
+			deleted++
+		}
+	}
+	return deleted + c.trash.drop(match)
+}
+
+// KeepCleared has Clear keep what it clears for grace, so Restore can bring
+// it back. It's set before serving.
+func (c *Cache) KeepCleared(grace time.Duration) {
+	c.trash.grace = grace
 }
 
+// Clear empties the cache, keeping the entries for Restore when KeepCleared
+// is set
 func (c *Cache) Clear() {
+	items := c.store.Items()
 	c.store.Flush()
+	c.trash.keep(items)
+}
+
+// Restore brings back the entries of the last Clear that haven't expired
+// since, returning how many it restored. Entries cached again since the
+// clear are newer, so they're kept. It returns false when nothing was
+// cleared within the grace period.
+func (c *Cache) Restore() (int, bool) {
+	items, found := c.trash.take()
+	if !found {
+		return 0, false
+	}
+	restored := 0
+	for key, item := range items {
+		entry, ok := item.Object.(*CacheEntry)
+		if !ok || clock.Since(entry.Timestamp) >= entry.lifetime(c.ttl) {
+			continue
+		}
+		if _, cached := c.store.Get(key); cached {
+			continue
+		}
+		c.StoreKey(key, entry)
+		restored++
+	}
+	return restored, true
 }
@@ -0,0 +1,34 @@
+package cache
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// An embeddings request of about 1 MB, the kind of body keys are hashed
+// from without being copied
+func BenchmarkGenerateKey(b *testing.B) {
+	inputs := make([]string, 1024)
+	for i := range inputs {
+		inputs[i] = strings.Repeat("lorem ipsum ", 85)
+	}
+	body, err := json.Marshal(map[string]interface{}{"model": "text-embedding-3-small", "input": inputs})
+	if err != nil {
+		b.Fatal(err)
+	}
+	headers := http.Header{
+		"Authorization": {"Bearer sk-benchmark"},
+		"Content-Type":  {"application/json"},
+	}
+	c := New(time.Minute, 1, 0, 0)
+
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.generateKey(http.MethodPost, "/v1/embeddings", headers, body)
+	}
+}
@@ -0,0 +1,245 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"goproxyai/internal/clock"
+)
+
+// Request fields that change the vector an input is embedded as. user
+// only says who asked, so it isn't part of the key.
+var embeddingKeyFields = []string{"model", "dimensions", "encoding_format"}
+
+// EmbeddingCache keeps the vector of each embeddings input, so an input
+// seen before isn't embedded again, however the requests it's in differ.
+// Vectors are kept for the TTL within a byte budget, dropping the oldest
+// first.
+type EmbeddingCache struct {
+	mutex    sync.Mutex
+	ttl      time.Duration
+	maxBytes int64
+	used     int64
+	entries  map[string]*list.Element
+	// Oldest first, as entries are only ever added at the back
+	order *list.List
+
+	// trash holds what Clear last cleared, for Restore
+	trash trash[*embeddingEntry]
+}
+
+// Embedding is a cached vector, as JSON in the encoding it was asked for
+type Embedding struct {
+	Vector json.RawMessage
+	Model  string // the model upstream said embedded it
+}
+
+type embeddingEntry struct {
+	Embedding
+	timestamp time.Time
+	// tenant and user are who the input was embedded for, so a deletion
+	// request reaches it
+	tenant string
+	user   string
+	key    string
+}
+
+func (e *embeddingEntry) size() int64 {
+	return int64(len(e.Vector) + len(e.Model) + len(e.key))
+}
+
+func NewEmbeddingCache(ttl time.Duration, maxMB int) *EmbeddingCache {
+	return &EmbeddingCache{
+		ttl:      ttl,
+		maxBytes: int64(maxMB) * 1024 * 1024,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// EmbeddingKeys derives the cache key of each input of an embeddings
+// request within scope, such as a tenant, and returns them with the
+// inputs. It returns false for bodies whose input isn't a string or a list
+// of strings, such as token arrays.
+func EmbeddingKeys(scope string, body []byte) ([]string, []string, bool) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) != nil || len(fields["input"]) == 0 {
+		return nil, nil, false
+	}
+	var inputs []string
+	if json.Unmarshal(fields["input"], &inputs) != nil || len(inputs) == 0 {
+		var input string
+		if json.Unmarshal(fields["input"], &input) != nil {
+			return nil, nil, false
+		}
+		inputs = []string{input}
+	}
+
+	keys := make([]string, len(inputs))
+	for i, input := range inputs {
+		digest := sha256.New()
+		writeKeyField(digest, scope)
+		for _, name := range embeddingKeyFields {
+			writeKeyField(digest, name)
+			writeKeyField(digest, string(fields[name]))
+		}
+		writeKeyField(digest, input)
+		keys[i] = hex.EncodeToString(digest.Sum(nil))
+	}
+	return keys, inputs, true
+}
+
+// Get returns the vector cached under key
+func (c *EmbeddingCache) Get(key string) (Embedding, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, found := c.entries[key]
+	if !found {
+		return Embedding{}, false
+	}
+	entry := element.Value.(*embeddingEntry)
+	if clock.Since(entry.timestamp) >= c.ttl {
+		c.remove(element)
+		return Embedding{}, false
+	}
+	return entry.Embedding, true
+}
+
+// Set caches a vector embedded for tenant and user, unless it alone
+// outgrows the byte budget
+func (c *EmbeddingCache) Set(key, tenant, user string, embedding Embedding) {
+	entry := &embeddingEntry{Embedding: embedding, timestamp: clock.Now(), tenant: tenant, user: user, key: key}
+	size := entry.size()
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if previous, found := c.entries[key]; found {
+		c.remove(previous)
+	}
+	c.evict(size)
+	c.entries[key] = c.order.PushBack(entry)
+	c.used += size
+}
+
+// Delete drops the vectors of a tenant, of an end user, or of a user
+// within a tenant when both are given, returning how many it dropped,
+// those in the trash included
+func (c *EmbeddingCache) Delete(tenant, user string) int {
+	match := func(entry *embeddingEntry) bool {
+		return (tenant == "" || entry.tenant == tenant) && (user == "" || entry.user == user)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	deleted := 0
+	for _, element := range c.entries {
+		if match(element.Value.(*embeddingEntry)) {
+			c.remove(element)
+			deleted++
+		}
+	}
+	return deleted + c.trash.drop(match)
+}
+
+// KeepCleared has Clear keep what it clears for grace, so Restore can bring
+// it back. It's set before serving.
+func (c *EmbeddingCache) KeepCleared(grace time.Duration) {
+	c.trash.grace = grace
+}
+
+func (c *EmbeddingCache) Clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	cleared := make(map[string]*embeddingEntry, len(c.entries))
+	for key, element := range c.entries {
+		cleared[key] = element.Value.(*embeddingEntry)
+	}
+	c.trash.keep(cleared)
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+	c.used = 0
+}
+
+// Restore brings back the vectors of the last Clear that haven't expired
+// or been cached again since, returning how many it restored. Vectors
+// cached since aren't evicted for them, so those that no longer fit the
+// byte budget stay cleared. It returns false when nothing was cleared
+// within the grace period.
+func (c *EmbeddingCache) Restore() (int, bool) {
+	cleared, found := c.trash.take()
+	if !found {
+		return 0, false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var entries []*embeddingEntry
+	for element := c.order.Front(); element != nil; element = element.Next() {
+		entries = append(entries, element.Value.(*embeddingEntry))
+	}
+	restored := 0
+	for key, entry := range cleared {
+		size := entry.size()
+		if _, cached := c.entries[key]; cached || clock.Since(entry.timestamp) >= c.ttl || c.used+size > c.maxBytes {
+			continue
+		}
+		entries = append(entries, entry)
+		c.used += size
+		restored++
+	}
+	// Eviction relies on the oldest being first, so the order is rebuilt
+	// with the restored vectors where they belong
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].timestamp.Before(entries[j].timestamp) })
+	c.order.Init()
+	for _, entry := range entries {
+		c.entries[entry.key] = c.order.PushBack(entry)
+	}
+	return restored, true
+}
+
+func (c *EmbeddingCache) Stats() map[string]interface{} {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats := map[string]interface{}{
+		"item_count": len(c.entries),
+		"bytes":      c.used,
+		"max_bytes":  c.maxBytes,
+		"ttl":        c.ttl.String(),
+	}
+	if trashed := c.trash.stats(); trashed != nil {
+		stats["trash"] = trashed
+	}
+	return stats
+}
+
+// evict makes room for size more bytes, dropping expired vectors and then
+// the oldest. Both are at the front, so it stops at the first it keeps.
+func (c *EmbeddingCache) evict(size int64) {
+	for element := c.order.Front(); element != nil; element = c.order.Front() {
+		entry := element.Value.(*embeddingEntry)
+		if c.used+size <= c.maxBytes && clock.Since(entry.timestamp) < c.ttl {
+			return
+		}
+		c.remove(element)
+	}
+}
+
+func (c *EmbeddingCache) remove(element *list.Element) {
+	entry := c.order.Remove(element).(*embeddingEntry)
+	delete(c.entries, entry.key)
+	c.used -= entry.size()
+}
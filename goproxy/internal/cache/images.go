@@ -0,0 +1,272 @@
+package cache
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"goproxyai/internal/clock"
+)
+
+// Request fields that change the images generated. response_format only
+// changes how they're delivered and user who asked, so neither is part of
+// the key.
+var imageKeyFields = []string{"model", "prompt", "size", "quality", "style", "n", "background", "output_format"}
+
+// ImageCache keeps image generation responses, with the images as base64,
+// so a repeated prompt is answered without generating it again. Entries
+// are kept for the TTL within a byte budget, dropping the oldest first.
+type ImageCache struct {
+	mutex    sync.Mutex
+	ttl      time.Duration
+	maxBytes int64
+	used     int64
+	entries  map[string]*ImageEntry
+	byID     map[string]*ImageEntry
+
+	// trash holds what Clear last cleared, for Restore
+	trash trash[*ImageEntry]
+}
+
+// ImageEntry is a cached image generation response
+type ImageEntry struct {
+	// ID names the entry in the proxy's image URLs; it's random, so the
+	// URLs can't be guessed from the prompt
+	ID        string
+	Body      []byte // the upstream response, images as b64_json
+	Timestamp time.Time
+	// Stored names the images' copies in an image store, once they've
+	// been put there
+	Stored []string
+	// Tenant and User are who the images were generated for, so a deletion
+	// request reaches them
+	Tenant string
+	User   string
+	key    string
+}
+
+func NewImageCache(ttl time.Duration, maxMB int) *ImageCache {
+	return &ImageCache{
+		ttl:      ttl,
+		maxBytes: int64(maxMB) * 1024 * 1024,
+		entries:  make(map[string]*ImageEntry),
+		byID:     make(map[string]*ImageEntry),
+	}
+}
+
+// ImageKey derives the cache key of an image generation request within
+// scope, such as a tenant. It returns false for bodies without a prompt.
+func ImageKey(scope string, body []byte) (string, bool) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) != nil || len(fields["prompt"]) == 0 {
+		return "", false
+	}
+
+	digest := sha256.New()
+	writeKeyField(digest, scope)
+	for _, name := range imageKeyFields {
+		writeKeyField(digest, name)
+		writeKeyField(digest, string(fields[name]))
+	}
+	return hex.EncodeToString(digest.Sum(nil)), true
+}
+
+// Get returns a copy of the entry cached under key
+func (c *ImageCache) Get(key string) (*ImageEntry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, found := c.entries[key]
+	if !found {
+		return nil, false
+	}
+	if clock.Since(entry.Timestamp) >= c.ttl {
+		c.remove(entry)
+		return nil, false
+	}
+	copied := *entry
+	return &copied, true
+}
+
+// Set caches a response generated for tenant and user, unless it alone
+// outgrows the byte budget, and returns a copy of the new entry
+func (c *ImageCache) Set(key, tenant, user string, body []byte) (*ImageEntry, bool) {
+	size := int64(len(body))
+	if size > c.maxBytes {
+		return nil, false
+	}
+
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, false
+	}
+	entry := &ImageEntry{ID: hex.EncodeToString(id[:]), Body: body, Timestamp: clock.Now(), Tenant: tenant, User: user, key: key}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if previous, found := c.entries[key]; found {
+		c.remove(previous)
+	}
+	c.evict(size)
+	c.entries[key] = entry
+	c.byID[entry.ID] = entry
+	c.used += size
+	copied := *entry
+	return &copied, true
+}
+
+// SetStored records the names an entry's images were stored under
+func (c *ImageCache) SetStored(id string, names []string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if entry, found := c.byID[id]; found {
+		entry.Stored = names
+	}
+}
+
+// Image returns the decoded image at index of the entry with id, and its
+// content type
+func (c *ImageCache) Image(id string, index int) ([]byte, string, bool) {
+	c.mutex.Lock()
+	entry, found := c.byID[id]
+	if found && clock.Since(entry.Timestamp) >= c.ttl {
+		c.remove(entry)
+		found = false
+	}
+	c.mutex.Unlock()
+	if !found {
+		return nil, "", false
+	}
+
+	var response struct {
+		OutputFormat string `json:"output_format"`
+		Data         []struct {
+			B64JSON string `json:"b64_json"`
+		} `json:"data"`
+	}
+	if json.Unmarshal(entry.Body, &response) != nil || index < 0 || index >= len(response.Data) {
+		return nil, "", false
+	}
+	image, err := base64.StdEncoding.DecodeString(response.Data[index].B64JSON)
+	if err != nil {
+		return nil, "", false
+	}
+	switch response.OutputFormat {
+	case "jpeg", "webp":
+		return image, "image/" + response.OutputFormat, true
+	default:
+		return image, "image/png", true
+	}
+}
+
+// Delete drops the entries of a tenant, of an end user, or of a user within
+// a tenant when both are given, returning how many it dropped, those in
+// the trash included. Copies in an image store are left where they are.
+func (c *ImageCache) Delete(tenant, user string) int {
+	match := func(entry *ImageEntry) bool {
+		return (tenant == "" || entry.Tenant == tenant) && (user == "" || entry.User == user)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	deleted := 0
+	for _, entry := range c.entries {
+		if match(entry) {
+			c.remove(entry)
+			deleted++
+		}
+	}
+	return deleted + c.trash.drop(match)
+}
+
+// KeepCleared has Clear keep what it clears for grace, so Restore can bring
+// it back. It's set before serving.
+func (c *ImageCache) KeepCleared(grace time.Duration) {
+	c.trash.grace = grace
+}
+
+func (c *ImageCache) Clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.trash.keep(c.entries)
+	c.entries = make(map[string]*ImageEntry)
+	c.byID = make(map[string]*ImageEntry)
+	c.used = 0
+}
+
+// Restore brings back the entries of the last Clear that haven't expired
+// or been cached again since, returning how many it restored. Entries
+// cached since aren't evicted for them, so those that no longer fit the
+// byte budget stay cleared. It returns false when nothing was cleared
+// within the grace period.
+func (c *ImageCache) Restore() (int, bool) {
+	entries, found := c.trash.take()
+	if !found {
+		return 0, false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	restored := 0
+	for key, entry := range entries {
+		size := int64(len(entry.Body))
+		if _, cached := c.entries[key]; cached || clock.Since(entry.Timestamp) >= c.ttl || c.used+size > c.maxBytes {
+			continue
+		}
+		c.entries[key] = entry
+		c.byID[entry.ID] = entry
+		c.used += size
+		restored++
+	}
+	return restored, true
+}
+
+func (c *ImageCache) Stats() map[string]interface{} {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats := map[string]interface{}{
+		"item_count": len(c.entries),
+		"bytes":      c.used,
+		"max_bytes":  c.maxBytes,
+		"ttl":        c.ttl.String(),
+	}
+	if trashed := c.trash.stats(); trashed != nil {
+		stats["trash"] = trashed
+	}
+	return stats
+}
+
+// evict makes room for size more bytes, dropping expired entries and then
+// the oldest
+func (c *ImageCache) evict(size int64) {
+	for _, entry := range c.entries {
+		if clock.Since(entry.Timestamp) >= c.ttl {
+			c.remove(entry)
+		}
+	}
+	for c.used+size > c.maxBytes {
+		var oldest *ImageEntry
+		for _, entry := range c.entries {
+			if oldest == nil || entry.Timestamp.Before(oldest.Timestamp) {
+				oldest = entry
+			}
+		}
+		c.remove(oldest)
+	}
+}
+
+func (c *ImageCache) remove(entry *ImageEntry) {
+	delete(c.entries, entry.key)
+	delete(c.byID, entry.ID)
+	c.used -= int64(len(entry.Body))
+}
@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"sync"
+	"time"
+
+	"goproxyai/internal/clock"
+)
+
+// trash holds the entries a cache last cleared for a grace period, so a
+// clear made by mistake can be undone. Only the last clear is kept.
+type trash[E any] struct {
+	mutex      sync.Mutex
+	grace      time.Duration
+	entries    map[string]E
+	trashed    time.Time
+	generation int
+}
+
+// keep holds entries for the grace period, in place of any cleared before.
+// Without a grace period they're dropped right away.
+func (t *trash[E]) keep(entries map[string]E) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.grace <= 0 {
+		return
+	}
+	t.entries, t.trashed = entries, clock.Now()
+	t.generation++
+	generation := t.generation
+	// Frees the entries once they can't be restored anymore, unless another
+	// clear has replaced them by then
+	time.AfterFunc(t.grace, func() {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		if t.generation == generation {
+			t.entries = nil
+		}
+	})
+}
+
+// take empties the trash, returning what it held if that's still within
+// the grace period
+func (t *trash[E]) take() (map[string]E, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	entries := t.entries
+	t.entries = nil
+	if entries == nil || clock.Since(t.trashed) >= t.grace {
+		return nil, false
+	}
+	return entries, true
+}
+
+// drop removes the entries match selects, returning how many it removed
+func (t *trash[E]) drop(match func(E) bool) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	dropped := 0
+	for key, entry := range t.entries {
+		if match(entry) {
+			delete(t.entries, key)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// stats describes what the trash holds, or nil when it's empty
+func (t *trash[E]) stats() map[string]interface{} {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.entries == nil || clock.Since(t.trashed) >= t.grace {
+		return nil
+	}
+	return map[string]interface{}{
+		"item_count":       len(t.entries),
+		"restorable_until": t.trashed.Add(t.grace).UTC(),
+	}
+}
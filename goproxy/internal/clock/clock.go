@@ -0,0 +1,55 @@
+// Package clock is where the proxy reads the current time for anything a
+// test might want to fast-forward: cache expiry, key lifetimes, rate limits,
+// daily usage and the months reports and budget alerts cover. It's the system clock unless a harness such as proxytest
+// swaps in a fake one.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+var (
+	mutex   sync.RWMutex
+	current Clock = systemClock{}
+)
+
+// Now is the current time by the installed clock
+func Now() time.Time {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return current.Now()
+}
+
+// Since is the time elapsed since t by the installed clock
+func Since(t time.Time) time.Duration {
+	return Now().Sub(t)
+}
+
+// Until is the time left until t by the installed clock
+func Until(t time.Time) time.Duration {
+	return t.Sub(Now())
+}
+
+// Set installs c for the whole process and returns a function putting the
+// previous clock back
+func Set(c Clock) (restore func()) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	previous := current
+	current = c
+	return func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		current = previous
+	}
+}
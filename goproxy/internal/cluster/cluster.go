@@ -0,0 +1,389 @@
+// Package cluster lets the replicas of a proxy deployment share rate-limit
+// and usage counters without an external store. Each replica gossips what
+// it knows with a few others every round; counters only ever grow on the
+// replica that owns them, so whatever order the gossip arrives in, every
+// replica converges on the same view, partitions included.
+package cluster
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"goproxyai/internal/clock"
+	"goproxyai/internal/usage"
+)
+
+const (
+	// GossipPath is where replicas exchange what they know
+	GossipPath = "/cluster/gossip"
+	// CachePath is where members get and put the cache entries they own
+	CachePath = "/cluster/cache/"
+	// DeletionPath is where members pass on DELETE /admin/data requests
+	DeletionPath = "/cluster/deletions"
+	// SecretHeader carries CLUSTER_SECRET on gossip, cache and deletion
+	// requests
+	SecretHeader = "X-Cluster-Secret"
+
+	// fanout is how many members each round gossips with
+	fanout = 3
+	// A member that missed this many rounds is down, and its requests no
+	// longer count against rate limits
+	downRounds = 5
+	// A member down this long is forgotten, its usage with it
+	forgetAfter = time.Hour
+)
+
+// Member is what a replica knows of one member of the cluster, itself
+// included. Only the member itself changes it, bumping Heartbeat every
+// round, so the copy with the highest Heartbeat is the latest.
+type Member struct {
+	ID        string `json:"id"`
+	URL       string `json:"url,omitempty"`
+	Heartbeat int64  `json:"heartbeat"`
+
+	// Limits counts the requests the member admitted per limiter and key,
+	// by a hash of both so keys aren't sent around the cluster
+	Limits map[string]Window `json:"limits,omitempty"`
+	// Usage is the member's usage per day and tenant, for the current and
+	// previous month
+	Usage map[string]map[string]usage.Totals `json:"usage,omitempty"`
+}
+
+// Window counts requests in fixed one-minute windows, the one starting at
+// Start and the one before
+type Window struct {
+	Start    int64 `json:"start"` // Unix minute
+	Current  int64 `json:"current"`
+	Previous int64 `json:"previous"`
+}
+
+// Message is what a gossip exchange carries each way: the sender, and the
+// members it knows are up
+type Message struct {
+	Members []Member `json:"members"`
+}
+
+// Node is this replica's place in the cluster
+type Node struct {
+	id       string
+	url      string
+	secret   string
+	seeds    []string
+	interval time.Duration
+	usage    *usage.Tracker
+	client   *http.Client
+	logger   *log.Logger
+
+	mutex     sync.Mutex
+	heartbeat int64
+	limits    map[string]*Window
+	members   map[string]*peer
+
+	// ring places cache keys, over ringMembers
+	ring        *ring
+	ringMembers []ringMember
+}
+
+// peer is another member as last heard of
+type peer struct {
+	Member
+	updated time.Time // when its Heartbeat last went up
+}
+
+// New joins the cluster seeds belong to as id, reachable at url by the
+// other members. Gossip starts with Start.
+func New(id, url, secret string, seeds []string, interval time.Duration, tracker *usage.Tracker, logger *log.Logger) *Node {
+	url = strings.TrimSuffix(url, "/")
+	n := &Node{
+		id:       id,
+		url:      url,
+		secret:   secret,
+		interval: interval,
+		usage:    tracker,
+		client:   &http.Client{Timeout: interval * downRounds},
+		logger:   logger,
+		limits:   make(map[string]*Window),
+		members:  make(map[string]*peer),
+	}
+	// A restarted replica's heartbeat starts ahead of where it left off, so
+	// its new counters replace the old ones
+	n.heartbeat = time.Now().UnixMilli()
+	for _, seed := range seeds {
+		if seed = strings.TrimSuffix(seed, "/"); seed != url {
+			n.seeds = append(n.seeds, seed)
+		}
+	}
+	return n
+}
+
+// Start gossips every interval
+func (n *Node) Start() {
+	go func() {
+		ticker := time.NewTicker(n.interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			n.gossip()
+		}
+	}()
+}
+
+// Authorized reports whether a request from another member carries the
+// cluster's secret
+func (n *Node) Authorized(secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(n.secret)) == 1
+}
+
+// Exchange merges what another member sent, answering with what this one
+// knows in return
+func (n *Node) Exchange(received Message) Message {
+	n.merge(received)
+	return n.message()
+}
+
+// gossip exchanges with a few members, or the seeds while none are known
+func (n *Node) gossip() {
+	message := n.message()
+	body, err := json.Marshal(message)
+	if err != nil {
+		n.logger.Printf("Could not encode cluster gossip: %v", err)
+		return
+	}
+	for _, target := range n.targets() {
+		received, err := n.send(target, body)
+		if err != nil {
+			n.logger.Printf("Cluster gossip with %s failed: %v", target, err)
+			continue
+		}
+		n.merge(received)
+	}
+}
+
+func (n *Node) send(target string, body []byte) (Message, error) {
+	var received Message
+	req, err := http.NewRequest(http.MethodPost, target+GossipPath, bytes.NewReader(body))
+	if err != nil {
+		return received, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SecretHeader, n.secret)
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return received, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return received, fmt.Errorf("returned %d", resp.StatusCode)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&received)
+	return received, err
+}
+
+// targets picks up to fanout members to gossip with. Seeds nobody has
+// heard from yet are tried too, so a partitioned replica finds its way
+// back once they're reachable again.
+func (n *Node) targets() []string {
+	n.mutex.Lock()
+	known := make(map[string]bool)
+	var urls []string
+	for _, p := range n.members {
+		if p.URL != "" && !known[p.URL] {
+			known[p.URL] = true
+			urls = append(urls, p.URL)
+		}
+	}
+	n.mutex.Unlock()
+	for _, seed := range n.seeds {
+		if !known[seed] {
+			urls = append(urls, seed)
+		}
+	}
+	rand.Shuffle(len(urls), func(i, j int) { urls[i], urls[j] = urls[j], urls[i] })
+	return urls[:min(len(urls), fanout)]
+}
+
+// message is this member as it is now, with the other members up
+func (n *Node) message() Message {
+	now := clock.Now()
+	// Usage is shared for long enough for monthly totals
+	lastMonth := time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, time.UTC)
+	tenantDays := n.usage.TenantDays(lastMonth)
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.heartbeat++
+	self := Member{ID: n.id, URL: n.url, Heartbeat: n.heartbeat, Limits: make(map[string]Window), Usage: tenantDays}
+	minute := now.Unix() / 60
+	for id, w := range n.limits {
+		if w.Start < minute-1 {
+			// Nothing left to count
+			delete(n.limits, id)
+			continue
+		}
+		self.Limits[id] = *w
+	}
+
+	message := Message{Members: []Member{self}}
+	for id, p := range n.members {
+		switch {
+		case now.Sub(p.updated) > forgetAfter:
+			delete(n.members, id)
+		case n.up(p, now):
+			// Members that are down aren't passed on, or they'd come back
+			// from whoever forgets them last
+			message.Members = append(message.Members, p.Member)
+		}
+	}
+	n.updateRing(now)
+	return message
+}
+
+func (n *Node) merge(received Message) {
+	now := clock.Now()
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	for _, m := range received.Members {
+		if m.ID == "" || m.ID == n.id {
+			continue
+		}
+		if known, found := n.members[m.ID]; found && known.Heartbeat >= m.Heartbeat {
+			continue
+		}
+		n.members[m.ID] = &peer{Member: m, updated: now}
+	}
+	n.updateRing(now)
+}
+
+// up reports whether a member gossiped recently enough to count
+func (n *Node) up(p *peer, now time.Time) bool {
+	return now.Sub(p.updated) < n.interval*downRounds
+}
+
+// Admitted estimates the requests the other members admitted for a key
+// over the last minute
+func (n *Node) Admitted(limiter, key string) float64 {
+	id := limitID(limiter, key)
+	now := clock.Now()
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	var admitted float64
+	for _, p := range n.members {
+		if w, found := p.Limits[id]; found && n.up(p, now) {
+			admitted += w.estimate(now)
+		}
+	}
+	return admitted
+}
+
+// Admit counts a request this member admitted for a key
+func (n *Node) Admit(limiter, key string) {
+	id := limitID(limiter, key)
+	minute := clock.Now().Unix() / 60
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	w, found := n.limits[id]
+	if !found {
+		w = &Window{Start: minute}
+		n.limits[id] = w
+	}
+	w.advance(minute)
+	w.Current++
+}
+
+func limitID(limiter, key string) string {
+	hash := sha256.Sum256([]byte(limiter + "\x00" + key))
+	return hex.EncodeToString(hash[:12])
+}
+
+// advance moves the window on to minute
+func (w *Window) advance(minute int64) {
+	switch {
+	case minute == w.Start:
+	case minute == w.Start+1:
+		w.Previous, w.Current = w.Current, 0
+	default:
+		w.Previous, w.Current = 0, 0
+	}
+	w.Start = minute
+}
+
+// estimate counts the requests over the minute up to now, taking the part
+// of the previous window that's still in it
+func (w Window) estimate(now time.Time) float64 {
+	minute := now.Unix() / 60
+	elapsed := float64(now.UnixNano()%int64(time.Minute)) / float64(time.Minute)
+	switch minute {
+	case w.Start:
+		return float64(w.Previous)*(1-elapsed) + float64(w.Current)
+	case w.Start + 1:
+		return float64(w.Current) * (1 - elapsed)
+	}
+	return 0
+}
+
+// Usage sums every known member's usage per day and tenant, this one's
+// included. Members that are down still count until they're forgotten.
+func (n *Node) Usage(from time.Time) map[string]map[string]usage.Totals {
+	result := n.usage.TenantDays(from)
+	fromDay := from.UTC().Format("2006-01-02")
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	for _, p := range n.members {
+		for day, byTenant := range p.Usage {
+			if day < fromDay {
+				continue
+			}
+			if result[day] == nil {
+				result[day] = make(map[string]usage.Totals)
+			}
+			for tenant, totals := range byTenant {
+				sum := result[day][tenant]
+				sum.Add(totals)
+				result[day][tenant] = sum
+			}
+		}
+	}
+	return result
+}
+
+// MemberStatus describes a member for /admin/cluster
+type MemberStatus struct {
+	ID       string    `json:"id"`
+	URL      string    `json:"url,omitempty"`
+	Self     bool      `json:"self,omitempty"`
+	Up       bool      `json:"up"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// Members lists the members known, this one first
+func (n *Node) Members() []MemberStatus {
+	now := clock.Now()
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	members := []MemberStatus{{ID: n.id, URL: n.url, Self: true, Up: true, LastSeen: now.UTC()}}
+	var others []MemberStatus
+	for _, p := range n.members {
+		others = append(others, MemberStatus{ID: p.ID, URL: p.URL, Up: n.up(p, now), LastSeen: p.updated.UTC()})
+	}
+	sort.Slice(others, func(i, j int) bool { return others[i].ID < others[j].ID })
+	return append(members, others...)
+}
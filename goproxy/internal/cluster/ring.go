@@ -0,0 +1,105 @@
+package cluster
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Each member takes this many points on the ring, so keys spread evenly
+// and a member leaving only moves its own share
+const ringPoints = 128
+
+// ring places keys on the members that are up and reachable, by consistent
+// hashing of their IDs, so every member that sees the same members agrees
+// on who owns what
+type ring struct {
+	points  []uint64
+	members map[uint64]ringMember
+}
+
+type ringMember struct {
+	id  string
+	url string
+}
+
+func newRing(members []ringMember) *ring {
+	r := &ring{members: make(map[uint64]ringMember, len(members)*ringPoints)}
+	for _, m := range members {
+		for i := 0; i < ringPoints; i++ {
+			point := ringHash(m.id + "#" + strconv.Itoa(i))
+			r.points = append(r.points, point)
+			r.members[point] = m
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// owner is the member holding key: the first point at or after its hash
+func (r *ring) owner(key string) (ringMember, bool) {
+	if len(r.points) == 0 {
+		return ringMember{}, false
+	}
+	point := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= point })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.members[r.points[i]], true
+}
+
+func ringHash(value string) uint64 {
+	hash := sha256.Sum256([]byte(value))
+	return binary.BigEndian.Uint64(hash[:8])
+}
+
+// updateRing rebuilds the ring when the members up have changed. The
+// mutex is held.
+func (n *Node) updateRing(now time.Time) {
+	var members []ringMember
+	if n.url != "" {
+		members = append(members, ringMember{id: n.id, url: n.url})
+	}
+	for _, p := range n.members {
+		if p.URL != "" && n.up(p, now) {
+			members = append(members, ringMember{id: p.ID, url: p.URL})
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].id < members[j].id })
+	if n.ring != nil && sameMembers(n.ringMembers, members) {
+		return
+	}
+	n.ring, n.ringMembers = newRing(members), members
+}
+
+func sameMembers(a, b []ringMember) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Owner is the URL of the member a key belongs on, and whether that's this
+// one. A replica with no CLUSTER_ADVERTISE_URL owns nothing but what it
+// can't place elsewhere.
+func (n *Node) Owner(key string) (string, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.ring == nil {
+		return n.url, true
+	}
+	m, found := n.ring.owner(key)
+	if !found || m.id == n.id {
+		return n.url, true
+	}
+	return m.url, false
+}
@@ -0,0 +1,213 @@
+// Package compaction shrinks the prompts of long chat completion requests
+// without changing what they say: whitespace is normalized and paragraphs
+// the conversation already holds are dropped where they repeat
+package compaction
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// Paragraphs shorter than this are kept even when they repeat, since
+// short ones repeat by chance and the placeholder would save little
+const minRepeatLength = 200
+
+// What a repeated paragraph is replaced with
+const repeatPlaceholder = "[repeated text omitted]"
+
+var innerSpace = regexp.MustCompile(`[ \t]{2,}`)
+
+// Compact normalizes the whitespace of every text in a chat completion
+// request's messages and drops paragraphs already seen earlier in the
+// conversation. Indentation is kept, so code keeps its shape. It returns
+// false if nothing changed or the body isn't a chat completion request.
+func Compact(body []byte) ([]byte, bool, error) {
+	var fields map[string]json.RawMessage
+	var messages []map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return body, false, err
+	}
+	if err := json.Unmarshal(fields["messages"], &messages); err != nil {
+		return body, false, err
+	}
+
+	seen := make(map[string]bool)
+	compact := func(text string) string {
+		return dedupe(normalize(text), seen)
+	}
+	changed := false
+	for _, message := range messages {
+		content, ok, err := compactContent(message["content"], compact)
+		if err != nil {
+			return body, false, err
+		}
+		if ok {
+			message["content"] = content
+			changed = true
+		}
+	}
+	if !changed {
+		return body, false, nil
+	}
+
+	encoded, err := json.Marshal(messages)
+	if err != nil {
+		return body, false, err
+	}
+	fields["messages"] = encoded
+	compacted, err := json.Marshal(fields)
+	if err != nil {
+		return body, false, err
+	}
+	return compacted, true, nil
+}
+
+// compactContent rewrites a message's content, a string or an array of
+// content parts whose text parts are rewritten and the rest kept
+func compactContent(raw json.RawMessage, compact func(string) string) (json.RawMessage, bool, error) {
+	if len(raw) == 0 {
+		return raw, false, nil
+	}
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		compacted := compact(text)
+		if compacted == text {
+			return raw, false, nil
+		}
+		encoded, err := json.Marshal(compacted)
+		return encoded, err == nil, err
+	}
+
+	var parts []map[string]json.RawMessage
+	if json.Unmarshal(raw, &parts) != nil {
+		return raw, false, nil
+	}
+	changed := false
+	for _, part := range parts {
+		if string(part["type"]) != `"text"` || json.Unmarshal(part["text"], &text) != nil {
+			continue
+		}
+		if compacted := compact(text); compacted != text {
+			encoded, err := json.Marshal(compacted)
+			if err != nil {
+				return raw, false, err
+			}
+			part["text"] = encoded
+			changed = true
+		}
+	}
+	if !changed {
+		return raw, false, nil
+	}
+	encoded, err := json.Marshal(parts)
+	return encoded, err == nil, err
+}
+
+// normalize trims trailing whitespace, collapses runs of spaces and tabs
+// after a line's indentation and runs of blank lines, and drops blank lines
+// at either end
+func normalize(text string) string {
+	lines := strings.Split(text, "\n")
+	kept := lines[:0]
+	blank := false
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		indent := len(line) - len(strings.TrimLeft(line, " \t"))
+		line = line[:indent] + innerSpace.ReplaceAllString(line[indent:], " ")
+		if line == "" {
+			if blank {
+				continue
+			}
+			blank = true
+		} else {
+			blank = false
+		}
+		kept = append(kept, line)
+	}
+	return strings.Trim(strings.Join(kept, "\n"), "\n")
+}
+
+// dedupe replaces the paragraphs of text already in seen, adding the rest
+func dedupe(text string, seen map[string]bool) string {
+	paragraphs := strings.Split(text, "\n\n")
+	for i, paragraph := range paragraphs {
+		key := strings.TrimSpace(paragraph)
+		if len(key) < minRepeatLength {
+			continue
+		}
+		if seen[key] {
+			paragraphs[i] = repeatPlaceholder
+		} else {
+			seen[key] = true
+		}
+	}
+	return strings.Join(paragraphs, "\n\n")
+}
+
+// OldTurns picks the messages a summary can stand in for: those after the
+// system messages the conversation opens with, up to the last keep
+// messages. The kept messages start at a user message, so no answer or
+// tool result is kept without what it answers. None are picked when
+// start == end.
+func OldTurns(messages []json.RawMessage, keep int) (start, end int) {
+	for start < len(messages) && isSystem(role(messages[start])) {
+		start++
+	}
+	end = len(messages) - keep
+	for end > start && role(messages[end]) != "user" {
+		end--
+	}
+	if end < start {
+		end = start
+	}
+	return start, end
+}
+
+// Transcript renders messages as plain text for a summarizer to read, a
+// line per message naming its role
+func Transcript(messages []json.RawMessage) string {
+	var transcript strings.Builder
+	for _, message := range messages {
+		var m struct {
+			Role    string          `json:"role"`
+			Content json.RawMessage `json:"content"`
+		}
+		if json.Unmarshal(message, &m) != nil {
+			continue
+		}
+		transcript.WriteString(m.Role + ": " + strings.Join(contentText(m.Content), "\n") + "\n\n")
+	}
+	return strings.TrimSpace(transcript.String())
+}
+
+func contentText(raw json.RawMessage) []string {
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return []string{text}
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	_ = json.Unmarshal(raw, &parts)
+	var texts []string
+	for _, part := range parts {
+		if part.Type == "text" {
+			texts = append(texts, part.Text)
+		}
+	}
+	return texts
+}
+
+func role(message json.RawMessage) string {
+	var m struct {
+		Role string `json:"role"`
+	}
+	_ = json.Unmarshal(message, &m)
+	return m.Role
+}
+
+func isSystem(role string) bool {
+	return role == "system" || role == "developer"
+}
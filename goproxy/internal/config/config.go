@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -14,29 +15,669 @@ type Config struct {
 	CacheTTL       time.Duration
 	RequestTimeout time.Duration
 	MaxCacheSize   int64 // max cache size in MB
+	MaxUploadSize  int64 // max multipart upload size in MB, defaults to the OpenAI file limit
+	TTSCacheSize   int64 // max size in KB of a cached speech response, 0 disables TTS caching
+	AdminToken     string
+	UserRateLimit  int    // requests per minute per end-user, 0 disables
+	UserIDHeader   string // header whose value is injected as the request's user field
+	TenantsFile    string
+	PricingFile    string
+	ReportDir      string // directory for scheduled chargeback reports, empty disables
+	UpstreamAPIKey string // sent upstream in place of virtual keys
+	KeyLifetime    time.Duration
+	KeyMaxLifetime time.Duration // 0 means no global cap
+	KeyExpiryWarn  time.Duration // window before expiry in which responses carry a warning
+	AlertInterval  time.Duration
+	SMTPAddr       string
+	SMTPFrom       string
+	SMTPUsername   string
+	SMTPPassword   string
+
+	ListenAddrs []string // addresses or interfaces to bind, empty binds all interfaces
+
+	// Addresses or CIDRs of load balancers whose X-Forwarded-For is
+	// believed. Without any, clients are the address they connect from.
+	TrustedProxies []string
+
+	// On SIGTERM or SIGINT, requests already upstream and open streams get
+	// ShutdownTimeout to finish before their connections are closed
+	ShutdownTimeout time.Duration
+
+	// Timeouts of client connections, 0 disables each. HTTPReadTimeout
+	// covers reading a request's body and HTTPWriteTimeout writing its
+	// response, or each write once the response streams.
+	HTTPReadHeaderTimeout time.Duration
+	HTTPReadTimeout       time.Duration
+	HTTPWriteTimeout      time.Duration
+	HTTPIdleTimeout       time.Duration // how long a keep-alive connection may sit idle
+	HTTPMaxHeaderBytes    int
+
+	UploadSpoolDir    string // where Uploads API parts are buffered, empty uses the system temp dir
+	UploadPartRetries int
+
+	CacheMaxEntrySize int64 // KB; larger responses are streamed through without being buffered
+
+	// DELETE /cache keeps what it cleared for CacheTrashGrace, so POST
+	// /cache/restore can bring it back. 0 clears for good.
+	CacheTrashGrace time.Duration
+
+	StreamMaxDuration time.Duration // streams open longer than this are logged as possible leaks, 0 disables
+	StreamMaxPerKey   int           // streams a key may have open at once unless it sets its own, 0 = unlimited
+
+	SSEHeartbeatInterval time.Duration // comment sent to quiet event streams this often, 0 disables
+	SSEIdleTimeout       time.Duration // longest gap between upstream chunks of an event stream, 0 = unbounded
+
+	UpstreamConcurrencyMax int // ceiling of the adaptive upstream concurrency limit, 0 disables it
+	UpstreamConcurrencyMin int
+	UpstreamLatencyTarget  time.Duration // slower responses count as congestion, 0 ignores latency
+	UpstreamQueueTimeout   time.Duration // how long a request waits for a slot before a 503
+
+	LoadShedMaxMemory     int64 // MB of memory held by the runtime past which requests are shed, 0 disables
+	LoadShedMaxGoroutines int   // goroutine count past which requests are shed, 0 disables
+
+	// Caps on client connections, overall and per IP, and on /v1 requests
+	// being answered at once, whatever their rate. 0 disables each.
+	MaxConnections      int
+	MaxConnectionsPerIP int
+	MaxInFlight         int
+
+	MaxRequestBodySize  int64  // MB of a /v1 body other than an upload, 0 = unlimited
+	MaxResponseBodySize int64  // MB, 0 = unlimited
+	ResponseSizePolicy  string // "stream" passes oversized responses through uncached, "abort" fails them with 502
+
+	// Upstream response headers clients are sent, by name or with a
+	// trailing * by prefix, the default list when empty; * sends them all
+	ResponseHeaders []string
+
+	GRPCPort string // port of the optional gRPC frontend, empty disables it
+
+	Compression        bool
+	CompressionMinSize int // bytes; responses of known length below this aren't compressed
+
+	WebhookSecret  string   // signing secret of OpenAI webhooks, empty disables the receiver
+	WebhookTargets []string // internal endpoints verified webhooks are forwarded to
+
+	TunnelAllowlist []string // CONNECT destinations (host[:port], *.suffix), empty disables tunneling
+	TunnelToken     string
+
+	TLSCertFile     string // serve HTTPS, and with it HTTP/2, when set
+	TLSKeyFile      string
+	TLSPolicy       string // default, or fips to allow only approved TLS on every connection
+	H2C             bool   // accept cleartext HTTP/2 when not serving TLS
+	HTTP2MaxStreams uint32
+	HTTP3           bool   // also serve HTTP/3 over QUIC, in builds tagged http3
+	HTTP3Port       string // UDP port of HTTP/3, empty uses PORT
+
+	// How upstream and the shadow upstream are verified, and the client
+	// certificate the proxy presents to them
+	UpstreamCAFile        string // PEM certificates trusted besides the system's
+	UpstreamCertFile      string
+	UpstreamKeyFile       string
+	UpstreamTLSMinVersion string // 1.0 to 1.3, empty leaves Go's default
+	UpstreamTLSInsecure   bool   // skip certificate verification, for labs only
+
+	EmbeddingsBatchWindow    time.Duration // how long single-input embedding requests wait to be coalesced, 0 disables
+	EmbeddingsBatchMaxInputs int
+
+	// Vectors of embeddings inputs are cached one by one, for
+	// EmbeddingsCacheTTL within EmbeddingsCacheSize MB, so only inputs not
+	// seen before are sent upstream
+	EmbeddingsCache     bool
+	EmbeddingsCacheTTL  time.Duration
+	EmbeddingsCacheSize int
+
+	LocalBatchConcurrency int
+	LocalBatchRate        int // requests per minute across a local batch, 0 = unpaced
+	LocalBatchMaxRequests int
+
+	FanoutModels    []string // models a fan-out goes to when the request doesn't name any
+	FanoutMaxModels int
+	FanoutTimeout   time.Duration // covers the whole fan-out; requests may only shorten it
+
+	UpstreamMode      string // live, mock, record or replay
+	MockResponsesFile string
+	CassetteDir       string        // where record mode writes and replay mode reads
+	MockLatency       time.Duration // before each mock response
+	MockChunkDelay    time.Duration // between streamed mock chunks
+
+	// At startup, each API key configured for an upstream lists its models
+	// there. A key that can't is fatal, or with VerifyUpstreamPolicy
+	// degraded, reported by /health while the proxy serves anyway.
+	VerifyUpstreamOnStart bool
+	VerifyUpstreamPolicy  string // refuse or degraded
+	VerifyUpstreamTimeout time.Duration
+
+	// Fault injection; rates are probabilities from 0 to 1
+	ChaosLatency      time.Duration // most latency added
+	ChaosLatencyRate  float64
+	ChaosErrorRate    float64
+	ChaosErrorStatus  []string // statuses injected errors are picked from
+	ChaosTruncateRate float64
+	ChaosDropRate     float64
+	ChaosHeader       bool // honour faults requested in X-Chaos
+
+	// Shadow traffic: a copy of each sampled request goes to ShadowURL or
+	// ShadowModel (or both) and the answers are compared
+	ShadowURL             string
+	ShadowModel           string
+	ShadowAPIKey          string
+	ShadowSampleRate      float64
+	ShadowMaxInFlight     int
+	ShadowSimilarityModel string // embeddings model for similarity, words are compared without one
+	ShadowReportInterval  time.Duration
+	ShadowReportDir       string
+
+	// Every /v1 request is journaled to a file a day in JournalDir, synced
+	// to disk every JournalSyncInterval, for reconciling against invoices
+	JournalDir          string
+	JournalSyncInterval time.Duration
+
+	// Requests upstream took SlowLogThreshold or longer to answer are kept
+	// for /admin/slow, and appended to SlowLogFile when set, with the first
+	// SlowLogExcerpt characters of their prompt, redacted
+	SlowLogThreshold time.Duration // 0 disables
+	SlowLogFile      string
+	SlowLogExcerpt   int
+
+	// Traffic captures started from the admin API record /v1 exchanges for
+	// up to CaptureMaxDuration, within CaptureMaxSize MB, into CaptureDir
+	CaptureDir         string // empty uses the system temp dir
+	CaptureMaxDuration time.Duration
+	CaptureMaxSize     int
+
+	// Chat completions answered 200 with empty content are asked again
+	// once, with EmptyCompletionFallbackModel if set
+	EmptyCompletionRetry         bool
+	EmptyCompletionFallbackModel string
+
+	// Chat completion streams upstream drops partway are resumed by asking
+	// for the rest of the answer, up to StreamRecoveryMaxAttempts times
+	StreamRecovery            bool
+	StreamRecoveryMaxAttempts int
+	StreamRecoveryPrompt      string // sent after the partial answer to ask for the rest
+
+	// Completion streams upstream reports no usage for are billed by the
+	// tokens the proxy counts in them, and every stream's usage is reported
+	// to the client as StreamUsageReport says
+	StreamUsageCounting bool
+	StreamUsageReport   string // none, comment, trailer or both
+
+	// Completions, embeddings and errors are answered with the fields and
+	// envelope the API uses, whichever backend sent them
+	ResponseNormalization bool
+
+	// A key sending the same uncacheable request more than
+	// DuplicateThreshold times within DuplicateWindow is logged and
+	// counted, and refused when DuplicateAction is throttle
+	DuplicateThreshold int // 0 disables
+	DuplicateWindow    time.Duration
+	DuplicateAction    string // warn or throttle
+
+	// Registered post-processors run on completion responses, in order
+	PostProcessors []string
+
+	// Registered stream hooks run on every server-sent event, in order
+	StreamHooks []string
+
+	// Lua plugins run at the pre_route, pre_forward and post_response hooks,
+	// in order, each call stopped after PluginTimeout
+	Plugins       []string
+	PluginTimeout time.Duration
+
+	// External authorization service asked about every /v1 request, with
+	// its verdicts cached for ExtAuthzCacheTTL. When it can't be reached,
+	// requests are refused unless ExtAuthzFailOpen is set
+	ExtAuthzURL      string
+	ExtAuthzTimeout  time.Duration
+	ExtAuthzCacheTTL time.Duration
+	ExtAuthzFailOpen bool
+
+	// Rego policy bundle evaluated for every /v1 request, checked for
+	// changes every PolicyReloadInterval when set. Times given to the
+	// policy are in PolicyTimezone, along with which of the schedules in
+	// PolicySchedulesFile are active
+	PolicyBundle         string
+	PolicyQuery          string
+	PolicyReloadInterval time.Duration
+	PolicyTimezone       string
+	PolicySchedulesFile  string
+
+	// Request pipeline stages in the order they run, the default order
+	// when empty
+	Pipeline []string
+
+	// X-Proxy-* request overrides keys without their own list may use, and
+	// the named upstreams X-Proxy-Upstream can pick, as name=url entries
+	ProxyOverrides  []string
+	UpstreamTargets []string
+
+	// MaxMind database clients are located in by address. Requests from
+	// outside GeoIPAllowedCountries, when set, or from GeoIPBlockedCountries
+	// are refused, as are ones from unknown places with GeoIPBlockUnknown.
+	// GeoIPUpstreams sends countries to UpstreamTargets, as COUNTRY=name.
+	GeoIPDB               string
+	GeoIPAllowedCountries []string
+	GeoIPBlockedCountries []string
+	GeoIPBlockUnknown     bool
+	GeoIPUpstreams        []string
+
+	// Opt-in cache of image generations by prompt, size and model, kept
+	// for ImageCacheTTL within ImageCacheSize MB. Image URLs handed out
+	// point at ImageCacheURL, or at the host the request came in on.
+	ImageCache     bool
+	ImageCacheTTL  time.Duration
+	ImageCacheSize int
+	ImageCacheURL  string
+
+	// Generated images are copied into ImageStore when it's set, a
+	// file://, s3:// or gs:// location, and served from there at URLs
+	// that don't expire. Buckets are reached with the ImageStore* keys.
+	ImageStore          string
+	ImageStoreEndpoint  string
+	ImageStoreRegion    string
+	ImageStoreAccessKey string
+	ImageStoreSecretKey string
+
+	// Fine-tuning jobs created through the proxy are kept in
+	// FineTuneStateFile, or in memory when it's empty, and unfinished ones
+	// checked on every FineTunePollInterval. Endpoints in FineTuneWebhooks
+	// are told when a job finishes.
+	FineTuneStateFile    string
+	FineTunePollInterval time.Duration
+	FineTuneWebhooks     []string
+
+	// Chat, embeddings and image generation request bodies are checked
+	// against their OpenAI schemas, and malformed ones refused with a 400
+	// before going upstream
+	RequestValidation bool
+
+	// Chat completion requests using deprecated parameters are rewritten
+	// to their current form: functions to tools, and max_tokens to
+	// max_completion_tokens for models starting with one of
+	// MaxCompletionTokensModels, a built-in list when empty
+	RequestMigration          bool
+	MaxCompletionTokensModels []string
+
+	// Embeddings requests for a retired model are served by its successor,
+	// from old=new or old=new:dimensions entries
+	EmbeddingsMigrations []string
+
+	// Body parameters filled in for requests that leave them out, by
+	// route; a key's own defaults in TENANTS_FILE come first
+	RequestDefaultsFile string
+
+	// Declarative rewrites of the requests they match, applied in order
+	// before requests are routed
+	RequestRulesFile string
+
+	// Chat completions naming a session in X-Session-ID are sent with its
+	// history from SessionStore, the newest SessionMaxTokens of it, and
+	// their answers added to it. Sessions expire SessionTTL after their
+	// last turn.
+	SessionStore     string
+	SessionTTL       time.Duration
+	SessionMaxTokens int
+
+	// Chat completion prompts over PromptCompactionThreshold tokens have
+	// their whitespace normalized and repeated paragraphs dropped; if
+	// that's not enough and PromptCompactionSummaryModel is set, all but
+	// the last PromptCompactionKeepMessages turns are summarized by it
+	PromptCompaction             bool
+	PromptCompactionThreshold    int
+	PromptCompactionSummaryModel string
+	PromptCompactionKeepMessages int
+
+	// Function tool definitions are checked before going upstream: their
+	// names, and their parameters for a well-formed JSON schema
+	ToolValidation bool
+
+	// Tools the proxy runs itself for chat completions that name them in
+	// X-Server-Tools, sending the results back to the model for up to
+	// ServerToolsMaxRounds rounds; each call may take ServerToolsTimeout
+	ServerToolsFile      string
+	ServerToolsMaxRounds int
+	ServerToolsTimeout   time.Duration
+
+	// Completion answers say where they came from, in headers, in their
+	// body under ProvenanceField, or both: ProxyID, the model that
+	// answered, the cache status and the transforms the proxy applied
+	Provenance      string
+	ProvenanceField string
+	ProxyID         string
+
+	// Stored data older than these is purged, 0 keeping it: usage records,
+	// the recent requests /admin/traffic and /admin/errors show, and
+	// cassettes recorded with UPSTREAM_MODE=record. Sessions are kept for
+	// SessionTTL.
+	UsageRetention    time.Duration
+	LogRetention      time.Duration
+	CassetteRetention time.Duration
+
+	// Sessions kept outside memory, cassettes and images in ImageStore are
+	// encrypted with AES-GCM under this base64 key, or the one in
+	// StorageEncryptionKeyFile, such as a KMS agent writes
+	StorageEncryptionKey     string
+	StorageEncryptionKeyFile string
+
+	// /stats and the request and cache counters are snapshotted every
+	// StatsExportInterval to StatsExport, for environments no Prometheus
+	// scrapes: a file:// path each is appended to as a JSON line, or a
+	// Pushgateway address they're pushed to
+	StatsExport         string
+	StatsExportInterval time.Duration
+
+	// Replicas gossip their rate-limit and usage counters with each other
+	// every ClusterGossipInterval, starting from ClusterPeers, so limits
+	// hold across the cluster rather than per replica. ClusterAdvertiseURL
+	// is where the others reach this one, and ClusterSecret authenticates
+	// the gossip.
+	ClusterPeers          []string
+	ClusterAdvertiseURL   string
+	ClusterSecret         string
+	ClusterGossipInterval time.Duration
+
+	// Cached responses are kept by the member their key hashes to, which
+	// the others ask for it within ClusterCacheTimeout
+	ClusterCache        bool
+	ClusterCacheTimeout time.Duration
+
+	// Getenv is what the configuration was read with, for registered
+	// extensions such as post-processors to read their own settings
+	Getenv func(key string) string
 }
 
+// Load reads the configuration from the environment
 func Load() *Config {
+	return LoadFrom(os.Getenv)
+}
+
+// LoadFrom reads the configuration from variables looked up with getenv
+// rather than the environment, so an embedder or test harness can configure
+// a server without touching the process's environment
+func LoadFrom(getenv func(key string) string) *Config {
+	env := lookup(getenv)
 	return &Config{
-		Port:           getEnv("PORT", "8080"),
-		ProxyURL:       getEnv("PROXY_URL", ""),
-		OpenAIAPIURL:   getEnv("OPENAI_API_URL", "https://api.openai.com"),
-		RateLimit:      getEnvInt("RATE_LIMIT", 60), // 60 requests per minute by default
-		CacheTTL:       getEnvDuration("CACHE_TTL", "5m"),
-		RequestTimeout: getEnvDuration("REQUEST_TIMEOUT", "30s"),
-		MaxCacheSize:   getEnvInt64("MAX_CACHE_SIZE", 100), // 100MB by default
+		Port:           env.get("PORT", "8080"),
+		ProxyURL:       env.get("PROXY_URL", ""),
+		OpenAIAPIURL:   env.get("OPENAI_API_URL", "https://api.openai.com"),
+		RateLimit:      env.int("RATE_LIMIT", 60), // 60 requests per minute by default
+		CacheTTL:       env.duration("CACHE_TTL", "5m"),
+		RequestTimeout: env.duration("REQUEST_TIMEOUT", "30s"),
+		MaxCacheSize:   env.int64("MAX_CACHE_SIZE", 100), // 100MB by default
+		MaxUploadSize:  env.int64("MAX_UPLOAD_SIZE", 512),
+		TTSCacheSize:   env.int64("TTS_CACHE_MAX_SIZE", 0),
+		AdminToken:     env.get("ADMIN_TOKEN", ""),
+		UserRateLimit:  env.int("USER_RATE_LIMIT", 0),
+		UserIDHeader:   env.get("USER_ID_HEADER", "X-User-ID"),
+		TenantsFile:    env.get("TENANTS_FILE", ""),
+		PricingFile:    env.get("PRICING_FILE", ""),
+		ReportDir:      env.get("CHARGEBACK_REPORT_DIR", ""),
+		UpstreamAPIKey: env.get("OPENAI_API_KEY", ""),
+		KeyLifetime:    env.duration("KEY_DEFAULT_LIFETIME", "720h"),
+		KeyMaxLifetime: env.duration("KEY_MAX_LIFETIME", "0"),
+		KeyExpiryWarn:  env.duration("KEY_EXPIRY_WARNING", "72h"),
+		AlertInterval:  env.duration("ALERT_INTERVAL", "1m"),
+		SMTPAddr:       env.get("SMTP_ADDR", ""),
+		SMTPFrom:       env.get("SMTP_FROM", "goproxyai@localhost"),
+		SMTPUsername:   env.get("SMTP_USERNAME", ""),
+		SMTPPassword:   env.get("SMTP_PASSWORD", ""),
+
+		ListenAddrs: env.list("LISTEN_ADDRS"),
+
+		TrustedProxies: env.list("TRUSTED_PROXIES"),
+
+		ShutdownTimeout: env.duration("SHUTDOWN_TIMEOUT", "30s"),
+
+		HTTPReadHeaderTimeout: env.duration("HTTP_READ_HEADER_TIMEOUT", "10s"),
+		HTTPReadTimeout:       env.duration("HTTP_READ_TIMEOUT", "5m"),
+		HTTPWriteTimeout:      env.duration("HTTP_WRITE_TIMEOUT", "5m"),
+		HTTPIdleTimeout:       env.duration("HTTP_IDLE_TIMEOUT", "2m"),
+		HTTPMaxHeaderBytes:    env.int("HTTP_MAX_HEADER_BYTES", 1<<20),
+
+		UploadSpoolDir:    env.get("UPLOAD_SPOOL_DIR", ""),
+		UploadPartRetries: env.int("UPLOAD_PART_RETRIES", 3),
+
+		CacheMaxEntrySize: env.int64("CACHE_MAX_ENTRY_SIZE", 10240),
+
+		CacheTrashGrace: env.duration("CACHE_TRASH_GRACE", "15m"),
+
+		StreamMaxDuration: env.duration("STREAM_MAX_DURATION", "1h"),
+		StreamMaxPerKey:   env.int("STREAM_MAX_PER_KEY", 0),
+
+		SSEHeartbeatInterval: env.duration("SSE_HEARTBEAT_INTERVAL", "15s"),
+		SSEIdleTimeout:       env.duration("SSE_IDLE_TIMEOUT", "5m"),
+
+		UpstreamConcurrencyMax: env.int("UPSTREAM_CONCURRENCY_MAX", 0),
+		UpstreamConcurrencyMin: env.int("UPSTREAM_CONCURRENCY_MIN", 4),
+		UpstreamLatencyTarget:  env.duration("UPSTREAM_LATENCY_TARGET", "30s"),
+		UpstreamQueueTimeout:   env.duration("UPSTREAM_QUEUE_TIMEOUT", "1s"),
+
+		LoadShedMaxMemory:     env.int64("LOAD_SHED_MAX_MEMORY", 0),
+		LoadShedMaxGoroutines: env.int("LOAD_SHED_MAX_GOROUTINES", 0),
+
+		MaxConnections:      env.int("MAX_CONNECTIONS", 0),
+		MaxConnectionsPerIP: env.int("MAX_CONNECTIONS_PER_IP", 0),
+		MaxInFlight:         env.int("MAX_IN_FLIGHT_REQUESTS", 0),
+
+		MaxRequestBodySize:  env.int64("MAX_REQUEST_BODY_SIZE", 64),
+		MaxResponseBodySize: env.int64("MAX_RESPONSE_BODY_SIZE", 64),
+		ResponseSizePolicy:  env.get("RESPONSE_SIZE_POLICY", "stream"),
+
+		ResponseHeaders: env.list("RESPONSE_HEADERS"),
+
+		GRPCPort: env.get("GRPC_PORT", ""),
+
+		Compression:        env.get("RESPONSE_COMPRESSION", "true") == "true",
+		CompressionMinSize: env.int("COMPRESSION_MIN_SIZE", 1024),
+
+		WebhookSecret:  env.get("OPENAI_WEBHOOK_SECRET", ""),
+		WebhookTargets: env.list("WEBHOOK_TARGETS"),
+
+		TunnelAllowlist: env.list("TUNNEL_ALLOWLIST"),
+		TunnelToken:     env.get("TUNNEL_TOKEN", ""),
+
+		TLSCertFile:     env.get("TLS_CERT_FILE", ""),
+		TLSKeyFile:      env.get("TLS_KEY_FILE", ""),
+		TLSPolicy:       env.get("TLS_POLICY", ""),
+		H2C:             env.get("H2C", "false") == "true",
+		HTTP2MaxStreams: uint32(env.int("HTTP2_MAX_CONCURRENT_STREAMS", 250)),
+		HTTP3:           env.get("HTTP3", "false") == "true",
+		HTTP3Port:       env.get("HTTP3_PORT", ""),
+
+		UpstreamCAFile:        env.get("UPSTREAM_CA_FILE", ""),
+		UpstreamCertFile:      env.get("UPSTREAM_CLIENT_CERT_FILE", ""),
+		UpstreamKeyFile:       env.get("UPSTREAM_CLIENT_KEY_FILE", ""),
+		UpstreamTLSMinVersion: env.get("UPSTREAM_TLS_MIN_VERSION", ""),
+		UpstreamTLSInsecure:   env.get("UPSTREAM_TLS_INSECURE_SKIP_VERIFY", "false") == "true",
+
+		EmbeddingsBatchWindow:    env.duration("EMBEDDINGS_BATCH_WINDOW", "0"),
+		EmbeddingsBatchMaxInputs: env.int("EMBEDDINGS_BATCH_MAX_INPUTS", 256),
+
+		EmbeddingsCache:     env.get("EMBEDDINGS_CACHE", "false") == "true",
+		EmbeddingsCacheTTL:  env.duration("EMBEDDINGS_CACHE_TTL", "24h"),
+		EmbeddingsCacheSize: env.int("EMBEDDINGS_CACHE_SIZE", 256),
+
+		LocalBatchConcurrency: env.int("LOCAL_BATCH_CONCURRENCY", 4),
+		LocalBatchRate:        env.int("LOCAL_BATCH_RATE", 0),
+		LocalBatchMaxRequests: env.int("LOCAL_BATCH_MAX_REQUESTS", 1000),
+
+		FanoutModels:    env.list("FANOUT_MODELS"),
+		FanoutMaxModels: env.int("FANOUT_MAX_MODELS", 8),
+		FanoutTimeout:   env.duration("FANOUT_TIMEOUT", "60s"),
+
+		UpstreamMode:      env.get("UPSTREAM_MODE", "live"),
+		MockResponsesFile: env.get("MOCK_RESPONSES_FILE", ""),
+		CassetteDir:       env.get("CASSETTE_DIR", "cassettes"),
+		MockLatency:       env.duration("MOCK_LATENCY", "0"),
+		MockChunkDelay:    env.duration("MOCK_CHUNK_DELAY", "20ms"),
+
+		VerifyUpstreamOnStart: env.get("VERIFY_UPSTREAM_ON_START", "false") == "true",
+		VerifyUpstreamPolicy:  env.get("VERIFY_UPSTREAM_POLICY", "refuse"),
+		VerifyUpstreamTimeout: env.duration("VERIFY_UPSTREAM_TIMEOUT", "10s"),
+
+		ChaosLatency:      env.duration("CHAOS_LATENCY", "0"),
+		ChaosLatencyRate:  env.float("CHAOS_LATENCY_RATE", 0),
+		ChaosErrorRate:    env.float("CHAOS_ERROR_RATE", 0),
+		ChaosErrorStatus:  env.list("CHAOS_ERROR_STATUS"),
+		ChaosTruncateRate: env.float("CHAOS_TRUNCATE_RATE", 0),
+		ChaosDropRate:     env.float("CHAOS_DROP_RATE", 0),
+		ChaosHeader:       env.get("CHAOS_HEADER", "false") == "true",
+
+		ShadowURL:             env.get("SHADOW_URL", ""),
+		ShadowModel:           env.get("SHADOW_MODEL", ""),
+		ShadowAPIKey:          env.get("SHADOW_API_KEY", ""),
+		ShadowSampleRate:      env.float("SHADOW_SAMPLE_RATE", 1),
+		ShadowMaxInFlight:     env.int("SHADOW_MAX_IN_FLIGHT", 16),
+		ShadowSimilarityModel: env.get("SHADOW_SIMILARITY_MODEL", ""),
+		ShadowReportInterval:  env.duration("SHADOW_REPORT_INTERVAL", "1h"),
+		ShadowReportDir:       env.get("SHADOW_REPORT_DIR", ""),
+
+		JournalDir:          env.get("JOURNAL_DIR", ""),
+		JournalSyncInterval: env.duration("JOURNAL_SYNC_INTERVAL", "1s"),
+
+		SlowLogThreshold: env.duration("SLOW_LOG_THRESHOLD", "0"),
+		SlowLogFile:      env.get("SLOW_LOG_FILE", ""),
+		SlowLogExcerpt:   env.int("SLOW_LOG_EXCERPT", 200),
+
+		CaptureDir:         env.get("CAPTURE_DIR", ""),
+		CaptureMaxDuration: env.duration("CAPTURE_MAX_DURATION", "10m"),
+		CaptureMaxSize:     env.int("CAPTURE_MAX_SIZE", 50),
+
+		EmptyCompletionRetry:         env.get("EMPTY_COMPLETION_RETRY", "false") == "true",
+		EmptyCompletionFallbackModel: env.get("EMPTY_COMPLETION_FALLBACK_MODEL", ""),
+
+		StreamRecovery:            env.get("STREAM_RECOVERY", "false") == "true",
+		StreamRecoveryMaxAttempts: env.int("STREAM_RECOVERY_MAX_ATTEMPTS", 1),
+		StreamRecoveryPrompt:      env.get("STREAM_RECOVERY_PROMPT", "Continue your previous response exactly where it stopped, without repeating any of it."),
+
+		StreamUsageCounting: env.get("STREAM_USAGE_COUNTING", "false") == "true",
+		StreamUsageReport:   env.get("STREAM_USAGE_REPORT", "comment"),
+
+		ResponseNormalization: env.get("RESPONSE_NORMALIZATION", "false") == "true",
+
+		DuplicateThreshold: env.int("DUPLICATE_THRESHOLD", 0),
+		DuplicateWindow:    env.duration("DUPLICATE_WINDOW", "1m"),
+		DuplicateAction:    env.get("DUPLICATE_ACTION", "warn"),
+
+		PostProcessors: env.list("POSTPROCESSORS"),
+
+		StreamHooks: env.list("STREAM_HOOKS"),
+
+		Plugins:       env.list("PLUGINS"),
+		PluginTimeout: env.duration("PLUGIN_TIMEOUT", "100ms"),
+
+		ExtAuthzURL:      env.get("EXT_AUTHZ_URL", ""),
+		ExtAuthzTimeout:  env.duration("EXT_AUTHZ_TIMEOUT", "1s"),
+		ExtAuthzCacheTTL: env.duration("EXT_AUTHZ_CACHE_TTL", "30s"),
+		ExtAuthzFailOpen: env.get("EXT_AUTHZ_FAIL_OPEN", "false") == "true",
+
+		PolicyBundle:         env.get("POLICY_BUNDLE", ""),
+		PolicyQuery:          env.get("POLICY_QUERY", "data.openaiproxy.decision"),
+		PolicyReloadInterval: env.duration("POLICY_RELOAD_INTERVAL", "0"),
+		PolicyTimezone:       env.get("POLICY_TIMEZONE", "UTC"),
+		PolicySchedulesFile:  env.get("POLICY_SCHEDULES_FILE", ""),
+
+		Pipeline: env.list("PIPELINE"),
+
+		ProxyOverrides:  env.list("PROXY_OVERRIDES"),
+		UpstreamTargets: env.list("UPSTREAM_TARGETS"),
+
+		GeoIPDB:               env.get("GEOIP_DB", ""),
+		GeoIPAllowedCountries: env.list("GEOIP_ALLOWED_COUNTRIES"),
+		GeoIPBlockedCountries: env.list("GEOIP_BLOCKED_COUNTRIES"),
+		GeoIPBlockUnknown:     env.get("GEOIP_BLOCK_UNKNOWN", "false") == "true",
+		GeoIPUpstreams:        env.list("GEOIP_UPSTREAMS"),
+
+		ImageCache:     env.get("IMAGE_CACHE", "false") == "true",
+		ImageCacheTTL:  env.duration("IMAGE_CACHE_TTL", "24h"),
+		ImageCacheSize: env.int("IMAGE_CACHE_SIZE", 512),
+		ImageCacheURL:  env.get("IMAGE_CACHE_URL", ""),
+
+		ImageStore:          env.get("IMAGE_STORE", ""),
+		ImageStoreEndpoint:  env.get("IMAGE_STORE_ENDPOINT", ""),
+		ImageStoreRegion:    env.get("IMAGE_STORE_REGION", env.get("AWS_REGION", "us-east-1")),
+		ImageStoreAccessKey: env.get("IMAGE_STORE_ACCESS_KEY", env.get("AWS_ACCESS_KEY_ID", "")),
+		ImageStoreSecretKey: env.get("IMAGE_STORE_SECRET_KEY", env.get("AWS_SECRET_ACCESS_KEY", "")),
+
+		FineTuneStateFile:    env.get("FINETUNE_STATE_FILE", ""),
+		FineTunePollInterval: env.duration("FINETUNE_POLL_INTERVAL", "1m"),
+		FineTuneWebhooks:     env.list("FINETUNE_WEBHOOKS"),
+
+		RequestValidation: env.get("REQUEST_VALIDATION", "false") == "true",
+
+		RequestMigration:          env.get("REQUEST_MIGRATION", "false") == "true",
+		MaxCompletionTokensModels: env.list("MAX_COMPLETION_TOKENS_MODELS"),
+
+		EmbeddingsMigrations: env.list("EMBEDDINGS_MODEL_MIGRATIONS"),
+
+		RequestDefaultsFile: env.get("REQUEST_DEFAULTS_FILE", ""),
+
+		RequestRulesFile: env.get("REQUEST_RULES_FILE", ""),
+
+		SessionStore:     env.get("SESSION_STORE", ""),
+		SessionTTL:       env.duration("SESSION_TTL", "24h"),
+		SessionMaxTokens: env.int("SESSION_MAX_TOKENS", 8000),
+
+		PromptCompaction:             env.get("PROMPT_COMPACTION", "false") == "true",
+		PromptCompactionThreshold:    env.int("PROMPT_COMPACTION_THRESHOLD", 32000),
+		PromptCompactionSummaryModel: env.get("PROMPT_COMPACTION_SUMMARY_MODEL", ""),
+		PromptCompactionKeepMessages: env.int("PROMPT_COMPACTION_KEEP_MESSAGES", 6),
+
+		ToolValidation: env.get("TOOL_VALIDATION", "false") == "true",
+
+		ServerToolsFile:      env.get("SERVER_TOOLS_FILE", ""),
+		ServerToolsMaxRounds: env.int("SERVER_TOOLS_MAX_ROUNDS", 5),
+		ServerToolsTimeout:   env.duration("SERVER_TOOLS_TIMEOUT", "10s"),
+
+		Provenance:      env.get("PROVENANCE", ""),
+		ProvenanceField: env.get("PROVENANCE_FIELD", "x_proxy_provenance"),
+		ProxyID:         env.get("PROXY_ID", ""),
+
+		UsageRetention:    env.duration("USAGE_RETENTION", "0"),
+		LogRetention:      env.duration("LOG_RETENTION", "0"),
+		CassetteRetention: env.duration("CASSETTE_RETENTION", "0"),
+
+		StorageEncryptionKey:     env.get("STORAGE_ENCRYPTION_KEY", ""),
+		StorageEncryptionKeyFile: env.get("STORAGE_ENCRYPTION_KEY_FILE", ""),
+
+		StatsExport:         env.get("STATS_EXPORT", ""),
+		StatsExportInterval: env.duration("STATS_EXPORT_INTERVAL", "1m"),
+
+		ClusterPeers:          env.list("CLUSTER_PEERS"),
+		ClusterAdvertiseURL:   env.get("CLUSTER_ADVERTISE_URL", ""),
+		ClusterSecret:         env.get("CLUSTER_SECRET", ""),
+		ClusterGossipInterval: env.duration("CLUSTER_GOSSIP_INTERVAL", "1s"),
+
+		ClusterCache:        env.get("CLUSTER_CACHE", "false") == "true",
+		ClusterCacheTimeout: env.duration("CLUSTER_CACHE_TIMEOUT", "250ms"),
+
+		Getenv: getenv,
 	}
 }
 
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
+// lookup returns a variable's value, or "" when it's unset
+type lookup func(key string) string
+
+func (env lookup) get(key, defaultValue string) string {
+	if value := env(key); value != "" {
 		return value
 	}
 	return defaultValue
 }
 
-func getEnvInt(key string, defaultValue int) int {
-	if value := os.Getenv(key); value != "" {
+// list splits a comma-separated variable, dropping empty entries
+func (env lookup) list(key string) []string {
+	var values []string
+	for _, value := range strings.Split(env(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func (env lookup) int(key string, defaultValue int) int {
+	if value := env(key); value != "" {
 		if intValue, err := strconv.Atoi(value); err == nil {
 			return intValue
 		}
@@ -44,8 +685,8 @@ func getEnvInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
-func getEnvInt64(key string, defaultValue int64) int64 {
-	if value := os.Getenv(key); value != "" {
+func (env lookup) int64(key string, defaultValue int64) int64 {
+	if value := env(key); value != "" {
 		if intValue, err := strconv.ParseInt(value, 10, 64); err == nil {
 			return intValue
 		}
@@ -53,8 +694,17 @@ func getEnvInt64(key string, defaultValue int64) int64 {
 	return defaultValue
 }
 
-func getEnvDuration(key string, defaultValue string) time.Duration {
-	if value := os.Getenv(key); value != "" {
+func (env lookup) float(key string, defaultValue float64) float64 {
+	if value := env(key); value != "" {
+		if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
+			return floatValue
+		}
+	}
+	return defaultValue
+}
+
+func (env lookup) duration(key string, defaultValue string) time.Duration {
+	if value := env(key); value != "" {
 		if duration, err := time.ParseDuration(value); err == nil {
 			return duration
 		}
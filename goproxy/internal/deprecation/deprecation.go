@@ -0,0 +1,229 @@
+// Package deprecation notices when upstream says a model is deprecated or
+// shutting down, and keeps track of the keys still calling it so their
+// owners can be told before it's gone
+package deprecation
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"goproxyai/internal/clock"
+)
+
+// Error codes upstream refuses deprecated models with
+var errorCodes = map[string]bool{
+	"model_deprecated": true,
+	"model_retired":    true,
+	"model_sunset":     true,
+}
+
+// Words that tell a model_not_found apart from a typo
+var noticeWords = []string{"deprecated", "shut down", "sunset", "retired", "decommissioned"}
+
+// Notice is what upstream said about a deprecated model
+type Notice struct {
+	Model string `json:"model"`
+	// When upstream says the model stops working, if it did
+	Sunset *time.Time `json:"sunset,omitempty"`
+	// Upstream's own words: an error message, or the headers it sent
+	Message   string    `json:"message"`
+	Source    string    `json:"source"` // "headers" or "error"
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// Caller is a key that has called a deprecated model since it was flagged
+type Caller struct {
+	Tenant   string    `json:"tenant,omitempty"`
+	KeyID    string    `json:"key_id"`
+	KeyName  string    `json:"key_name,omitempty"`
+	Requests int64     `json:"requests"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// Model is a deprecated model with the keys still calling it, most
+// recently seen first
+type Model struct {
+	Notice
+	Callers []Caller `json:"callers"`
+}
+
+// Tracker remembers the models upstream has flagged as deprecated
+type Tracker struct {
+	mutex  sync.RWMutex
+	models map[string]*model
+}
+
+type model struct {
+	notice  Notice
+	callers map[string]*Caller
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{models: make(map[string]*model)}
+}
+
+// Flag records upstream's notice for a model, keeping when it was first
+// seen and taking the latest sunset and message
+func (t *Tracker) Flag(notice Notice) {
+	if notice.Model == "" {
+		return
+	}
+	now := clock.Now()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	m, found := t.models[notice.Model]
+	if !found {
+		notice.FirstSeen = now
+		m = &model{callers: make(map[string]*Caller)}
+		t.models[notice.Model] = m
+	} else {
+		notice.FirstSeen = m.notice.FirstSeen
+		if notice.Sunset == nil {
+			notice.Sunset = m.notice.Sunset
+		}
+	}
+	notice.LastSeen = now
+	m.notice = notice
+}
+
+// Lookup returns upstream's notice for a model, if it has flagged it
+func (t *Tracker) Lookup(name string) (Notice, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	m, found := t.models[name]
+	if !found {
+		return Notice{}, false
+	}
+	return m.notice, true
+}
+
+// Called counts a request from a key for a model, when the model is
+// deprecated, reporting whether it is
+func (t *Tracker) Called(name string, caller Caller) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	m, found := t.models[name]
+	if !found {
+		return false
+	}
+	c, found := m.callers[caller.KeyID]
+	if !found {
+		c = &caller
+		m.callers[caller.KeyID] = c
+	}
+	c.Requests++
+	c.LastSeen = clock.Now()
+	return true
+}
+
+// Report lists the deprecated models, soonest sunset first, with the keys
+// still calling them
+func (t *Tracker) Report() []Model {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	report := make([]Model, 0, len(t.models))
+	for _, m := range t.models {
+		entry := Model{Notice: m.notice, Callers: make([]Caller, 0, len(m.callers))}
+		for _, caller := range m.callers {
+			entry.Callers = append(entry.Callers, *caller)
+		}
+		sort.Slice(entry.Callers, func(i, j int) bool { return entry.Callers[i].LastSeen.After(entry.Callers[j].LastSeen) })
+		report = append(report, entry)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		a, b := report[i].Sunset, report[j].Sunset
+		if (a == nil) != (b == nil) {
+			return a != nil
+		}
+		if a != nil && !a.Equal(*b) {
+			return a.Before(*b)
+		}
+		return report[i].Model < report[j].Model
+	})
+	return report
+}
+
+// FromHeaders reads a notice from the Deprecation and Sunset headers of RFC
+// 9745 and RFC 8594, or a Warning that mentions deprecation
+func FromHeaders(model string, headers http.Header) (Notice, bool) {
+	deprecation := headers.Get("Deprecation")
+	sunset := headers.Get("Sunset")
+	var warning string
+	for _, value := range headers.Values("Warning") {
+		if mentionsDeprecation(value) {
+			warning = value
+			break
+		}
+	}
+	if deprecation == "" && sunset == "" && warning == "" || deprecation == "false" {
+		return Notice{}, false
+	}
+
+	var parts []string
+	if deprecation != "" {
+		parts = append(parts, "Deprecation: "+deprecation)
+	}
+	if sunset != "" {
+		parts = append(parts, "Sunset: "+sunset)
+	}
+	if warning != "" {
+		parts = append(parts, "Warning: "+warning)
+	}
+	notice := Notice{Model: model, Message: strings.Join(parts, ", "), Source: "headers"}
+	if when, err := http.ParseTime(sunset); err == nil {
+		notice.Sunset = &when
+	}
+	return notice, true
+}
+
+// FromError reads a notice from an error response refusing a deprecated
+// model
+func FromError(model string, status int, body []byte) (Notice, bool) {
+	if status < 400 || status >= 500 {
+		return Notice{}, false
+	}
+	var answer struct {
+		Error struct {
+			Message string `json:"message"`
+			Code    string `json:"code"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &answer) != nil {
+		return Notice{}, false
+	}
+	// A model_not_found is only a deprecation when the message says so, and
+	// other errors mentioning deprecation are about parameters
+	notFound := answer.Error.Code == "model_not_found" && mentionsDeprecation(answer.Error.Message)
+	if !errorCodes[answer.Error.Code] && !notFound {
+		return Notice{}, false
+	}
+	return Notice{Model: model, Message: answer.Error.Message, Source: "error"}, true
+}
+
+func mentionsDeprecation(text string) bool {
+	text = strings.ToLower(text)
+	for _, word := range noticeWords {
+		if strings.Contains(text, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// Warning is the Warning header value that tells a client its model is
+// deprecated
+func (n Notice) Warning() string {
+	text := n.Model + " is deprecated upstream"
+	if n.Sunset != nil {
+		text += " and shuts down " + n.Sunset.UTC().Format("2006-01-02")
+	}
+	return `299 goproxyai ` + strconv.Quote(text)
+}
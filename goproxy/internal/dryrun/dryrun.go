@@ -0,0 +1,167 @@
+// Package dryrun traces a request through the proxy without sending it
+// upstream. A trace travels in the request's context; code along the way
+// adds the steps it takes, and the proxy client records the upstream
+// request it would have made instead of making it.
+package dryrun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrDryRun is returned in place of an upstream response
+var ErrDryRun = errors.New("dry run, not sent upstream")
+
+// Headers whose values are masked in a trace
+var secretHeaders = map[string]bool{
+	"Authorization": true, "Proxy-Authorization": true, "Api-Key": true, "X-Api-Key": true, "X-Admin-Token": true,
+	"Cookie": true, "Set-Cookie": true,
+}
+
+// Step is one thing that happened to the request
+type Step struct {
+	Stage  string `json:"stage"`
+	Detail string `json:"detail"`
+}
+
+// Upstream is the request that would have gone upstream, with the headers
+// the proxy added, changed or removed compared to what the client sent
+type Upstream struct {
+	Method    string            `json:"method"`
+	URL       string            `json:"url"`
+	Headers   map[string]string `json:"headers"`
+	Added     []string          `json:"added,omitempty"`
+	Changed   []string          `json:"changed,omitempty"`
+	Removed   []string          `json:"removed,omitempty"`
+	BodyBytes int               `json:"body_bytes"`
+}
+
+// Trace collects the steps of one dry run
+type Trace struct {
+	mutex    sync.Mutex
+	client   http.Header
+	steps    []Step
+	entered  []int // steps recording stages entered
+	upstream *Upstream
+}
+
+type traceKey struct{}
+
+// New starts a trace of a request the client sent with header
+func New(header http.Header) *Trace {
+	return &Trace{client: header.Clone()}
+}
+
+// WithTrace makes requests handled with ctx dry runs recorded in t
+func WithTrace(ctx context.Context, t *Trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+// From returns the trace of a dry run, or nil for a real request
+func From(ctx context.Context) *Trace {
+	t, _ := ctx.Value(traceKey{}).(*Trace)
+	return t
+}
+
+// Add records a step; it does nothing on a nil trace, so callers needn't
+// check for a dry run first
+func (t *Trace) Add(stage, format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.steps = append(t.steps, Step{Stage: stage, Detail: fmt.Sprintf(format, args...)})
+}
+
+// Enter records that the request reached a stage of the pipeline, and
+// returns the step recording it for Leave
+func (t *Trace) Enter(stage string) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.steps = append(t.steps, Step{Stage: stage})
+	t.entered = append(t.entered, len(t.steps)-1)
+	return len(t.steps) - 1
+}
+
+// Leave records how the stage entered at step was done with the request:
+// passed on to a later stage, sent upstream, or answered with status
+func (t *Trace) Leave(step, status int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	switch {
+	case t.entered[len(t.entered)-1] > step:
+		t.steps[step].Detail = "passed"
+	case t.upstream != nil:
+		t.steps[step].Detail = "sent upstream"
+	default:
+		t.steps[step].Detail = fmt.Sprintf("answered %d", status)
+	}
+}
+
+// Send records the request that would have gone upstream
+func (t *Trace) Send(method, url string, header http.Header, bodyBytes int) {
+	upstream := &Upstream{Method: method, URL: url, Headers: make(map[string]string, len(header)), BodyBytes: bodyBytes}
+	for name := range header {
+		value := strings.Join(header.Values(name), ", ")
+		upstream.Headers[name] = MaskHeader(name, value)
+		if before, sent := t.client[name]; !sent {
+			upstream.Added = append(upstream.Added, name)
+		} else if strings.Join(before, ", ") != value {
+			upstream.Changed = append(upstream.Changed, name)
+		}
+	}
+	for name := range t.client {
+		if _, kept := header[name]; !kept {
+			upstream.Removed = append(upstream.Removed, name)
+		}
+	}
+	sort.Strings(upstream.Added)
+	sort.Strings(upstream.Changed)
+	sort.Strings(upstream.Removed)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.upstream = upstream
+	t.steps = append(t.steps, Step{Stage: "upstream", Detail: method + " " + url + " (not sent)"})
+}
+
+// Steps returns the steps so far
+func (t *Trace) Steps() []Step {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]Step(nil), t.steps...)
+}
+
+// Upstream returns the request that would have gone upstream, or nil if
+// the request never got that far
+func (t *Trace) Upstream() *Upstream {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.upstream
+}
+
+// Mask hides all but the ends of a secret
+func Mask(secret string) string {
+	if len(secret) <= 12 {
+		return "****"
+	}
+	return secret[:7] + "..." + secret[len(secret)-4:]
+}
+
+// MaskHeader masks the value of a header that carries a secret, such as
+// Authorization, and returns any other as it is
+func MaskHeader(name, value string) string {
+	if !secretHeaders[name] {
+		return value
+	}
+	if token, found := strings.CutPrefix(value, "Bearer "); found {
+		return "Bearer " + Mask(token)
+	}
+	return Mask(value)
+}
@@ -0,0 +1,100 @@
+// Package encryption seals what the proxy writes to disk and other stores
+// with AES-GCM, so prompts and answers aren't kept in plaintext
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Sealed data starts with this, followed by the nonce and the ciphertext
+var sealedPrefix = []byte("goproxyai-sealed-v1:")
+
+var ErrNoKey = errors.New("data is encrypted but no storage encryption key is configured")
+
+// Sealer encrypts and decrypts stored data with one key. A nil *Sealer
+// leaves data as it is, for stores that aren't encrypted.
+type Sealer struct {
+	aead cipher.AEAD
+}
+
+// New returns a sealer for a 16, 24 or 32 byte AES key
+func New(key []byte) (*Sealer, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("expected a 16, 24 or 32 byte key, got %d bytes", len(key))
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Sealer{aead: aead}, nil
+}
+
+// Load returns the sealer for a base64 key given directly or read from a
+// file, such as one a KMS or secrets manager agent writes, or nil when
+// neither is set
+func Load(encoded, file string) (*Sealer, error) {
+	if encoded != "" && file != "" {
+		return nil, errors.New("set the key or the key file, not both")
+	}
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(data)
+	}
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("key isn't valid base64: %w", err)
+	}
+	return New(key)
+}
+
+// Seal encrypts data under a fresh random nonce
+func (s *Sealer) Seal(data []byte) ([]byte, error) {
+	if s == nil {
+		return data, nil
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, 0, len(sealedPrefix)+len(nonce)+len(data)+s.aead.Overhead())
+	sealed = append(sealed, sealedPrefix...)
+	sealed = append(sealed, nonce...)
+	return s.aead.Seal(sealed, nonce, data, nil), nil
+}
+
+// Open decrypts what Seal encrypted. Data that isn't sealed, written
+// before encryption was turned on, is returned as it is, and sealed again
+// when it's next written.
+func (s *Sealer) Open(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, sealedPrefix) {
+		return data, nil
+	}
+	if s == nil {
+		return nil, ErrNoKey
+	}
+	data = data[len(sealedPrefix):]
+	if len(data) < s.aead.NonceSize() {
+		return nil, errors.New("sealed data is truncated")
+	}
+	nonce, ciphertext := data[:s.aead.NonceSize()], data[s.aead.NonceSize():]
+	opened, err := s.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, errors.New("sealed data can't be decrypted with this key")
+	}
+	return opened, nil
+}
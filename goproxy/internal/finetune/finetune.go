@@ -0,0 +1,264 @@
+// Package finetune tracks the lifecycle of fine-tuning jobs created through
+// the proxy, from the job objects upstream returns
+package finetune
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"goproxyai/internal/clock"
+)
+
+// Job statuses as OpenAI reports them
+const (
+	StatusValidatingFiles = "validating_files"
+	StatusQueued          = "queued"
+	StatusRunning         = "running"
+	StatusSucceeded       = "succeeded"
+	StatusFailed          = "failed"
+	StatusCancelled       = "cancelled"
+)
+
+// Job is what the proxy knows about one fine-tuning job
+type Job struct {
+	ID             string     `json:"id"`
+	Tenant         string     `json:"tenant,omitempty"`
+	KeyID          string     `json:"key_id,omitempty"`
+	Model          string     `json:"model"`
+	FineTunedModel string     `json:"fine_tuned_model,omitempty"`
+	Status         string     `json:"status"`
+	Error          string     `json:"error,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+	FinishedAt     *time.Time `json:"finished_at,omitempty"`
+}
+
+// Finished reports whether the job has reached a final status
+func (j *Job) Finished() bool {
+	return j.Status == StatusSucceeded || j.Status == StatusFailed || j.Status == StatusCancelled
+}
+
+// Owner is who a job was created by, and the headers to check on it with
+type Owner struct {
+	Tenant string
+	KeyID  string
+	Header http.Header
+}
+
+// upstreamJob is the part of an OpenAI fine-tuning job object the tracker
+// reads
+type upstreamJob struct {
+	Object         string `json:"object"`
+	ID             string `json:"id"`
+	Model          string `json:"model"`
+	FineTunedModel string `json:"fine_tuned_model"`
+	Status         string `json:"status"`
+	CreatedAt      int64  `json:"created_at"`
+	FinishedAt     int64  `json:"finished_at"`
+	Error          *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type stateFile struct {
+	Jobs []*Job `json:"jobs"`
+}
+
+// Tracker keeps the jobs seen, persisted to a state file when it has one
+type Tracker struct {
+	mutex   sync.Mutex
+	path    string
+	jobs    map[string]*Job
+	headers map[string]http.Header
+}
+
+// Load reads tracked jobs from a state file, which needn't exist yet. An
+// empty path keeps them in memory only.
+func Load(path string) (*Tracker, error) {
+	t := &Tracker{
+		path:    path,
+		jobs:    make(map[string]*Job),
+		headers: make(map[string]http.Header),
+	}
+	if path == "" {
+		return t, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file stateFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for _, job := range file.Jobs {
+		t.jobs[job.ID] = job
+	}
+	return t, nil
+}
+
+// Observe updates the tracker from an upstream response carrying a job or
+// a list of jobs. Jobs it hasn't seen are attributed to owner. It returns
+// the jobs that have just finished.
+func (t *Tracker) Observe(body []byte, owner Owner) ([]Job, error) {
+	var page struct {
+		Object string        `json:"object"`
+		Data   []upstreamJob `json:"data"`
+	}
+	if err := json.Unmarshal(body, &page); err != nil {
+		return nil, err
+	}
+	upstream := page.Data
+	if page.Object != "list" {
+		var job upstreamJob
+		if err := json.Unmarshal(body, &job); err != nil {
+			return nil, err
+		}
+		upstream = []upstreamJob{job}
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var finished []Job
+	changed := false
+	for _, u := range upstream {
+		if u.Object != "fine_tuning.job" || u.ID == "" {
+			continue
+		}
+		job, known := t.jobs[u.ID]
+		if !known {
+			job = &Job{ID: u.ID, Tenant: owner.Tenant, KeyID: owner.KeyID, CreatedAt: clock.Now().UTC()}
+			if u.CreatedAt > 0 {
+				job.CreatedAt = time.Unix(u.CreatedAt, 0).UTC()
+			}
+			t.jobs[u.ID] = job
+		}
+		if owner.Header != nil {
+			t.headers[u.ID] = owner.Header
+		}
+
+		wasFinished := job.Finished()
+		before := *job
+		job.Model = u.Model
+		job.FineTunedModel = u.FineTunedModel
+		if u.Error != nil {
+			job.Error = u.Error.Message
+		}
+		if u.FinishedAt > 0 {
+			finishedAt := time.Unix(u.FinishedAt, 0).UTC()
+			job.FinishedAt = &finishedAt
+		}
+		t.setStatus(job, u.Status)
+		if !known || job.Status != before.Status || job.FineTunedModel != before.FineTunedModel || job.Error != before.Error {
+			changed = true
+		}
+		if job.Finished() && !wasFinished {
+			finished = append(finished, *job)
+		}
+	}
+	if changed {
+		return finished, t.save()
+	}
+	return finished, nil
+}
+
+// SetStatus records a status learned other than from a job object, such as
+// from a webhook. It only applies to jobs being tracked, and reports
+// whether the job has just finished.
+func (t *Tracker) SetStatus(id, status string) (Job, bool, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	job, known := t.jobs[id]
+	if !known || job.Status == status {
+		return Job{}, false, nil
+	}
+	wasFinished := job.Finished()
+	t.setStatus(job, status)
+	if job.Finished() && job.FinishedAt == nil {
+		now := clock.Now().UTC()
+		job.FinishedAt = &now
+	}
+	return *job, job.Finished() && !wasFinished, t.save()
+}
+
+func (t *Tracker) setStatus(job *Job, status string) {
+	if status == "" || status == job.Status {
+		return
+	}
+	job.Status = status
+	job.UpdatedAt = clock.Now().UTC()
+}
+
+// Jobs lists tracked jobs, newest first, optionally only a tenant's or only
+// those in a status
+func (t *Tracker) Jobs(tenant, status string) []Job {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	jobs := make([]Job, 0, len(t.jobs))
+	for _, job := range t.jobs {
+		if tenant != "" && job.Tenant != tenant || status != "" && job.Status != status {
+			continue
+		}
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.After(jobs[j].CreatedAt) })
+	return jobs
+}
+
+// Unfinished returns the IDs of jobs still in progress, with their owners
+// and the headers last used to reach each. Headers aren't persisted, so
+// jobs loaded from the state file have none until a client looks them up
+// again.
+func (t *Tracker) Unfinished() map[string]Owner {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	unfinished := make(map[string]Owner)
+	for id, job := range t.jobs {
+		if !job.Finished() {
+			unfinished[id] = Owner{Tenant: job.Tenant, KeyID: job.KeyID, Header: t.headers[id]}
+		}
+	}
+	return unfinished
+}
+
+// save writes the jobs to the state file, replacing it atomically
+func (t *Tracker) save() error {
+	if t.path == "" {
+		return nil
+	}
+
+	file := stateFile{Jobs: make([]*Job, 0, len(t.jobs))}
+	for _, job := range t.jobs {
+		file.Jobs = append(file.Jobs, job)
+	}
+	sort.Slice(file.Jobs, func(i, j int) bool { return file.Jobs[i].CreatedAt.Before(file.Jobs[j].CreatedAt) })
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(t.path), ".finetunes-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), t.path)
+}
@@ -0,0 +1,77 @@
+// Package geoip looks up where client addresses are in a MaxMind database,
+// such as GeoLite2 Country or City, read from its .mmdb file
+package geoip
+
+import (
+	"net"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Location is where an address is, as ISO 3166 country and continent codes
+type Location struct {
+	Country   string `json:"country"`
+	Continent string `json:"continent,omitempty"`
+}
+
+// DB is a MaxMind database held in memory
+type DB struct {
+	Type    string
+	BuiltAt time.Time
+	reader  *maxminddb.Reader
+}
+
+// The fields of Country and City records a Location is made of
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+	Continent struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"continent"`
+}
+
+// Open reads the database in file
+func Open(file string) (*DB, error) {
+	reader, err := maxminddb.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	return newDB(reader), nil
+}
+
+// Parse reads a database from the contents of its file
+func Parse(contents []byte) (*DB, error) {
+	reader, err := maxminddb.FromBytes(contents)
+	if err != nil {
+		return nil, err
+	}
+	return newDB(reader), nil
+}
+
+func newDB(reader *maxminddb.Reader) *DB {
+	return &DB{
+		Type:    reader.Metadata.DatabaseType,
+		BuiltAt: time.Unix(int64(reader.Metadata.BuildEpoch), 0).UTC(),
+		reader:  reader,
+	}
+}
+
+// Lookup returns where ip is, or false when the database doesn't know
+func (db *DB) Lookup(ip net.IP) (Location, bool) {
+	var r record
+	if err := db.reader.Lookup(ip, &r); err != nil {
+		return Location{}, false
+	}
+	location := Location{Country: r.Country.ISOCode, Continent: r.Continent.Code}
+	if location.Country == "" {
+		// Anonymous proxies and satellite providers only have the country
+		// their address block is registered in
+		location.Country = r.RegisteredCountry.ISOCode
+	}
+	return location, location.Country != ""
+}
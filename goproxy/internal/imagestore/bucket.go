@@ -0,0 +1,197 @@
+package imagestore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"goproxyai/internal/clock"
+)
+
+// Bucket keeps images in an S3 bucket, or any store speaking the S3 API,
+// with requests signed by AWS Signature Version 4
+type Bucket struct {
+	bucket     string
+	prefix     string
+	creds      Credentials
+	httpClient *http.Client
+}
+
+func NewBucket(bucket, prefix string, creds Credentials) *Bucket {
+	return &Bucket{
+		bucket:     bucket,
+		prefix:     prefix,
+		creds:      creds,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (b *Bucket) Put(ctx context.Context, name, contentType string, data []byte) error {
+	if !validName(name) {
+		return fmt.Errorf("invalid image name %q", name)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, b.objectURL(name), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := b.do(req, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return bucketError(resp)
+	}
+	return nil
+}
+
+func (b *Bucket) Get(ctx context.Context, name string) ([]byte, string, error) {
+	if !validName(name) {
+		return nil, "", ErrNotFound
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.objectURL(name), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := b.do(req, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", bucketError(resp)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	t := resp.Header.Get("Content-Type")
+	if t == "" {
+		t = contentType(name)
+	}
+	return data, t, nil
+}
+
+// objectURL addresses objects path-style, which every S3-compatible store
+// accepts whatever the bucket is called
+func (b *Bucket) objectURL(name string) string {
+	key := name
+	if b.prefix != "" {
+		key = b.prefix + "/" + name
+	}
+	return strings.TrimSuffix(b.creds.Endpoint, "/") + "/" + b.bucket + "/" + key
+}
+
+func (b *Bucket) do(req *http.Request, body []byte) (*http.Response, error) {
+	sign(req, body, b.creds, clock.Now())
+	return b.httpClient.Do(req)
+}
+
+// sign adds a Signature Version 4 Authorization header covering the host
+// and every header already set on the request
+func sign(req *http.Request, body []byte, creds Credentials, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalPath(req.URL.Path),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + creds.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretKey), date)
+	for _, part := range []string{creds.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalPath encodes each segment of the path once, as S3 signs it
+func canonicalPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = uriEncode(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func canonicalQuery(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(name)+"="+uriEncode(value))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode percent-encodes everything but the unreserved characters
+func uriEncode(s string) string {
+	var encoded strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			encoded.WriteByte(c)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		}
+	}
+	return encoded.String()
+}
+
+// bucketError reports a failed request with the store's own message, which
+// S3 sends as XML
+func bucketError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("image store returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,57 @@
+package imagestore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Dir keeps images as files in a local directory
+type Dir struct {
+	root string
+}
+
+// NewDir opens a directory store, creating the directory if need be
+func NewDir(root string) (*Dir, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+	return &Dir{root: root}, nil
+}
+
+// Put writes an image, replacing the file atomically so readers never see
+// part of one
+func (d *Dir) Put(ctx context.Context, name, contentType string, data []byte) error {
+	if !validName(name) {
+		return fmt.Errorf("invalid image name %q", name)
+	}
+	tmp, err := os.CreateTemp(d.root, ".image-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(d.root, name))
+}
+
+func (d *Dir) Get(ctx context.Context, name string) ([]byte, string, error) {
+	if !validName(name) {
+		return nil, "", ErrNotFound
+	}
+	data, err := os.ReadFile(filepath.Join(d.root, name))
+	if os.IsNotExist(err) {
+		return nil, "", ErrNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return data, contentType(name), nil
+}
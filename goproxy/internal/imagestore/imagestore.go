@@ -0,0 +1,80 @@
+// Package imagestore keeps generated images in an object store, so the
+// proxy can serve them at URLs that outlive upstream's
+package imagestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+)
+
+var ErrNotFound = errors.New("image not found")
+
+// Store is where images are kept, by name
+type Store interface {
+	Put(ctx context.Context, name, contentType string, data []byte) error
+	Get(ctx context.Context, name string) ([]byte, string, error)
+}
+
+// Credentials sign requests to S3 and GCS buckets. GCS takes HMAC keys
+// through its S3-compatible XML API.
+type Credentials struct {
+	Endpoint  string // defaults to AWS S3 in Region, or GCS
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+// Open returns the store a location names: file:///dir for a local
+// directory, s3://bucket/prefix or gs://bucket/prefix for a bucket
+func Open(location string, creds Credentials) (Store, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.Trim(u.Path, "/")
+	switch u.Scheme {
+	case "file":
+		if u.Path == "" {
+			return nil, fmt.Errorf("%s names no directory", location)
+		}
+		return NewDir(u.Path)
+	case "s3", "gs":
+		if u.Host == "" {
+			return nil, fmt.Errorf("%s names no bucket", location)
+		}
+		if creds.AccessKey == "" || creds.SecretKey == "" {
+			return nil, fmt.Errorf("%s needs an access key and secret key", location)
+		}
+		if creds.Endpoint == "" {
+			creds.Endpoint = "https://s3." + creds.Region + ".amazonaws.com"
+			if u.Scheme == "gs" {
+				creds.Endpoint = "https://storage.googleapis.com"
+			}
+		}
+		if u.Scheme == "gs" {
+			// GCS accepts any region in signatures, and documents "auto"
+			creds.Region = "auto"
+		}
+		return NewBucket(u.Host, prefix, creds), nil
+	default:
+		return nil, fmt.Errorf("unsupported image store %q, expected file://, s3:// or gs://", location)
+	}
+}
+
+// contentType is the type of an image by its name's extension
+func contentType(name string) string {
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// validName rejects names that would reach outside the store
+func validName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, `/\`) && name != "." && name != ".."
+}
@@ -0,0 +1,38 @@
+package imagestore
+
+import (
+	"context"
+
+	"goproxyai/internal/encryption"
+)
+
+// Sealed keeps images in another store encrypted
+type Sealed struct {
+	store  Store
+	sealer *encryption.Sealer
+}
+
+// NewSealed encrypts the images put in store with sealer and decrypts them
+// as they're read back
+func NewSealed(store Store, sealer *encryption.Sealer) *Sealed {
+	return &Sealed{store: store, sealer: sealer}
+}
+
+func (s *Sealed) Put(ctx context.Context, name, contentType string, data []byte) error {
+	sealed, err := s.sealer.Seal(data)
+	if err != nil {
+		return err
+	}
+	return s.store.Put(ctx, name, contentType, sealed)
+}
+
+func (s *Sealed) Get(ctx context.Context, name string) ([]byte, string, error) {
+	data, contentType, err := s.store.Get(ctx, name)
+	if err != nil {
+		return nil, "", err
+	}
+	if data, err = s.sealer.Open(data); err != nil {
+		return nil, "", err
+	}
+	return data, contentType, nil
+}
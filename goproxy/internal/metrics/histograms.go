@@ -0,0 +1,121 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Context key the proxy sets to the model a request asks for, for its sizes
+// and stream duration to be counted under
+const ModelKey = "request_model"
+
+// Models come from clients, so past this many the rest share one series
+const maxHistogramModels = 200
+
+// otherModel is the series models past maxHistogramModels are counted in
+const otherModel = "other"
+
+var (
+	tokenBuckets    = []float64{16, 64, 256, 1024, 4096, 16384, 65536, 262144}
+	byteBuckets     = []float64{256, 1024, 4096, 16384, 65536, 262144, 1 << 20, 4 << 20, 16 << 20}
+	durationBuckets = []float64{0.5, 1, 2, 5, 10, 30, 60, 120, 300, 600}
+)
+
+// Histograms are distributions of request and response sizes, tokens and
+// stream durations by model, served in the Prometheus text format
+type Histograms struct {
+	PromptTokens     *Histogram
+	CompletionTokens *Histogram
+	RequestBytes     *Histogram
+	ResponseBytes    *Histogram
+	StreamDuration   *Histogram
+}
+
+func newHistograms() *Histograms {
+	return &Histograms{
+		PromptTokens:     newHistogram("goproxyai_prompt_tokens", "Prompt tokens per response, by model", tokenBuckets),
+		CompletionTokens: newHistogram("goproxyai_completion_tokens", "Completion tokens per response, by model", tokenBuckets),
+		RequestBytes:     newHistogram("goproxyai_request_body_bytes", "Size of request bodies as clients sent them, by model", byteBuckets),
+		ResponseBytes:    newHistogram("goproxyai_response_body_bytes", "Size of response bodies as clients received them, by model", byteBuckets),
+		StreamDuration:   newHistogram("goproxyai_stream_duration_seconds", "How long streamed responses stayed open, by model", durationBuckets),
+	}
+}
+
+// write writes every histogram in the Prometheus text format
+func (h *Histograms) write(w io.Writer) {
+	for _, histogram := range []*Histogram{h.PromptTokens, h.CompletionTokens, h.RequestBytes, h.ResponseBytes, h.StreamDuration} {
+		histogram.write(w)
+	}
+}
+
+// Histogram counts observations by model into cumulative buckets
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	mutex  sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	counts []uint64 // per bucket, plus +Inf last; made cumulative when written
+	sum    float64
+}
+
+func newHistogram(name, help string, buckets []float64) *Histogram {
+	return &Histogram{name: name, help: help, buckets: buckets, series: make(map[string]*series)}
+}
+
+// Observe counts value for model
+func (h *Histogram) Observe(model string, value float64) {
+	if model == "" {
+		model = "unknown"
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	s, found := h.series[model]
+	if !found {
+		if len(h.series) >= maxHistogramModels {
+			model = otherModel
+			s = h.series[model]
+		}
+		if s == nil {
+			s = &series{counts: make([]uint64, len(h.buckets)+1)}
+			h.series[model] = s
+		}
+	}
+	s.counts[sort.SearchFloat64s(h.buckets, value)]++
+	s.sum += value
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	models := make([]string, 0, len(h.series))
+	for model := range h.series {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+	for _, model := range models {
+		s := h.series[model]
+		label := labelEscaper.Replace(model)
+		var cumulative uint64
+		for i, count := range s.counts {
+			cumulative += count
+			le := "+Inf"
+			if i < len(h.buckets) {
+				le = strconv.FormatFloat(h.buckets[i], 'f', -1, 64)
+			}
+			fmt.Fprintf(w, "%s_bucket{model=\"%s\",le=\"%s\"} %d\n", h.name, label, le, cumulative)
+		}
+		fmt.Fprintf(w, "%s_sum{model=\"%s\"} %s\n", h.name, label, strconv.FormatFloat(s.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count{model=\"%s\"} %d\n", h.name, label, cumulative)
+	}
+}
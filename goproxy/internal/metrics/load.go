@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"fmt"
+	"log"
+	runtimemetrics "runtime/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Fraction of a threshold usage has to fall back under before shedding
+// stops, so the monitor doesn't flap around the threshold
+const loadRecoveryRatio = 0.9
+
+var loadSamples = []string{
+	"/memory/classes/total:bytes",
+	"/memory/classes/heap/released:bytes",
+	"/sched/goroutines:goroutines",
+}
+
+// LoadMonitor samples the memory the Go runtime holds from the OS and the
+// goroutine count, and reports the process as overloaded while either is
+// over its threshold
+type LoadMonitor struct {
+	maxMemory     uint64 // bytes, 0 = unchecked
+	maxGoroutines uint64 // 0 = unchecked
+
+	mutex      sync.Mutex
+	memory     uint64
+	goroutines uint64
+	reason     string // why the process is overloaded, empty when it isn't
+	since      time.Time
+
+	shed atomic.Int64
+}
+
+// NewLoadMonitor starts sampling every interval. maxMemoryMB and
+// maxGoroutines of 0 leave that resource unchecked.
+func NewLoadMonitor(maxMemoryMB int64, maxGoroutines int, interval time.Duration, logger *log.Logger) *LoadMonitor {
+	m := &LoadMonitor{
+		maxMemory:     uint64(maxMemoryMB) * 1024 * 1024,
+		maxGoroutines: uint64(maxGoroutines),
+	}
+	samples := make([]runtimemetrics.Sample, len(loadSamples))
+	for i, name := range loadSamples {
+		samples[i].Name = name
+	}
+	m.sample(samples, logger)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			m.sample(samples, logger)
+		}
+	}()
+	return m
+}
+
+func (m *LoadMonitor) sample(samples []runtimemetrics.Sample, logger *log.Logger) {
+	runtimemetrics.Read(samples)
+	memory := samples[0].Value.Uint64() - samples[1].Value.Uint64()
+	goroutines := samples[2].Value.Uint64()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.memory, m.goroutines = memory, goroutines
+
+	ratio := 1.0
+	if m.reason != "" {
+		ratio = loadRecoveryRatio
+	}
+	reason := ""
+	switch {
+	case m.maxMemory > 0 && float64(memory) > float64(m.maxMemory)*ratio:
+		reason = fmt.Sprintf("memory %d MB over %d MB", memory/1024/1024, m.maxMemory/1024/1024)
+	case m.maxGoroutines > 0 && float64(goroutines) > float64(m.maxGoroutines)*ratio:
+		reason = fmt.Sprintf("%d goroutines over %d", goroutines, m.maxGoroutines)
+	}
+
+	switch {
+	case reason != "" && m.reason == "":
+		logger.Printf("Load shedding started: %s", reason)
+		m.since = time.Now()
+	case reason == "" && m.reason != "":
+		logger.Printf("Load shedding stopped after %v, %d requests shed so far", time.Since(m.since).Round(time.Second), m.shed.Load())
+	}
+	m.reason = reason
+}
+
+// Overloaded reports whether requests should be shed, and why
+func (m *LoadMonitor) Overloaded() (string, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.reason, m.reason != ""
+}
+
+// RecordShed counts a request turned away
+func (m *LoadMonitor) RecordShed() {
+	m.shed.Add(1)
+}
+
+func (m *LoadMonitor) Stats() map[string]interface{} {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return map[string]interface{}{
+		"overloaded":     m.reason != "",
+		"reason":         m.reason,
+		"memory_mb":      m.memory / 1024 / 1024,
+		"max_memory_mb":  m.maxMemory / 1024 / 1024,
+		"goroutines":     m.goroutines,
+		"max_goroutines": m.maxGoroutines,
+		"shed":           m.shed.Load(),
+	}
+}
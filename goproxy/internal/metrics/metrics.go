@@ -0,0 +1,231 @@
+package metrics
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/dryrun"
+)
+
+const recentLimit = 50
+
+// Context keys the proxy sets on the requests it attributes to a tenant or
+// an end user, for their records to say whose they are, and to the country
+// GEOIP_DB places them in
+const (
+	TenantKey  = "tenant_id"
+	UserKey    = "user_id"
+	CountryKey = "country"
+)
+
+type Recorder struct {
+	mutex        sync.RWMutex
+	startedAt    time.Time
+	totalCount   int64
+	errorCount   int64
+	statusCounts map[int]int64
+	cacheCounts  map[string]int64
+	countries    map[string]int64
+	recent       []RequestRecord
+	errors       []RequestRecord
+	histograms   *Histograms
+}
+
+type RequestRecord struct {
+	Timestamp time.Time     `json:"timestamp"`
+	ClientIP  string        `json:"client_ip"`
+	Method    string        `json:"method"`
+	Path      string        `json:"path"`
+	Status    int           `json:"status"`
+	Latency   time.Duration `json:"latency_ns"`
+	Cache     string        `json:"cache,omitempty"`
+	Error     string        `json:"error,omitempty"`
+	Tenant    string        `json:"tenant,omitempty"`
+	User      string        `json:"user,omitempty"`
+	Country   string        `json:"country,omitempty"`
+}
+
+func New() *Recorder {
+	return &Recorder{
+		startedAt:    time.Now(),
+		statusCounts: make(map[int]int64),
+		cacheCounts:  make(map[string]int64),
+		countries:    make(map[string]int64),
+		histograms:   newHistograms(),
+	}
+}
+
+// Histograms are the recorder's distributions of sizes, tokens and stream
+// durations by model
+func (r *Recorder) Histograms() *Histograms {
+	return r.histograms
+}
+
+func (r *Recorder) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		requestBytes := c.Request.ContentLength
+
+		c.Next()
+		// A dry run's trace isn't traffic
+		if dryrun.From(c.Request.Context()) != nil {
+			return
+		}
+		if model := c.GetString(ModelKey); model != "" {
+			r.observe(c, model, requestBytes, time.Since(start))
+		}
+
+		record := RequestRecord{
+			Timestamp: start,
+			ClientIP:  c.ClientIP(),
+			Method:    c.Request.Method,
+			Path:      c.Request.URL.Path,
+			Status:    c.Writer.Status(),
+			Latency:   time.Since(start),
+			Cache:     c.Writer.Header().Get("X-Cache"),
+			Error:     c.Errors.String(),
+			Tenant:    c.GetString(TenantKey),
+			User:      c.GetString(UserKey),
+			Country:   c.GetString(CountryKey),
+		}
+		r.Record(record)
+	}
+}
+
+// observe counts a model request's body sizes and, for a stream, how long
+// it stayed open
+func (r *Recorder) observe(c *gin.Context, model string, requestBytes int64, duration time.Duration) {
+	if requestBytes >= 0 {
+		r.histograms.RequestBytes.Observe(model, float64(requestBytes))
+	}
+	if size := c.Writer.Size(); size >= 0 {
+		r.histograms.ResponseBytes.Observe(model, float64(size))
+	}
+	if strings.HasPrefix(c.Writer.Header().Get("Content-Type"), "text/event-stream") {
+		r.histograms.StreamDuration.Observe(model, duration.Seconds())
+	}
+}
+
+func (r *Recorder) Record(record RequestRecord) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.totalCount++
+	r.statusCounts[record.Status]++
+	if record.Cache != "" {
+		r.cacheCounts[strings.ToLower(record.Cache)]++
+	}
+	if record.Country != "" {
+		r.countries[record.Country]++
+	}
+	r.recent = appendRecent(r.recent, record)
+
+	// Upstream failures and proxy-side errors are kept separately so they
+	// don't scroll out of view under normal traffic
+	if record.Status >= 500 || record.Error != "" {
+		r.errorCount++
+		r.errors = appendRecent(r.errors, record)
+	}
+}
+
+func appendRecent(records []RequestRecord, record RequestRecord) []RequestRecord {
+	records = append(records, record)
+	if len(records) > recentLimit {
+		records = records[len(records)-recentLimit:]
+	}
+	return records
+}
+
+// Purge drops the recent requests and errors recorded before before,
+// returning how many it dropped
+func (r *Recorder) Purge(before time.Time) int {
+	return r.remove(func(record RequestRecord) bool { return record.Timestamp.Before(before) })
+}
+
+// Delete drops the recent requests and errors of a tenant, of an end user,
+// or of a user within a tenant when both are given, returning how many it
+// dropped
+func (r *Recorder) Delete(tenant, user string) int {
+	return r.remove(func(record RequestRecord) bool {
+		return (tenant == "" || record.Tenant == tenant) && (user == "" || record.User == user)
+	})
+}
+
+func (r *Recorder) remove(match func(RequestRecord) bool) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	removed := 0
+	keep := func(records []RequestRecord) []RequestRecord {
+		kept := records[:0]
+		for _, record := range records {
+			if match(record) {
+				removed++
+			} else {
+				kept = append(kept, record)
+			}
+		}
+		return kept
+	}
+	r.recent = keep(r.recent)
+	r.errors = keep(r.errors)
+	return removed
+}
+
+func (r *Recorder) Stats() map[string]interface{} {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	statusCounts := make(map[int]int64, len(r.statusCounts))
+	for status, count := range r.statusCounts {
+		statusCounts[status] = count
+	}
+
+	cacheCounts := make(map[string]int64, len(r.cacheCounts))
+	for result, count := range r.cacheCounts {
+		cacheCounts[result] = count
+	}
+
+	stats := map[string]interface{}{
+		"uptime":         time.Since(r.startedAt).Round(time.Second).String(),
+		"total_requests": r.totalCount,
+		"total_errors":   r.errorCount,
+		"status_codes":   statusCounts,
+		"cache_results":  cacheCounts,
+	}
+	if len(r.countries) > 0 {
+		countryCounts := make(map[string]int64, len(r.countries))
+		for country, count := range r.countries {
+			countryCounts[country] = count
+		}
+		stats["countries"] = countryCounts
+	}
+	return stats
+}
+
+// Recent returns the latest requests, newest first
+func (r *Recorder) Recent() []RequestRecord {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return reversed(r.recent)
+}
+
+// Errors returns the latest failed requests, newest first
+func (r *Recorder) Errors() []RequestRecord {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return reversed(r.errors)
+}
+
+func reversed(records []RequestRecord) []RequestRecord {
+	result := make([]RequestRecord, len(records))
+	for i, record := range records {
+		result[len(records)-1-i] = record
+	}
+	return result
+}
@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Content type of the Prometheus text format
+const PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// WritePrometheus writes the request counters and every histogram in the
+// Prometheus text format
+func (r *Recorder) WritePrometheus(w io.Writer) {
+	r.mutex.RLock()
+	statuses := make([]int, 0, len(r.statusCounts))
+	for status := range r.statusCounts {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	fmt.Fprintf(w, "# HELP goproxyai_requests_total Requests served, by status\n# TYPE goproxyai_requests_total counter\n")
+	for _, status := range statuses {
+		fmt.Fprintf(w, "goproxyai_requests_total{status=\"%d\"} %d\n", status, r.statusCounts[status])
+	}
+	results := make([]string, 0, len(r.cacheCounts))
+	for result := range r.cacheCounts {
+		results = append(results, result)
+	}
+	sort.Strings(results)
+	fmt.Fprintf(w, "# HELP goproxyai_cache_results_total Requests by X-Cache result\n# TYPE goproxyai_cache_results_total counter\n")
+	for _, result := range results {
+		fmt.Fprintf(w, "goproxyai_cache_results_total{result=\"%s\"} %d\n", labelEscaper.Replace(result), r.cacheCounts[result])
+	}
+	countries := make([]string, 0, len(r.countries))
+	for country := range r.countries {
+		countries = append(countries, country)
+	}
+	sort.Strings(countries)
+	if len(countries) > 0 {
+		fmt.Fprintf(w, "# HELP goproxyai_requests_by_country_total Requests by the country GEOIP_DB places their client in\n# TYPE goproxyai_requests_by_country_total counter\n")
+	}
+	for _, country := range countries {
+		fmt.Fprintf(w, "goproxyai_requests_by_country_total{country=\"%s\"} %d\n", labelEscaper.Replace(country), r.countries[country])
+	}
+	WriteGauge(w, "goproxyai_uptime_seconds", "Seconds since the proxy started", time.Since(r.startedAt).Seconds())
+	r.mutex.RUnlock()
+
+	r.histograms.write(w)
+}
+
+// WriteGauge writes a gauge without labels in the Prometheus text format
+func WriteGauge(w io.Writer, name, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// WriteCounter writes a counter without labels in the Prometheus text format
+func WriteCounter(w io.Writer, name, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+}
+
+// Label values escape backslashes, quotes and newlines
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,131 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+// Runs that haven't been seen for this long are assumed to have finished
+// without the proxy observing it, e.g. when clients stop polling. Finished
+// runs are remembered for as long so repeated polls aren't counted again.
+const runStaleAfter = time.Hour
+
+// RunTracker follows the lifecycle of long-running objects, Assistants API
+// runs and background Responses API responses, as they pass through the
+// proxy so operators can see how many are active per tenant
+type RunTracker struct {
+	mutex     sync.Mutex
+	runs      map[string]*runState
+	finished  map[string]time.Time
+	started   int64
+	completed map[string]int64
+	lastPrune time.Time
+}
+
+type runState struct {
+	tenant  string
+	status  string
+	updated time.Time
+}
+
+func NewRunTracker() *RunTracker {
+	return &RunTracker{
+		runs:      make(map[string]*runState),
+		finished:  make(map[string]time.Time),
+		completed: make(map[string]int64),
+	}
+}
+
+// Observe records the latest status seen for a run, from a create or poll
+// response or a streamed event. It reports whether this is the first time
+// the run has been seen finished, so its usage can be counted exactly once.
+func (t *RunTracker) Observe(tenant, runID, status string) bool {
+	if runID == "" || status == "" {
+		return false
+	}
+	if tenant == "" {
+		tenant = "unknown"
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	t.prune(now)
+
+	if !runActive(status) {
+		if _, seen := t.finished[runID]; seen {
+			return false
+		}
+		delete(t.runs, runID)
+		t.finished[runID] = now
+		t.completed[status]++
+		return true
+	}
+
+	run, exists := t.runs[runID]
+	if !exists {
+		run = &runState{tenant: tenant}
+		t.runs[runID] = run
+		t.started++
+	}
+	run.status = status
+	run.updated = now
+	return false
+}
+
+func runActive(status string) bool {
+	switch status {
+	case "queued", "in_progress", "requires_action", "cancelling":
+		return true
+	}
+	return false
+}
+
+// prune drops stale runs and forgets old finished ones, at most once a
+// minute. Callers must hold the mutex.
+func (t *RunTracker) prune(now time.Time) {
+	if now.Sub(t.lastPrune) < time.Minute {
+		return
+	}
+	t.lastPrune = now
+
+	for id, run := range t.runs {
+		if now.Sub(run.updated) > runStaleAfter {
+			delete(t.runs, id)
+			t.completed["stale"]++
+		}
+	}
+	for id, finishedAt := range t.finished {
+		if now.Sub(finishedAt) > runStaleAfter {
+			delete(t.finished, id)
+		}
+	}
+}
+
+func (t *RunTracker) Stats() map[string]interface{} {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.prune(time.Now())
+
+	activeByTenant := make(map[string]int)
+	activeByStatus := make(map[string]int)
+	for _, run := range t.runs {
+		activeByTenant[run.tenant]++
+		activeByStatus[run.status]++
+	}
+
+	completed := make(map[string]int64, len(t.completed))
+	for status, count := range t.completed {
+		completed[status] = count
+	}
+
+	return map[string]interface{}{
+		"active":           len(t.runs),
+		"active_by_tenant": activeByTenant,
+		"active_by_status": activeByStatus,
+		"started":          t.started,
+		"finished":         completed,
+	}
+}
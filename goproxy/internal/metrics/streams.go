@@ -0,0 +1,159 @@
+package metrics
+
+import (
+	"log"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// StreamTracker accounts for long-lived proxied exchanges, event streams
+// and CONNECT tunnels, each of which holds goroutines and connections for
+// as long as it stays open. A watchdog logs the ones open longer than
+// expected so clients that never disconnect show up before they pile up.
+type StreamTracker struct {
+	mutex    sync.Mutex
+	nextID   uint64
+	active   map[uint64]*streamState
+	started  int64
+	finished int64
+	longest  time.Duration
+}
+
+type streamState struct {
+	kind    string
+	tenant  string
+	target  string
+	client  string
+	started time.Time
+	flagged bool
+}
+
+func NewStreamTracker() *StreamTracker {
+	return &StreamTracker{active: make(map[uint64]*streamState)}
+}
+
+// Start records a stream opening and returns the function to call once it
+// has closed
+func (t *StreamTracker) Start(kind, tenant, target, client string) func() {
+	if tenant == "" {
+		tenant = "unknown"
+	}
+
+	t.mutex.Lock()
+	t.nextID++
+	id := t.nextID
+	t.active[id] = &streamState{
+		kind:    kind,
+		tenant:  tenant,
+		target:  target,
+		client:  client,
+		started: time.Now(),
+	}
+	t.started++
+	t.mutex.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { t.finish(id) })
+	}
+}
+
+func (t *StreamTracker) finish(id uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	stream, found := t.active[id]
+	if !found {
+		return
+	}
+	delete(t.active, id)
+	t.finished++
+	if duration := time.Since(stream.started); duration > t.longest {
+		t.longest = duration
+	}
+}
+
+// Active is how many streams are open
+func (t *StreamTracker) Active() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.active)
+}
+
+// Watch logs every maxDuration/4 the streams that have been open longer
+// than maxDuration: once when they first cross it, then as a count
+func (t *StreamTracker) Watch(maxDuration time.Duration, logger *log.Logger) {
+	if maxDuration <= 0 {
+		return
+	}
+	interval := maxDuration / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			t.check(maxDuration, logger)
+		}
+	}()
+}
+
+func (t *StreamTracker) check(maxDuration time.Duration, logger *log.Logger) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	overdue := 0
+	for _, stream := range t.active {
+		age := time.Since(stream.started)
+		if age <= maxDuration {
+			continue
+		}
+		overdue++
+		if !stream.flagged {
+			stream.flagged = true
+			logger.Printf("Possible stream leak: %s %s for tenant %s from %s open for %v (limit %v)",
+				stream.kind, stream.target, stream.tenant, stream.client, age.Round(time.Second), maxDuration)
+		}
+	}
+	if overdue > 1 {
+		logger.Printf("%d of %d streams have been open longer than %v", overdue, len(t.active), maxDuration)
+	}
+}
+
+// Stats summarises open streams by kind and tenant, alongside the process
+// goroutine count they contribute to
+func (t *StreamTracker) Stats(maxDuration time.Duration) map[string]interface{} {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	byKind := make(map[string]int)
+	byTenant := make(map[string]int)
+	var oldest time.Duration
+	overdue := 0
+	for _, stream := range t.active {
+		byKind[stream.kind]++
+		byTenant[stream.tenant]++
+		age := time.Since(stream.started)
+		if age > oldest {
+			oldest = age
+		}
+		if maxDuration > 0 && age > maxDuration {
+			overdue++
+		}
+	}
+
+	return map[string]interface{}{
+		"active":             len(t.active),
+		"active_by_kind":     byKind,
+		"active_by_tenant":   byTenant,
+		"overdue":            overdue,
+		"oldest_seconds":     int64(oldest.Seconds()),
+		"longest_seconds":    int64(t.longest.Seconds()),
+		"started":            t.started,
+		"finished":           t.finished,
+		"goroutines":         runtime.NumGoroutine(),
+		"max_duration_limit": maxDuration.String(),
+	}
+}
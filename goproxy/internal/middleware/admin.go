@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminAuth protects admin endpoints with a static token. An empty token
+// leaves the endpoints open, matching the behaviour of /stats and /cache.
+func AdminAuth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token == "" {
+			c.Next()
+			return
+		}
+
+		provided := c.GetHeader("X-Admin-Token")
+		if provided == "" {
+			provided = strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		}
+
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": "Invalid or missing admin token",
+				"code":  "ADMIN_UNAUTHORIZED",
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,213 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ChaosHeader lets a request ask for its own faults when ChaosConfig.AllowHeader is set
+const ChaosHeader = "X-Chaos"
+
+// Most event stream writes, usually one per event, let through before the
+// stream is cut off
+const maxStreamTruncation = 4
+
+var errChaosTruncated = errors.New("response truncated by fault injection")
+
+// ChaosConfig sets how often each fault is injected, each rate being a
+// probability from 0 to 1
+type ChaosConfig struct {
+	Latency      time.Duration // most latency added, chosen uniformly up to it
+	LatencyRate  float64
+	ErrorRate    float64
+	ErrorStatus  []int // picked from at random for injected errors
+	TruncateRate float64
+	DropRate     float64
+
+	// AllowHeader honours X-Chaos on requests, e.g.
+	// "latency=2s,latency_rate=1,error_rate=0.5,truncate_rate=0.2,drop_rate=0.1",
+	// which replaces the configured faults for that request
+	AllowHeader bool
+}
+
+func (c ChaosConfig) enabled() bool {
+	return c.LatencyRate > 0 || c.ErrorRate > 0 || c.TruncateRate > 0 || c.DropRate > 0
+}
+
+// Chaos injects faults into the requests it handles, so client retry and
+// timeout handling can be exercised in staging: added latency, 429 and 5xx
+// errors in the OpenAI error format, responses cut off partway, and
+// connections closed without a response. Responses with an injected fault
+// carry X-Chaos-Injected naming it.
+func Chaos(config ChaosConfig) gin.HandlerFunc {
+	if len(config.ErrorStatus) == 0 {
+		config.ErrorStatus = []int{http.StatusTooManyRequests, http.StatusInternalServerError}
+	}
+	return func(c *gin.Context) {
+		faults := config
+		if header := c.GetHeader(ChaosHeader); header != "" {
+			// Never forwarded upstream, whether honoured or not
+			c.Request.Header.Del(ChaosHeader)
+			if config.AllowHeader {
+				var err error
+				if faults, err = parseChaosHeader(header, config.ErrorStatus); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{
+						"error": "Invalid " + ChaosHeader + " header: " + err.Error(),
+						"code":  "CHAOS_INVALID",
+					})
+					c.Abort()
+					return
+				}
+			}
+		}
+		if !faults.enabled() {
+			c.Next()
+			return
+		}
+
+		if faults.Latency > 0 && rand.Float64() < faults.LatencyRate {
+			delay := time.Duration(rand.Int63n(int64(faults.Latency)) + 1)
+			c.Header("X-Chaos-Injected", "latency")
+			select {
+			case <-c.Request.Context().Done():
+				c.Abort()
+				return
+			case <-time.After(delay):
+			}
+		}
+
+		if rand.Float64() < faults.DropRate {
+			dropConnection(c)
+			return
+		}
+
+		if rand.Float64() < faults.ErrorRate {
+			status := faults.ErrorStatus[rand.Intn(len(faults.ErrorStatus))]
+			errorType := "server_error"
+			if status == http.StatusTooManyRequests {
+				errorType = "rate_limit_exceeded"
+				c.Header("Retry-After", "1")
+			}
+			c.Header("X-Chaos-Injected", "error")
+			c.JSON(status, gin.H{"error": gin.H{
+				"message": fmt.Sprintf("Injected %d by fault injection", status),
+				"type":    errorType,
+				"code":    "chaos_injected",
+			}})
+			c.Abort()
+			return
+		}
+
+		if rand.Float64() < faults.TruncateRate {
+			c.Header("X-Chaos-Injected", "truncate")
+			c.Writer = &truncatingWriter{ResponseWriter: c.Writer}
+		}
+		c.Next()
+	}
+}
+
+func parseChaosHeader(header string, errorStatus []int) (ChaosConfig, error) {
+	faults := ChaosConfig{ErrorStatus: errorStatus, LatencyRate: 1}
+	for _, field := range strings.Split(header, ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(field), "=")
+		if !found {
+			return faults, fmt.Errorf("expected key=value, got %q", field)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+
+		if key == "latency" {
+			latency, err := time.ParseDuration(value)
+			if err != nil || latency < 0 {
+				return faults, fmt.Errorf("latency must be a duration such as 2s")
+			}
+			faults.Latency = latency
+			continue
+		}
+		if key == "error_status" {
+			status, err := strconv.Atoi(value)
+			if err != nil || status < 400 || status > 599 {
+				return faults, fmt.Errorf("error_status must be a 4xx or 5xx status")
+			}
+			faults.ErrorStatus = []int{status}
+			continue
+		}
+
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return faults, fmt.Errorf("%s must be a probability from 0 to 1", key)
+		}
+		switch key {
+		case "latency_rate":
+			faults.LatencyRate = rate
+		case "error_rate":
+			faults.ErrorRate = rate
+		case "truncate_rate":
+			faults.TruncateRate = rate
+		case "drop_rate":
+			faults.DropRate = rate
+		default:
+			return faults, fmt.Errorf("unknown fault %q", key)
+		}
+	}
+	return faults, nil
+}
+
+// dropConnection closes the client's connection without a response.
+// HTTP/2 connections carry other requests and can't be taken over, so those
+// get a bare 502 instead.
+func dropConnection(c *gin.Context) {
+	c.Abort()
+	conn, _, err := c.Writer.Hijack()
+	if err != nil {
+		c.Header("X-Chaos-Injected", "drop")
+		c.Status(http.StatusBadGateway)
+		return
+	}
+	conn.Close()
+}
+
+// truncatingWriter cuts a response off partway by closing the connection:
+// bodies within the first write, event streams within one of their first
+// few events. Later writes fail, which ends the handler's relay. Over HTTP/2
+// the response just ends early.
+type truncatingWriter struct {
+	gin.ResponseWriter
+	writes    int // left before the one that's cut
+	decided   bool
+	truncated bool
+}
+
+func (w *truncatingWriter) Write(data []byte) (int, error) {
+	if w.truncated {
+		return 0, errChaosTruncated
+	}
+	if !w.decided {
+		w.decided = true
+		if strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+			w.writes = rand.Intn(maxStreamTruncation)
+		}
+	}
+	if w.writes > 0 || len(data) == 0 {
+		w.writes--
+		return w.ResponseWriter.Write(data)
+	}
+
+	n, _ := w.ResponseWriter.Write(data[:rand.Intn(len(data))])
+	w.ResponseWriter.Flush()
+	w.truncated = true
+	if conn, _, err := w.ResponseWriter.Hijack(); err == nil {
+		conn.Close()
+	}
+	return n, errChaosTruncated
+}
+
+func (w *truncatingWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
@@ -6,6 +6,8 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/metrics"
 )
 
 type LoggingMiddleware struct {
@@ -36,9 +38,15 @@ func (lm *LoggingMiddleware) formatLog(param gin.LogFormatterParams) string {
 	)
 }
 
+// RequestLogger logs a line for each request, ending in the country its
+// client is in when GEOIP_DB knows it
 func RequestLogger() gin.HandlerFunc {
 	return gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
-		return fmt.Sprintf("[%s] %s \"%s %s %s\" %d %d \"%s\" \"%s\" %s\n",
+		var country string
+		if value, ok := param.Keys[metrics.CountryKey].(string); ok && value != "" {
+			country = " country=" + value
+		}
+		return fmt.Sprintf("[%s] %s \"%s %s %s\" %d %d \"%s\" \"%s\" %s%s\n",
 			param.TimeStamp.Format("2006/01/02 - 15:04:05"),
 			param.ClientIP,
 			param.Method,
@@ -49,6 +57,7 @@ func RequestLogger() gin.HandlerFunc {
 			param.Request.Referer(),
 			param.Request.UserAgent(),
 			param.Latency,
+			country,
 		)
 	})
 }
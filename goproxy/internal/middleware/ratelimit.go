@@ -7,6 +7,9 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"golang.org/x/time/rate"
+
+	"goproxyai/internal/clock"
+	"goproxyai/internal/dryrun"
 )
 
 type RateLimiter struct {
@@ -15,6 +18,17 @@ type RateLimiter struct {
 	rate     rate.Limit
 	burst    int
 	cleanup  time.Duration
+
+	// name and peers share the limiter across the replicas of a cluster
+	name  string
+	peers Peers
+}
+
+// Peers counts requests across the replicas of a cluster: what the others
+// admitted for a key over the last minute, and what this one admits
+type Peers interface {
+	Admitted(limiter, key string) float64
+	Admit(limiter, key string)
 }
 
 func NewRateLimiter(requestsPerMinute int) *RateLimiter {
@@ -31,19 +45,79 @@ func NewRateLimiter(requestsPerMinute int) *RateLimiter {
 	return rl
 }
 
-func (rl *RateLimiter) getLimiter(key string) *rate.Limiter {
+// Share counts what the other replicas admitted against each key's limit,
+// under the limiter's name, so a key gets about its limit across the
+// cluster rather than on every replica. It's set before serving.
+func (rl *RateLimiter) Share(name string, peers Peers) {
+	rl.name = name
+	rl.peers = peers
+}
+
+func (rl *RateLimiter) getLimiter(key string, limit rate.Limit, burst int) *rate.Limiter {
 	rl.mutex.Lock()
 	defer rl.mutex.Unlock()
 
 	limiter, exists := rl.limiters[key]
-	if !exists {
-		limiter = rate.NewLimiter(rl.rate, rl.burst)
+	if !exists || limiter.Limit() != limit || limiter.Burst() != burst {
+		limiter = rate.NewLimiter(limit, burst)
 		rl.limiters[key] = limiter
 	}
 
 	return limiter
 }
 
+// Allow reports whether a request for the given key may proceed, consuming
+// a token if so
+func (rl *RateLimiter) Allow(key string) bool {
+	return rl.allow(key, rl.rate, rl.burst)
+}
+
+// AllowRate is like Allow but applies a per-key limit instead of the
+// limiter's default, e.g. for API keys with their own quota
+func (rl *RateLimiter) AllowRate(key string, requestsPerMinute int) bool {
+	return rl.allow(key, rate.Limit(float64(requestsPerMinute)/60.0), requestsPerMinute)
+}
+
+// allow takes a token from the key's bucket, if it has one left over from
+// what the other replicas admitted
+func (rl *RateLimiter) allow(key string, limit rate.Limit, burst int) bool {
+	limiter := rl.getLimiter(key, limit, burst)
+	now := clock.Now()
+	if rl.peers == nil {
+		return limiter.AllowN(now, 1)
+	}
+	if limiter.TokensAt(now)-rl.peers.Admitted(rl.name, key) < 1 || !limiter.AllowN(now, 1) {
+		return false
+	}
+	rl.peers.Admit(rl.name, key)
+	return true
+}
+
+// Tokens reports how many requests the key could make right now without
+// consuming any, for dry runs
+func (rl *RateLimiter) Tokens(key string) float64 {
+	return rl.tokens(key, rl.rate, rl.burst)
+}
+
+// TokensRate is Tokens for a per-key limit, as AllowRate applies
+func (rl *RateLimiter) TokensRate(key string, requestsPerMinute int) float64 {
+	return rl.tokens(key, rate.Limit(float64(requestsPerMinute)/60.0), requestsPerMinute)
+}
+
+func (rl *RateLimiter) tokens(key string, limit rate.Limit, burst int) float64 {
+	rl.mutex.RLock()
+	defer rl.mutex.RUnlock()
+
+	tokens := float64(burst)
+	if limiter, exists := rl.limiters[key]; exists && limiter.Limit() == limit && limiter.Burst() == burst {
+		tokens = limiter.TokensAt(clock.Now())
+	}
+	if rl.peers != nil {
+		tokens -= rl.peers.Admitted(rl.name, key)
+	}
+	return tokens
+}
+
 func (rl *RateLimiter) cleanupRoutine() {
 	ticker := time.NewTicker(rl.cleanup)
 	defer ticker.Stop()
@@ -64,17 +138,30 @@ func (rl *RateLimiter) Middleware() gin.HandlerFunc {
 		// Use client IP as the key for rate limiting
 		key := c.ClientIP()
 
-		limiter := rl.getLimiter(key)
+		if t := dryrun.From(c.Request.Context()); t != nil {
+			tokens := rl.Tokens(key)
+			t.Add("ratelimit", "client %s has %.1f of %d requests left", key, tokens, rl.burst)
+			if tokens < 1 {
+				rateLimitExceeded(c)
+				return
+			}
+			c.Next()
+			return
+		}
 
-		if !limiter.Allow() {
-			c.JSON(http.StatusTooManyRequests, gin.H{
-				"error": "Rate limit exceeded. Please try again later.",
-				"code":  "RATE_LIMIT_EXCEEDED",
-			})
-			c.Abort()
+		if !rl.Allow(key) {
+			rateLimitExceeded(c)
 			return
 		}
 
 		c.Next()
 	}
 }
+
+func rateLimitExceeded(c *gin.Context) {
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error": "Rate limit exceeded. Please try again later.",
+		"code":  "RATE_LIMIT_EXCEEDED",
+	})
+	c.Abort()
+}
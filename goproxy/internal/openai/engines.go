@@ -0,0 +1,126 @@
+package openai
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+const enginesPath = "/v1/engines"
+
+// Endpoints of an engine that live on under the model they name, by what
+// follows the engine in the path
+var engineEndpoints = map[string]string{
+	"completions":      "/v1/completions",
+	"chat/completions": "/v1/chat/completions",
+	"embeddings":       "/v1/embeddings",
+}
+
+// EngineRoute is what a legacy /v1/engines path asks for in the current API
+type EngineRoute struct {
+	Path   string // the current path
+	Engine string // the model the path names, empty for the engine list
+	// Listing is set for the engine list or one engine, whose answer is a
+	// model or a list of them to be described as engines
+	Listing bool
+}
+
+// ParseEnginePath maps a legacy /v1/engines path to its current form:
+// /v1/engines to /v1/models, /v1/engines/{id} to /v1/models/{id},
+// and /v1/engines/{id}/completions, chat/completions and embeddings to
+// the endpoints taking the engine as their model. Other paths, such as
+// the retired search and answers endpoints, aren't mapped.
+func ParseEnginePath(method, path string) (EngineRoute, bool) {
+	if path == enginesPath || path == enginesPath+"/" {
+		return EngineRoute{Path: "/v1/models", Listing: true}, method == "GET"
+	}
+	rest, found := strings.CutPrefix(path, enginesPath+"/")
+	if !found || rest == "" {
+		return EngineRoute{}, false
+	}
+	engine, endpoint, _ := strings.Cut(rest, "/")
+	if endpoint == "" {
+		return EngineRoute{Path: "/v1/models/" + engine, Engine: engine, Listing: true}, method == "GET"
+	}
+	current, found := engineEndpoints[endpoint]
+	if !found || method != "POST" {
+		return EngineRoute{}, false
+	}
+	return EngineRoute{Path: current, Engine: engine}, true
+}
+
+// SetEngineModel makes the engine a legacy path names the model of its
+// request body, as the engine decided which model answered
+func SetEngineModel(body []byte, engine string) ([]byte, bool) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) != nil || fields == nil {
+		return body, false
+	}
+	var given string
+	if json.Unmarshal(fields["model"], &given) == nil && given == engine {
+		return body, false
+	}
+	updated, err := SetField(body, "model", engine)
+	if err != nil {
+		return body, false
+	}
+	return updated, true
+}
+
+// model and engine are the objects /v1/models and /v1/engines describe
+// the same thing with
+type model struct {
+	ID      string `json:"id"`
+	Created *int64 `json:"created,omitempty"`
+	OwnedBy string `json:"owned_by"`
+}
+
+type engine struct {
+	Object  string `json:"object"`
+	ID      string `json:"id"`
+	Created *int64 `json:"created"`
+	Owner   string `json:"owner"`
+	Ready   bool   `json:"ready"`
+}
+
+func asEngine(m model) engine {
+	return engine{Object: "engine", ID: m.ID, Created: m.Created, Owner: m.OwnedBy, Ready: true}
+}
+
+// ModelsAsEngines describes a model, or a list of models, the way the
+// engines endpoints did. Other bodies, such as errors, are left alone.
+func ModelsAsEngines(body []byte) ([]byte, bool) {
+	var object struct {
+		Object string            `json:"object"`
+		Data   []json.RawMessage `json:"data"`
+	}
+	if json.Unmarshal(body, &object) != nil {
+		return body, false
+	}
+	switch object.Object {
+	case "model":
+		var m model
+		if json.Unmarshal(body, &m) != nil {
+			return body, false
+		}
+		encoded, err := json.Marshal(asEngine(m))
+		if err != nil {
+			return body, false
+		}
+		return encoded, true
+	case "list":
+		engines := make([]engine, 0, len(object.Data))
+		for _, raw := range object.Data {
+			var m model
+			if json.Unmarshal(raw, &m) != nil {
+				return body, false
+			}
+			engines = append(engines, asEngine(m))
+		}
+		encoded, err := json.Marshal(map[string]interface{}{"object": "list", "data": engines})
+		if err != nil {
+			return body, false
+		}
+		return encoded, true
+	}
+	return body, false
+}
@@ -0,0 +1,224 @@
+package openai
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// Model families that refuse max_tokens and take max_completion_tokens
+// instead, by prefix
+var MaxCompletionTokensModels = []string{"o1", "o3", "o4", "gpt-5"}
+
+// Migration reports which deprecated parameters of a chat completion
+// request were rewritten
+type Migration struct {
+	Functions bool // functions and function_call became tools and tool_choice
+	MaxTokens bool // max_tokens became max_completion_tokens
+}
+
+func (m Migration) Any() bool {
+	return m.Functions || m.MaxTokens
+}
+
+func (m Migration) String() string {
+	var names []string
+	if m.Functions {
+		names = append(names, "functions to tools")
+	}
+	if m.MaxTokens {
+		names = append(names, "max_tokens to max_completion_tokens")
+	}
+	return strings.Join(names, ", ")
+}
+
+// MigrateChatRequest rewrites the deprecated parameters of a chat
+// completion request body into their current form: functions and
+// function_call into tools and tool_choice, along with the function calls
+// and results in the conversation, and max_tokens into
+// max_completion_tokens for models that require it. Requests already using
+// the current parameter are left alone. The body is returned unchanged when
+// there's nothing to rewrite or it isn't a JSON object.
+func MigrateChatRequest(body []byte, tokenModels []string) ([]byte, Migration, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil || fields == nil {
+		return body, Migration{}, err
+	}
+
+	var m Migration
+	if isSet(fields["functions"]) && !isSet(fields["tools"]) {
+		if err := migrateFunctions(fields); err != nil {
+			return body, Migration{}, err
+		}
+		m.Functions = true
+	}
+	if isSet(fields["max_tokens"]) && !isSet(fields["max_completion_tokens"]) {
+		var model string
+		_ = json.Unmarshal(fields["model"], &model)
+		if hasModelPrefix(model, tokenModels) {
+			fields["max_completion_tokens"] = fields["max_tokens"]
+			delete(fields, "max_tokens")
+			m.MaxTokens = true
+		}
+	}
+	if !m.Any() {
+		return body, m, nil
+	}
+
+	migrated, err := json.Marshal(fields)
+	if err != nil {
+		return body, Migration{}, err
+	}
+	return migrated, m, nil
+}
+
+func hasModelPrefix(model string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(model, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func migrateFunctions(fields map[string]json.RawMessage) error {
+	var functions []json.RawMessage
+	if err := json.Unmarshal(fields["functions"], &functions); err != nil {
+		return err
+	}
+	tools := make([]map[string]json.RawMessage, len(functions))
+	for i, function := range functions {
+		tools[i] = map[string]json.RawMessage{"type": json.RawMessage(`"function"`), "function": function}
+	}
+	encoded, err := json.Marshal(tools)
+	if err != nil {
+		return err
+	}
+	fields["tools"] = encoded
+	delete(fields, "functions")
+
+	if call := fields["function_call"]; isSet(call) {
+		if !isSet(fields["tool_choice"]) {
+			var choice interface{} = call // "none" and "auto" mean the same
+			var named struct {
+				Name string `json:"name"`
+			}
+			if json.Unmarshal(call, &named) == nil && named.Name != "" {
+				choice = map[string]interface{}{"type": "function", "function": named}
+			}
+			if fields["tool_choice"], err = json.Marshal(choice); err != nil {
+				return err
+			}
+		}
+		delete(fields, "function_call")
+	}
+	// function_call answers hold a single call, which is all a legacy
+	// client can read back
+	if !isSet(fields["parallel_tool_calls"]) {
+		fields["parallel_tool_calls"] = json.RawMessage("false")
+	}
+
+	if !isSet(fields["messages"]) {
+		return nil
+	}
+	var messages []map[string]json.RawMessage
+	if err := json.Unmarshal(fields["messages"], &messages); err != nil {
+		return err
+	}
+	fields["messages"], err = json.Marshal(migrateMessages(messages))
+	return err
+}
+
+// migrateMessages turns the function calls in a conversation into tool
+// calls, and the function results after them into tool results answering
+// those calls. Ids are made up from each call's position, so the same
+// conversation always migrates the same way.
+func migrateMessages(messages []map[string]json.RawMessage) []map[string]json.RawMessage {
+	var pending string
+	for i, message := range messages {
+		var role string
+		_ = json.Unmarshal(message["role"], &role)
+		switch {
+		case role == "assistant" && isSet(message["function_call"]):
+			id := "call_" + strconv.Itoa(i)
+			call, err := json.Marshal([]map[string]json.RawMessage{{
+				"id":       json.RawMessage(strconv.Quote(id)),
+				"type":     json.RawMessage(`"function"`),
+				"function": message["function_call"],
+			}})
+			if err != nil {
+				continue
+			}
+			message["tool_calls"] = call
+			delete(message, "function_call")
+			pending = id
+		case role == "function" && pending != "":
+			message["role"] = json.RawMessage(`"tool"`)
+			message["tool_call_id"] = json.RawMessage(strconv.Quote(pending))
+			delete(message, "name")
+			pending = ""
+		}
+	}
+	return messages
+}
+
+// LegacyFunctionCall rewrites a chat completion, or a chunk of a streamed
+// one, to answer with function_call the way it did before tools, for
+// clients whose request was migrated from functions. Only the first tool
+// call of each choice is kept. The body is returned unchanged, and false,
+// when it has no tool calls to rewrite or isn't JSON.
+func LegacyFunctionCall(body []byte) ([]byte, bool) {
+	var completion map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&completion); err != nil {
+		return body, false
+	}
+	choices, _ := completion["choices"].([]interface{})
+
+	changed := false
+	for _, choice := range choices {
+		choice, _ := choice.(map[string]interface{})
+		if choice == nil {
+			continue
+		}
+		for _, key := range []string{"message", "delta"} {
+			message, _ := choice[key].(map[string]interface{})
+			calls, found := message["tool_calls"].([]interface{})
+			if !found {
+				continue
+			}
+			if len(calls) > 0 {
+				if call, _ := calls[0].(map[string]interface{}); call != nil && callIndex(call) == 0 {
+					message["function_call"] = call["function"]
+				}
+			}
+			delete(message, "tool_calls")
+			changed = true
+		}
+		if choice["finish_reason"] == "tool_calls" {
+			choice["finish_reason"] = "function_call"
+			changed = true
+		}
+	}
+	if !changed {
+		return body, false
+	}
+
+	var encoded bytes.Buffer
+	encoder := json.NewEncoder(&encoded)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(completion); err != nil {
+		return body, false
+	}
+	return bytes.TrimSuffix(encoded.Bytes(), []byte("\n")), true
+}
+
+// callIndex is a streamed tool call's index, which whole answers don't
+// carry and are taken as 0
+func callIndex(call map[string]interface{}) int64 {
+	index, _ := call["index"].(json.Number)
+	n, _ := index.Int64()
+	return n
+}
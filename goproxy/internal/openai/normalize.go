@@ -0,0 +1,232 @@
+package openai
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// The finish reasons other backends use, by the one the API has for them
+var finishReasons = map[string]string{
+	"eos":                "stop",
+	"eos_token":          "stop",
+	"end":                "stop",
+	"end_turn":           "stop",
+	"stop_sequence":      "stop",
+	"complete":           "stop",
+	"finished":           "stop",
+	"max_tokens":         "length",
+	"max_length":         "length",
+	"max_output_tokens":  "length",
+	"model_length":       "length",
+	"tool_use":           "tool_calls",
+	"tool_call":          "tool_calls",
+	"function_calls":     "tool_calls",
+	"safety":             "content_filter",
+	"recitation":         "content_filter",
+	"blocklist":          "content_filter",
+	"prohibited_content": "content_filter",
+	"content_filtered":   "content_filter",
+}
+
+// NormalizeFinishReason maps a backend's finish reason to the API's stop,
+// length, tool_calls, content_filter or function_call. Reasons it doesn't
+// know are returned as they are.
+func NormalizeFinishReason(reason string) string {
+	lower := strings.TrimPrefix(strings.ToLower(reason), "finish_reason_")
+	if normalized, found := finishReasons[lower]; found {
+		return normalized
+	}
+	switch lower {
+	case "stop", "length", "tool_calls", "content_filter", "function_call":
+		return lower
+	}
+	return reason
+}
+
+// NormalizeCompletion gives a chat completion, completion or embeddings
+// response the fields clients rely on: every choice ends with one of the
+// API's finish reasons, and usage is there, counted from the request and
+// the answer when the backend left it out. The body is returned unchanged,
+// and false, when there's nothing to fix or it isn't JSON.
+func NormalizeCompletion(body, request []byte, model string) ([]byte, bool) {
+	var completion map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&completion); err != nil || completion == nil {
+		return body, false
+	}
+	object, _ := completion["object"].(string)
+	if object != "chat.completion" && object != "text_completion" && object != "list" {
+		return body, false
+	}
+
+	changed := normalizeChoices(completion, false)
+	if _, found := completion["usage"].(map[string]interface{}); !found {
+		prompt := CountPromptTokens(request)
+		if object == "list" {
+			completion["usage"] = map[string]int{"prompt_tokens": prompt, "total_tokens": prompt}
+		} else {
+			output := CountTokens(model, ExtractOutputText(body))
+			completion["usage"] = map[string]int{
+				"prompt_tokens":     prompt,
+				"completion_tokens": output,
+				"total_tokens":      prompt + output,
+			}
+		}
+		changed = true
+	}
+	if !changed {
+		return body, false
+	}
+	return encodeNormalized(body, completion)
+}
+
+// NormalizeChunk does the same for the finish reasons of a chunk of a
+// streamed completion. Chunks before the last have no finish reason, so a
+// missing one is left alone.
+func NormalizeChunk(data []byte) ([]byte, bool) {
+	var chunk map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&chunk); err != nil || chunk == nil {
+		return data, false
+	}
+	if !normalizeChoices(chunk, true) {
+		return data, false
+	}
+	return encodeNormalized(data, chunk)
+}
+
+// normalizeChoices maps each choice's finish reason, taking a whole
+// answer's missing one for stop
+func normalizeChoices(completion map[string]interface{}, streamed bool) bool {
+	choices, _ := completion["choices"].([]interface{})
+	changed := false
+	for _, choice := range choices {
+		choice, _ := choice.(map[string]interface{})
+		if choice == nil {
+			continue
+		}
+		reason, _ := choice["finish_reason"].(string)
+		if reason == "" {
+			if !streamed {
+				choice["finish_reason"] = "stop"
+				changed = true
+			}
+			continue
+		}
+		if normalized := NormalizeFinishReason(reason); normalized != reason {
+			choice["finish_reason"] = normalized
+			changed = true
+		}
+	}
+	return changed
+}
+
+// apiError is what the API's error envelope holds
+type apiError struct {
+	Message string      `json:"message"`
+	Type    string      `json:"type"`
+	Param   interface{} `json:"param"`
+	Code    interface{} `json:"code"`
+}
+
+// NormalizeError rewrites an error response in the API's envelope,
+// {"error": {"message", "type", "param", "code"}}, from the shapes other
+// backends answer with: a bare string error, a top-level message or detail,
+// as FastAPI and vLLM servers send, or a plain text or HTML page. The
+// type is filled in from status when the backend gave none. An error
+// already in the envelope is returned unchanged, and false.
+func NormalizeError(status int, body []byte) ([]byte, bool) {
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if decoder.Decode(&fields) != nil {
+		fields = nil
+	}
+
+	envelope := apiError{Type: errorType(status)}
+	switch given := fields["error"].(type) {
+	case map[string]interface{}:
+		message, _ := given["message"].(string)
+		kind, _ := given["type"].(string)
+		_, hasParam := given["param"]
+		_, hasCode := given["code"]
+		if message != "" && kind != "" && hasParam && hasCode {
+			return body, false
+		}
+		envelope.Message = message
+		if kind != "" {
+			envelope.Type = kind
+		}
+		envelope.Param, envelope.Code = given["param"], given["code"]
+	case string:
+		envelope.Message = given
+		envelope.Code = fields["code"]
+	default:
+		if fields != nil {
+			envelope.Message = detailMessage(fields)
+			if kind, _ := fields["type"].(string); kind != "" && kind != "error" {
+				envelope.Type = kind
+			}
+			envelope.Param, envelope.Code = fields["param"], fields["code"]
+		} else if text := strings.TrimSpace(string(body)); !strings.HasPrefix(text, "<") {
+			envelope.Message = text
+		}
+	}
+	if envelope.Message == "" {
+		envelope.Message = http.StatusText(status)
+	}
+	return encodeNormalized(body, map[string]apiError{"error": envelope})
+}
+
+// detailMessage finds the message of an error body without an error field
+func detailMessage(fields map[string]interface{}) string {
+	if message, ok := fields["message"].(string); ok {
+		return message
+	}
+	switch detail := fields["detail"].(type) {
+	case string:
+		return detail
+	case []interface{}:
+		// FastAPI's validation errors, one per invalid field
+		var messages []string
+		for _, item := range detail {
+			item, _ := item.(map[string]interface{})
+			if message, ok := item["msg"].(string); ok {
+				messages = append(messages, message)
+			}
+		}
+		return strings.Join(messages, "; ")
+	}
+	return ""
+}
+
+// errorType is the API's error type for a status
+func errorType(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return "authentication_error"
+	case status == http.StatusForbidden:
+		return "permission_error"
+	case status == http.StatusNotFound:
+		return "not_found_error"
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case status >= 500:
+		return "server_error"
+	}
+	return "invalid_request_error"
+}
+
+func encodeNormalized(body []byte, value interface{}) ([]byte, bool) {
+	var encoded bytes.Buffer
+	encoder := json.NewEncoder(&encoded)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return body, false
+	}
+	return bytes.TrimSuffix(encoded.Bytes(), []byte("\n")), true
+}
@@ -0,0 +1,305 @@
+package openai
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// RequestInfo holds the request body fields the proxy cares about
+type RequestInfo struct {
+	Model  string `json:"model"`
+	User   string `json:"user"`
+	Stream bool   `json:"stream"`
+}
+
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+
+	// The Responses API reports input and output tokens instead
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// Endpoints that accept the end-user identifier in the request body
+var userFieldPaths = []string{
+	"/v1/chat/completions",
+	"/v1/completions",
+	"/v1/embeddings",
+	"/v1/images/generations",
+	"/v1/responses",
+}
+
+func SupportsUserField(path string) bool {
+	for _, userPath := range userFieldPaths {
+		if path == userPath {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseRequest extracts known fields from a JSON request body. Bodies that
+// aren't JSON objects yield an empty RequestInfo.
+func ParseRequest(body []byte) RequestInfo {
+	var info RequestInfo
+	if len(body) > 0 {
+		_ = json.Unmarshal(body, &info)
+	}
+	return info
+}
+
+// ParseUsage extracts the usage block from a JSON response body, or from
+// the response carried by a Responses API stream event
+func ParseUsage(body []byte) (*Usage, bool) {
+	var resp struct {
+		Usage    *Usage `json:"usage"`
+		Response *struct {
+			Usage *Usage `json:"usage"`
+		} `json:"response"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, false
+	}
+
+	usage := resp.Usage
+	if usage == nil && resp.Response != nil {
+		usage = resp.Response.Usage
+	}
+	if usage == nil {
+		return nil, false
+	}
+	if usage.PromptTokens == 0 && usage.CompletionTokens == 0 {
+		usage.PromptTokens = usage.InputTokens
+		usage.CompletionTokens = usage.OutputTokens
+	}
+	return usage, true
+}
+
+// Object identifies an API object in a response body or stream event, e.g.
+// a "thread.run" and its status
+type Object struct {
+	ID     string `json:"id"`
+	Object string `json:"object"`
+	Status string `json:"status"`
+	Model  string `json:"model"`
+}
+
+// ParseObject identifies the object in body. Responses API stream events
+// wrap the response they're about, so for those the response is returned.
+func ParseObject(body []byte) Object {
+	var event struct {
+		Object
+		Response *Object `json:"response"`
+	}
+	_ = json.Unmarshal(body, &event)
+	if event.Response != nil && event.Response.Object == "response" {
+		return *event.Response
+	}
+	return event.Object
+}
+
+// ExtractText collects the user-supplied text of a request: chat message
+// contents, completion prompts, embedding or moderation inputs and
+// Responses API instructions and input items
+func ExtractText(body []byte) []string {
+	var req struct {
+		Messages []struct {
+			Content json.RawMessage `json:"content"`
+		} `json:"messages"`
+		Prompt       json.RawMessage `json:"prompt"`
+		Input        json.RawMessage `json:"input"`
+		Instructions json.RawMessage `json:"instructions"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil
+	}
+
+	var texts []string
+	for _, message := range req.Messages {
+		texts = appendText(texts, message.Content)
+	}
+	texts = appendText(texts, req.Prompt)
+	texts = appendText(texts, req.Input)
+	texts = appendText(texts, req.Instructions)
+	return texts
+}
+
+// appendText handles the shapes text fields take in the API: a string, an
+// array of strings, an array of content parts with a text field, or an
+// array of input items that have content of their own
+func appendText(texts []string, raw json.RawMessage) []string {
+	if len(raw) == 0 {
+		return texts
+	}
+
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return append(texts, text)
+	}
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return texts
+	}
+	for _, item := range items {
+		var part struct {
+			Text    string          `json:"text"`
+			Content json.RawMessage `json:"content"`
+		}
+		if err := json.Unmarshal(item, &text); err == nil {
+			texts = append(texts, text)
+		} else if err := json.Unmarshal(item, &part); err == nil {
+			if part.Text != "" {
+				texts = append(texts, part.Text)
+			}
+			texts = appendText(texts, part.Content)
+		}
+	}
+	return texts
+}
+
+// ExtractOutputText collects the generated text of a response: chat message
+// contents and tool call arguments, completion texts and Responses API
+// output text, one entry per choice or output item
+func ExtractOutputText(body []byte) []string {
+	var resp struct {
+		Choices []struct {
+			Text    string `json:"text"`
+			Message struct {
+				Content   json.RawMessage `json:"content"`
+				ToolCalls []struct {
+					Function struct {
+						Name      string `json:"name"`
+						Arguments string `json:"arguments"`
+					} `json:"function"`
+				} `json:"tool_calls"`
+			} `json:"message"`
+		} `json:"choices"`
+		Output []struct {
+			Content   json.RawMessage `json:"content"`
+			Name      string          `json:"name"`
+			Arguments string          `json:"arguments"`
+		} `json:"output"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil
+	}
+
+	var texts []string
+	for _, choice := range resp.Choices {
+		var text []string
+		if choice.Text != "" {
+			text = append(text, choice.Text)
+		}
+		text = appendText(text, choice.Message.Content)
+		for _, call := range choice.Message.ToolCalls {
+			text = append(text, call.Function.Name+" "+call.Function.Arguments)
+		}
+		texts = append(texts, strings.Join(text, "\n"))
+	}
+	for _, item := range resp.Output {
+		text := appendText(nil, item.Content)
+		if item.Name != "" {
+			text = append(text, item.Name+" "+item.Arguments)
+		}
+		if len(text) > 0 {
+			texts = append(texts, strings.Join(text, "\n"))
+		}
+	}
+	return texts
+}
+
+// EmptyCompletion reports whether a chat completion's first choice has no
+// content but whitespace. Choices that call tools or functions, refuse or
+// answer with audio aren't empty, whatever their content.
+func EmptyCompletion(body []byte) bool {
+	var resp struct {
+		Choices []struct {
+			Message struct {
+				Content      json.RawMessage   `json:"content"`
+				ToolCalls    []json.RawMessage `json:"tool_calls"`
+				FunctionCall json.RawMessage   `json:"function_call"`
+				Refusal      string            `json:"refusal"`
+				Audio        json.RawMessage   `json:"audio"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || len(resp.Choices) == 0 {
+		return false
+	}
+	message := resp.Choices[0].Message
+	if len(message.ToolCalls) > 0 || isSet(message.FunctionCall) || message.Refusal != "" || isSet(message.Audio) {
+		return false
+	}
+	return strings.TrimSpace(strings.Join(appendText(nil, message.Content), "")) == ""
+}
+
+func isSet(raw json.RawMessage) bool {
+	return len(raw) > 0 && string(raw) != "null"
+}
+
+// EstimateTokens approximates the token count of texts using the usual
+// four-characters-per-token rule of thumb, for when no tokenizer loads
+func EstimateTokens(texts []string) int {
+	var chars int
+	for _, text := range texts {
+		chars += len(text)
+	}
+	return (chars + 3) / 4
+}
+
+// SetField sets a top-level field on a JSON object body and returns the new
+// body. The original body is returned unchanged if it isn't a JSON object.
+func SetField(body []byte, field string, value interface{}) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return body, err
+	}
+	if fields == nil {
+		return body, errors.New("request body is not a JSON object")
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return body, err
+	}
+	fields[field] = encoded
+
+	return json.Marshal(fields)
+}
+
+// SetDefaults adds the fields of defaults a JSON object body leaves out or
+// sets to null, and returns the new body with the names of the fields it
+// added, sorted. The original body is returned unchanged if it isn't a JSON
+// object.
+func SetDefaults(body []byte, defaults map[string]json.RawMessage) ([]byte, []string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return body, nil, err
+	}
+	if fields == nil {
+		return body, nil, errors.New("request body is not a JSON object")
+	}
+
+	var added []string
+	for name, value := range defaults {
+		if !isSet(fields[name]) {
+			fields[name] = value
+			added = append(added, name)
+		}
+	}
+	if len(added) == 0 {
+		return body, nil, nil
+	}
+	sort.Strings(added)
+
+	updated, err := json.Marshal(fields)
+	if err != nil {
+		return body, nil, err
+	}
+	return updated, added, nil
+}
@@ -0,0 +1,102 @@
+package openai
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+// Encoding used for models the tokenizer's table doesn't know, which are
+// newer than it: every model since gpt-4o uses o200k_base
+const defaultEncoding = tiktoken.MODEL_O200K_BASE
+
+// Tokens added by the chat format: each message is wrapped in a few
+// control tokens, and every reply is primed with three more
+const (
+	tokensPerMessage = 3
+	tokensPerReply   = 3
+)
+
+var (
+	encodingsMutex sync.Mutex
+	encodings      = make(map[string]*tiktoken.Tiktoken)
+)
+
+func init() {
+	// The BPE ranks are embedded in the binary rather than downloaded on
+	// first use, so counting works without egress to the internet
+	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+}
+
+// EncodingName reports which tiktoken encoding model's text is tokenized with
+func EncodingName(model string) string {
+	if name, found := tiktoken.MODEL_TO_ENCODING[model]; found {
+		return name
+	}
+	for prefix, name := range tiktoken.MODEL_PREFIX_TO_ENCODING {
+		if strings.HasPrefix(model, prefix) {
+			return name
+		}
+	}
+	return defaultEncoding
+}
+
+// encoding returns the tokenizer for an encoding, building it on first use;
+// building one parses the full rank table, so they're kept for the process
+func encoding(name string) (*tiktoken.Tiktoken, error) {
+	encodingsMutex.Lock()
+	defer encodingsMutex.Unlock()
+
+	if enc, found := encodings[name]; found {
+		return enc, nil
+	}
+	enc, err := tiktoken.GetEncoding(name)
+	if err != nil {
+		return nil, err
+	}
+	encodings[name] = enc
+	return enc, nil
+}
+
+// CountTokens counts the tokens of texts as model would tokenize them.
+// Special tokens in the text are counted as the plain text they are, which
+// is how the API treats them in user content.
+func CountTokens(model string, texts []string) int {
+	enc, err := encoding(EncodingName(model))
+	if err != nil {
+		return EstimateTokens(texts)
+	}
+
+	var tokens int
+	for _, text := range texts {
+		tokens += len(enc.EncodeOrdinary(text))
+	}
+	return tokens
+}
+
+// CountPromptTokens counts the tokens of a request's input the way the
+// upstream bills them: the text ExtractText finds, plus each message's role
+// and name and the chat format's overhead
+func CountPromptTokens(body []byte) int {
+	var req struct {
+		Model    string `json:"model"`
+		Messages []struct {
+			Role string `json:"role"`
+			Name string `json:"name"`
+		} `json:"messages"`
+	}
+	_ = json.Unmarshal(body, &req)
+
+	texts := ExtractText(body)
+	for _, message := range req.Messages {
+		texts = append(texts, message.Role, message.Name)
+	}
+	tokens := CountTokens(req.Model, texts)
+	if len(req.Messages) > 0 {
+		tokens += len(req.Messages)*tokensPerMessage + tokensPerReply
+	}
+	return tokens
+}
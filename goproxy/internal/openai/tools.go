@@ -0,0 +1,138 @@
+package openai
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// Tool is a tool a request declares, in tools or the deprecated functions
+type Tool struct {
+	Param      string // where it's declared, such as tools[2]
+	Definition string // where its name and parameters are, such as tools[2].function
+	Type       string // function, custom or a built-in tool such as web_search
+
+	// Name is the function or custom tool's name, or a built-in tool's type
+	Name       string
+	Parameters json.RawMessage // a function's JSON schema, if it has one
+	Strict     bool
+}
+
+// ParseTools returns the tools a request body declares, in both the Chat
+// Completions form, {"type": "function", "function": {"name": ...}}, and the
+// flat one of the Responses and Realtime APIs, {"type": "function", "name":
+// ...}. Bodies that aren't JSON objects declare none.
+func ParseTools(body []byte) []Tool {
+	var fields struct {
+		Tools     []map[string]json.RawMessage `json:"tools"`
+		Functions []map[string]json.RawMessage `json:"functions"`
+	}
+	if json.Unmarshal(body, &fields) != nil {
+		return nil
+	}
+
+	tools := make([]Tool, 0, len(fields.Tools)+len(fields.Functions))
+	for i, declared := range fields.Tools {
+		param := "tools[" + strconv.Itoa(i) + "]"
+		tool := Tool{Param: param, Definition: param}
+		_ = json.Unmarshal(declared["type"], &tool.Type)
+		definition := declared
+		// Chat Completions nests the definition under the tool's type
+		if nested, ok := declared[tool.Type]; ok && (tool.Type == "function" || tool.Type == "custom") {
+			definition = nil
+			_ = json.Unmarshal(nested, &definition)
+			tool.Definition += "." + tool.Type
+		}
+		if tool.Type == "function" || tool.Type == "custom" {
+			_ = json.Unmarshal(definition["name"], &tool.Name)
+		} else {
+			tool.Name = tool.Type
+		}
+		tool.Parameters = definition["parameters"]
+		_ = json.Unmarshal(definition["strict"], &tool.Strict)
+		tools = append(tools, tool)
+	}
+	for i, function := range fields.Functions {
+		param := "functions[" + strconv.Itoa(i) + "]"
+		tool := Tool{Param: param, Definition: param, Type: "function", Parameters: function["parameters"]}
+		_ = json.Unmarshal(function["name"], &tool.Name)
+		tools = append(tools, tool)
+	}
+	return tools
+}
+
+// ForcedTool is the name of the tool a request's tool_choice, or its
+// deprecated function_call, makes the model call, empty when it names none
+func ForcedTool(body []byte) string {
+	var fields struct {
+		ToolChoice   json.RawMessage `json:"tool_choice"`
+		FunctionCall json.RawMessage `json:"function_call"`
+	}
+	if json.Unmarshal(body, &fields) != nil {
+		return ""
+	}
+	for _, raw := range []json.RawMessage{fields.ToolChoice, fields.FunctionCall} {
+		var choice map[string]json.RawMessage
+		var name, kind string
+		if json.Unmarshal(raw, &choice) != nil {
+			continue
+		}
+		_ = json.Unmarshal(choice["type"], &kind)
+		if nested, ok := choice[kind]; ok {
+			choice = nil
+			_ = json.Unmarshal(nested, &choice)
+		}
+		switch kind {
+		case "", "function", "custom":
+			if json.Unmarshal(choice["name"], &name) == nil && name != "" {
+				return name
+			}
+		case "allowed_tools":
+			// Narrows the declared tools rather than forcing one
+		default:
+			return kind
+		}
+	}
+	return ""
+}
+
+// RemoveTools drops the tools whose Param is in remove from a request
+// body. When none are left, tool_choice and parallel_tool_calls go too,
+// since upstream refuses them without tools.
+func RemoveTools(body []byte, remove map[string]bool) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	left := 0
+	for _, field := range []string{"tools", "functions"} {
+		var declared []json.RawMessage
+		if !isSet(fields[field]) {
+			continue
+		}
+		if err := json.Unmarshal(fields[field], &declared); err != nil {
+			return nil, err
+		}
+		kept := declared[:0]
+		for i, tool := range declared {
+			if !remove[field+"["+strconv.Itoa(i)+"]"] {
+				kept = append(kept, tool)
+			}
+		}
+		if len(kept) == 0 {
+			delete(fields, field)
+			continue
+		}
+		left += len(kept)
+		encoded, err := json.Marshal(kept)
+		if err != nil {
+			return nil, err
+		}
+		fields[field] = encoded
+	}
+	if left == 0 {
+		delete(fields, "tool_choice")
+		delete(fields, "function_call")
+		delete(fields, "parallel_tool_calls")
+	}
+	return json.Marshal(fields)
+}
@@ -0,0 +1,111 @@
+package plugins
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// jsonModule gives scripts json.decode and json.encode. Objects and arrays
+// both become tables; a table encodes as an array when its keys are 1 to n,
+// and as an object otherwise. JSON null decodes to nil, so keys holding it
+// disappear from their table.
+func jsonModule(L *lua.LState) *lua.LTable {
+	module := L.NewTable()
+	module.RawSetString("decode", L.NewFunction(func(L *lua.LState) int {
+		var value interface{}
+		if err := json.Unmarshal([]byte(L.CheckString(1)), &value); err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(toLua(L, value))
+		return 1
+	}))
+	module.RawSetString("encode", L.NewFunction(func(L *lua.LState) int {
+		encoded, err := json.Marshal(fromLua(L.CheckAny(1), 0))
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LString(encoded))
+		return 1
+	}))
+	return module
+}
+
+func toLua(L *lua.LState, value interface{}) lua.LValue {
+	switch value := value.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(value)
+	case float64:
+		return lua.LNumber(value)
+	case string:
+		return lua.LString(value)
+	case []interface{}:
+		table := L.CreateTable(len(value), 0)
+		for _, item := range value {
+			table.Append(toLua(L, item))
+		}
+		return table
+	case map[string]interface{}:
+		table := L.CreateTable(0, len(value))
+		for key, item := range value {
+			table.RawSetString(key, toLua(L, item))
+		}
+		return table
+	}
+	return lua.LNil
+}
+
+// Tables nested deeper than this, usually because they refer to
+// themselves, encode as null
+const maxJSONDepth = 64
+
+func fromLua(value lua.LValue, depth int) interface{} {
+	switch value := value.(type) {
+	case lua.LBool:
+		return bool(value)
+	case lua.LNumber:
+		if number := float64(value); !math.IsInf(number, 0) && !math.IsNaN(number) {
+			return number
+		}
+	case lua.LString:
+		return string(value)
+	case *lua.LTable:
+		if depth >= maxJSONDepth {
+			return nil
+		}
+		if length := value.Len(); length > 0 && countKeys(value) == length {
+			array := make([]interface{}, 0, length)
+			for i := 1; i <= length; i++ {
+				array = append(array, fromLua(value.RawGetInt(i), depth+1))
+			}
+			return array
+		}
+		object := make(map[string]interface{})
+		var keys []string
+		value.ForEach(func(key, item lua.LValue) {
+			if key, ok := key.(lua.LString); ok {
+				keys = append(keys, string(key))
+			}
+		})
+		sort.Strings(keys)
+		for _, key := range keys {
+			object[key] = fromLua(value.RawGetString(key), depth+1)
+		}
+		return object
+	}
+	return nil
+}
+
+func countKeys(table *lua.LTable) int {
+	count := 0
+	table.ForEach(func(lua.LValue, lua.LValue) { count++ })
+	return count
+}
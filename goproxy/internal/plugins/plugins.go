@@ -0,0 +1,365 @@
+// Package plugins runs operator-supplied Lua scripts at fixed points in a
+// request's life, so behaviour can be customised without forking the proxy.
+// Scripts run sandboxed: no filesystem, network, OS or module loading, and a
+// time limit on every call.
+package plugins
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// Hook points, named after the global functions scripts define for them
+const (
+	PreRoute     = "pre_route"     // before routing: method, path, query and headers
+	PreForward   = "pre_forward"   // before the request goes upstream: also the body
+	PostResponse = "post_response" // before a non-streamed response reaches the client
+)
+
+var hooks = []string{PreRoute, PreForward, PostResponse}
+
+// Base library functions scripts can't have: they reach the filesystem
+// or load code from outside the script
+var unsafeGlobals = []string{"dofile", "loadfile", "load", "loadstring", "require", "module", "print", "collectgarbage"}
+
+// Idle interpreters kept per plugin for reuse
+const maxIdleStates = 16
+
+// Request is what hooks see of a request. Body is nil at pre_route, which
+// runs before the body has been read.
+type Request struct {
+	Method string
+	Path   string
+	Query  string
+	Header http.Header
+	Body   []byte
+}
+
+// Response is a response a hook has to answer with, or the upstream
+// response post_response sees
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// Host holds the loaded plugins
+type Host struct {
+	plugins []*plugin
+	timeout time.Duration
+}
+
+type plugin struct {
+	name   string
+	proto  *lua.FunctionProto
+	hooks  map[string]bool
+	idle   chan *lua.LState
+	logger *log.Logger
+}
+
+// Load compiles and runs each script once, failing if any doesn't compile,
+// errors at the top level or defines none of the hooks. Each hook call is
+// stopped after timeout.
+func Load(paths []string, timeout time.Duration, logger *log.Logger) (*Host, error) {
+	host := &Host{timeout: timeout}
+	for _, path := range paths {
+		source, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		chunk, err := parse.Parse(strings.NewReader(string(source)), path)
+		if err != nil {
+			return nil, fmt.Errorf("plugin %s: %w", name, err)
+		}
+		proto, err := lua.Compile(chunk, path)
+		if err != nil {
+			return nil, fmt.Errorf("plugin %s: %w", name, err)
+		}
+
+		p := &plugin{name: name, proto: proto, hooks: make(map[string]bool), idle: make(chan *lua.LState, maxIdleStates), logger: logger}
+		L, err := p.newState(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("plugin %s: %w", name, err)
+		}
+		for _, hook := range hooks {
+			if L.GetGlobal(hook).Type() == lua.LTFunction {
+				p.hooks[hook] = true
+			}
+		}
+		p.put(L)
+		if len(p.hooks) == 0 {
+			return nil, fmt.Errorf("plugin %s defines none of %s", name, strings.Join(hooks, ", "))
+		}
+		host.plugins = append(host.plugins, p)
+	}
+	return host, nil
+}
+
+// Has reports whether any plugin defines hook
+func (h *Host) Has(hook string) bool {
+	if h == nil {
+		return false
+	}
+	for _, p := range h.plugins {
+		if p.hooks[hook] {
+			return true
+		}
+	}
+	return false
+}
+
+// Names lists the loaded plugins, in the order they run
+func (h *Host) Names() []string {
+	names := make([]string, len(h.plugins))
+	for i, p := range h.plugins {
+		names[i] = p.name
+	}
+	return names
+}
+
+// Request runs a pre_route or pre_forward hook of each plugin in turn. They
+// may change req in place, or answer it themselves by returning a response
+// table, in which case the later plugins don't run and the response is
+// returned.
+func (h *Host) Request(ctx context.Context, hook string, req *Request) (*Response, error) {
+	for _, p := range h.plugins {
+		if !p.hooks[hook] {
+			continue
+		}
+		var answer *Response
+		err := p.call(ctx, h.timeout, hook, func(L *lua.LState) ([]lua.LValue, func(lua.LValue)) {
+			table, read := requestTable(L, req)
+			return []lua.LValue{table}, func(ret lua.LValue) {
+				read()
+				if table, ok := ret.(*lua.LTable); ok {
+					answer = &Response{StatusCode: http.StatusOK, Header: make(http.Header)}
+					readResponse(table, answer, snapshot{})
+				}
+			}
+		})
+		if err != nil {
+			return nil, fmt.Errorf("plugin %s %s: %w", p.name, hook, err)
+		}
+		if answer != nil {
+			return answer, nil
+		}
+	}
+	return nil, nil
+}
+
+// Response runs each plugin's post_response hook in turn, which may change
+// resp in place
+func (h *Host) Response(ctx context.Context, req *Request, resp *Response) error {
+	for _, p := range h.plugins {
+		if !p.hooks[PostResponse] {
+			continue
+		}
+		err := p.call(ctx, h.timeout, PostResponse, func(L *lua.LState) ([]lua.LValue, func(lua.LValue)) {
+			reqTable, _ := requestTable(L, req)
+			respTable, snapshot := responseTable(L, resp)
+			return []lua.LValue{reqTable, respTable}, func(lua.LValue) {
+				readResponse(respTable, resp, snapshot)
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("plugin %s %s: %w", p.name, PostResponse, err)
+		}
+	}
+	return nil
+}
+
+// call runs hook with the arguments args builds, then hands its return
+// value back. An interpreter that errored or timed out is thrown away
+// rather than reused.
+func (p *plugin) call(ctx context.Context, timeout time.Duration, hook string, args func(*lua.LState) ([]lua.LValue, func(lua.LValue))) error {
+	L, err := p.get(timeout)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	L.SetContext(ctx)
+
+	values, done := args(L)
+	if err := L.CallByParam(lua.P{Fn: L.GetGlobal(hook), NRet: 1, Protect: true}, values...); err != nil {
+		L.Close()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("took longer than %v", timeout)
+		}
+		return err
+	}
+	done(L.Get(-1))
+	L.SetTop(0)
+	L.RemoveContext()
+	p.put(L)
+	return nil
+}
+
+func (p *plugin) get(timeout time.Duration) (*lua.LState, error) {
+	select {
+	case L := <-p.idle:
+		return L, nil
+	default:
+		return p.newState(timeout)
+	}
+}
+
+func (p *plugin) put(L *lua.LState) {
+	select {
+	case p.idle <- L:
+	default:
+		L.Close()
+	}
+}
+
+// newState makes a sandboxed interpreter with the script loaded: the base,
+// string, table and math libraries without the unsafe globals, plus log and
+// json
+func (p *plugin) newState(timeout time.Duration) (*lua.LState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true, CallStackSize: 200, RegistryMaxSize: 1 << 20})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range unsafeGlobals {
+		L.SetGlobal(name, lua.LNil)
+	}
+	L.SetGlobal("log", L.NewFunction(func(L *lua.LState) int {
+		p.logger.Printf("Plugin %s: %s", p.name, L.CheckString(1))
+		return 0
+	}))
+	L.SetGlobal("json", jsonModule(L))
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	L.SetContext(ctx)
+	L.Push(L.NewFunctionFromProto(p.proto))
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
+		L.Close()
+		return nil, err
+	}
+	L.SetTop(0)
+	L.RemoveContext()
+	return L, nil
+}
+
+// requestTable presents req to a script as
+// {method=, path=, query=, headers={}, body=}, returning a function that
+// applies the script's changes back to req
+func requestTable(L *lua.LState, req *Request) (*lua.LTable, func()) {
+	table := L.NewTable()
+	table.RawSetString("method", lua.LString(req.Method))
+	table.RawSetString("path", lua.LString(req.Path))
+	table.RawSetString("query", lua.LString(req.Query))
+	headers, snapshot := headerTable(L, req.Header)
+	table.RawSetString("headers", headers)
+	if req.Body != nil {
+		table.RawSetString("body", lua.LString(req.Body))
+	}
+
+	return table, func() {
+		if method, ok := table.RawGetString("method").(lua.LString); ok && method != "" {
+			req.Method = strings.ToUpper(string(method))
+		}
+		if path, ok := table.RawGetString("path").(lua.LString); ok && strings.HasPrefix(string(path), "/") {
+			req.Path = string(path)
+		}
+		if query, ok := table.RawGetString("query").(lua.LString); ok {
+			req.Query = string(query)
+		}
+		readHeaders(table.RawGetString("headers"), req.Header, snapshot)
+		if req.Body != nil {
+			if body, ok := table.RawGetString("body").(lua.LString); ok {
+				req.Body = []byte(body)
+			}
+		}
+	}
+}
+
+// snapshot is a response as a script was given it, to tell what it changed
+type snapshot struct {
+	headers map[string]string
+	body    string
+}
+
+// responseTable presents resp to a script as {status=, headers={}, body=}
+func responseTable(L *lua.LState, resp *Response) (*lua.LTable, snapshot) {
+	table := L.NewTable()
+	table.RawSetString("status", lua.LNumber(resp.StatusCode))
+	headers, headerSnapshot := headerTable(L, resp.Header)
+	table.RawSetString("headers", headers)
+	table.RawSetString("body", lua.LString(resp.Body))
+	return table, snapshot{headers: headerSnapshot, body: string(resp.Body)}
+}
+
+// readResponse applies a script's response table to resp
+func readResponse(table *lua.LTable, resp *Response, before snapshot) {
+	if status, ok := table.RawGetString("status").(lua.LNumber); ok && status >= 100 && status <= 599 {
+		resp.StatusCode = int(status)
+	}
+	readHeaders(table.RawGetString("headers"), resp.Header, before.headers)
+	if body, ok := table.RawGetString("body").(lua.LString); ok && string(body) != before.body {
+		resp.Body = []byte(body)
+		resp.Header.Del("Content-Length")
+	}
+}
+
+// headerTable presents headers as a table of names to values, with
+// repeated headers joined by commas
+func headerTable(L *lua.LState, header http.Header) (*lua.LTable, map[string]string) {
+	table := L.NewTable()
+	snapshot := make(map[string]string, len(header))
+	for name, values := range header {
+		value := strings.Join(values, ", ")
+		table.RawSetString(name, lua.LString(value))
+		snapshot[name] = value
+	}
+	return table, snapshot
+}
+
+// readHeaders applies the changes a script made to a header table: headers
+// it set or changed are replaced, ones it removed are deleted, and ones it
+// left alone keep all their values
+func readHeaders(value lua.LValue, header http.Header, snapshot map[string]string) {
+	table, ok := value.(*lua.LTable)
+	if !ok {
+		return
+	}
+	seen := make(map[string]bool)
+	table.ForEach(func(key, value lua.LValue) {
+		name, ok := key.(lua.LString)
+		if !ok {
+			return
+		}
+		canonical := http.CanonicalHeaderKey(string(name))
+		seen[canonical] = true
+		if before, existed := snapshot[string(name)]; !existed || lua.LVAsString(value) != before {
+			header.Set(canonical, lua.LVAsString(value))
+		}
+	})
+	for name := range snapshot {
+		if !seen[http.CanonicalHeaderKey(name)] {
+			header.Del(name)
+		}
+	}
+}
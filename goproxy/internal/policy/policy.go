@@ -0,0 +1,223 @@
+// Package policy evaluates Rego policies, embedded with OPA, to decide
+// whether a request may go through and how it should be changed on the way.
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/open-policy-agent/opa/loader"
+	"github.com/open-policy-agent/opa/rego"
+
+	"goproxyai/internal/clock"
+)
+
+// Input is what a policy sees of a request, as input
+type Input struct {
+	KeyID     string `json:"key_id"`
+	Tenant    string `json:"tenant,omitempty"`
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Model     string `json:"model,omitempty"`
+	User      string `json:"user,omitempty"`
+	MaxTokens int    `json:"max_tokens,omitempty"` // max_tokens or max_completion_tokens
+	Stream    bool   `json:"stream"`
+	Time      Time   `json:"time"`
+}
+
+// Time is when the request arrived, in the configured time zone, so
+// policies can decide by time of day, date, and the schedules active then
+type Time struct {
+	RFC3339   string   `json:"rfc3339"`
+	Date      string   `json:"date"`
+	Hour      int      `json:"hour"`
+	Minute    int      `json:"minute"`
+	Weekday   string   `json:"weekday"`
+	Timezone  string   `json:"timezone"`
+	Schedules []string `json:"schedules"`
+}
+
+// NewTime describes t for a policy, with which of schedules are active
+func NewTime(t time.Time, schedules Schedules) Time {
+	return Time{
+		RFC3339:   t.Format(time.RFC3339),
+		Date:      t.Format("2006-01-02"),
+		Hour:      t.Hour(),
+		Minute:    t.Minute(),
+		Weekday:   t.Weekday().String(),
+		Timezone:  t.Location().String(),
+		Schedules: schedules.Active(t),
+	}
+}
+
+// Decision is what the policy decided. Besides allowing or denying, an
+// allowed request can be transformed: Set replaces top-level fields of the
+// request body, and Headers are added when it's forwarded upstream.
+// RateLimit holds the key to that many requests a minute while the policy
+// says so, and RetryAfter tells a denied client when to come back, such as
+// at the end of a maintenance window.
+type Decision struct {
+	Allow      bool                   `json:"allow"`
+	Status     int                    `json:"status,omitempty"`
+	Reason     string                 `json:"reason,omitempty"`
+	RetryAfter int                    `json:"retry_after,omitempty"` // seconds
+	RateLimit  int                    `json:"rate_limit,omitempty"`  // requests per minute
+	Headers    map[string]string      `json:"headers,omitempty"`
+	Set        map[string]interface{} `json:"set,omitempty"`
+}
+
+// Status describes the policy in force
+type Status struct {
+	Bundle   string    `json:"bundle"`
+	Query    string    `json:"query"`
+	Revision string    `json:"revision,omitempty"`
+	LoadedAt time.Time `json:"loaded_at"`
+}
+
+// Engine holds the prepared policy, swapped whole when the bundle is
+// reloaded so evaluations never see half of one
+type Engine struct {
+	path  string
+	query string
+
+	mutex       sync.RWMutex
+	prepared    rego.PreparedEvalQuery
+	revision    string
+	loadedAt    time.Time
+	fingerprint string
+}
+
+// Load reads the bundle at path, a directory of .rego and data files or a
+// .tar.gz bundle, and prepares query against it
+func Load(path, query string) (*Engine, error) {
+	engine := &Engine{path: path, query: query}
+	if err := engine.Reload(context.Background()); err != nil {
+		return nil, err
+	}
+	return engine, nil
+}
+
+// Reload reads the bundle again. If it no longer compiles the policy in
+// force is kept and the error returned.
+func (e *Engine) Reload(ctx context.Context) error {
+	fingerprint, err := fingerprint(e.path)
+	if err != nil {
+		return err
+	}
+	bundle, err := loader.NewFileLoader().AsBundle(e.path)
+	if err != nil {
+		return err
+	}
+	prepared, err := rego.New(
+		rego.Query(e.query),
+		rego.ParsedBundle("policy", bundle),
+	).PrepareForEval(ctx)
+	if err != nil {
+		return err
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.prepared = prepared
+	e.revision = bundle.Manifest.Revision
+	e.loadedAt = clock.Now()
+	e.fingerprint = fingerprint
+	return nil
+}
+
+// Watch reloads the bundle every interval when its files have changed,
+// logging a bundle that fails to load and carrying on with the old one
+func (e *Engine) Watch(interval time.Duration, logger *log.Logger) {
+	go func() {
+		for range time.Tick(interval) {
+			current, err := fingerprint(e.path)
+			if err != nil {
+				logger.Printf("Error checking policy bundle %s: %v", e.path, err)
+				continue
+			}
+			e.mutex.RLock()
+			changed := current != e.fingerprint
+			e.mutex.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := e.Reload(context.Background()); err != nil {
+				logger.Printf("Policy bundle %s changed but failed to load, keeping the previous one: %v", e.path, err)
+				continue
+			}
+			logger.Printf("Reloaded policy bundle %s", e.path)
+		}
+	}()
+}
+
+// Status describes the policy in force
+func (e *Engine) Status() Status {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return Status{Bundle: e.path, Query: e.query, Revision: e.revision, LoadedAt: e.loadedAt}
+}
+
+// Evaluate runs the policy on input. The query may give a boolean, or an
+// object read as a Decision; when it's undefined the request is denied.
+func (e *Engine) Evaluate(ctx context.Context, input Input) (Decision, error) {
+	e.mutex.RLock()
+	prepared := e.prepared
+	e.mutex.RUnlock()
+
+	results, err := prepared.Eval(ctx, rego.EvalInput(input))
+	if err != nil {
+		return Decision{}, err
+	}
+	if len(results) == 0 || len(results[0].Expressions) == 0 {
+		return Decision{}, nil
+	}
+
+	switch value := results[0].Expressions[0].Value.(type) {
+	case bool:
+		return Decision{Allow: value}, nil
+	case map[string]interface{}:
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return Decision{}, err
+		}
+		var decision Decision
+		if err := json.Unmarshal(encoded, &decision); err != nil {
+			return Decision{}, fmt.Errorf("invalid policy decision: %w", err)
+		}
+		return decision, nil
+	default:
+		return Decision{}, fmt.Errorf("policy query %s gave %T, expected a boolean or an object", e.query, value)
+	}
+}
+
+// fingerprint summarises the names, sizes and modification times of the
+// bundle's files, to tell when it has changed
+func fingerprint(path string) (string, error) {
+	var summary []byte
+	err := filepath.WalkDir(path, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		summary = fmt.Appendf(summary, "%s\x00%d\x00%d\n", name, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("policy bundle %s not found", path)
+	}
+	return string(summary), err
+}
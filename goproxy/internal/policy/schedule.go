@@ -0,0 +1,162 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Schedules are named windows of time, such as business hours, nights and
+// weekends or a maintenance window, that policies see as active or not
+type Schedules map[string]Schedule
+
+// Schedule is the windows a schedule is active in, any of which will do
+type Schedule []Window
+
+// Window is a span of the day on some days. With neither days nor dates it
+// applies every day; with no times, all of the day. A window whose to is
+// before its from runs past midnight into the next day.
+type Window struct {
+	Days  []string `json:"days,omitempty"`  // weekdays, e.g. "monday" or "mon"
+	Dates []string `json:"dates,omitempty"` // 2026-12-24, or 12-25 for every year
+	From  string   `json:"from,omitempty"`  // 09:00
+	To    string   `json:"to,omitempty"`    // 18:00
+
+	days     map[time.Weekday]bool
+	dates    map[string]bool
+	from, to time.Duration
+}
+
+// UnmarshalJSON takes one window or a list of them
+func (s *Schedule) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		var window Window
+		if err := json.Unmarshal(data, &window); err != nil {
+			return err
+		}
+		*s = Schedule{window}
+		return nil
+	}
+	var windows []Window
+	if err := json.Unmarshal(data, &windows); err != nil {
+		return err
+	}
+	*s = windows
+	return nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday": time.Sunday, "monday": time.Monday, "tuesday": time.Tuesday, "wednesday": time.Wednesday,
+	"thursday": time.Thursday, "friday": time.Friday, "saturday": time.Saturday,
+}
+
+// LoadSchedules reads the schedules in file, a JSON object of schedules by
+// name, or none when file is empty
+func LoadSchedules(file string) (Schedules, error) {
+	if file == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var schedules Schedules
+	if err := json.Unmarshal(data, &schedules); err != nil {
+		return nil, err
+	}
+	for name, schedule := range schedules {
+		if len(schedule) == 0 {
+			return nil, fmt.Errorf("schedule %q has no windows", name)
+		}
+		for i := range schedule {
+			if err := schedule[i].parse(); err != nil {
+				return nil, fmt.Errorf("schedule %q: %w", name, err)
+			}
+		}
+	}
+	return schedules, nil
+}
+
+func (w *Window) parse() error {
+	w.days = make(map[time.Weekday]bool)
+	for _, day := range w.Days {
+		found := false
+		for name, weekday := range weekdays {
+			if len(day) >= 3 && strings.HasPrefix(name, strings.ToLower(day)) {
+				w.days[weekday], found = true, true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown day %q", day)
+		}
+	}
+	w.dates = make(map[string]bool)
+	for _, date := range w.Dates {
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			if _, err := time.Parse("01-02", date); err != nil {
+				return fmt.Errorf("invalid date %q, expected 2006-01-02 or 01-02", date)
+			}
+		}
+		w.dates[date] = true
+	}
+	var err error
+	if w.from, err = timeOfDay(w.From, 0); err != nil {
+		return err
+	}
+	if w.to, err = timeOfDay(w.To, 24*time.Hour); err != nil {
+		return err
+	}
+	if w.from == w.to {
+		return fmt.Errorf("window from %s to %s is empty", w.From, w.To)
+	}
+	return nil
+}
+
+// timeOfDay parses 15:04 as the time since midnight
+func timeOfDay(value string, unset time.Duration) (time.Duration, error) {
+	if value == "" {
+		return unset, nil
+	}
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected 15:04", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Active names the schedules active at t, in name order
+func (s Schedules) Active(t time.Time) []string {
+	active := []string{}
+	for name, schedule := range s {
+		for _, window := range schedule {
+			if window.contains(t) {
+				active = append(active, name)
+				break
+			}
+		}
+	}
+	sort.Strings(active)
+	return active
+}
+
+func (w *Window) contains(t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	since := t.Sub(midnight)
+	if w.from < w.to {
+		return w.on(midnight) && since >= w.from && since < w.to
+	}
+	// Past midnight, the window belongs to the day it started on
+	return w.on(midnight) && since >= w.from || w.on(midnight.AddDate(0, 0, -1)) && since < w.to
+}
+
+// on reports whether the window applies on day
+func (w *Window) on(day time.Time) bool {
+	if len(w.days) == 0 && len(w.dates) == 0 {
+		return true
+	}
+	return w.days[day.Weekday()] || w.dates[day.Format("2006-01-02")] || w.dates[day.Format("01-02")]
+}
@@ -0,0 +1,268 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"goproxyai/internal/encryption"
+)
+
+// Response headers that describe one particular exchange and would be
+// wrong, or leak something, when replayed
+var unrecordedHeaders = []string{"Set-Cookie", "Date", "Content-Length", "Content-Encoding"}
+
+// Cassette is one recorded upstream exchange. Bodies are kept as text when
+// they're valid UTF-8, so cassettes can be read and diffed, and as base64
+// otherwise.
+type Cassette struct {
+	Request struct {
+		Method     string `json:"method"`
+		Path       string `json:"path"`
+		Body       string `json:"body,omitempty"`
+		BodyBase64 []byte `json:"body_base64,omitempty"`
+	} `json:"request"`
+	Response struct {
+		StatusCode int         `json:"status_code"`
+		Headers    http.Header `json:"headers"`
+		Body       string      `json:"body,omitempty"`
+		BodyBase64 []byte      `json:"body_base64,omitempty"`
+	} `json:"response"`
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+// CassetteTransport records upstream exchanges to cassette files, or
+// replays them without contacting upstream. Requests are matched by a hash
+// of their method, path, query and body, with JSON bodies compared
+// regardless of key order and whitespace; headers, including the API key,
+// play no part and are never written to disk.
+type CassetteTransport struct {
+	dir    string
+	base   http.RoundTripper // nil when replaying
+	logger *log.Logger
+	sealer *encryption.Sealer
+}
+
+// NewRecordingTransport sends requests on through base and writes each
+// complete response to dir, encrypted with sealer when it's set
+func NewRecordingTransport(dir string, base http.RoundTripper, logger *log.Logger, sealer *encryption.Sealer) (*CassetteTransport, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &CassetteTransport{dir: dir, base: base, logger: logger, sealer: sealer}, nil
+}
+
+// NewReplayTransport answers requests from the cassettes in dir, decrypting
+// them with sealer when they're encrypted
+func NewReplayTransport(dir string, sealer *encryption.Sealer) (*CassetteTransport, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &CassetteTransport{dir: dir, sealer: sealer}, nil
+}
+
+func (t *CassetteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	path := req.URL.Path
+	if req.URL.RawQuery != "" {
+		path += "?" + req.URL.RawQuery
+	}
+	file := filepath.Join(t.dir, cassetteName(req.Method, path, body))
+
+	if t.base == nil {
+		return t.replay(req, file, path)
+	}
+
+	// The body has been read for hashing; hand the base transport a copy
+	outgoing := req.Clone(req.Context())
+	outgoing.Body = io.NopCloser(bytes.NewReader(body))
+	outgoing.ContentLength = int64(len(body))
+	resp, err := t.base.RoundTrip(outgoing)
+	if err != nil {
+		return nil, err
+	}
+
+	cassette := &Cassette{RecordedAt: time.Now().UTC()}
+	cassette.Request.Method = req.Method
+	cassette.Request.Path = path
+	cassette.Request.Body, cassette.Request.BodyBase64 = splitBody(body)
+	cassette.Response.StatusCode = resp.StatusCode
+	cassette.Response.Headers = resp.Header.Clone()
+	for _, header := range unrecordedHeaders {
+		cassette.Response.Headers.Del(header)
+	}
+
+	resp.Body = &recordingBody{ReadCloser: resp.Body, save: func(data []byte) {
+		cassette.Response.Body, cassette.Response.BodyBase64 = splitBody(data)
+		if err := writeCassette(file, cassette, t.sealer); err != nil {
+			// The client still gets its response; only the recording is lost
+			t.logger.Printf("Failed to record cassette %s: %v", file, err)
+		}
+	}}
+	return resp, nil
+}
+
+// Purge deletes the cassettes recorded before before, returning how many
+// it deleted
+func (t *CassetteTransport) Purge(before time.Time) (int, error) {
+	entries, err := os.ReadDir(t.dir)
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(before) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(t.dir, entry.Name())); err != nil && !os.IsNotExist(err) {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+func (t *CassetteTransport) replay(req *http.Request, file, path string) (*http.Response, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return mockError(req, http.StatusNotFound, fmt.Sprintf("No cassette recorded for %s %s (%s)", req.Method, path, filepath.Base(file)), "cassette_not_found"), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if data, err = t.sealer.Open(data); err != nil {
+		return nil, fmt.Errorf("cassette %s: %w", file, err)
+	}
+	var cassette Cassette
+	if err := json.Unmarshal(data, &cassette); err != nil {
+		return nil, fmt.Errorf("parse cassette %s: %w", file, err)
+	}
+
+	body := []byte(cassette.Response.Body)
+	if cassette.Response.BodyBase64 != nil {
+		body = cassette.Response.BodyBase64
+	}
+	resp := mockResponse(req, cassette.Response.StatusCode, "", io.NopCloser(bytes.NewReader(body)), int64(len(body)))
+	resp.Header = cassette.Response.Headers.Clone()
+	if resp.Header == nil {
+		resp.Header = http.Header{}
+	}
+	resp.Header.Set("X-Cassette", filepath.Base(file))
+	return resp, nil
+}
+
+// cassetteName names the cassette for a request: readable enough to find
+// by endpoint, with a hash that tells requests to it apart
+func cassetteName(method, path string, body []byte) string {
+	digest := sha256.New()
+	writeKeyPart(digest, method)
+	writeKeyPart(digest, path)
+	digest.Write(canonicalBody(body))
+
+	endpoint, _, _ := strings.Cut(strings.Trim(path, "/"), "?")
+	endpoint = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return '_'
+	}, endpoint)
+	return fmt.Sprintf("%s_%s_%s.json", method, endpoint, hex.EncodeToString(digest.Sum(nil))[:16])
+}
+
+func writeKeyPart(w io.Writer, part string) {
+	fmt.Fprintf(w, "%d:%s", len(part), part)
+}
+
+// canonicalBody re-encodes a JSON body so that key order and whitespace
+// don't change its hash; other bodies are used as they are
+func canonicalBody(body []byte) []byte {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil || decoder.More() {
+		return body
+	}
+	canonical, err := json.Marshal(value)
+	if err != nil {
+		return body
+	}
+	return canonical
+}
+
+func splitBody(body []byte) (string, []byte) {
+	if utf8.Valid(body) {
+		return string(body), nil
+	}
+	return "", body
+}
+
+func writeCassette(file string, cassette *Cassette, sealer *encryption.Sealer) error {
+	data, err := json.MarshalIndent(cassette, "", "  ")
+	if err != nil {
+		return err
+	}
+	if data, err = sealer.Seal(append(data, '\n')); err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(file), ".cassette-*")
+	if err != nil {
+		return err
+	}
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	return os.Rename(temp.Name(), file)
+}
+
+// recordingBody keeps a copy of everything read from a response body and
+// saves it once the body has been read to the end. Responses the client
+// abandons halfway aren't recorded.
+type recordingBody struct {
+	io.ReadCloser
+	buffer bytes.Buffer
+	save   func([]byte)
+	saved  bool
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buffer.Write(p[:n])
+	if err == io.EOF && !b.saved {
+		b.saved = true
+		b.save(b.buffer.Bytes())
+	}
+	return n, err
+}
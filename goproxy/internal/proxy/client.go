@@ -3,46 +3,117 @@ package proxy
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"goproxyai/internal/dryrun"
 )
 
+// ErrResponseTooLarge is returned when an upstream body outgrows the
+// response size limit
+var ErrResponseTooLarge = errors.New("upstream response exceeds the size limit")
+
+// ErrShuttingDown is returned for requests that hadn't gone upstream when
+// the proxy began shutting down
+var ErrShuttingDown = errors.New("proxy is shutting down")
+
 type Client struct {
 	httpClient   *http.Client
+	streamClient *http.Client
 	proxyURL     string
 	openAIAPIURL string
 	timeout      time.Duration
+
+	// maxResponseBytes bounds bodies read into memory by Forward, 0 means
+	// unlimited
+	maxResponseBytes int64
+
+	// limiter, when set, bounds the requests in flight upstream
+	limiter *ConcurrencyLimiter
+
+	connections *ConnectionStats
+
+	// draining is set once the proxy is shutting down
+	draining atomic.Bool
 }
 
-func NewClient(proxyURL, openAIAPIURL string, timeout time.Duration) *Client {
+// NewClient makes a client for the upstream at openAIAPIURL. tlsConfig,
+// when set, is how connections to it are verified and authenticated.
+func NewClient(proxyURL, openAIAPIURL string, timeout time.Duration, maxResponseBytes int64, limiter *ConcurrencyLimiter, tlsConfig *tls.Config) *Client {
 	client := &http.Client{
 		Timeout: timeout,
 	}
 
 	// Configure proxy if provided
+	var transport *http.Transport
 	if proxyURL != "" {
 		if proxyURLParsed, err := url.Parse(proxyURL); err == nil {
-			client.Transport = &http.Transport{
+			transport = &http.Transport{
 				Proxy: http.ProxyURL(proxyURLParsed),
 			}
 		}
 	}
+	if tlsConfig != nil {
+		if transport == nil {
+			transport = http.DefaultTransport.(*http.Transport).Clone()
+		}
+		transport.TLSClientConfig = tlsConfig.Clone()
+	}
+	if transport != nil {
+		client.Transport = transport
+	}
+
+	// Streams can legitimately outlive the request timeout, so their client
+	// has none and the caller's context bounds the exchange instead
+	streamClient := &http.Client{
+		Transport: client.Transport,
+	}
 
 	return &Client{
-		httpClient:   client,
-		proxyURL:     proxyURL,
-		openAIAPIURL: openAIAPIURL,
-		timeout:      timeout,
+		httpClient:       client,
+		streamClient:     streamClient,
+		proxyURL:         proxyURL,
+		openAIAPIURL:     openAIAPIURL,
+		timeout:          timeout,
+		maxResponseBytes: maxResponseBytes,
+		limiter:          limiter,
+		connections:      NewConnectionStats(),
 	}
 }
 
+// Transport returns the transport requests are sent upstream with
+func (c *Client) Transport() http.RoundTripper {
+	if c.httpClient.Transport == nil {
+		return http.DefaultTransport
+	}
+	return c.httpClient.Transport
+}
+
+// SetTransport replaces the transport requests are sent upstream with, e.g.
+// to answer them locally or record them
+func (c *Client) SetTransport(transport http.RoundTripper) {
+	c.httpClient.Transport = transport
+	c.streamClient.Transport = transport
+}
+
 type ProxyRequest struct {
 	Method  string
 	Path    string
-	Headers map[string]string
+	Query   string // raw query string, without the "?"
+	Headers http.Header
 	Body    []byte
+
+	// BodyStream, when set, is sent instead of Body without buffering it,
+	// e.g. for large multipart uploads. ContentLength is -1 if unknown.
+	BodyStream    io.Reader
+	ContentLength int64
 }
 
 type ProxyResponse struct {
@@ -51,42 +122,263 @@ type ProxyResponse struct {
 	Body       []byte
 }
 
+// StreamResponse is an upstream response whose body hasn't been read yet.
+// The caller must close Body.
+type StreamResponse struct {
+	StatusCode    int
+	Headers       map[string][]string
+	ContentLength int64
+	Body          io.ReadCloser
+}
+
+// Forward sends the request upstream and reads the whole response body,
+// failing with ErrResponseTooLarge rather than buffering past the limit
 func (c *Client) Forward(ctx context.Context, req *ProxyRequest) (*ProxyResponse, error) {
+	resp, err := c.do(ctx, c.httpClient, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if c.maxResponseBytes > 0 && resp.ContentLength > c.maxResponseBytes {
+		return nil, ErrResponseTooLarge
+	}
+	reading := time.Now()
+	respBody, err := io.ReadAll(LimitBody(resp.Body, c.maxResponseBytes))
+	timingFrom(ctx).add(time.Since(reading), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ProxyResponse{
+		StatusCode: resp.StatusCode,
+		Headers:    resp.Headers,
+		Body:       respBody,
+	}, nil
+}
+
+// Stream sends the request upstream and returns as soon as the response
+// headers arrive, leaving the body to be consumed by the caller. Unlike
+// Forward it applies no timeout of its own.
+func (c *Client) Stream(ctx context.Context, req *ProxyRequest) (*StreamResponse, error) {
+	return c.do(ctx, c.streamClient, req)
+}
+
+type upstreamKey struct{}
+
+// WithUpstream makes requests sent with ctx go to baseURL instead of the
+// client's upstream, e.g. for a request that asked for a named upstream
+func WithUpstream(ctx context.Context, baseURL string) context.Context {
+	return context.WithValue(ctx, upstreamKey{}, baseURL)
+}
+
+// Upstream returns the upstream WithUpstream made ctx go to, if any
+func Upstream(ctx context.Context) (string, bool) {
+	baseURL, ok := ctx.Value(upstreamKey{}).(string)
+	return baseURL, ok
+}
+
+type timingKey struct{}
+
+// Timing adds up how long the upstream exchanges of a context took, each
+// from sending the request until its response headers arrived, or its
+// whole body for Forward. Time queued for a concurrency slot isn't counted.
+type Timing struct {
+	mutex    sync.Mutex
+	total    time.Duration
+	requests int
+}
+
+// WithTiming makes requests sent with ctx add their time to the Timing
+// returned
+func WithTiming(ctx context.Context) (context.Context, *Timing) {
+	timing := &Timing{}
+	return context.WithValue(ctx, timingKey{}, timing), timing
+}
+
+func timingFrom(ctx context.Context) *Timing {
+	timing, _ := ctx.Value(timingKey{}).(*Timing)
+	return timing
+}
+
+func (t *Timing) add(took time.Duration, requests int) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.total += took
+	t.requests += requests
+}
+
+// Total returns the time spent on upstream and how many requests it was
+// spent on
+func (t *Timing) Total() (time.Duration, int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.total, t.requests
+}
+
+type forwardedKey struct{}
+
+// TrackForwarded marks ctx so that once a request sent with it has gone
+// upstream, the ones sent after it, such as retries and server tool rounds,
+// still go out while the client drains
+func TrackForwarded(ctx context.Context) context.Context {
+	return context.WithValue(ctx, forwardedKey{}, new(atomic.Bool))
+}
+
+// Drain refuses the requests sent from now on with ErrShuttingDown, and
+// those queued for a concurrency slot, so only the ones already upstream
+// are answered. Requests whose context has gone upstream before are still
+// sent, unless they have to queue.
+func (c *Client) Drain() {
+	c.draining.Store(true)
+	if c.limiter != nil {
+		c.limiter.Drain()
+	}
+}
+
+func (c *Client) do(ctx context.Context, client *http.Client, req *ProxyRequest) (*StreamResponse, error) {
 	targetURL := c.openAIAPIURL + req.Path
+	if baseURL, ok := Upstream(ctx); ok {
+		targetURL = baseURL + req.Path
+	}
+	if req.Query != "" {
+		targetURL += "?" + req.Query
+	}
 
 	var bodyReader io.Reader
-	if len(req.Body) > 0 {
+	if req.BodyStream != nil {
+		bodyReader = req.BodyStream
+	} else if len(req.Body) > 0 {
 		bodyReader = bytes.NewReader(req.Body)
 	}
 
-	httpReq, err := http.NewRequestWithContext(ctx, req.Method, targetURL, bodyReader)
+	traceCtx, traced := c.connections.trace(ctx)
+	defer traced()
+	httpReq, err := http.NewRequestWithContext(traceCtx, req.Method, targetURL, bodyReader)
 	if err != nil {
 		return nil, err
 	}
+	if req.BodyStream != nil {
+		httpReq.ContentLength = req.ContentLength
+	}
 
-	for key, value := range req.Headers {
-		httpReq.Header.Set(key, value)
+	if req.Headers != nil {
+		httpReq.Header = req.Headers.Clone()
 	}
+	RemoveHopByHop(httpReq.Header)
+	// Leave encoding to the transport, which asks for gzip and decompresses
+	// it, so the proxy always sees identity bodies it can parse and cache.
+	// Responses are compressed for clients separately.
+	httpReq.Header.Del("Accept-Encoding")
 
-	resp, err := c.httpClient.Do(httpReq)
-	if err != nil {
-		return nil, err
+	if t := dryrun.From(ctx); t != nil {
+		bodyBytes := len(req.Body)
+		if req.BodyStream != nil {
+			bodyBytes = int(req.ContentLength)
+		}
+		t.Send(req.Method, targetURL, httpReq.Header, bodyBytes)
+		return nil, dryrun.ErrDryRun
 	}
-	defer resp.Body.Close()
 
-	respBody, err := io.ReadAll(resp.Body)
+	forwarded, _ := ctx.Value(forwardedKey{}).(*atomic.Bool)
+	if c.draining.Load() && (forwarded == nil || !forwarded.Load()) {
+		return nil, ErrShuttingDown
+	}
+	var slot *Slot
+	if c.limiter != nil {
+		if slot, err = c.limiter.Acquire(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if forwarded != nil {
+		forwarded.Store(true)
+	}
+	sent := time.Now()
+	resp, err := client.Do(httpReq)
+	timingFrom(ctx).add(time.Since(sent), 1)
+	if slot != nil {
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		// How long upstream takes to answer is what tells how it's coping,
+		// but the request is in flight until its body has been read
+		slot.Report(status, err)
+	}
 	if err != nil {
+		slot.Release()
 		return nil, err
 	}
-
-	headers := make(map[string][]string)
-	for key, values := range resp.Header {
-		headers[key] = values
+	if err := decodeBody(resp); err != nil {
+		resp.Body.Close()
+		slot.Release()
+		return nil, fmt.Errorf("decode %s response: %w", resp.Header.Get("Content-Encoding"), err)
+	}
+	if slot != nil {
+		resp.Body = &slotBody{ReadCloser: resp.Body, slot: slot}
 	}
 
-	return &ProxyResponse{
-		StatusCode: resp.StatusCode,
-		Headers:    headers,
-		Body:       respBody,
+	headers := resp.Header.Clone()
+	RemoveHopByHop(headers)
+	AddVia(headers, resp.ProtoMajor, resp.ProtoMinor)
+
+	return &StreamResponse{
+		StatusCode:    resp.StatusCode,
+		Headers:       headers,
+		ContentLength: resp.ContentLength,
+		Body:          resp.Body,
 	}, nil
 }
+
+// slotBody frees its request's concurrency slot once it's closed
+type slotBody struct {
+	io.ReadCloser
+	slot *Slot
+}
+
+func (b *slotBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.slot.Release()
+	return err
+}
+
+// ConnectionStats reports how upstream connections have been dialed and
+// reused
+func (c *Client) ConnectionStats() map[string]interface{} {
+	return c.connections.Stats()
+}
+
+// LimitBody returns a reader that fails with ErrResponseTooLarge once more
+// than limit bytes have been read from r. A limit of 0 means unlimited.
+func LimitBody(r io.Reader, limit int64) io.Reader {
+	if limit <= 0 {
+		return r
+	}
+	return &limitedBody{r: r, remaining: limit}
+}
+
+type limitedBody struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		// Only an error if there's actually more to come
+		var probe [1]byte
+		n, err := l.r.Read(probe[:])
+		if n > 0 {
+			return 0, ErrResponseTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,225 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrOverloaded is returned when the adaptive concurrency limit is reached
+// and no upstream slot frees up within the queue timeout
+var ErrOverloaded = errors.New("upstream concurrency limit reached")
+
+// Fraction of the limit kept after a sign of upstream congestion
+const backoffRatio = 0.9
+
+// ConcurrencyLimiter bounds in-flight upstream requests with an AIMD limit.
+// The limit grows by one for every limit's worth of quick, successful
+// responses while it's actually in use, and shrinks by a tenth on 429s, 5xx,
+// failed requests and responses slower than the latency target, as timed
+// to their headers. A request's slot is held until its response body is
+// closed, so streams count against the limit for as long as they run.
+type ConcurrencyLimiter struct {
+	mutex         sync.Mutex
+	limit         float64
+	min           float64
+	max           float64
+	latencyTarget time.Duration
+	queueTimeout  time.Duration
+	inFlight      int
+	waiters       []chan struct{}
+	drained       chan struct{} // closed once the proxy is shutting down
+
+	// Every decrease starts a new epoch; responses to requests sent in an
+	// earlier epoch reflect the old limit and don't shrink it again
+	epoch uint64
+
+	requests   int64
+	drops      int64
+	rejections int64
+}
+
+func NewConcurrencyLimiter(min, max int, latencyTarget, queueTimeout time.Duration) *ConcurrencyLimiter {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	return &ConcurrencyLimiter{
+		limit:         float64(min),
+		min:           float64(min),
+		max:           float64(max),
+		latencyTarget: latencyTarget,
+		queueTimeout:  queueTimeout,
+		drained:       make(chan struct{}),
+	}
+}
+
+// Slot is a request's place under the limit. Report tells the limit how the
+// request went and Release frees the place; each only counts once, and both
+// do nothing on a nil Slot.
+type Slot struct {
+	limiter  *ConcurrencyLimiter
+	epoch    uint64
+	started  time.Time
+	reported sync.Once
+	released sync.Once
+}
+
+// Acquire waits for an upstream slot. It fails with ErrOverloaded when no
+// slot frees up within the queue timeout, and with ErrShuttingDown when the
+// limiter is drained while it waits.
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context) (*Slot, error) {
+	l.mutex.Lock()
+	l.requests++
+	if l.inFlight < l.current() {
+		l.inFlight++
+		slot := l.slot(l.epoch)
+		l.mutex.Unlock()
+		return slot, nil
+	}
+	if l.queueTimeout <= 0 {
+		l.rejections++
+		l.mutex.Unlock()
+		return nil, ErrOverloaded
+	}
+	ready := make(chan struct{})
+	l.waiters = append(l.waiters, ready)
+	l.mutex.Unlock()
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-ready:
+	case <-timer.C:
+		err = ErrOverloaded
+	case <-l.drained:
+		err = ErrShuttingDown
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err != nil {
+		if l.removeWaiter(ready) {
+			if err == ErrOverloaded {
+				l.rejections++
+			}
+			return nil, err
+		}
+		// The slot was handed over just as the wait ended; pass it on
+		l.inFlight--
+		l.wake()
+		return nil, err
+	}
+	return l.slot(l.epoch), nil
+}
+
+// Drain fails the requests queued for a slot with ErrShuttingDown, and
+// those that would queue from now on
+func (l *ConcurrencyLimiter) Drain() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	select {
+	case <-l.drained:
+	default:
+		close(l.drained)
+	}
+}
+
+func (l *ConcurrencyLimiter) slot(epoch uint64) *Slot {
+	return &Slot{limiter: l, epoch: epoch, started: time.Now()}
+}
+
+// Report adjusts the limit by the request's outcome, timed from when the
+// slot was acquired
+func (s *Slot) Report(status int, err error) {
+	if s == nil {
+		return
+	}
+	s.reported.Do(func() { s.limiter.report(s.epoch, time.Since(s.started), status, err) })
+}
+
+// Release frees the slot for the next request
+func (s *Slot) Release() {
+	if s == nil {
+		return
+	}
+	s.released.Do(s.limiter.release)
+}
+
+func (l *ConcurrencyLimiter) report(epoch uint64, latency time.Duration, status int, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		// The client went away, which says nothing about upstream
+	case err != nil, status == http.StatusTooManyRequests, status >= 500,
+		l.latencyTarget > 0 && latency > l.latencyTarget:
+		l.drops++
+		if epoch == l.epoch {
+			l.epoch++
+			l.limit = math.Max(l.min, l.limit*backoffRatio)
+		}
+	case float64(l.inFlight) >= l.limit/2:
+		// Only grow while the limit is what's holding traffic back
+		l.limit = math.Min(l.max, l.limit+1/l.limit)
+	}
+	l.wake()
+}
+
+func (l *ConcurrencyLimiter) release() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.inFlight--
+	l.wake()
+}
+
+// wake hands free slots to queued requests in arrival order
+func (l *ConcurrencyLimiter) wake() {
+	for len(l.waiters) > 0 && l.inFlight < l.current() {
+		l.inFlight++
+		close(l.waiters[0])
+		l.waiters = l.waiters[1:]
+	}
+}
+
+func (l *ConcurrencyLimiter) removeWaiter(ready chan struct{}) bool {
+	for i, waiter := range l.waiters {
+		if waiter == ready {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (l *ConcurrencyLimiter) current() int {
+	return int(l.limit)
+}
+
+// Stats reports the current limit and how it has been applied
+func (l *ConcurrencyLimiter) Stats() map[string]interface{} {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return map[string]interface{}{
+		"limit":          l.current(),
+		"min":            int(l.min),
+		"max":            int(l.max),
+		"in_flight":      l.inFlight,
+		"queued":         len(l.waiters),
+		"requests":       l.requests,
+		"drops":          l.drops,
+		"rejections":     l.rejections,
+		"latency_target": l.latencyTarget.String(),
+	}
+}
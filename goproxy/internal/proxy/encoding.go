@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// decodeBody undoes a Content-Encoding the transport left in place, as it
+// does for anything but the gzip it asked for itself, so the proxy only
+// ever relays and caches identity bodies. Encodings it can't decode are
+// left as they are, header included.
+func decodeBody(resp *http.Response) error {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	var body io.Reader
+	switch encoding {
+	case "", "identity":
+		resp.Header.Del("Content-Encoding")
+		return nil
+	case "gzip", "x-gzip":
+		decoder, err := gzip.NewReader(resp.Body)
+		if err == io.EOF {
+			// An empty body, as a HEAD or 204 has, whatever the header says
+			body = http.NoBody
+			break
+		}
+		if err != nil {
+			return err
+		}
+		body = decoder
+	case "deflate":
+		// Servers disagree on whether deflate means zlib-wrapped or raw, so
+		// the zlib header is looked for first
+		buffered := bufio.NewReader(resp.Body)
+		if header, err := buffered.Peek(2); err == nil && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 && header[0]&0x0f == 8 {
+			decoder, err := zlib.NewReader(buffered)
+			if err != nil {
+				return err
+			}
+			body = decoder
+		} else {
+			body = flate.NewReader(buffered)
+		}
+	case "br":
+		body = brotli.NewReader(resp.Body)
+	default:
+		return nil
+	}
+
+	resp.Body = &decodedBody{Reader: body, raw: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+// decodedBody reads through a decoder and closes the body beneath it
+type decodedBody struct {
+	io.Reader
+	raw io.ReadCloser
+}
+
+func (b *decodedBody) Close() error {
+	if closer, ok := b.Reader.(io.Closer); ok {
+		closer.Close()
+	}
+	return b.raw.Close()
+}
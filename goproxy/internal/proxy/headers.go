@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Pseudonym the proxy identifies itself with in Via headers
+const viaPseudonym = "goproxyai"
+
+// Hop-by-hop headers from RFC 7230 section 6.1 and their common
+// predecessors. They describe a single connection, so they're never
+// forwarded.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// RemoveHopByHop deletes hop-by-hop headers, including any the Connection
+// header names
+func RemoveHopByHop(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+// AddVia records the proxy as an intermediary for a message received over
+// the given HTTP version
+func AddVia(header http.Header, protoMajor, protoMinor int) {
+	version := strconv.Itoa(protoMajor)
+	if protoMajor < 2 {
+		version += "." + strconv.Itoa(protoMinor)
+	}
+	header.Add("Via", version+" "+viaPseudonym)
+}
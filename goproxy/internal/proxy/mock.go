@@ -0,0 +1,423 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"goproxyai/internal/openai"
+)
+
+const (
+	defaultMockContent    = "This is a mock response."
+	defaultMockDimensions = 1536
+)
+
+var defaultMockModels = []string{"gpt-4o", "gpt-4o-mini", "text-embedding-3-small", "text-embedding-3-large"}
+
+// MockRule is a canned response for requests it matches. Empty fields match
+// anything; the first matching rule in the file wins.
+type MockRule struct {
+	Path     string `json:"path"`
+	Model    string `json:"model"`
+	Contains string `json:"contains"` // substring of the request's text
+
+	Content string `json:"content"`
+	Status  int    `json:"status"` // an error status answers with an OpenAI style error
+	Error   string `json:"error"`
+	Latency string `json:"latency"`
+
+	latency time.Duration
+}
+
+type mockFile struct {
+	Content string     `json:"content"`
+	Models  []string   `json:"models"`
+	Rules   []MockRule `json:"rules"`
+}
+
+// MockTransport answers upstream requests itself with canned chat,
+// completion, embedding, moderation and model list responses, so the proxy
+// runs with no network egress, no API key and no cost. Everything between
+// the client and the transport, from caching to usage tracking, works as
+// it does against OpenAI.
+type MockTransport struct {
+	content    string
+	models     []string
+	rules      []MockRule
+	latency    time.Duration // before the response headers
+	chunkDelay time.Duration // between streamed chunks
+}
+
+// NewMockTransport loads canned responses from a JSON file of the form
+// {"content": "...", "models": [...], "rules": [{"contains": "...", "content": "..."}]}
+// if given
+func NewMockTransport(path string, latency, chunkDelay time.Duration) (*MockTransport, error) {
+	file := mockFile{Content: defaultMockContent, Models: defaultMockModels}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		for i := range file.Rules {
+			if file.Rules[i].Latency == "" {
+				continue
+			}
+			if file.Rules[i].latency, err = time.ParseDuration(file.Rules[i].Latency); err != nil {
+				return nil, fmt.Errorf("parse %s: rule %d: %w", path, i+1, err)
+			}
+		}
+	}
+
+	return &MockTransport{
+		content:    file.Content,
+		models:     file.Models,
+		rules:      file.Rules,
+		latency:    latency,
+		chunkDelay: chunkDelay,
+	}, nil
+}
+
+func (m *MockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	info := openai.ParseRequest(body)
+	path := req.URL.Path
+	rule := m.match(path, info.Model, body)
+
+	latency := m.latency
+	if rule.latency > 0 {
+		latency = rule.latency
+	}
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+
+	if rule.Status >= 400 {
+		message := rule.Error
+		if message == "" {
+			message = http.StatusText(rule.Status)
+		}
+		return mockError(req, rule.Status, message, "mock_error"), nil
+	}
+
+	content := m.content
+	if rule.Content != "" {
+		content = rule.Content
+	}
+
+	switch {
+	case req.Method == http.MethodPost && path == "/v1/chat/completions":
+		return m.completion(req, body, info, content, true), nil
+	case req.Method == http.MethodPost && path == "/v1/completions":
+		return m.completion(req, body, info, content, false), nil
+	case req.Method == http.MethodPost && path == "/v1/embeddings":
+		return m.embeddings(req, body, info.Model)
+	case req.Method == http.MethodPost && path == "/v1/moderations":
+		return m.moderations(req, body), nil
+	case req.Method == http.MethodGet && path == "/v1/models":
+		return m.listModels(req), nil
+	}
+	return mockError(req, http.StatusNotFound, fmt.Sprintf("%s %s is not available in mock mode", req.Method, path), "mock_unsupported"), nil
+}
+
+func (m *MockTransport) match(path, model string, body []byte) MockRule {
+	var text string
+	for _, rule := range m.rules {
+		if rule.Path != "" && rule.Path != path {
+			continue
+		}
+		if rule.Model != "" && rule.Model != model {
+			continue
+		}
+		if rule.Contains != "" {
+			if text == "" {
+				text = strings.Join(openai.ExtractText(body), "\n")
+			}
+			if !strings.Contains(text, rule.Contains) {
+				continue
+			}
+		}
+		return rule
+	}
+	return MockRule{}
+}
+
+// completion answers a chat or legacy completion, streamed word by word
+// when the request asks for a stream
+func (m *MockTransport) completion(req *http.Request, body []byte, info openai.RequestInfo, content string, chat bool) *http.Response {
+	var streamOptions struct {
+		StreamOptions struct {
+			IncludeUsage bool `json:"include_usage"`
+		} `json:"stream_options"`
+	}
+	_ = json.Unmarshal(body, &streamOptions)
+
+	prompt := openai.CountPromptTokens(body)
+	completion := openai.CountTokens(info.Model, []string{content})
+	usage := map[string]int{
+		"prompt_tokens":     prompt,
+		"completion_tokens": completion,
+		"total_tokens":      prompt + completion,
+	}
+
+	id, object := "cmpl-mock-"+mockID(), "text_completion"
+	if chat {
+		id, object = "chatcmpl-mock-"+mockID(), "chat.completion"
+	}
+	created := time.Now().Unix()
+
+	if !info.Stream {
+		choice := map[string]interface{}{"index": 0, "finish_reason": "stop"}
+		if chat {
+			choice["message"] = map[string]interface{}{"role": "assistant", "content": content}
+		} else {
+			choice["text"] = content
+		}
+		return mockJSON(req, http.StatusOK, map[string]interface{}{
+			"id":      id,
+			"object":  object,
+			"created": created,
+			"model":   info.Model,
+			"choices": []interface{}{choice},
+			"usage":   usage,
+		})
+	}
+
+	// The first chat chunk carries the role, the last one the finish reason
+	chunk := func(piece string, first bool, finish interface{}) map[string]interface{} {
+		choice := map[string]interface{}{"index": 0, "finish_reason": finish}
+		if chat {
+			delta := map[string]interface{}{}
+			if first {
+				delta["role"] = "assistant"
+			}
+			if piece != "" || first {
+				delta["content"] = piece
+			}
+			choice["delta"] = delta
+		} else {
+			choice["text"] = piece
+		}
+		event := map[string]interface{}{
+			"id":      id,
+			"object":  object,
+			"created": created,
+			"model":   info.Model,
+			"choices": []interface{}{choice},
+		}
+		if chat {
+			event["object"] = "chat.completion.chunk"
+		}
+		return event
+	}
+
+	var events []interface{}
+	if chat {
+		events = append(events, chunk("", true, nil))
+	}
+	for _, piece := range strings.SplitAfter(content, " ") {
+		if piece != "" {
+			events = append(events, chunk(piece, false, nil))
+		}
+	}
+	events = append(events, chunk("", false, "stop"))
+	if streamOptions.StreamOptions.IncludeUsage {
+		final := chunk("", false, nil)
+		final["choices"] = []interface{}{}
+		final["usage"] = usage
+		events = append(events, final)
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		for i, event := range events {
+			if i > 0 && m.chunkDelay > 0 {
+				timer := time.NewTimer(m.chunkDelay)
+				select {
+				case <-req.Context().Done():
+					timer.Stop()
+					writer.CloseWithError(req.Context().Err())
+					return
+				case <-timer.C:
+				}
+			}
+			data, _ := json.Marshal(event)
+			if _, err := fmt.Fprintf(writer, "data: %s\n\n", data); err != nil {
+				return
+			}
+		}
+		writer.Write([]byte("data: [DONE]\n\n"))
+		writer.Close()
+	}()
+
+	return mockResponse(req, http.StatusOK, "text/event-stream", reader, -1)
+}
+
+// embeddings answers with unit vectors derived from a hash of each input,
+// so the same text always embeds the same way
+func (m *MockTransport) embeddings(req *http.Request, body []byte, model string) (*http.Response, error) {
+	var params struct {
+		Input          json.RawMessage `json:"input"`
+		Dimensions     int             `json:"dimensions"`
+		EncodingFormat string          `json:"encoding_format"`
+	}
+	_ = json.Unmarshal(body, &params)
+
+	var inputs []string
+	var single string
+	if err := json.Unmarshal(params.Input, &single); err == nil {
+		inputs = []string{single}
+	} else if err := json.Unmarshal(params.Input, &inputs); err != nil {
+		// Token arrays have no text to hash; embed their JSON instead
+		var tokens []json.RawMessage
+		if err := json.Unmarshal(params.Input, &tokens); err != nil {
+			return mockError(req, http.StatusBadRequest, "input must be a string or an array", "invalid_input"), nil
+		}
+		for _, token := range tokens {
+			inputs = append(inputs, string(token))
+		}
+	}
+
+	dimensions := params.Dimensions
+	if dimensions <= 0 {
+		dimensions = defaultMockDimensions
+	}
+
+	data := make([]interface{}, len(inputs))
+	for i, input := range inputs {
+		vector := mockVector(input, dimensions)
+		var embedding interface{} = vector
+		if params.EncodingFormat == "base64" {
+			encoded := make([]byte, 4*len(vector))
+			for j, value := range vector {
+				binary.LittleEndian.PutUint32(encoded[4*j:], math.Float32bits(value))
+			}
+			embedding = base64.StdEncoding.EncodeToString(encoded)
+		}
+		data[i] = map[string]interface{}{"object": "embedding", "index": i, "embedding": embedding}
+	}
+
+	tokens := openai.CountTokens(model, inputs)
+	return mockJSON(req, http.StatusOK, map[string]interface{}{
+		"object": "list",
+		"data":   data,
+		"model":  model,
+		"usage":  map[string]int{"prompt_tokens": tokens, "total_tokens": tokens},
+	}), nil
+}
+
+func mockVector(input string, dimensions int) []float32 {
+	vector := make([]float32, dimensions)
+	var norm float64
+	seed := sha256.Sum256([]byte(input))
+	for i := 0; i < dimensions; i += 8 {
+		block := sha256.Sum256(append(seed[:], byte(i), byte(i>>8), byte(i>>16)))
+		for j := 0; j < 8 && i+j < dimensions; j++ {
+			value := float64(binary.LittleEndian.Uint32(block[4*j:]))/math.MaxUint32*2 - 1
+			vector[i+j] = float32(value)
+			norm += value * value
+		}
+	}
+	norm = math.Sqrt(norm)
+	for i := range vector {
+		vector[i] = float32(float64(vector[i]) / norm)
+	}
+	return vector
+}
+
+// moderations never flags anything, so tenants requiring moderation work
+// offline
+func (m *MockTransport) moderations(req *http.Request, body []byte) *http.Response {
+	texts := openai.ExtractText(body)
+	if len(texts) == 0 {
+		texts = []string{""}
+	}
+	results := make([]interface{}, len(texts))
+	for i := range texts {
+		results[i] = map[string]interface{}{
+			"flagged":         false,
+			"categories":      map[string]bool{},
+			"category_scores": map[string]float64{},
+		}
+	}
+	return mockJSON(req, http.StatusOK, map[string]interface{}{
+		"id":      "modr-mock-" + mockID(),
+		"model":   "omni-moderation-latest",
+		"results": results,
+	})
+}
+
+func (m *MockTransport) listModels(req *http.Request) *http.Response {
+	models := make([]interface{}, len(m.models))
+	for i, model := range m.models {
+		models[i] = map[string]interface{}{"id": model, "object": "model", "created": 0, "owned_by": "mock"}
+	}
+	return mockJSON(req, http.StatusOK, map[string]interface{}{"object": "list", "data": models})
+}
+
+func mockError(req *http.Request, status int, message, code string) *http.Response {
+	errorType := "invalid_request_error"
+	switch {
+	case status == http.StatusTooManyRequests:
+		errorType = "rate_limit_exceeded"
+	case status >= 500:
+		errorType = "server_error"
+	}
+	return mockJSON(req, status, map[string]interface{}{
+		"error": map[string]interface{}{"message": message, "type": errorType, "code": code},
+	})
+}
+
+func mockJSON(req *http.Request, status int, value interface{}) *http.Response {
+	data, _ := json.Marshal(value)
+	return mockResponse(req, status, "application/json", io.NopCloser(bytes.NewReader(data)), int64(len(data)))
+}
+
+func mockResponse(req *http.Request, status int, contentType string, body io.ReadCloser, length int64) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {contentType}, "X-Mock-Response": {"true"}},
+		Body:          body,
+		ContentLength: length,
+		Request:       req,
+	}
+}
+
+func mockID() string {
+	id := make([]byte, 12)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// TLS versions UPSTREAM_TLS_MIN_VERSION accepts
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// UpstreamTLS is how connections to upstream are verified, and how the
+// proxy identifies itself on them
+type UpstreamTLS struct {
+	CAFile     string // PEM certificates trusted besides the system's, such as a corporate proxy's
+	CertFile   string // client certificate presented to upstream, with KeyFile
+	KeyFile    string
+	MinVersion string // 1.0 to 1.3, empty leaves Go's default
+
+	// InsecureSkipVerify accepts any certificate upstream presents, for
+	// lab environments only
+	InsecureSkipVerify bool
+}
+
+// Config builds the TLS config for connecting to upstream, or returns nil
+// when every setting is left at Go's default
+func (u UpstreamTLS) Config() (*tls.Config, error) {
+	if u == (UpstreamTLS{}) {
+		return nil, nil
+	}
+	config := &tls.Config{InsecureSkipVerify: u.InsecureSkipVerify}
+
+	if u.MinVersion != "" {
+		version, found := tlsVersions[u.MinVersion]
+		if !found {
+			return nil, fmt.Errorf("unknown TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", u.MinVersion)
+		}
+		config.MinVersion = version
+	}
+
+	if u.CAFile != "" {
+		bundle, err := os.ReadFile(u.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no PEM certificates in %s", u.CAFile)
+		}
+		config.RootCAs = roots
+	}
+
+	if (u.CertFile == "") != (u.KeyFile == "") {
+		return nil, errors.New("a client certificate needs both its certificate and key file")
+	}
+	if u.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(u.CertFile, u.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
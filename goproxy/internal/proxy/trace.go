@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// ConnectionStats counts what upstream requests did at the transport level,
+// so operators can check that keep-alive connections are being reused
+// rather than dialed and handshaken for every request
+type ConnectionStats struct {
+	mutex sync.Mutex
+
+	requests      int64
+	newConns      int64
+	reusedConns   int64
+	idleReused    int64
+	idleTime      time.Duration
+	dnsLookups    int64
+	dnsErrors     int64
+	dnsTime       time.Duration
+	dials         int64
+	dialErrors    int64
+	tlsHandshakes int64
+	tlsErrors     int64
+	tlsTime       time.Duration
+
+	// Requests waiting on the pool for a connection: a steady queue here
+	// means the pool is saturated
+	waiting    int
+	maxWaiting int
+	waitTime   time.Duration
+	maxWait    time.Duration
+}
+
+func NewConnectionStats() *ConnectionStats {
+	return &ConnectionStats{}
+}
+
+// trace attaches hooks recording one request's connection to ctx. done
+// must be called once the request has its response or has failed.
+func (s *ConnectionStats) trace(ctx context.Context) (context.Context, func()) {
+	var (
+		mutex                         sync.Mutex
+		waitStart, dnsStart, tlsStart time.Time
+		waiting                       bool
+	)
+	stopWaiting := func() time.Duration {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !waiting {
+			return -1
+		}
+		waiting = false
+		return time.Since(waitStart)
+	}
+
+	s.mutex.Lock()
+	s.requests++
+	s.mutex.Unlock()
+
+	trace := &httptrace.ClientTrace{
+		GetConn: func(string) {
+			mutex.Lock()
+			waitStart, waiting = time.Now(), true
+			mutex.Unlock()
+
+			s.mutex.Lock()
+			s.waiting++
+			if s.waiting > s.maxWaiting {
+				s.maxWaiting = s.waiting
+			}
+			s.mutex.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			wait := stopWaiting()
+
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			if wait >= 0 {
+				s.waiting--
+				s.waitTime += wait
+				if wait > s.maxWait {
+					s.maxWait = wait
+				}
+			}
+			if !info.Reused {
+				s.newConns++
+				return
+			}
+			s.reusedConns++
+			if info.WasIdle {
+				s.idleReused++
+				s.idleTime += info.IdleTime
+			}
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			mutex.Lock()
+			dnsStart = time.Now()
+			mutex.Unlock()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			mutex.Lock()
+			took := time.Since(dnsStart)
+			mutex.Unlock()
+
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			s.dnsLookups++
+			s.dnsTime += took
+			if info.Err != nil {
+				s.dnsErrors++
+			}
+		},
+		ConnectDone: func(network, addr string, err error) {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			s.dials++
+			if err != nil {
+				s.dialErrors++
+			}
+		},
+		TLSHandshakeStart: func() {
+			mutex.Lock()
+			tlsStart = time.Now()
+			mutex.Unlock()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			mutex.Lock()
+			took := time.Since(tlsStart)
+			mutex.Unlock()
+
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			s.tlsHandshakes++
+			s.tlsTime += took
+			if err != nil {
+				s.tlsErrors++
+			}
+		},
+	}
+
+	done := func() {
+		// A request that failed before the pool handed it a connection
+		// never reaches GotConn
+		if stopWaiting() >= 0 {
+			s.mutex.Lock()
+			s.waiting--
+			s.mutex.Unlock()
+		}
+	}
+	return httptrace.WithClientTrace(ctx, trace), done
+}
+
+func (s *ConnectionStats) Stats() map[string]interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var reuseRatio float64
+	if conns := s.newConns + s.reusedConns; conns > 0 {
+		reuseRatio = float64(s.reusedConns) / float64(conns)
+	}
+
+	return map[string]interface{}{
+		"requests":           s.requests,
+		"new_connections":    s.newConns,
+		"reused_connections": s.reusedConns,
+		"reuse_ratio":        reuseRatio,
+		"idle_reused":        s.idleReused,
+		"idle_avg_ms":        averageMillis(s.idleTime, s.idleReused),
+		"dns_lookups":        s.dnsLookups,
+		"dns_errors":         s.dnsErrors,
+		"dns_avg_ms":         averageMillis(s.dnsTime, s.dnsLookups),
+		"dials":              s.dials,
+		"dial_errors":        s.dialErrors,
+		"tls_handshakes":     s.tlsHandshakes,
+		"tls_errors":         s.tlsErrors,
+		"tls_avg_ms":         averageMillis(s.tlsTime, s.tlsHandshakes),
+		"waiting":            s.waiting,
+		"max_waiting":        s.maxWaiting,
+		"wait_avg_ms":        averageMillis(s.waitTime, s.newConns+s.reusedConns),
+		"wait_max_ms":        float64(s.maxWait.Microseconds()) / 1000,
+	}
+}
+
+func averageMillis(total time.Duration, count int64) float64 {
+	if count == 0 {
+		return 0
+	}
+	return float64((total / time.Duration(count)).Microseconds()) / 1000
+}
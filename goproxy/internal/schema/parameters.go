@@ -0,0 +1,168 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+)
+
+// The types a JSON schema may name
+var jsonTypes = map[string]bool{
+	"string": true, "number": true, "integer": true, "boolean": true,
+	"object": true, "array": true, "null": true,
+}
+
+// CheckParameters makes sure a function tool's parameters are a JSON
+// schema a model can be given: an object schema whose types, properties,
+// items, required lists, enums and combinators are well formed. Strict
+// functions must also list every property as required and refuse
+// additional ones, as upstream demands for structured outputs. Params in
+// the error are relative to the parameters, such as
+// properties.city.type.
+func CheckParameters(raw json.RawMessage, strict bool) *Error {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return &Error{Message: "is not valid JSON: " + err.Error()}
+	}
+	schema, ok := value.(map[string]interface{})
+	if !ok {
+		return &Error{Message: "expected a JSON schema object, got " + typeOf(value)}
+	}
+	if t, set := schema["type"]; (set || strict) && t != "object" {
+		return &Error{Param: "type", Message: `must be "object"`}
+	}
+	return checkSchema(schema, "", strict)
+}
+
+func checkSchema(schema map[string]interface{}, param string, strict bool) *Error {
+	if t, set := schema["type"]; set {
+		if err := checkType(t, join(param, "type")); err != nil {
+			return err
+		}
+	}
+	if enum, set := schema["enum"]; set {
+		if values, ok := enum.([]interface{}); !ok || len(values) == 0 {
+			return &Error{Param: join(param, "enum"), Message: "must be a non-empty array"}
+		}
+	}
+
+	properties := map[string]interface{}{}
+	if raw, set := schema["properties"]; set {
+		var ok bool
+		if properties, ok = raw.(map[string]interface{}); !ok {
+			return &Error{Param: join(param, "properties"), Message: "expected object, got " + typeOf(raw)}
+		}
+		for _, name := range sortedKeys(properties) {
+			if err := checkSubschema(properties[name], join(param, "properties."+name), strict); err != nil {
+				return err
+			}
+		}
+	}
+
+	required := map[string]bool{}
+	if raw, set := schema["required"]; set {
+		names, ok := raw.([]interface{})
+		if !ok {
+			return &Error{Param: join(param, "required"), Message: "expected array, got " + typeOf(raw)}
+		}
+		for i, name := range names {
+			s, ok := name.(string)
+			if !ok {
+				return &Error{Param: join(param, "required") + "[" + strconv.Itoa(i) + "]", Message: "expected string, got " + typeOf(name)}
+			}
+			if _, described := properties[s]; !described {
+				return &Error{Param: join(param, "required") + "[" + strconv.Itoa(i) + "]", Message: "names " + strconv.Quote(s) + ", which isn't in properties"}
+			}
+			required[s] = true
+		}
+	}
+	if strict && schema["type"] == "object" {
+		for _, name := range sortedKeys(properties) {
+			if !required[name] {
+				return &Error{Param: join(param, "required"), Message: "must list " + strconv.Quote(name) + " in a strict function"}
+			}
+		}
+		if schema["additionalProperties"] != false {
+			return &Error{Param: join(param, "additionalProperties"), Message: "must be false in a strict function"}
+		}
+	}
+
+	for _, field := range []string{"items", "additionalProperties", "not"} {
+		if raw, set := schema[field]; set {
+			if _, isBool := raw.(bool); isBool {
+				continue
+			}
+			if err := checkSubschema(raw, join(param, field), strict); err != nil {
+				return err
+			}
+		}
+	}
+	for _, field := range []string{"anyOf", "oneOf", "allOf"} {
+		raw, set := schema[field]
+		if !set {
+			continue
+		}
+		options, ok := raw.([]interface{})
+		if !ok || len(options) == 0 {
+			return &Error{Param: join(param, field), Message: "must be a non-empty array"}
+		}
+		for i, option := range options {
+			if err := checkSubschema(option, join(param, field)+"["+strconv.Itoa(i)+"]", strict); err != nil {
+				return err
+			}
+		}
+	}
+	for _, field := range []string{"$defs", "definitions"} {
+		raw, set := schema[field]
+		if !set {
+			continue
+		}
+		definitions, ok := raw.(map[string]interface{})
+		if !ok {
+			return &Error{Param: join(param, field), Message: "expected object, got " + typeOf(raw)}
+		}
+		for _, name := range sortedKeys(definitions) {
+			if err := checkSubschema(definitions[name], join(param, field+"."+name), strict); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func checkSubschema(value interface{}, param string, strict bool) *Error {
+	schema, ok := value.(map[string]interface{})
+	if !ok {
+		return &Error{Param: param, Message: "expected a JSON schema object, got " + typeOf(value)}
+	}
+	return checkSchema(schema, param, strict)
+}
+
+func checkType(value interface{}, param string) *Error {
+	names, ok := value.([]interface{})
+	if !ok {
+		names = []interface{}{value}
+	}
+	if len(names) == 0 {
+		return &Error{Param: param, Message: "must not be empty"}
+	}
+	for _, name := range names {
+		if s, ok := name.(string); !ok || !jsonTypes[s] {
+			return &Error{Param: param, Message: "must be one of string, number, integer, boolean, object, array, null"}
+		}
+	}
+	return nil
+}
+
+// sortedKeys keeps the first error reported the same from run to run
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,258 @@
+// Package schema validates request bodies against JSON schemas for the
+// OpenAI endpoints it knows, so malformed requests can be refused without
+// a round trip upstream. It implements the part of JSON Schema those
+// schemas use: type, properties, required, enum, items, anyOf and the
+// numeric, length and size bounds.
+package schema
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"path"
+	"strconv"
+	"strings"
+)
+
+//go:embed schemas
+var schemaFiles embed.FS
+
+// Schemas by the endpoint they describe
+var endpointSchemas = map[string]string{
+	"/v1/chat/completions":   "schemas/chat_completions.json",
+	"/v1/embeddings":         "schemas/embeddings.json",
+	"/v1/images/generations": "schemas/images_generations.json",
+}
+
+// Schema is a JSON schema, or the part of one this package understands
+type Schema struct {
+	Type                 types              `json:"type"`
+	Properties           map[string]*Schema `json:"properties"`
+	Required             []string           `json:"required"`
+	Enum                 []interface{}      `json:"enum"`
+	Items                *Schema            `json:"items"`
+	AnyOf                []*Schema          `json:"anyOf"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+	MinItems             *int               `json:"minItems"`
+	MaxItems             *int               `json:"maxItems"`
+	Description          string             `json:"description"`
+	AdditionalProperties *Schema            `json:"additionalProperties"`
+}
+
+// types is a schema's type, which may be one type or a list of them
+type types []string
+
+func (t *types) UnmarshalJSON(data []byte) error {
+	var one string
+	if json.Unmarshal(data, &one) == nil {
+		*t = types{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*t = many
+	return nil
+}
+
+// Error is the first place a body breaks its schema
+type Error struct {
+	Param   string // where, such as messages[0].role; empty for the body itself
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Param == "" {
+		return e.Message
+	}
+	return e.Param + ": " + e.Message
+}
+
+// Load parses the schemas of every endpoint this package knows
+func Load() (map[string]*Schema, error) {
+	schemas := make(map[string]*Schema, len(endpointSchemas))
+	for endpoint, file := range endpointSchemas {
+		data, err := schemaFiles.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var s Schema
+		if err := json.Unmarshal(data, &s); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path.Base(file), err)
+		}
+		schemas[endpoint] = &s
+	}
+	return schemas, nil
+}
+
+// Validate checks a JSON body against the schema, returning nil when it
+// conforms
+func (s *Schema) Validate(body []byte) *Error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return &Error{Message: "body is not valid JSON: " + err.Error()}
+	}
+	return s.validate(value, "")
+}
+
+func (s *Schema) validate(value interface{}, param string) *Error {
+	if len(s.Type) > 0 && !s.allows(value) {
+		return &Error{Param: param, Message: "expected " + strings.Join(s.Type, " or ") + ", got " + typeOf(value)}
+	}
+	if len(s.Enum) > 0 && !inEnum(s.Enum, value) {
+		return &Error{Param: param, Message: "must be one of " + enumList(s.Enum)}
+	}
+	if len(s.AnyOf) > 0 {
+		var first *Error
+		for _, option := range s.AnyOf {
+			err := option.validate(value, param)
+			if err == nil {
+				first = nil
+				break
+			}
+			if first == nil {
+				first = err
+			}
+		}
+		if first != nil {
+			return first
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		length := len([]rune(v))
+		if s.MinLength != nil && length < *s.MinLength {
+			return &Error{Param: param, Message: fmt.Sprintf("must be at least %d characters", *s.MinLength)}
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			return &Error{Param: param, Message: fmt.Sprintf("must be at most %d characters", *s.MaxLength)}
+		}
+	case json.Number:
+		n, _ := v.Float64()
+		if s.Minimum != nil && n < *s.Minimum {
+			return &Error{Param: param, Message: "must be at least " + formatNumber(*s.Minimum)}
+		}
+		if s.Maximum != nil && n > *s.Maximum {
+			return &Error{Param: param, Message: "must be at most " + formatNumber(*s.Maximum)}
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			if *s.MinItems == 1 {
+				return &Error{Param: param, Message: "must not be empty"}
+			}
+			return &Error{Param: param, Message: fmt.Sprintf("must have at least %d items", *s.MinItems)}
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			return &Error{Param: param, Message: fmt.Sprintf("must have at most %d items", *s.MaxItems)}
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				if err := s.Items.validate(item, param+"["+strconv.Itoa(i)+"]"); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, found := v[name]; !found {
+				return &Error{Param: join(param, name), Message: "is required"}
+			}
+		}
+		// Fields the schema doesn't describe are left for upstream to
+		// judge, since new ones appear all the time
+		for name, property := range s.Properties {
+			if field, found := v[name]; found {
+				if err := property.validate(field, join(param, name)); err != nil {
+					return err
+				}
+			}
+		}
+		if s.AdditionalProperties != nil {
+			for name, field := range v {
+				if _, described := s.Properties[name]; described {
+					continue
+				}
+				if err := s.AdditionalProperties.validate(field, join(param, name)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Schema) allows(value interface{}) bool {
+	actual := typeOf(value)
+	for _, t := range s.Type {
+		if t == actual || t == "number" && actual == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+// typeOf names a decoded value's JSON type, telling integers from other
+// numbers as JSON Schema does
+func typeOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if r, ok := new(big.Rat).SetString(v.String()); ok && r.IsInt() {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// inEnum compares values by their JSON encoding, so the string "1" isn't
+// taken for the number 1
+func inEnum(enum []interface{}, value interface{}) bool {
+	encoded, _ := json.Marshal(value)
+	for _, allowed := range enum {
+		if e, _ := json.Marshal(allowed); bytes.Equal(e, encoded) {
+			return true
+		}
+	}
+	return false
+}
+
+func enumList(enum []interface{}) string {
+	values := make([]string, len(enum))
+	for i, value := range enum {
+		if value == nil {
+			values[i] = "null"
+		} else {
+			values[i] = fmt.Sprint(value)
+		}
+	}
+	return strings.Join(values, ", ")
+}
+
+func formatNumber(n float64) string {
+	return strconv.FormatFloat(n, 'f', -1, 64)
+}
+
+func join(param, name string) string {
+	if param == "" {
+		return name
+	}
+	return param + "." + name
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/tenant"
+)
+
+// tenantAdminAuth accepts either the operator's admin token or the admin
+// token of the tenant named in the path
+func (s *Server) tenantAdminAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, found := s.tenants.Tenant(c.Param("id")); !found {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Unknown tenant"})
+			c.Abort()
+			return
+		}
+
+		if s.config.AdminToken == "" {
+			c.Next()
+			return
+		}
+
+		authorization := c.GetHeader("Authorization")
+		provided := c.GetHeader("X-Admin-Token")
+		if provided == "" {
+			provided = strings.TrimPrefix(authorization, "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(s.config.AdminToken)) == 1 {
+			c.Next()
+			return
+		}
+
+		if t, found := s.tenants.LookupAdmin(authorization); found && t.ID == c.Param("id") {
+			c.Next()
+			return
+		}
+
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Invalid or missing admin token",
+			"code":  "ADMIN_UNAUTHORIZED",
+		})
+		c.Abort()
+	}
+}
+
+func (s *Server) listAlerts(c *gin.Context) {
+	t, _ := s.tenants.Tenant(c.Param("id"))
+	alerts := t.Alerts
+	if alerts == nil {
+		alerts = []tenant.Alert{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"alerts": alerts})
+}
+
+func (s *Server) createAlert(c *gin.Context) {
+	var alert tenant.Alert
+	if err := c.ShouldBindJSON(&alert); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	if err := s.alerts.Validate(alert); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	created, err := s.tenants.AddAlert(c.Param("id"), alert)
+	if err != nil {
+		s.logger.Printf("Error saving alert for tenant %s: %v", c.Param("id"), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save alert"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, created)
+}
+
+func (s *Server) deleteAlert(c *gin.Context) {
+	err := s.tenants.RemoveAlert(c.Param("id"), c.Param("alert"))
+	if errors.Is(err, tenant.ErrUnknownAlert) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown alert"})
+		return
+	}
+	if err != nil {
+		s.logger.Printf("Error removing alert for tenant %s: %v", c.Param("id"), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove alert"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Alert removed"})
+}
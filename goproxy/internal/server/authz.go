@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/authz"
+	"goproxyai/internal/openai"
+	"goproxyai/internal/usage"
+)
+
+// extAuthz asks the external authorization service about each /v1 request
+// once the key and tenant are known. Denied requests are answered here;
+// allowed ones go on with any headers the service annotated them with.
+func (s *Server) extAuthz() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.authz == nil {
+			c.Next()
+			return
+		}
+
+		input := authz.Input{
+			KeyID:  usage.KeyID(c.GetHeader("Authorization")),
+			Tenant: c.GetString(ctxTenantID),
+			Method: c.Request.Method,
+			Path:   c.Request.URL.Path,
+		}
+		if s.config.UserIDHeader != "" {
+			input.User = c.GetHeader(s.config.UserIDHeader)
+		}
+		body, ok := peekBody(c)
+		if !ok {
+			return
+		}
+		info := openai.ParseRequest(body)
+		input.Model = info.Model
+		if info.User != "" {
+			input.User = info.User
+		}
+
+		decision, err := s.authz.Check(c.Request.Context(), input)
+		if err != nil {
+			s.logger.Printf("Authorization check failed for %s %s: %v", input.Method, input.Path, err)
+			c.Error(err)
+			if s.config.ExtAuthzFailOpen {
+				c.Next()
+				return
+			}
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error": "Authorization service is unavailable",
+				"code":  "AUTHZ_UNAVAILABLE",
+			})
+			c.Abort()
+			return
+		}
+
+		if !decision.Allow {
+			deny(c, decision.Status, decision.Reason, "AUTHZ_DENIED")
+			return
+		}
+		annotate(c, decision.Headers)
+		c.Next()
+	}
+}
+
+// peekBody reads the request body and puts it back for the handler.
+// Uploads are streamed through untouched, so their body is left alone and
+// nil returned. It writes the error response itself when it returns false.
+func peekBody(c *gin.Context) ([]byte, bool) {
+	if isStreamedUpload(c.Request.URL.Path, c.GetHeader("Content-Type")) {
+		return nil, true
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		bodyReadFailed(c, err)
+		c.Abort()
+		return nil, false
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	return body, true
+}
+
+// deny refuses a request with the status and reason a verdict gave, 403
+// and a generic reason when it gave none
+func deny(c *gin.Context, status int, reason, code string) {
+	if status < 400 || status > 599 {
+		status = http.StatusForbidden
+	}
+	if reason == "" {
+		reason = "Request denied by authorization policy"
+	}
+	c.JSON(status, gin.H{
+		"error": reason,
+		"code":  code,
+	})
+	c.Abort()
+}
+
+// annotate adds headers to those the request is forwarded upstream with
+func annotate(c *gin.Context, headers map[string]string) {
+	if len(headers) == 0 {
+		return
+	}
+	upstreamHeaders, _ := c.Value(ctxUpstreamHeaders).(map[string]string)
+	annotated := make(map[string]string, len(upstreamHeaders)+len(headers))
+	for name, value := range upstreamHeaders {
+		annotated[name] = value
+	}
+	for name, value := range headers {
+		annotated[name] = value
+	}
+	c.Set(ctxUpstreamHeaders, annotated)
+}
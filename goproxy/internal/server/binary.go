@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/cache"
+	"goproxyai/internal/proxy"
+)
+
+// isBinaryEndpoint reports whether the endpoint returns binary data such as
+// synthesized audio or downloaded file and image contents
+func isBinaryEndpoint(method, path string) bool {
+	if method == http.MethodPost && path == "/v1/audio/speech" {
+		return true
+	}
+	return method == http.MethodGet && strings.HasPrefix(path, "/v1/files/") && strings.HasSuffix(path, "/content")
+}
+
+// binaryHandler streams binary responses to the client as they arrive with
+// the upstream Content-Type and Content-Length. Speech responses are teed
+// into memory only while they fit the cache's size cap.
+func (s *Server) binaryHandler(c *gin.Context, path string, headers http.Header, upstreamHeaders map[string]string, body []byte, cacheDisabled bool) {
+	method := c.Request.Method
+
+	if cacheEntry, found := s.cacheGet(c, cacheDisabled, method, path, headers, body); found {
+		s.logger.Printf("Cache hit for %s %s", method, path)
+		s.provenanceHeaders(c)
+		s.writeCached(c, cacheEntry)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), s.requestTimeout(c))
+	defer cancel()
+	resp, err := s.proxyClient.Stream(ctx, &proxy.ProxyRequest{
+		Method:  method,
+		Path:    path,
+		Headers: withUpstreamHeaders(headers, upstreamHeaders),
+		Body:    body,
+	})
+	if err != nil {
+		s.logger.Printf("Error forwarding request: %v", err)
+		c.Error(err)
+		s.forwardFailed(c, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var limit int64
+	if !cacheDisabled && method == http.MethodPost && s.cache.Cacheable(method, path, resp.StatusCode) {
+		limit = s.cache.EntryLimit(path)
+	}
+	captured, written, err := s.relay(c, resp, "MISS", limit)
+	if err != nil {
+		// Headers are already sent, so all that's left is to log it
+		s.logger.Printf("Error streaming %s %s after %d bytes: %v", method, path, written, err)
+		c.Error(err)
+		return
+	}
+
+	if respBody, ok := captured.complete(); ok {
+		s.cache.Set(method, path, headers, body, &cache.CacheEntry{
+			StatusCode: resp.StatusCode,
+			Headers:    resp.Headers,
+			Body:       respBody,
+			TTL:        c.GetDuration(ctxCacheTTL),
+			Tenant:     c.GetString(ctxTenantID),
+			User:       c.GetString(ctxUser),
+		})
+	}
+
+	s.logger.Printf("%s %s -> %d (%d bytes, streamed)", method, path, resp.StatusCode, written)
+}
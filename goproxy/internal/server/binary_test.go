@@ -0,0 +1,37 @@
+package server_test
+
+import (
+	"net/http"
+	"testing"
+
+	"goproxyai/proxytest"
+)
+
+// Speech requests are JSON, but clients must get upstream's audio type back
+// whether the audio comes from upstream or the cache
+func TestSpeechKeepsUpstreamContentType(t *testing.T) {
+	h := proxytest.New(t, proxytest.WithEnv("TTS_CACHE_MAX_SIZE", "64"))
+	audio := []byte("ID3\x04\x00\x00\x00\x00\x00\x00fake mpeg frames")
+	h.Upstream.Handle(http.MethodPost, "/v1/audio/speech", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "audio/mpeg")
+		w.Write(audio)
+	})
+
+	speech := map[string]interface{}{"model": "tts-1", "input": "Hello", "voice": "alloy"}
+	header := http.Header{"Content-Type": {"application/json"}}
+	check := func(t testing.TB, resp *proxytest.Response) {
+		if string(resp.Body) != string(audio) {
+			t.Errorf("body = %q, want the upstream audio", resp.Body)
+		}
+	}
+	h.Run(
+		proxytest.Step{Name: "miss", Path: "/v1/audio/speech", Body: speech, Header: header, WantStatus: 200,
+			WantHeader: map[string]string{"Content-Type": "audio/mpeg", "X-Cache": "MISS"}, Check: check},
+		proxytest.Step{Name: "hit", Path: "/v1/audio/speech", Body: speech, Header: header, WantStatus: 200,
+			WantHeader: map[string]string{"Content-Type": "audio/mpeg", "X-Cache": "HIT"}, Check: check},
+	)
+
+	if requests := len(h.Upstream.Requests()); requests != 1 {
+		t.Errorf("upstream got %d requests, want 1", requests)
+	}
+}
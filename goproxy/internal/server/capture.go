@@ -0,0 +1,596 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/clock"
+	"goproxyai/internal/dryrun"
+	"goproxyai/internal/encryption"
+)
+
+// Longest request or response body a capture keeps of each exchange
+const maxCapturedBody = 1 << 20
+
+// Finished captures listed, and kept on disk, before the oldest is deleted
+const captureLimit = 20
+
+var errCaptureRunning = errors.New("a capture is already running")
+
+// capture records the /v1 exchanges of a window into a HAR or NDJSON file
+type capture struct {
+	ID        string    `json:"id"`
+	Format    string    `json:"format"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Redacted  bool      `json:"redact_bodies"`
+	Started   time.Time `json:"started"`
+	Ends      time.Time `json:"ends"`
+	Status    string    `json:"status"` // running, finished or failed
+	Entries   int       `json:"entries"`
+	Bytes     int64     `json:"bytes"`
+	Truncated bool      `json:"truncated"` // stopped early at CAPTURE_MAX_SIZE
+	Error     string    `json:"error,omitempty"`
+
+	path    string
+	entries []harEntry
+	timer   *time.Timer
+}
+
+// captures runs one capture at a time and keeps the files of the last few.
+// With a sealer the files are encrypted, since they hold prompts and
+// answers.
+type captures struct {
+	mutex    sync.Mutex
+	dir      string
+	maxBytes int64
+	sealer   *encryption.Sealer
+	active   atomic.Pointer[capture]
+	all      []*capture
+	logger   *log.Logger
+}
+
+func newCaptures(dir string, maxMB int, sealer *encryption.Sealer, logger *log.Logger) *captures {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return &captures{dir: dir, maxBytes: int64(maxMB) * 1024 * 1024, sealer: sealer, logger: logger}
+}
+
+// start begins a capture that ends after duration
+func (r *captures) start(format, tenantID string, redact bool, duration time.Duration) (capture, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.active.Load() != nil {
+		return capture{}, errCaptureRunning
+	}
+	if err := os.MkdirAll(r.dir, 0o700); err != nil {
+		return capture{}, err
+	}
+	var id [8]byte
+	rand.Read(id[:])
+	now := clock.Now().UTC()
+	c := &capture{
+		ID:       "cap_" + hex.EncodeToString(id[:]),
+		Format:   format,
+		Tenant:   tenantID,
+		Redacted: redact,
+		Started:  now,
+		Ends:     now.Add(duration),
+		Status:   "running",
+	}
+	c.path = filepath.Join(r.dir, "capture-"+c.ID+"."+format)
+	c.timer = time.AfterFunc(duration, func() { r.finish(c, false) })
+	r.all = append(r.all, c)
+	r.active.Store(c)
+	return *c, nil
+}
+
+// running returns the capture recording now, if any
+func (r *captures) running() *capture {
+	return r.active.Load()
+}
+
+// record adds an exchange to a capture, unless it has finished since the
+// exchange began. A capture that outgrows CAPTURE_MAX_SIZE ends there.
+func (r *captures) record(c *capture, entry harEntry, size int64) {
+	r.mutex.Lock()
+	if r.active.Load() != c {
+		r.mutex.Unlock()
+		return
+	}
+	full := c.Bytes+size > r.maxBytes
+	if !full {
+		c.entries = append(c.entries, entry)
+		c.Entries++
+		c.Bytes += size
+	}
+	r.mutex.Unlock()
+
+	if full {
+		r.finish(c, true)
+	}
+}
+
+// finish ends a capture and writes its file
+func (r *captures) finish(c *capture, truncated bool) {
+	r.mutex.Lock()
+	if !r.active.CompareAndSwap(c, nil) {
+		r.mutex.Unlock()
+		return
+	}
+	c.timer.Stop()
+	c.Truncated = truncated
+	entries := c.entries
+	c.entries = nil
+	r.mutex.Unlock()
+
+	err := r.write(c.path, c.Format, entries)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.kept(c) {
+		// Deleted while its file was being written
+		os.Remove(c.path)
+		return
+	}
+	if err != nil {
+		r.logger.Printf("Failed to write capture %s: %v", c.ID, err)
+		c.Status, c.Error = "failed", err.Error()
+	} else {
+		c.Status = "finished"
+	}
+	r.prune()
+}
+
+func (r *captures) kept(c *capture) bool {
+	for _, kept := range r.all {
+		if kept == c {
+			return true
+		}
+	}
+	return false
+}
+
+// prune deletes the oldest captures past captureLimit
+func (r *captures) prune() {
+	for len(r.all) > captureLimit && r.all[0] != r.active.Load() {
+		os.Remove(r.all[0].path)
+		r.all = r.all[1:]
+	}
+}
+
+// list returns the captures, newest first
+func (r *captures) list() []capture {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	list := make([]capture, len(r.all))
+	for i, c := range r.all {
+		list[len(r.all)-1-i] = *c
+	}
+	return list
+}
+
+func (r *captures) get(id string) (capture, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, c := range r.all {
+		if c.ID == id {
+			return *c, true
+		}
+	}
+	return capture{}, false
+}
+
+// remove stops a capture if it's running, discarding what it recorded, and
+// deletes its file
+func (r *captures) remove(id string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for i, c := range r.all {
+		if c.ID != id {
+			continue
+		}
+		if r.active.CompareAndSwap(c, nil) {
+			c.timer.Stop()
+		}
+		os.Remove(c.path)
+		r.all = append(r.all[:i], r.all[i+1:]...)
+		return true
+	}
+	return false
+}
+
+// write writes a capture's file, sealed when there's a sealer
+func (r *captures) write(path, format string, entries []harEntry) error {
+	var encoded bytes.Buffer
+	if format == "ndjson" {
+		encoder := json.NewEncoder(&encoded)
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				return err
+			}
+		}
+	} else {
+		if entries == nil {
+			entries = []harEntry{}
+		}
+		err := json.NewEncoder(&encoded).Encode(harFile{Log: harLog{
+			Version: "1.2",
+			Creator: harCreator{Name: "goproxyai", Version: "1.0.0"},
+			Entries: entries,
+		}})
+		if err != nil {
+			return err
+		}
+	}
+	data, err := r.sealer.Seal(encoded.Bytes())
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// read returns the contents of a capture's file, decrypted
+func (r *captures) read(c capture) ([]byte, error) {
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		return nil, err
+	}
+	return r.sealer.Open(data)
+}
+
+// HAR 1.2, as browsers' developer tools export it
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ClientIP        string      `json:"_clientIPAddress,omitempty"`
+}
+
+type harRequest struct {
+	Method      string       `json:"method"`
+	URL         string       `json:"url"`
+	HTTPVersion string       `json:"httpVersion"`
+	Cookies     []harPair    `json:"cookies"`
+	Headers     []harPair    `json:"headers"`
+	QueryString []harPair    `json:"queryString"`
+	PostData    *harPostData `json:"postData,omitempty"`
+	HeadersSize int          `json:"headersSize"`
+	BodySize    int64        `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int        `json:"status"`
+	StatusText  string     `json:"statusText"`
+	HTTPVersion string     `json:"httpVersion"`
+	Cookies     []harPair  `json:"cookies"`
+	Headers     []harPair  `json:"headers"`
+	Content     harContent `json:"content"`
+	RedirectURL string     `json:"redirectURL"`
+	HeadersSize int        `json:"headersSize"`
+	BodySize    int64      `json:"bodySize"`
+}
+
+type harPair struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// capturedBody keeps the start of a body as it's read or written
+type capturedBody struct {
+	data      bytes.Buffer
+	size      int64
+	truncated bool
+}
+
+func (b *capturedBody) Write(data []byte) (int, error) {
+	b.size += int64(len(data))
+	if room := maxCapturedBody - b.data.Len(); room < len(data) {
+		b.truncated = true
+		data = data[:room]
+	}
+	b.data.Write(data)
+	return len(data), nil
+}
+
+// text returns the body for a HAR entry: redacted when asked and it's
+// text, base64 when it isn't
+func (b *capturedBody) text(redact bool) (string, string, string) {
+	var comment string
+	if b.truncated {
+		comment = fmt.Sprintf("truncated to the first %d of %d bytes", b.data.Len(), b.size)
+	}
+	if !utf8.Valid(b.data.Bytes()) {
+		return base64.StdEncoding.EncodeToString(b.data.Bytes()), "base64", comment
+	}
+	text := b.data.String()
+	if redact {
+		text = redactText(text)
+	}
+	return text, "", comment
+}
+
+// captureReader keeps what the handlers read of a request body
+type captureReader struct {
+	io.ReadCloser
+	body *capturedBody
+}
+
+func (r *captureReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.body.Write(p[:n])
+	return n, err
+}
+
+// captureWriter keeps what's written of a response body. It sits inside
+// compression, so it sees the body before it's encoded.
+type captureWriter struct {
+	gin.ResponseWriter
+	body *capturedBody
+}
+
+func (w *captureWriter) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	w.body.Write(data[:n])
+	return n, err
+}
+
+func (w *captureWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// captureTraffic records /v1 exchanges while a capture is running, as the
+// client sent and received them, with credential headers masked. It runs
+// right inside the compression stage, or first when there's none. Dry
+// runs aren't recorded.
+func (s *Server) captureTraffic() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		recording := s.captures.running()
+		if recording == nil || dryrun.From(c.Request.Context()) != nil {
+			c.Next()
+			return
+		}
+
+		start := clock.Now()
+		request := c.Request
+		requestHeaders := harHeaders(request.Header)
+		requestBody := &capturedBody{}
+		if request.Body != nil && request.Body != http.NoBody {
+			request.Body = &captureReader{ReadCloser: request.Body, body: requestBody}
+		}
+		responseBody := &capturedBody{}
+		c.Writer = &captureWriter{ResponseWriter: c.Writer, body: responseBody}
+
+		c.Next()
+
+		if recording.Tenant != "" && c.GetString(ctxTenantID) != recording.Tenant {
+			return
+		}
+		elapsed := float64(clock.Since(start).Microseconds()) / 1000
+		entry := harEntry{
+			StartedDateTime: start.UTC(),
+			Time:            elapsed,
+			Request: harRequest{
+				Method:      request.Method,
+				URL:         requestURL(request),
+				HTTPVersion: request.Proto,
+				Cookies:     []harPair{},
+				Headers:     requestHeaders,
+				QueryString: harQuery(request),
+				HeadersSize: -1,
+				BodySize:    requestBody.size,
+			},
+			Response: harResponse{
+				Status:      c.Writer.Status(),
+				StatusText:  http.StatusText(c.Writer.Status()),
+				HTTPVersion: request.Proto,
+				Cookies:     []harPair{},
+				Headers:     harHeaders(c.Writer.Header()),
+				Content:     harContent{Size: responseBody.size, MimeType: c.Writer.Header().Get("Content-Type")},
+				HeadersSize: -1,
+				BodySize:    responseBody.size,
+			},
+			Timings:  harTimings{Wait: elapsed},
+			ClientIP: c.ClientIP(),
+		}
+		if requestBody.size > 0 {
+			text, encoding, comment := requestBody.text(recording.Redacted)
+			entry.Request.PostData = &harPostData{MimeType: request.Header.Get("Content-Type"), Text: text, Encoding: encoding, Comment: comment}
+		}
+		if responseBody.size > 0 {
+			content := &entry.Response.Content
+			content.Text, content.Encoding, content.Comment = responseBody.text(recording.Redacted)
+		}
+		s.captures.record(recording, entry, int64(requestBody.data.Len()+responseBody.data.Len()))
+	}
+}
+
+func requestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.URL.RequestURI()
+}
+
+// harHeaders lists headers in name order, with secrets masked
+func harHeaders(header http.Header) []harPair {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := []harPair{}
+	for _, name := range names {
+		for _, value := range header[name] {
+			pairs = append(pairs, harPair{Name: name, Value: dryrun.MaskHeader(name, value)})
+		}
+	}
+	return pairs
+}
+
+func harQuery(r *http.Request) []harPair {
+	pairs := []harPair{}
+	for name, values := range r.URL.Query() {
+		for _, value := range values {
+			pairs = append(pairs, harPair{Name: name, Value: value})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Name < pairs[j].Name })
+	return pairs
+}
+
+type startCaptureRequest struct {
+	Seconds      int    `json:"seconds"`
+	Format       string `json:"format"`
+	Tenant       string `json:"tenant"`
+	RedactBodies *bool  `json:"redact_bodies"`
+}
+
+func (s *Server) startCapture(c *gin.Context) {
+	var req startCaptureRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	duration := time.Duration(req.Seconds) * time.Second
+	if duration <= 0 || duration > s.config.CaptureMaxDuration {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("seconds must be between 1 and %d", int(s.config.CaptureMaxDuration.Seconds()))})
+		return
+	}
+	if req.Format == "" {
+		req.Format = "har"
+	}
+	if req.Format != "har" && req.Format != "ndjson" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be har or ndjson"})
+		return
+	}
+	if req.Tenant != "" {
+		if _, found := s.tenants.Tenant(req.Tenant); !found {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown tenant"})
+			return
+		}
+	}
+	redact := req.RedactBodies == nil || *req.RedactBodies
+
+	started, err := s.captures.start(req.Format, req.Tenant, redact, duration)
+	if errors.Is(err, errCaptureRunning) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "A capture is already running. Wait for it to finish or delete it.",
+			"code":  "CAPTURE_RUNNING",
+		})
+		return
+	}
+	if err != nil {
+		s.logger.Printf("Error starting capture: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start capture"})
+		return
+	}
+	s.logger.Printf("Capture %s started for %v", started.ID, duration)
+	c.JSON(http.StatusCreated, started)
+}
+
+func (s *Server) listCaptures(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"captures": s.captures.list()})
+}
+
+// downloadCapture serves a finished capture's file
+func (s *Server) downloadCapture(c *gin.Context) {
+	found, ok := s.captures.get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown capture"})
+		return
+	}
+	switch found.Status {
+	case "running":
+		c.JSON(http.StatusConflict, gin.H{
+			"error": fmt.Sprintf("The capture is still running until %s", found.Ends.Format(time.RFC3339)),
+			"code":  "CAPTURE_RUNNING",
+		})
+		return
+	case "failed":
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "The capture couldn't be written: " + found.Error})
+		return
+	}
+
+	data, err := s.captures.read(found)
+	if err != nil {
+		s.logger.Printf("Failed to read capture %s: %v", found.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "The capture couldn't be read"})
+		return
+	}
+	contentType := "application/json"
+	if found.Format == "ndjson" {
+		contentType = "application/x-ndjson"
+	}
+	c.Header("Content-Disposition", `attachment; filename="`+filepath.Base(found.path)+`"`)
+	c.Data(http.StatusOK, contentType, data)
+}
+
+func (s *Server) deleteCapture(c *gin.Context) {
+	if !s.captures.remove(c.Param("id")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown capture"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/clock"
+	"goproxyai/internal/cluster"
+)
+
+// joinCluster gossips the rate limiters' counters and the usage with the
+// replicas CLUSTER_PEERS leads to
+func (s *Server) joinCluster() {
+	s.cluster = cluster.New(s.config.ProxyID, s.config.ClusterAdvertiseURL, s.config.ClusterSecret, s.config.ClusterPeers, s.config.ClusterGossipInterval, s.usage, s.logger)
+	s.rateLimiter.Share("ip", s.cluster)
+	s.keyRateLimiter.Share("key", s.cluster)
+	s.policyLimiter.Share("policy", s.cluster)
+	if s.userRateLimiter != nil {
+		s.userRateLimiter.Share("user", s.cluster)
+	}
+	if s.config.ClusterCache {
+		s.clusterCache = newClusterCache(s.cluster, s.cache, s.config.ClusterSecret, s.config.ClusterCacheTimeout, s.logger)
+		s.cache.Share(s.clusterCache)
+	}
+	s.cluster.Start()
+	s.logger.Printf("Cluster member %s gossiping every %v with %v", s.config.ProxyID, s.config.ClusterGossipInterval, s.config.ClusterPeers)
+}
+
+// clusterAuth only lets in requests from other members, which carry
+// CLUSTER_SECRET
+func (s *Server) clusterAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !s.cluster.Authorized(c.GetHeader(cluster.SecretHeader)) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "Invalid or missing cluster secret",
+				"code":  "CLUSTER_UNAUTHORIZED",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// receiveGossip answers another replica's gossip with this one's
+func (s *Server) receiveGossip(c *gin.Context) {
+	var message cluster.Message
+	if err := c.ShouldBindJSON(&message); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	c.JSON(http.StatusOK, s.cluster.Exchange(message))
+}
+
+// getCluster lists the members of the cluster and the usage they've
+// counted between them this month, per day and tenant
+func (s *Server) getCluster(c *gin.Context) {
+	if s.cluster == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Clustering is disabled, set CLUSTER_PEERS",
+			"code":  "CLUSTER_DISABLED",
+		})
+		return
+	}
+	now := clock.Now().UTC()
+	c.JSON(http.StatusOK, gin.H{
+		"members": s.cluster.Members(),
+		"usage":   s.cluster.Usage(time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)),
+	})
+}
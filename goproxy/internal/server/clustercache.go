@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/cache"
+	"goproxyai/internal/cluster"
+)
+
+// clusterCache keeps each cache entry with the member its key hashes to,
+// so the cluster caches every response once and each replica hits on what
+// the others cached. When an owner can't be reached, the entry is looked
+// up and kept here instead.
+type clusterCache struct {
+	node   *cluster.Node
+	cache  *cache.Cache
+	secret string
+	client *http.Client
+	logger *log.Logger
+
+	hits   atomic.Int64 // entries the owner had
+	misses atomic.Int64 // entries the owner didn't have
+	stored atomic.Int64 // entries sent to their owner
+	errors atomic.Int64 // owners that couldn't be reached
+}
+
+func newClusterCache(node *cluster.Node, local *cache.Cache, secret string, timeout time.Duration, logger *log.Logger) *clusterCache {
+	return &clusterCache{
+		node:   node,
+		cache:  local,
+		secret: secret,
+		client: &http.Client{Timeout: timeout},
+		logger: logger,
+	}
+}
+
+func (cc *clusterCache) Get(key string) (*cache.CacheEntry, bool) {
+	owner, local := cc.node.Owner(key)
+	if local {
+		return nil, true
+	}
+	req, err := http.NewRequest(http.MethodGet, owner+cluster.CachePath+key, nil)
+	if err != nil {
+		return nil, true
+	}
+	req.Header.Set(cluster.SecretHeader, cc.secret)
+	resp, err := cc.client.Do(req)
+	if err != nil {
+		cc.errors.Add(1)
+		return nil, true
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		cc.misses.Add(1)
+		return nil, false
+	default:
+		cc.errors.Add(1)
+		return nil, true
+	}
+	var entry cache.CacheEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entry); err != nil {
+		cc.errors.Add(1)
+		return nil, true
+	}
+	cc.hits.Add(1)
+	return &entry, false
+}
+
+// Set sends the entry to its owner after the response has gone out, and
+// keeps it here if that fails
+func (cc *clusterCache) Set(key string, entry *cache.CacheEntry) bool {
+	owner, local := cc.node.Owner(key)
+	if local {
+		return true
+	}
+	go func() {
+		if err := cc.send(owner, key, entry); err != nil {
+			cc.errors.Add(1)
+			cc.logger.Printf("Could not cache entry with %s, keeping it here: %v", owner, err)
+			cc.cache.StoreKey(key, entry)
+			return
+		}
+		cc.stored.Add(1)
+	}()
+	return false
+}
+
+func (cc *clusterCache) send(owner, key string, entry *cache.CacheEntry) error {
+	body, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, owner+cluster.CachePath+key, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(cluster.SecretHeader, cc.secret)
+	resp, err := cc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (cc *clusterCache) stats() map[string]interface{} {
+	return map[string]interface{}{
+		"remote_hits":   cc.hits.Load(),
+		"remote_misses": cc.misses.Load(),
+		"sent":          cc.stored.Load(),
+		"errors":        cc.errors.Load(),
+	}
+}
+
+// validCacheKey reports whether key is what the cache hashes requests to
+func validCacheKey(key string) bool {
+	decoded, err := hex.DecodeString(key)
+	return err == nil && len(decoded) == 32
+}
+
+// getOwnedEntry answers another member looking up an entry this one owns
+func (s *Server) getOwnedEntry(c *gin.Context) {
+	key := c.Param("key")
+	if !validCacheKey(key) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cache key"})
+		return
+	}
+	entry, found := s.cache.LookupKey(key)
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not cached"})
+		return
+	}
+	c.JSON(http.StatusOK, entry)
+}
+
+// putOwnedEntry keeps an entry another member answered, for a key this one
+// owns
+func (s *Server) putOwnedEntry(c *gin.Context) {
+	key := c.Param("key")
+	if !validCacheKey(key) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cache key"})
+		return
+	}
+	// Bodies are base64 in JSON, a third larger than the cache holds them
+	limit := max(s.cache.EntryLimit("/v1/audio/speech"), s.cache.EntryLimit("/v1/chat/completions"))*2 + 1<<20
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+	var entry cache.CacheEntry
+	if err := c.ShouldBindJSON(&entry); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	s.cache.StoreKey(key, &entry)
+	c.Status(http.StatusNoContent)
+}
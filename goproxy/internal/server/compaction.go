@@ -0,0 +1,176 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/compaction"
+	"goproxyai/internal/dryrun"
+	"goproxyai/internal/openai"
+	"goproxyai/internal/proxy"
+)
+
+// What the summary model is asked to do with the old turns of a
+// conversation
+const summaryPrompt = "Summarize the conversation below for the assistant taking part in it, " +
+	"who will continue it without seeing it again. Keep every fact, decision, name, number " +
+	"and open question; drop pleasantries and repetition. Answer with the summary alone."
+
+// compactPrompts shrinks chat completion prompts longer than
+// PROMPT_COMPACTION_THRESHOLD tokens, first losslessly, then, if they're
+// still too long and PROMPT_COMPACTION_SUMMARY_MODEL is set, by having the
+// old turns summarized. The tokens saved are reported in
+// X-Prompt-Tokens-Saved.
+func (s *Server) compactPrompts() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method != http.MethodPost || c.Request.URL.Path != "/v1/chat/completions" {
+			c.Next()
+			return
+		}
+		body, ok := peekBody(c)
+		if !ok {
+			return
+		}
+		threshold := s.config.PromptCompactionThreshold
+		before := openai.CountPromptTokens(body)
+		if body == nil || before <= threshold {
+			c.Next()
+			return
+		}
+
+		trace := dryrun.From(c.Request.Context())
+		compacted, _, err := compaction.Compact(body)
+		if err != nil {
+			// Upstream says what's wrong with it
+			c.Next()
+			return
+		}
+		after := openai.CountPromptTokens(compacted)
+
+		if after > threshold && s.config.PromptCompactionSummaryModel != "" {
+			if trace != nil {
+				// The summary itself comes from upstream, so a dry run can't make it
+				trace.Add("compaction", "would summarize old turns of %d tokens, skipped in a dry run", after)
+			} else if summarized, err := s.summarizeOldTurns(c, body); err != nil {
+				s.logger.Printf("Could not summarize old turns, sending the prompt unsummarized: %v", err)
+				c.Error(err)
+			} else {
+				// Compacted again, as what the kept turns repeat may be gone now
+				if recompacted, _, err := compaction.Compact(summarized); err == nil {
+					summarized = recompacted
+				}
+				compacted, after = summarized, openai.CountPromptTokens(summarized)
+			}
+		}
+
+		if after < before {
+			c.Request.Body = io.NopCloser(bytes.NewReader(compacted))
+			c.Request.ContentLength = int64(len(compacted))
+			c.Request.Header.Set("Content-Length", strconv.Itoa(len(compacted)))
+			c.Header("X-Prompt-Tokens-Saved", strconv.Itoa(before-after))
+			trace.Add("compaction", "prompt of %d tokens compacted to %d", before, after)
+			transformed(c, "compaction")
+		}
+		c.Next()
+	}
+}
+
+// summarizeOldTurns replaces the old turns of a conversation with a
+// summary of them from PROMPT_COMPACTION_SUMMARY_MODEL, keeping the system
+// messages it opens with and the last PROMPT_COMPACTION_KEEP_MESSAGES
+func (s *Server) summarizeOldTurns(c *gin.Context, body []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	var messages []json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(fields["messages"], &messages); err != nil {
+		return nil, err
+	}
+	start, end := compaction.OldTurns(messages, s.config.PromptCompactionKeepMessages)
+	if start == end {
+		return nil, errors.New("no old turns to summarize")
+	}
+
+	summary, err := s.summarize(c, compaction.Transcript(messages[start:end]))
+	if err != nil {
+		return nil, err
+	}
+	summaryMessage, err := json.Marshal(map[string]string{
+		"role":    "system",
+		"content": "Summary of the earlier conversation:\n" + summary,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	summarized := make([]json.RawMessage, 0, len(messages)-(end-start)+1)
+	summarized = append(summarized, messages[:start]...)
+	summarized = append(summarized, summaryMessage)
+	summarized = append(summarized, messages[end:]...)
+	if fields["messages"], err = json.Marshal(summarized); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+// summarize asks the summary model, with the caller's credentials, to sum
+// up a transcript
+func (s *Server) summarize(c *gin.Context, transcript string) (string, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"model": s.config.PromptCompactionSummaryModel,
+		"messages": []map[string]string{
+			{"role": "system", "content": summaryPrompt},
+			{"role": "user", "content": transcript},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	headers := http.Header{
+		"Authorization": c.Request.Header.Values("Authorization"),
+		"Content-Type":  {"application/json"},
+	}
+	upstreamHeaders, _ := c.Value(ctxUpstreamHeaders).(map[string]string)
+	headers = withUpstreamHeaders(headers, upstreamHeaders)
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), s.config.RequestTimeout)
+	defer cancel()
+
+	resp, err := s.proxyClient.Forward(ctx, &proxy.ProxyRequest{
+		Method:  http.MethodPost,
+		Path:    "/v1/chat/completions",
+		Headers: headers,
+		Body:    body,
+	})
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("summary model returned %d", resp.StatusCode)
+	}
+
+	var completion struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(resp.Body, &completion); err != nil {
+		return "", err
+	}
+	if len(completion.Choices) == 0 || completion.Choices[0].Message.Content == "" {
+		return "", errors.New("summary model returned no summary")
+	}
+	return completion.Choices[0].Message.Content, nil
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// connDeadlines applies HTTP_READ_TIMEOUT and HTTP_WRITE_TIMEOUT to each
+// request instead of to the listener. Set on the listener, a read timeout
+// cancels requests still being answered when it passes and a write timeout
+// cuts every stream off, so here the read deadline only covers the request
+// body, and a response that streams has each write to the client bounded
+// rather than the whole response.
+func (s *Server) connDeadlines(next http.Handler) http.Handler {
+	if s.config.HTTPReadTimeout <= 0 && s.config.HTTPWriteTimeout <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		controller := http.NewResponseController(w)
+		if timeout := s.config.HTTPReadTimeout; timeout > 0 && r.Body != nil && r.Body != http.NoBody {
+			controller.SetReadDeadline(time.Now().Add(timeout))
+			r.Body = &deadlineBody{ReadCloser: r.Body, controller: controller}
+		}
+		if s.config.HTTPWriteTimeout > 0 {
+			controller.SetWriteDeadline(time.Now().Add(s.config.HTTPWriteTimeout))
+			w = &deadlineWriter{ResponseWriter: w, controller: controller, timeout: s.config.HTTPWriteTimeout}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// deadlineBody lifts the read deadline once the request body has been read,
+// so the connection can still notice the client going away while the
+// response is written
+type deadlineBody struct {
+	io.ReadCloser
+	controller *http.ResponseController
+	once       sync.Once
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.once.Do(func() { b.controller.SetReadDeadline(time.Time{}) })
+	}
+	return n, err
+}
+
+// deadlineWriter bounds each write of a streamed response by the write
+// timeout, from the first flush on
+type deadlineWriter struct {
+	http.ResponseWriter
+	controller *http.ResponseController
+	timeout    time.Duration
+	streaming  bool
+}
+
+func (w *deadlineWriter) Write(p []byte) (int, error) {
+	if w.streaming {
+		w.controller.SetWriteDeadline(time.Now().Add(w.timeout))
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *deadlineWriter) Flush() {
+	w.streaming = true
+	w.controller.SetWriteDeadline(time.Now().Add(w.timeout))
+	w.controller.Flush()
+}
+
+func (w *deadlineWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.controller.Hijack()
+}
+
+func (w *deadlineWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/dryrun"
+	"goproxyai/internal/middleware"
+	"goproxyai/internal/plugins"
+)
+
+type traceRequest struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers"`
+	Body    json.RawMessage   `json:"body"`
+}
+
+type traceResponse struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// debugTrace dry-runs a /v1 request through the pipeline and reports what
+// each stage did with it, and either the response the proxy gave itself or
+// the request it would have sent upstream. Nothing is sent upstream, no
+// rate limit tokens are used and nothing is cached or metered.
+func (s *Server) debugTrace(c *gin.Context) {
+	var req traceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if req.Method == "" {
+		req.Method = http.MethodPost
+	}
+	if !strings.HasPrefix(req.Path, "/v1/") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "path must be a /v1 request path"})
+		return
+	}
+
+	header := make(http.Header, len(req.Headers))
+	for name, value := range req.Headers {
+		header.Set(name, value)
+	}
+	if len(req.Body) > 0 && header.Get("Content-Type") == "" {
+		header.Set("Content-Type", "application/json")
+	}
+
+	t := dryrun.New(header)
+	traced, err := http.NewRequestWithContext(dryrun.WithTrace(c.Request.Context(), t), strings.ToUpper(req.Method), req.Path, bytes.NewReader(req.Body))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	traced.Header = header
+	traced.RemoteAddr = c.Request.RemoteAddr
+	traced.Host = c.Request.Host
+
+	handler := http.Handler(s.router)
+	if s.config.RequestMigration {
+		handler = s.legacyEngines(handler)
+	}
+	if s.plugins.Has(plugins.PreRoute) {
+		handler = s.preRoute(handler)
+	}
+	w := newBufferedResponse()
+	handler.ServeHTTP(w, traced)
+
+	result := gin.H{"steps": t.Steps()}
+	if upstream := t.Upstream(); upstream != nil {
+		result["upstream"] = upstream
+	} else {
+		response := traceResponse{Status: w.status}
+		if body := w.body.Bytes(); json.Valid(body) {
+			response.Body = body
+		} else if len(body) > 0 {
+			response.Body, _ = json.Marshal(string(body))
+		}
+		result["response"] = response
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// allow takes a request from the limiter's allowance for key, or in a dry
+// run reports what's left of it in the trace without taking any
+func allow(c *gin.Context, stage string, limiter *middleware.RateLimiter, key string, requestsPerMinute int) bool {
+	t := dryrun.From(c.Request.Context())
+	if t == nil {
+		return limiter.AllowRate(key, requestsPerMinute)
+	}
+	tokens := limiter.TokensRate(key, requestsPerMinute)
+	t.Add(stage, "%.1f of %d requests left", tokens, requestsPerMinute)
+	return tokens >= 1
+}
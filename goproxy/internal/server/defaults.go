@@ -0,0 +1,76 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/dryrun"
+	"goproxyai/internal/openai"
+)
+
+// loadDefaults reads REQUEST_DEFAULTS_FILE, body parameters filled in for
+// requests that leave them out, by route:
+// {"/v1/chat/completions": {"temperature": 0.2}}
+func loadDefaults(path string) (map[string]map[string]json.RawMessage, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var defaults map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(data, &defaults); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if err := checkDefaults(defaults); err != nil {
+		return nil, err
+	}
+	return defaults, nil
+}
+
+// checkDefaults makes sure defaults are keyed by /v1 routes, which is all
+// they're ever matched against
+func checkDefaults(defaults map[string]map[string]json.RawMessage) error {
+	for route := range defaults {
+		if !strings.HasPrefix(route, "/v1/") {
+			return fmt.Errorf("invalid route %q for defaults, expected a /v1 path", route)
+		}
+	}
+	return nil
+}
+
+// applyDefaults fills the body parameters a request leaves out with the
+// defaults its key has for the route, then with the route's own, so
+// platform-wide settings don't have to live in every client. It reports
+// whether it filled in any.
+func (s *Server) applyDefaults(c *gin.Context, path string, body []byte) ([]byte, bool) {
+	defaults := make(map[string]json.RawMessage)
+	for name, value := range s.routeDefaults[path] {
+		defaults[name] = value
+	}
+	if key, _, found := s.tenants.Lookup(c.GetHeader("Authorization")); found {
+		for name, value := range key.Defaults[path] {
+			defaults[name] = value
+		}
+	}
+	if len(defaults) == 0 || len(body) == 0 {
+		return body, false
+	}
+
+	updated, added, err := openai.SetDefaults(body, defaults)
+	if err != nil {
+		s.logger.Printf("Could not apply defaults to request body: %v", err)
+		return body, false
+	}
+	if len(added) == 0 {
+		return body, false
+	}
+	dryrun.From(c.Request.Context()).Add("defaults", "filled in %s", strings.Join(added, ", "))
+	transformed(c, "defaults")
+	return updated, true
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/cache"
+	"goproxyai/internal/deprecation"
+	"goproxyai/internal/dryrun"
+)
+
+// checkDeprecation flags a model upstream's response headers say is
+// deprecated. While the model is deprecated, it counts the key's request
+// and returns the headers with a Warning for the client.
+func (s *Server) checkDeprecation(c *gin.Context, tenantID, keyID, model string, headers map[string][]string) map[string][]string {
+	if model == "" {
+		return headers
+	}
+	if notice, ok := deprecation.FromHeaders(model, http.Header(headers)); ok {
+		s.deprecations.Flag(notice)
+	}
+	notice, ok := s.deprecatedCall(c, tenantID, keyID, model)
+	if !ok {
+		return headers
+	}
+	warned := http.Header(headers).Clone()
+	if warned == nil {
+		warned = http.Header{}
+	}
+	warned.Add("Warning", notice.Warning())
+	return warned
+}
+
+// checkDeprecatedError flags a model an error response refuses because
+// it's deprecated. The client already has the error to tell it so.
+func (s *Server) checkDeprecatedError(c *gin.Context, tenantID, keyID, model string, status int, body []byte) {
+	notice, ok := deprecation.FromError(model, status, body)
+	if !ok {
+		return
+	}
+	_, counted := s.deprecations.Lookup(model)
+	s.deprecations.Flag(notice)
+	if !counted {
+		s.deprecatedCall(c, tenantID, keyID, model)
+	}
+}
+
+// deprecatedEntry is a cache entry as it's served with a Warning when its
+// model is deprecated, leaving the cached one untouched
+func (s *Server) deprecatedEntry(c *gin.Context, tenantID, keyID, model string, entry *cache.CacheEntry) *cache.CacheEntry {
+	if _, deprecated := s.deprecations.Lookup(model); !deprecated {
+		return entry
+	}
+	warned := *entry
+	warned.Headers = s.checkDeprecation(c, tenantID, keyID, model, entry.Headers)
+	return &warned
+}
+
+// deprecatedCall counts a key's request for a model that's deprecated,
+// returning upstream's notice about it
+func (s *Server) deprecatedCall(c *gin.Context, tenantID, keyID, model string) (deprecation.Notice, bool) {
+	notice, found := s.deprecations.Lookup(model)
+	if !found {
+		return notice, false
+	}
+	// A dry run's trace isn't a call
+	if dryrun.From(c.Request.Context()) == nil {
+		caller := deprecation.Caller{Tenant: tenantID, KeyID: keyID}
+		if key, _, found := s.tenants.Lookup(c.GetHeader("Authorization")); found {
+			caller.KeyName = key.Name
+		}
+		s.deprecations.Called(model, caller)
+	}
+	return notice, true
+}
+
+// getDeprecationReport lists the models upstream has said are deprecated
+// and the keys still calling them
+func (s *Server) getDeprecationReport(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"models": s.deprecations.Report()})
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// dispatch serves a JSON POST through the router in-process, as if the
+// client had sent it to /v1 directly, so it gets the same key checks, rate
+// limits, caching and usage tracking
+func (s *Server) dispatch(ctx context.Context, header http.Header, remoteAddr, path string, body []byte, w http.ResponseWriter) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, path, bytes.NewReader(body))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(errorBody(err.Error()))
+		return
+	}
+	req.Header = header
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Del("Accept-Encoding")
+	req.RemoteAddr = remoteAddr
+
+	s.router.ServeHTTP(w, req)
+}
+
+func errorBody(message string) json.RawMessage {
+	encoded, _ := json.Marshal(gin.H{"error": message})
+	return encoded
+}
+
+// bufferedResponse is a minimal http.ResponseWriter that keeps the response
+// in memory
+type bufferedResponse struct {
+	header http.Header
+	body   bytes.Buffer
+	status int
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+}
+
+func (r *bufferedResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *bufferedResponse) Write(p []byte) (int, error) {
+	return r.body.Write(p)
+}
+
+func (r *bufferedResponse) WriteHeader(status int) {
+	r.status = status
+}
+
+// Hijack refuses, since there's no connection behind the response. A
+// truncated body shows up as invalid JSON to whoever reads it instead.
+func (r *bufferedResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, http.ErrNotSupported
+}
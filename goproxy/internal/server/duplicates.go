@@ -0,0 +1,156 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/clock"
+	"goproxyai/internal/dryrun"
+)
+
+// duplicates counts the byte-identical requests each key sends within a
+// window, so a client stuck retrying the same request shows up before it
+// runs up the bill
+type duplicates struct {
+	mutex     sync.Mutex
+	threshold int
+	window    time.Duration
+	seen      map[string]*duplicateState
+	swept     time.Time
+	flagged   int64 // requests past the threshold
+	throttled int64
+}
+
+// duplicateState is a request's count in the window its first copy opened
+type duplicateState struct {
+	first time.Time
+	count int
+}
+
+func newDuplicates(threshold int, window time.Duration) *duplicates {
+	return &duplicates{threshold: threshold, window: window, seen: make(map[string]*duplicateState), swept: clock.Now()}
+}
+
+// see counts a request and returns how many copies of it its window has
+// seen, including this one, and when that window closes
+func (d *duplicates) see(fingerprint string) (int, time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := clock.Now()
+	if now.Sub(d.swept) >= d.window {
+		d.sweep(now)
+	}
+	state, found := d.seen[fingerprint]
+	if !found || now.Sub(state.first) >= d.window {
+		state = &duplicateState{first: now}
+		d.seen[fingerprint] = state
+	}
+	state.count++
+	if state.count > d.threshold {
+		d.flagged++
+	}
+	return state.count, state.first.Add(d.window)
+}
+
+// count returns how many copies of a request its window has seen, without
+// counting one more
+func (d *duplicates) count(fingerprint string) int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	state, found := d.seen[fingerprint]
+	if !found || clock.Since(state.first) >= d.window {
+		return 0
+	}
+	return state.count
+}
+
+func (d *duplicates) throttle() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.throttled++
+}
+
+// sweep drops the requests whose window has closed
+func (d *duplicates) sweep(now time.Time) {
+	for fingerprint, state := range d.seen {
+		if now.Sub(state.first) >= d.window {
+			delete(d.seen, fingerprint)
+		}
+	}
+	d.swept = now
+}
+
+func (d *duplicates) counts() (int64, int64) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.flagged, d.throttled
+}
+
+func (d *duplicates) stats() map[string]interface{} {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return map[string]interface{}{
+		"tracked":   len(d.seen),
+		"flagged":   d.flagged,
+		"throttled": d.throttled,
+		"threshold": d.threshold,
+		"window":    d.window.String(),
+	}
+}
+
+// duplicateFingerprint identifies a request by its key and everything it
+// sends upstream
+func duplicateFingerprint(keyID, method, path string, body []byte) string {
+	digest := sha256.New()
+	digest.Write([]byte(keyID + "\x00" + method + " " + path + "\x00"))
+	digest.Write(body)
+	return hex.EncodeToString(digest.Sum(nil))
+}
+
+// checkDuplicate counts a POST the cache won't answer against the
+// identical ones its key sent within DUPLICATE_WINDOW. Past
+// DUPLICATE_THRESHOLD it's flagged in X-Duplicate-Requests and the
+// metrics, the pattern is logged the first time it crosses, and with
+// DUPLICATE_ACTION=throttle it's refused until the window closes. It
+// returns false when it has answered the request itself.
+func (s *Server) checkDuplicate(c *gin.Context, method, path, keyID string, body []byte) bool {
+	if s.duplicates == nil || method != http.MethodPost {
+		return true
+	}
+	fingerprint := duplicateFingerprint(keyID, method, path, body)
+	if trace := dryrun.From(c.Request.Context()); trace != nil {
+		trace.Add("duplicates", "%d identical requests from the key in the last %v (threshold %d)", s.duplicates.count(fingerprint), s.config.DuplicateWindow, s.config.DuplicateThreshold)
+		return true
+	}
+
+	count, closes := s.duplicates.see(fingerprint)
+	if count <= s.config.DuplicateThreshold {
+		return true
+	}
+	if count == s.config.DuplicateThreshold+1 {
+		s.logger.Printf("Possible retry loop: key %s sent %d identical %s %s within %v", keyID, count, method, path, s.config.DuplicateWindow)
+	}
+	c.Header("X-Duplicate-Requests", strconv.Itoa(count))
+	if s.config.DuplicateAction != "throttle" {
+		return true
+	}
+
+	s.duplicates.throttle()
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(closes.Sub(clock.Now()).Seconds()))))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error": fmt.Sprintf("This API key sent the same request %d times within %v, which looks like a retry loop. Change the request or retry later.", count, s.config.DuplicateWindow),
+		"code":  "DUPLICATE_REQUEST",
+	})
+	return false
+}
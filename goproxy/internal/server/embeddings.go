@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/cache"
+	"goproxyai/internal/openai"
+	"goproxyai/internal/proxy"
+)
+
+// forwardEmbeddings sends an embeddings request through the vector cache
+// and the batcher, which need whole bodies to answer from cached vectors
+// and split batched responses, and presents the result like any other
+// upstream response
+func (s *Server) forwardEmbeddings(ctx context.Context, c *gin.Context, req *proxy.ProxyRequest, cacheDisabled bool, tenantID, keyID string, info *openai.RequestInfo) (*proxy.StreamResponse, error) {
+	var resp *proxy.ProxyResponse
+	var err error
+	if s.vectors != nil && !cacheDisabled {
+		resp, err = s.embedCached(ctx, req, tenantID, keyID, info)
+	} else {
+		resp, err = s.sendEmbeddings(ctx, req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.config.ResponseNormalization {
+		normalizeCompletion(c, req, info.Model, resp)
+	}
+	return streamResponse(resp), nil
+}
+
+func (s *Server) sendEmbeddings(ctx context.Context, req *proxy.ProxyRequest) (*proxy.ProxyResponse, error) {
+	if s.embeddings != nil {
+		return s.embeddings.Forward(ctx, req)
+	}
+	return s.proxyClient.Forward(ctx, req)
+}
+
+// embedCached answers an embeddings request with the vectors cached for
+// its inputs, asking upstream only for those it has none for, each once.
+// Usage counts only the tokens sent upstream, and X-Embeddings-Cached how
+// many of the inputs weren't sent.
+func (s *Server) embedCached(ctx context.Context, req *proxy.ProxyRequest, tenantID, keyID string, info *openai.RequestInfo) (*proxy.ProxyResponse, error) {
+	scope := tenantID
+	if scope == "" {
+		scope = keyID
+	}
+	keys, inputs, ok := cache.EmbeddingKeys(scope, req.Body)
+	if !ok {
+		return s.sendEmbeddings(ctx, req)
+	}
+
+	vectors := make(map[string]cache.Embedding, len(keys))
+	var missing, missingKeys []string
+	for i, key := range keys {
+		if _, seen := vectors[key]; seen {
+			continue
+		}
+		if embedding, found := s.vectors.Get(key); found {
+			vectors[key] = embedding
+			continue
+		}
+		vectors[key] = cache.Embedding{}
+		missing = append(missing, inputs[i])
+		missingKeys = append(missingKeys, key)
+	}
+
+	answer := embeddingsAnswer{Object: "list"}
+	headers := map[string][]string{"Content-Type": {"application/json"}}
+	if len(missing) > 0 {
+		body, err := openai.SetField(req.Body, "input", missing)
+		if err != nil {
+			return nil, err
+		}
+		fetch := *req
+		fetch.Body = body
+		resp, err := s.sendEmbeddings(ctx, &fetch)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			return resp, err
+		}
+
+		var fetched embeddingsAnswer
+		if err := json.Unmarshal(resp.Body, &fetched); err != nil {
+			return nil, fmt.Errorf("reading embeddings response: %w", err)
+		}
+		if len(fetched.Data) != len(missing) {
+			return nil, fmt.Errorf("embeddings response has %d vectors for %d inputs", len(fetched.Data), len(missing))
+		}
+		for _, data := range fetched.Data {
+			if data.Index < 0 || data.Index >= len(missing) {
+				return nil, fmt.Errorf("embeddings response has a vector for input %d of %d", data.Index, len(missing))
+			}
+			embedding := cache.Embedding{Vector: data.Embedding, Model: fetched.Model}
+			vectors[missingKeys[data.Index]] = embedding
+			s.vectors.Set(missingKeys[data.Index], tenantID, info.User, embedding)
+		}
+		if len(missing) == len(inputs) {
+			// Nothing was cached or repeated, so upstream's answer is the answer
+			return resp, nil
+		}
+		for name, values := range resp.Headers {
+			if name != "Content-Length" {
+				headers[name] = values
+			}
+		}
+		answer.Model, answer.Usage = fetched.Model, fetched.Usage
+	}
+
+	answer.Data = make([]embeddingsData, len(keys))
+	for i, key := range keys {
+		answer.Data[i] = embeddingsData{Object: "embedding", Index: i, Embedding: vectors[key].Vector}
+		if answer.Model == "" {
+			answer.Model = vectors[key].Model
+		}
+	}
+	if answer.Model == "" {
+		answer.Model = info.Model
+	}
+	body, err := json.Marshal(answer)
+	if err != nil {
+		return nil, err
+	}
+	headers["X-Embeddings-Cached"] = []string{strconv.Itoa(len(inputs) - len(missing))}
+	return &proxy.ProxyResponse{StatusCode: http.StatusOK, Headers: headers, Body: body}, nil
+}
+
+type embeddingsAnswer struct {
+	Object string           `json:"object"`
+	Data   []embeddingsData `json:"data"`
+	Model  string           `json:"model"`
+	Usage  embeddingsUsage  `json:"usage"`
+}
+
+type embeddingsData struct {
+	Object    string          `json:"object"`
+	Index     int             `json:"index"`
+	Embedding json.RawMessage `json:"embedding"`
+}
+
+type embeddingsUsage struct {
+	PromptTokens int `json:"prompt_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/openai"
+	"goproxyai/internal/proxy"
+)
+
+// EmptyCompletionRetryHeader tells the client how a retry for an empty
+// completion went: recovered, still-empty, or failed when the retry itself
+// couldn't be made and the empty answer is returned
+const EmptyCompletionRetryHeader = "X-Empty-Completion-Retry"
+
+// forwardRetryingEmpty sends a chat completion upstream and, when it comes
+// back 200 with empty content, asks once more, with
+// EMPTY_COMPLETION_FALLBACK_MODEL if set. The whole answer is read before
+// anything is relayed so the empty one never reaches the client. info is
+// updated to the model that gave the returned answer, so it's metered
+// against that model.
+func (s *Server) forwardRetryingEmpty(ctx context.Context, c *gin.Context, req *proxy.ProxyRequest, tenantID, keyID string, info *openai.RequestInfo) (*proxy.ProxyResponse, error) {
+	resp, err := s.proxyClient.Forward(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK || !openai.EmptyCompletion(resp.Body) {
+		return resp, nil
+	}
+
+	retry := *req
+	retryInfo := *info
+	if model := s.config.EmptyCompletionFallbackModel; model != "" {
+		body, err := openai.SetField(req.Body, "model", model)
+		if err != nil {
+			return nil, err
+		}
+		retry.Body = body
+		retryInfo.Model = model
+		c.Header(EmptyCompletionRetryHeader+"-Model", model)
+	}
+	s.logger.Printf("Empty completion from %s, retrying with %s", info.Model, retryInfo.Model)
+
+	retried, err := s.proxyClient.Forward(ctx, &retry)
+	if err != nil {
+		s.logger.Printf("Retry for empty completion failed: %v", err)
+		c.Header(EmptyCompletionRetryHeader, "failed")
+		return resp, nil
+	}
+	// The empty answer's tokens were spent all the same
+	s.recordResponse(c, tenantID, keyID, *info, resp.Body)
+
+	if retried.StatusCode == http.StatusOK && !openai.EmptyCompletion(retried.Body) {
+		c.Header(EmptyCompletionRetryHeader, "recovered")
+	} else {
+		c.Header(EmptyCompletionRetryHeader, "still-empty")
+	}
+	*info = retryInfo
+	return retried, nil
+}
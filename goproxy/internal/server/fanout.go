@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/openai"
+)
+
+// Endpoints a fan-out may target
+var fanoutPaths = map[string]bool{
+	"/v1/chat/completions": true,
+	"/v1/completions":      true,
+	"/v1/responses":        true,
+}
+
+type fanoutRequest struct {
+	Models  []string        `json:"models"`
+	URL     string          `json:"url"`
+	Body    json.RawMessage `json:"body"`
+	Timeout string          `json:"timeout"`
+}
+
+type fanoutResult struct {
+	Model      string           `json:"model"`
+	StatusCode int              `json:"status_code,omitempty"`
+	LatencyMS  int64            `json:"latency_ms"`
+	Usage      *openai.Usage    `json:"usage,omitempty"`
+	CostUSD    *float64         `json:"cost_usd,omitempty"`
+	Body       json.RawMessage  `json:"body,omitempty"`
+	Error      *localBatchError `json:"error"`
+}
+
+// fanout sends the same request to several models at once and returns every
+// response side by side with its latency and cost, for evaluations and
+// best-of workflows. Each model's request is dispatched through /v1 with the
+// caller's headers, so keys, scopes, rate limits, caching and usage
+// tracking apply to each one. A single timeout covers the whole fan-out;
+// requests still running when it fires, or when the client goes away, are
+// cancelled.
+func (s *Server) fanout(c *gin.Context) {
+	var req fanoutRequest
+	if err := json.NewDecoder(http.MaxBytesReader(c.Writer, c.Request.Body, s.config.MaxUploadSize*1024*1024)).Decode(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	if req.URL == "" {
+		req.URL = "/v1/chat/completions"
+	}
+	if !fanoutPaths[req.URL] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported url " + req.URL})
+		return
+	}
+	if len(req.Body) == 0 || req.Body[0] != '{' {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "body must be a JSON object"})
+		return
+	}
+	if openai.ParseRequest(req.Body).Stream {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Streaming is not supported in a fan-out"})
+		return
+	}
+
+	models := req.Models
+	if len(models) == 0 {
+		models = s.config.FanoutModels
+	}
+	if len(models) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No models to fan out to"})
+		return
+	}
+	if len(models) > s.config.FanoutMaxModels {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("Fan-out exceeds the limit of %d models", s.config.FanoutMaxModels),
+			"code":  "FANOUT_TOO_LARGE",
+		})
+		return
+	}
+
+	timeout := s.config.FanoutTimeout
+	if req.Timeout != "" {
+		requested, err := time.ParseDuration(req.Timeout)
+		if err != nil || requested <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "timeout must be a positive duration such as 20s"})
+			return
+		}
+		// Callers may only shorten the configured timeout
+		if requested < timeout {
+			timeout = requested
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	results := make([]fanoutResult, len(models))
+	var wg sync.WaitGroup
+	for i, model := range models {
+		wg.Add(1)
+		go func(i int, model string) {
+			defer wg.Done()
+			results[i] = s.fanoutOne(ctx, c.Request, req.URL, req.Body, model)
+		}(i, model)
+	}
+	wg.Wait()
+
+	s.logger.Printf("Fan-out of %s to %d models completed in %v", req.URL, len(models), time.Since(start).Round(time.Millisecond))
+
+	c.JSON(http.StatusOK, gin.H{
+		"object":     "fanout",
+		"url":        req.URL,
+		"latency_ms": time.Since(start).Milliseconds(),
+		"results":    results,
+	})
+}
+
+func (s *Server) fanoutOne(ctx context.Context, fanoutReq *http.Request, path string, body json.RawMessage, model string) fanoutResult {
+	result := fanoutResult{Model: model}
+	if strings.TrimSpace(model) == "" {
+		result.Error = &localBatchError{Code: "invalid_model", Message: "model must not be empty"}
+		return result
+	}
+	body, err := openai.SetField(body, "model", model)
+	if err != nil {
+		result.Error = &localBatchError{Code: "invalid_body", Message: "body must be a JSON object"}
+		return result
+	}
+
+	header := fanoutReq.Header.Clone()
+	header.Del("Content-Length")
+
+	start := time.Now()
+	recorder := newBufferedResponse()
+	s.dispatch(ctx, header, fanoutReq.RemoteAddr, path, body, recorder)
+	result.LatencyMS = time.Since(start).Milliseconds()
+
+	if err := ctx.Err(); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			result.Error = &localBatchError{Code: "timeout", Message: "No response before the fan-out timeout"}
+		} else {
+			result.Error = &localBatchError{Code: "cancelled", Message: "Fan-out was cancelled"}
+		}
+		return result
+	}
+
+	result.StatusCode = recorder.status
+	respBody := recorder.body.Bytes()
+	if !json.Valid(respBody) {
+		encoded, _ := json.Marshal(strings.TrimSpace(string(respBody)))
+		respBody = encoded
+	}
+	result.Body = respBody
+
+	if tokens, ok := openai.ParseUsage(respBody); ok {
+		result.Usage = tokens
+		costModel := openai.ParseObject(respBody).Model
+		if costModel == "" {
+			costModel = model
+		}
+		if cost, ok := s.pricing.Cost(costModel, int64(tokens.PromptTokens), int64(tokens.CompletionTokens)); ok {
+			result.CostUSD = &cost
+		}
+	}
+	return result
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/dryrun"
+	"goproxyai/internal/openai"
+	"goproxyai/internal/proxy"
+	"goproxyai/internal/tenant"
+)
+
+// tenantFeatures enforces the resolved tenant's feature flags. It must run
+// after keyAuth.
+func (s *Server) tenantFeatures() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tenantID := c.GetString(ctxTenantID)
+		if tenantID == "" {
+			c.Next()
+			return
+		}
+		t, found := s.tenants.Tenant(tenantID)
+		if !found {
+			c.Next()
+			return
+		}
+		features := t.Features
+
+		if !features.CachingEnabled() {
+			c.Set(ctxCacheDisabled, true)
+		}
+
+		// Uploads are streamed through untouched; none of the body checks apply
+		if isStreamedUpload(c.Request.URL.Path, c.GetHeader("Content-Type")) {
+			c.Next()
+			return
+		}
+
+		if features.StreamingAllowed() && features.MaxContextTokens == 0 {
+			c.Next()
+			return
+		}
+
+		// The remaining checks need the body; put it back for the handler
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			bodyReadFailed(c, err)
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		if !features.StreamingAllowed() && openai.ParseRequest(body).Stream {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "Streaming is not enabled for this tenant",
+				"code":  "STREAMING_DISABLED",
+			})
+			c.Abort()
+			return
+		}
+
+		if features.MaxContextTokens > 0 {
+			if tokens := openai.CountPromptTokens(body); tokens > features.MaxContextTokens {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": fmt.Sprintf("Request context of %d tokens exceeds the tenant limit of %d", tokens, features.MaxContextTokens),
+					"code":  "CONTEXT_TOO_LARGE",
+				})
+				c.Abort()
+				return
+			}
+		}
+
+		c.Next()
+	}
+}
+
+// tenantModeration checks the request against the moderation endpoint when
+// the resolved tenant requires it. It must run after keyAuth.
+func (s *Server) tenantModeration() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tenantID := c.GetString(ctxTenantID)
+		t, found := s.tenants.Tenant(tenantID)
+		if tenantID == "" || !found || !t.Features.ModerationRequired {
+			c.Next()
+			return
+		}
+
+		body, ok := peekBody(c)
+		if !ok {
+			return
+		}
+		if texts := openai.ExtractText(body); len(texts) > 0 {
+			// The check itself goes upstream, so a dry run can't make it
+			if t := dryrun.From(c.Request.Context()); t != nil {
+				t.Add("moderation", "would check %d texts for tenant %s, skipped in a dry run", len(texts), tenantID)
+				c.Next()
+				return
+			}
+			flagged, err := s.moderate(c, texts)
+			if err != nil {
+				s.logger.Printf("Moderation check failed for tenant %s: %v", tenantID, err)
+				c.Error(err)
+				c.JSON(http.StatusBadGateway, gin.H{
+					"error": "Moderation check failed",
+					"code":  "MODERATION_ERROR",
+				})
+				c.Abort()
+				return
+			}
+			if len(flagged) > 0 {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error":      "Request was flagged by moderation",
+					"code":       "MODERATION_FLAGGED",
+					"categories": flagged,
+				})
+				c.Abort()
+				return
+			}
+		}
+
+		c.Next()
+	}
+}
+
+// moderate checks texts against the upstream moderation endpoint with the
+// same credentials the request would be forwarded with, returning the
+// flagged categories
+func (s *Server) moderate(c *gin.Context, texts []string) ([]string, error) {
+	body, err := json.Marshal(map[string]interface{}{"input": texts})
+	if err != nil {
+		return nil, err
+	}
+
+	headers := http.Header{
+		"Authorization": c.Request.Header.Values("Authorization"),
+		"Content-Type":  {"application/json"},
+	}
+	upstreamHeaders, _ := c.Value(ctxUpstreamHeaders).(map[string]string)
+	headers = withUpstreamHeaders(headers, upstreamHeaders)
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), s.config.RequestTimeout)
+	defer cancel()
+
+	resp, err := s.proxyClient.Forward(ctx, &proxy.ProxyRequest{
+		Method:  http.MethodPost,
+		Path:    "/v1/moderations",
+		Headers: headers,
+		Body:    body,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("moderation endpoint returned %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Results []struct {
+			Flagged    bool            `json:"flagged"`
+			Categories map[string]bool `json:"categories"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(resp.Body, &result); err != nil {
+		return nil, err
+	}
+
+	var flagged []string
+	seen := make(map[string]bool)
+	for _, r := range result.Results {
+		if !r.Flagged {
+			continue
+		}
+		for category, hit := range r.Categories {
+			if hit && !seen[category] {
+				seen[category] = true
+				flagged = append(flagged, category)
+			}
+		}
+		if len(flagged) == 0 {
+			flagged = append(flagged, "unspecified")
+		}
+	}
+	return flagged, nil
+}
+
+func (s *Server) getTenantFeatures(c *gin.Context) {
+	t, found := s.tenants.Tenant(c.Param("id"))
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown tenant"})
+		return
+	}
+
+	c.JSON(http.StatusOK, t.Features)
+}
+
+func (s *Server) updateTenantFeatures(c *gin.Context) {
+	var features tenant.Features
+	if err := c.ShouldBindJSON(&features); err != nil || features.MaxContextTokens < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	err := s.tenants.SetFeatures(c.Param("id"), features)
+	if errors.Is(err, tenant.ErrUnknownTenant) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown tenant"})
+		return
+	}
+	if err != nil {
+		s.logger.Printf("Error saving features for tenant %s: %v", c.Param("id"), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save features"})
+		return
+	}
+
+	s.logger.Printf("Updated features for tenant %s", c.Param("id"))
+	c.JSON(http.StatusOK, features)
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/clock"
+	"goproxyai/internal/finetune"
+	"goproxyai/internal/proxy"
+)
+
+const fineTuningJobsPath = "/v1/fine_tuning/jobs"
+
+// Headers a job is checked on with, so the poller sees it as its creator did
+var fineTuneHeaders = []string{"Authorization", "Openai-Organization", "Openai-Project"}
+
+// fineTuneEvent is the notification sent to FINETUNE_WEBHOOKS, shaped like
+// an OpenAI webhook event but carrying the whole job
+type fineTuneEvent struct {
+	ID        string       `json:"id"`
+	Type      string       `json:"type"`
+	CreatedAt int64        `json:"created_at"`
+	Data      finetune.Job `json:"data"`
+}
+
+// trackFineTunes records the fine-tuning jobs in an upstream response to
+// /v1/fine_tuning/jobs, remembering headers to check on them with
+func (s *Server) trackFineTunes(path, tenantID, keyID string, headers http.Header, body []byte) {
+	owner := finetune.Owner{Tenant: tenantID, KeyID: keyID, Header: make(http.Header)}
+	for _, name := range fineTuneHeaders {
+		if value := headers.Get(name); value != "" {
+			owner.Header.Set(name, value)
+		}
+	}
+	finished, err := s.finetunes.Observe(body, owner)
+	if err != nil {
+		s.logger.Printf("Could not track fine-tuning jobs from %s: %v", path, err)
+	}
+	for _, job := range finished {
+		s.notifyFineTune(job)
+	}
+}
+
+// notifyFineTune tells FINETUNE_WEBHOOKS a job has finished
+func (s *Server) notifyFineTune(job finetune.Job) {
+	event := fineTuneEvent{
+		ID:        job.ID + "." + job.Status,
+		Type:      "fine_tuning.job." + job.Status,
+		CreatedAt: clock.Now().Unix(),
+		Data:      job,
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		s.logger.Printf("Error encoding notification for fine-tuning job %s: %v", job.ID, err)
+		return
+	}
+	targets := s.finetuneHooks.Notify(event.ID, event.Type, body)
+	s.logger.Printf("Fine-tuning job %s %s, notified %d endpoints", job.ID, job.Status, targets)
+}
+
+// watchFineTunes checks on unfinished jobs every interval, so teams needn't
+// each poll upstream for them. Jobs loaded from the state file are checked
+// with the upstream API key, having no headers of their own until a client
+// looks them up again.
+func (s *Server) watchFineTunes(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.pollFineTunes()
+		}
+	}()
+}
+
+func (s *Server) pollFineTunes() {
+	for id, owner := range s.finetunes.Unfinished() {
+		header := owner.Header
+		if header == nil {
+			if s.config.UpstreamAPIKey == "" {
+				continue
+			}
+			header = http.Header{"Authorization": {"Bearer " + s.config.UpstreamAPIKey}}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), s.config.RequestTimeout)
+		if upstream, pinned := s.pinnedUpstream(owner.Tenant); pinned {
+			// The job lives where its tenant's traffic is pinned
+			ctx = proxy.WithUpstream(ctx, upstream)
+		}
+		resp, err := s.proxyClient.Forward(ctx, &proxy.ProxyRequest{
+			Method:  http.MethodGet,
+			Path:    fineTuningJobsPath + "/" + id,
+			Headers: header,
+		})
+		cancel()
+		if err != nil {
+			s.logger.Printf("Error checking fine-tuning job %s: %v", id, err)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			s.logger.Printf("Checking fine-tuning job %s returned %d", id, resp.StatusCode)
+			continue
+		}
+
+		finished, err := s.finetunes.Observe(resp.Body, finetune.Owner{})
+		if err != nil {
+			s.logger.Printf("Could not track fine-tuning job %s: %v", id, err)
+		}
+		for _, job := range finished {
+			s.notifyFineTune(job)
+		}
+	}
+}
+
+// fineTuneWebhook applies an OpenAI fine_tuning.job.* webhook event to the
+// job it's about
+func (s *Server) fineTuneWebhook(eventType, jobID string) {
+	status, found := strings.CutPrefix(eventType, "fine_tuning.job.")
+	if !found {
+		return
+	}
+	job, finished, err := s.finetunes.SetStatus(jobID, status)
+	if err != nil {
+		s.logger.Printf("Could not track fine-tuning job %s: %v", jobID, err)
+	}
+	if finished {
+		s.notifyFineTune(job)
+	}
+}
+
+func (s *Server) listFineTunes(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"jobs": s.finetunes.Jobs(c.Query("tenant"), c.Query("status")),
+	})
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/dryrun"
+	"goproxyai/internal/geoip"
+	"goproxyai/internal/metrics"
+	"goproxyai/internal/proxy"
+)
+
+// Set to the ISO code of the country a request's client is in, when
+// GEOIP_DB knows it
+const ctxCountry = metrics.CountryKey
+
+// geoRules are what GEOIP_* says to do with requests from each country
+type geoRules struct {
+	db        *geoip.DB
+	allowed   map[string]bool
+	blocked   map[string]bool
+	upstreams map[string]string // country to upstream URL
+}
+
+// countrySet reads ISO country codes, in either case
+func countrySet(codes []string) map[string]bool {
+	set := make(map[string]bool, len(codes))
+	for _, code := range codes {
+		set[strings.ToUpper(code)] = true
+	}
+	return set
+}
+
+// parseGeoUpstreams reads COUNTRY=name entries naming UPSTREAM_TARGETS
+func parseGeoUpstreams(entries []string, targets map[string]string) (map[string]string, error) {
+	upstreams := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		country, name, found := strings.Cut(entry, "=")
+		if !found || len(country) != 2 {
+			return nil, fmt.Errorf("invalid entry %q, expected COUNTRY=name", entry)
+		}
+		url, found := targets[name]
+		if !found {
+			return nil, fmt.Errorf("%s is sent to upstream %q, which UPSTREAM_TARGETS doesn't name", country, name)
+		}
+		upstreams[strings.ToUpper(country)] = url
+	}
+	return upstreams, nil
+}
+
+// locateClient looks up the country each request's client is in, for the
+// request log and metrics, refuses requests GEOIP_* doesn't allow from
+// there, and sends the rest to their country's upstream. A tenant pinned
+// to an upstream stays on it, since auth pins it after this. Clients on
+// loopback and private addresses, such as health checks, aren't placed.
+func (s *Server) locateClient() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ip := net.ParseIP(c.ClientIP())
+		if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() {
+			c.Next()
+			return
+		}
+		trace := dryrun.From(c.Request.Context())
+		location, found := s.geo.db.Lookup(ip)
+		country := location.Country
+		if found {
+			c.Set(ctxCountry, country)
+		}
+
+		var refused bool
+		switch {
+		case !found:
+			refused = s.config.GeoIPBlockUnknown
+		case len(s.geo.allowed) > 0:
+			refused = !s.geo.allowed[country] || s.geo.blocked[country]
+		default:
+			refused = s.geo.blocked[country]
+		}
+		if refused {
+			if found {
+				trace.Add("geoip", "refused: client is in %s", country)
+			} else {
+				trace.Add("geoip", "refused: client's location is unknown")
+			}
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "Requests from your location are not allowed",
+				"code":  "LOCATION_BLOCKED",
+			})
+			c.Abort()
+			return
+		}
+
+		if url, routed := s.geo.upstreams[country]; found && routed {
+			c.Request = c.Request.WithContext(proxy.WithUpstream(c.Request.Context(), url))
+			trace.Add("geoip", "client is in %s, sent to %s", country, url)
+		} else if found {
+			trace.Add("geoip", "client is in %s", country)
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"goproxyai/internal/openai"
+	proxyv1 "goproxyai/proto/proxy/v1"
+)
+
+// The proto field names match the REST API, so messages translate to and
+// from request and response bodies directly
+var (
+	protoRequest  = protojson.MarshalOptions{UseProtoNames: true}
+	protoResponse = protojson.UnmarshalOptions{DiscardUnknown: true}
+)
+
+func (s *Server) newGRPCServer() *grpc.Server {
+	grpcServer := grpc.NewServer()
+	proxyv1.RegisterProxyServer(grpcServer, &grpcService{server: s})
+	reflection.Register(grpcServer)
+	return grpcServer
+}
+
+func (s *Server) runGRPC(grpcServer *grpc.Server) {
+	listeners, err := s.listen(s.config.GRPCPort, false)
+	if err != nil {
+		s.logger.Fatalf("Failed to listen for gRPC on port %s: %v", s.config.GRPCPort, err)
+	}
+
+	for _, listener := range listeners[1:] {
+		s.logger.Printf("gRPC server starting on %s", listener.Addr())
+		go func(listener net.Listener) {
+			if err := grpcServer.Serve(listener); err != nil {
+				s.logger.Fatalf("gRPC server stopped: %v", err)
+			}
+		}(listener)
+	}
+	s.logger.Printf("gRPC server starting on %s", listeners[0].Addr())
+	if err := grpcServer.Serve(listeners[0]); err != nil {
+		s.logger.Fatalf("gRPC server stopped: %v", err)
+	}
+}
+
+// grpcService implements the gRPC frontend by translating each call into the
+// equivalent /v1 request and dispatching it through the router
+type grpcService struct {
+	proxyv1.UnimplementedProxyServer
+	server *Server
+}
+
+func (g *grpcService) CreateChatCompletion(ctx context.Context, req *proxyv1.ChatCompletionRequest) (*proxyv1.ChatCompletionResponse, error) {
+	resp := &proxyv1.ChatCompletionResponse{}
+	return resp, g.call(ctx, "/v1/chat/completions", req, resp)
+}
+
+func (g *grpcService) StreamChatCompletion(req *proxyv1.ChatCompletionRequest, stream proxyv1.Proxy_StreamChatCompletionServer) error {
+	return g.stream(stream.Context(), "/v1/chat/completions", req, func(data []byte) error {
+		chunk := &proxyv1.ChatCompletionChunk{}
+		if err := protoResponse.Unmarshal(data, chunk); err != nil {
+			return status.Errorf(codes.Internal, "invalid stream event from upstream: %v", err)
+		}
+		return stream.Send(chunk)
+	})
+}
+
+func (g *grpcService) CreateCompletion(ctx context.Context, req *proxyv1.CompletionRequest) (*proxyv1.CompletionResponse, error) {
+	resp := &proxyv1.CompletionResponse{}
+	return resp, g.call(ctx, "/v1/completions", req, resp)
+}
+
+func (g *grpcService) StreamCompletion(req *proxyv1.CompletionRequest, stream proxyv1.Proxy_StreamCompletionServer) error {
+	return g.stream(stream.Context(), "/v1/completions", req, func(data []byte) error {
+		chunk := &proxyv1.CompletionResponse{}
+		if err := protoResponse.Unmarshal(data, chunk); err != nil {
+			return status.Errorf(codes.Internal, "invalid stream event from upstream: %v", err)
+		}
+		return stream.Send(chunk)
+	})
+}
+
+func (g *grpcService) CreateEmbeddings(ctx context.Context, req *proxyv1.EmbeddingsRequest) (*proxyv1.EmbeddingsResponse, error) {
+	resp := &proxyv1.EmbeddingsResponse{}
+	return resp, g.call(ctx, "/v1/embeddings", req, resp)
+}
+
+func (g *grpcService) call(ctx context.Context, path string, req, resp proto.Message) error {
+	body, err := protoRequest.Marshal(req)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid request: %v", err)
+	}
+
+	w := newBufferedResponse()
+	g.server.dispatch(ctx, incomingHeader(ctx), peerAddress(ctx), path, body, w)
+	if w.status >= http.StatusMultipleChoices {
+		return httpError(ctx, w.status, w.body.Bytes())
+	}
+
+	if err := protoResponse.Unmarshal(w.body.Bytes(), resp); err != nil {
+		return status.Errorf(codes.Internal, "invalid response from upstream: %v", err)
+	}
+	return nil
+}
+
+func (g *grpcService) stream(ctx context.Context, path string, req proto.Message, send func([]byte) error) error {
+	body, err := protoRequest.Marshal(req)
+	if err == nil {
+		body, err = openai.SetField(body, "stream", true)
+	}
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid request: %v", err)
+	}
+
+	w := &eventWriter{header: make(http.Header), status: http.StatusOK, send: send}
+	g.server.dispatch(ctx, incomingHeader(ctx), peerAddress(ctx), path, body, w)
+	if w.status >= http.StatusMultipleChoices {
+		return httpError(ctx, w.status, w.body.Bytes())
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if w.body.Len() > 0 {
+		return status.Error(codes.Internal, "upstream did not return an event stream")
+	}
+	return nil
+}
+
+// incomingHeader turns the call's metadata into request headers, so the API
+// key and any other headers clients would send over REST carry over
+func incomingHeader(ctx context.Context) http.Header {
+	header := make(http.Header)
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, values := range md {
+		if strings.HasPrefix(key, ":") || strings.HasPrefix(key, "grpc-") || strings.HasSuffix(key, "-bin") || key == "content-type" || key == "te" {
+			continue
+		}
+		for _, value := range values {
+			header.Add(key, value)
+		}
+	}
+	return header
+}
+
+func peerAddress(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// httpError maps an HTTP error response to the closest gRPC status, using
+// the error message from either a proxy or an OpenAI error body
+func httpError(ctx context.Context, statusCode int, body []byte) error {
+	if err := ctx.Err(); err != nil {
+		return status.FromContextError(err).Err()
+	}
+
+	message := http.StatusText(statusCode)
+	var proxyErr struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if json.Unmarshal(body, &proxyErr) == nil && len(proxyErr.Error) > 0 {
+		var text string
+		var upstreamErr struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(proxyErr.Error, &text) == nil && text != "" {
+			message = text
+		} else if json.Unmarshal(proxyErr.Error, &upstreamErr) == nil && upstreamErr.Message != "" {
+			message = upstreamErr.Message
+		}
+	}
+
+	code := codes.Unknown
+	switch statusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		code = codes.InvalidArgument
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	case http.StatusGatewayTimeout:
+		code = codes.DeadlineExceeded
+	case http.StatusInternalServerError:
+		code = codes.Internal
+	}
+	return status.Error(code, message)
+}
+
+// eventWriter is an http.ResponseWriter that turns a server-sent event
+// stream into messages as it's written. Non-stream responses, such as
+// errors, are buffered instead.
+type eventWriter struct {
+	header  http.Header
+	status  int
+	send    func([]byte) error
+	pending []byte
+	body    bytes.Buffer
+	err     error
+}
+
+func (w *eventWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *eventWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *eventWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.status >= http.StatusMultipleChoices || !strings.HasPrefix(w.header.Get("Content-Type"), "text/event-stream") {
+		return w.body.Write(p)
+	}
+
+	w.pending = append(w.pending, p...)
+	for {
+		end := bytes.IndexByte(w.pending, '\n')
+		if end < 0 {
+			break
+		}
+		line := bytes.TrimSpace(w.pending[:end])
+		w.pending = w.pending[end+1:]
+
+		data, found := bytes.CutPrefix(line, []byte("data:"))
+		if !found {
+			continue
+		}
+		if data = bytes.TrimSpace(data); bytes.Equal(data, []byte("[DONE]")) {
+			continue
+		}
+		if err := w.send(data); err != nil {
+			w.err = err
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush is a no-op; events are sent as soon as their line is complete
+func (w *eventWriter) Flush() {}
+
+// Hijack refuses, since there's no connection behind the response
+func (w *eventWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, http.ErrNotSupported
+}
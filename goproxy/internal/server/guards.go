@@ -0,0 +1,145 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// guards cap the connections the listeners hold open, overall and per
+// client IP, and the /v1 requests being answered at once. They're the last
+// line of defense against floods that rate limits, which only count
+// requests that got through, don't stop.
+type guards struct {
+	maxConnections int
+	maxPerIP       int
+	maxInFlight    int64
+
+	mutex sync.Mutex
+	open  int
+	byIP  map[string]int
+
+	inFlight atomic.Int64
+
+	rejectedConnections atomic.Int64 // over MAX_CONNECTIONS
+	rejectedPerIP       atomic.Int64 // over MAX_CONNECTIONS_PER_IP
+	rejectedInFlight    atomic.Int64 // over MAX_IN_FLIGHT_REQUESTS
+}
+
+func newGuards(maxConnections, maxPerIP, maxInFlight int) *guards {
+	return &guards{
+		maxConnections: maxConnections,
+		maxPerIP:       maxPerIP,
+		maxInFlight:    int64(maxInFlight),
+		byIP:           make(map[string]int),
+	}
+}
+
+// listener closes connections past the caps as soon as they're accepted,
+// before any of their bytes are read
+func (g *guards) listener(listener net.Listener) net.Listener {
+	return &guardedListener{Listener: listener, g: g}
+}
+
+type guardedListener struct {
+	net.Listener
+	g *guards
+}
+
+func (l *guardedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if l.g.admit(ip) {
+			return &guardedConn{Conn: conn, g: l.g, ip: ip}, nil
+		}
+		conn.Close()
+	}
+}
+
+func (g *guards) admit(ip string) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.maxConnections > 0 && g.open >= g.maxConnections {
+		g.rejectedConnections.Add(1)
+		return false
+	}
+	if g.maxPerIP > 0 && g.byIP[ip] >= g.maxPerIP {
+		g.rejectedPerIP.Add(1)
+		return false
+	}
+	g.open++
+	g.byIP[ip]++
+	return true
+}
+
+func (g *guards) release(ip string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.open--
+	if g.byIP[ip]--; g.byIP[ip] <= 0 {
+		delete(g.byIP, ip)
+	}
+}
+
+// guardedConn gives its place back when it's closed, whether by the server
+// or by whoever took it over
+type guardedConn struct {
+	net.Conn
+	g    *guards
+	ip   string
+	once sync.Once
+}
+
+func (c *guardedConn) Close() error {
+	c.once.Do(func() { c.g.release(c.ip) })
+	return c.Conn.Close()
+}
+
+// limitInFlight turns /v1 requests away with a retriable 503 while
+// MAX_IN_FLIGHT_REQUESTS are being answered, streams included
+func (s *Server) limitInFlight() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.guards.inFlight.Add(1) > s.guards.maxInFlight {
+			s.guards.inFlight.Add(-1)
+			s.guards.rejectedInFlight.Add(1)
+			c.Header("Retry-After", "1")
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+				"error": "The proxy is handling too many requests. Please retry shortly.",
+				"code":  "OVERLOADED",
+			})
+			return
+		}
+		defer s.guards.inFlight.Add(-1)
+		c.Next()
+	}
+}
+
+// connections reports the connections open, and how many client IPs
+// they're from
+func (g *guards) connections() (int, int) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.open, len(g.byIP)
+}
+
+func (g *guards) stats() map[string]interface{} {
+	open, clients := g.connections()
+	return map[string]interface{}{
+		"connections":            open,
+		"clients":                clients,
+		"in_flight":              g.inFlight.Load(),
+		"max_connections":        g.maxConnections,
+		"max_connections_per_ip": g.maxPerIP,
+		"max_in_flight":          g.maxInFlight,
+		"rejected_connections":   g.rejectedConnections.Load(),
+		"rejected_per_ip":        g.rejectedPerIP.Load(),
+		"rejected_in_flight":     g.rejectedInFlight.Load(),
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"goproxyai/internal/tlspolicy"
+)
+
+// http3Server serves HTTP/3 on UDP sockets. Only builds tagged http3 have
+// one, since QUIC comes from quic-go.
+type http3Server interface {
+	Serve(conn net.PacketConn) error
+	Close() error
+}
+
+func (s *Server) http3Port() string {
+	if s.config.HTTP3Port != "" {
+		return s.config.HTTP3Port
+	}
+	return s.config.Port
+}
+
+// startHTTP3 serves HTTP/3 on the hosts the proxy listens on, with the
+// listener's certificate. HTTP/3 is always TLS 1.3.
+func (s *Server) startHTTP3(handler http.Handler) (http3Server, error) {
+	cert, err := tls.LoadX509KeyPair(s.config.TLSCertFile, s.config.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	tlspolicy.Current().Apply(tlsConfig)
+	tlsConfig.MinVersion = tls.VersionTLS13
+
+	conns, err := s.listenPackets(s.http3Port())
+	if err != nil {
+		return nil, err
+	}
+	server := s.newHTTP3Server(handler, tlsConfig)
+	for _, conn := range conns {
+		s.logger.Printf("HTTP/3 server starting on %s (udp)", conn.LocalAddr())
+		go func(conn net.PacketConn) {
+			if err := server.Serve(conn); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				s.logger.Printf("HTTP/3 server on %s stopped: %v", conn.LocalAddr(), err)
+			}
+		}(conn)
+	}
+	return server, nil
+}
+
+// advertiseHTTP3 tells HTTP/1.1 and HTTP/2 clients where HTTP/3 is served,
+// so they can move their next requests to it
+func (s *Server) advertiseHTTP3(next http.Handler) http.Handler {
+	altSvc := fmt.Sprintf(`h3=":%s"; ma=86400`, s.http3Port())
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", altSvc)
+		next.ServeHTTP(w, r)
+	})
+}
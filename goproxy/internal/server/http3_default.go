@@ -0,0 +1,15 @@
+//go:build !http3
+
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+// Without the http3 tag QUIC isn't linked in, so HTTP3 can't be set
+const http3Built = false
+
+func (s *Server) newHTTP3Server(handler http.Handler, tlsConfig *tls.Config) http3Server {
+	return nil
+}
@@ -0,0 +1,26 @@
+//go:build http3
+
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// Built with -tags http3, the proxy can serve HTTP/3 over quic-go
+const http3Built = true
+
+func (s *Server) newHTTP3Server(handler http.Handler, tlsConfig *tls.Config) http3Server {
+	return &http3.Server{
+		Handler:        handler,
+		TLSConfig:      tlsConfig,
+		MaxHeaderBytes: s.config.HTTPMaxHeaderBytes,
+		QuicConfig: &quic.Config{
+			MaxIdleTimeout:     s.config.HTTPIdleTimeout,
+			MaxIncomingStreams: int64(s.config.HTTP2MaxStreams),
+		},
+	}
+}
@@ -0,0 +1,445 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/cache"
+	"goproxyai/internal/dryrun"
+	"goproxyai/internal/imagestore"
+	"goproxyai/internal/openai"
+	"goproxyai/internal/proxy"
+)
+
+const imageGenerationsPath = "/v1/images/generations"
+
+// Endpoints that answer with generated images
+var imagePaths = map[string]bool{
+	imageGenerationsPath:    true,
+	"/v1/images/edits":      true,
+	"/v1/images/variations": true,
+}
+
+// Stored images are named by the hash of their contents
+var storedImageName = regexp.MustCompile(`^[0-9a-f]{64}\.(png|jpeg|webp)$`)
+
+// imageRequest is the part of an image request, JSON or multipart, that
+// decides how its response is handled
+type imageRequest struct {
+	Model          string
+	ResponseFormat string
+	Stream         bool
+	JSON           bool
+}
+
+// wantsURL reports whether the client expects image URLs, which DALL·E
+// models return unless asked for b64_json. GPT image models only return
+// base64.
+func (r imageRequest) wantsURL() bool {
+	if isGPTImageModel(r.Model) {
+		return false
+	}
+	return r.ResponseFormat == "" || r.ResponseFormat == "url"
+}
+
+// handlesImages reports whether an image request goes through imageHandler:
+// generations the image cache may answer, and any image request whose URLs
+// the image store replaces
+func (s *Server) handlesImages(method, path string, headers http.Header, body []byte, cacheDisabled bool) (imageRequest, bool) {
+	if method != http.MethodPost || !imagePaths[path] {
+		return imageRequest{}, false
+	}
+	image := parseImageRequest(headers.Get("Content-Type"), body)
+	if image.Stream {
+		return image, false
+	}
+	cached := s.images != nil && !cacheDisabled && path == imageGenerationsPath
+	stored := s.imageStore != nil && image.wantsURL()
+	return image, cached || stored
+}
+
+// imageHandler answers image generations from the image cache when the
+// same prompt was generated before, and copies images into the image store
+// for clients that asked for URLs. Upstream is asked for base64 whenever
+// the images are kept, so it's the images themselves that are kept rather
+// than URLs that expire; clients that asked for URLs get ones to the
+// proxy's copy instead.
+func (s *Server) imageHandler(c *gin.Context, path string, image imageRequest, headers http.Header, upstreamHeaders map[string]string, body []byte, cacheDisabled bool, tenantID, keyID string, info openai.RequestInfo) {
+	var key string
+	cacheable := false
+	if s.images != nil && !cacheDisabled && path == imageGenerationsPath {
+		scope := tenantID
+		if scope == "" {
+			scope = keyID
+		}
+		key, cacheable = cache.ImageKey(scope, body)
+	}
+	wantURL := image.wantsURL()
+	stored := s.imageStore != nil && wantURL
+	trace := dryrun.From(c.Request.Context())
+
+	if cacheable {
+		if entry, found := s.images.Get(key); found {
+			trace.Add("cache", "image hit, stored %s", entry.Timestamp.Format("2006-01-02T15:04:05Z07:00"))
+			s.logger.Printf("Image cache hit for %s", path)
+			s.writeImages(c, entry, wantURL, "HIT")
+			return
+		}
+		trace.Add("cache", "image miss")
+	}
+
+	// Multipart edits and variations are sent as they are, and any URLs
+	// they return downloaded instead
+	forwardBody := body
+	if (cacheable || stored) && image.JSON && !isGPTImageModel(image.Model) {
+		if updated, err := openai.SetField(body, "response_format", "b64_json"); err == nil {
+			forwardBody = updated
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), s.requestTimeout(c))
+	defer cancel()
+	resp, err := s.proxyClient.Forward(ctx, &proxy.ProxyRequest{
+		Method:  http.MethodPost,
+		Path:    path,
+		Headers: withUpstreamHeaders(headers, upstreamHeaders),
+		Body:    forwardBody,
+	})
+	if err != nil {
+		s.logger.Printf("Error forwarding request: %v", err)
+		c.Error(err)
+		s.forwardFailed(c, err)
+		return
+	}
+	s.recordResponse(c, tenantID, keyID, info, resp.Body)
+
+	inline := hasBase64Images(resp.Body)
+	if resp.StatusCode != http.StatusOK || !inline && !stored {
+		s.copyHeaders(c, resp.Headers)
+		c.Data(resp.StatusCode, http.Header(resp.Headers).Get("Content-Type"), resp.Body)
+		return
+	}
+
+	entry := &cache.ImageEntry{Body: resp.Body}
+	if cacheable && inline {
+		if cached, ok := s.images.Set(key, tenantID, info.User, resp.Body); ok {
+			entry = cached
+		} else {
+			s.logger.Printf("%s response of %d bytes exceeds IMAGE_CACHE_SIZE, not cached", path, len(resp.Body))
+		}
+	}
+	if wantURL && entry.ID == "" && !stored {
+		// Without an entry there's no copy to point URLs at, so these
+		// images can only be returned inline
+		wantURL = false
+	}
+	s.writeImages(c, entry, wantURL, "MISS")
+	s.logger.Printf("%s %s -> %d (%d bytes)", http.MethodPost, path, resp.StatusCode, len(resp.Body))
+}
+
+// writeImages answers with an image response, its images as URLs to the
+// proxy's copy when the client asked for URLs
+func (s *Server) writeImages(c *gin.Context, entry *cache.ImageEntry, wantURL bool, cacheStatus string) {
+	body := entry.Body
+	if wantURL {
+		urls, err := s.imageURLs(c, entry)
+		if err == nil {
+			body, err = withImageURLs(body, urls)
+		}
+		if err != nil {
+			// Images already given as upstream URLs are still usable for
+			// now, and base64 ones at all times
+			s.logger.Printf("Could not rewrite image URLs: %v", err)
+			body = entry.Body
+		}
+	}
+	c.Header("X-Cache", cacheStatus)
+	s.provenanceHeaders(c)
+	if !entry.Timestamp.IsZero() {
+		c.Header("X-Cache-Timestamp", entry.Timestamp.Format("2006-01-02T15:04:05Z07:00"))
+	}
+	c.Data(http.StatusOK, "application/json", body)
+}
+
+// imageURLs points at the entry's images in the image store, putting them
+// there the first time, or else at the image cache's copy
+func (s *Server) imageURLs(c *gin.Context, entry *cache.ImageEntry) ([]string, error) {
+	baseURL := s.imageBaseURL(c) + "/proxy/v1/images/"
+	if s.imageStore != nil {
+		names := entry.Stored
+		if names == nil {
+			ctx, cancel := context.WithTimeout(c.Request.Context(), s.requestTimeout(c))
+			defer cancel()
+			var err error
+			names, err = s.storeImages(ctx, entry.Body)
+			switch {
+			case err != nil && entry.ID == "":
+				return nil, err
+			case err != nil:
+				s.logger.Printf("Could not store images, linking the cached copy: %v", err)
+			case entry.ID != "":
+				s.images.SetStored(entry.ID, names)
+			}
+		}
+		if names != nil {
+			urls := make([]string, len(names))
+			for i, name := range names {
+				urls[i] = baseURL + name
+			}
+			return urls, nil
+		}
+	}
+
+	count, err := imageCount(entry.Body)
+	if err != nil {
+		return nil, err
+	}
+	urls := make([]string, count)
+	for i := range urls {
+		urls[i] = baseURL + entry.ID + "/" + strconv.Itoa(i)
+	}
+	return urls, nil
+}
+
+// storeImages puts the images of a response into the image store, each
+// named by the hash of its contents so storing one again changes nothing.
+// Images given as URLs are downloaded first.
+func (s *Server) storeImages(ctx context.Context, body []byte) ([]string, error) {
+	var response struct {
+		OutputFormat string `json:"output_format"`
+		Data         []struct {
+			B64JSON string `json:"b64_json"`
+			URL     string `json:"url"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(response.Data))
+	for i, image := range response.Data {
+		format := response.OutputFormat
+		var data []byte
+		var err error
+		switch {
+		case image.B64JSON != "":
+			data, err = base64.StdEncoding.DecodeString(image.B64JSON)
+		case image.URL != "":
+			var contentType string
+			data, contentType, err = s.downloadImage(ctx, image.URL)
+			format = strings.TrimPrefix(contentType, "image/")
+		default:
+			err = errors.New("image has neither b64_json nor url")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("image %d: %w", i, err)
+		}
+		if format != "jpeg" && format != "webp" {
+			format = "png"
+		}
+
+		digest := sha256.Sum256(data)
+		names[i] = hex.EncodeToString(digest[:]) + "." + format
+		if err := s.imageStore.Put(ctx, names[i], "image/"+format, data); err != nil {
+			return nil, fmt.Errorf("image %d: %w", i, err)
+		}
+	}
+	return names, nil
+}
+
+// downloadImage fetches an image upstream handed out a URL to, up to
+// MAX_RESPONSE_BODY_SIZE
+func (s *Server) downloadImage(ctx context.Context, url string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("download returned %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(proxy.LimitBody(resp.Body, s.config.MaxResponseBodySize*1024*1024))
+	if err != nil {
+		return nil, "", err
+	}
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return data, contentType, nil
+}
+
+// getCachedImage serves an image the proxy keeps for a cached generation,
+// for the URLs writeImages hands out
+func (s *Server) getCachedImage(c *gin.Context) {
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+	image, contentType, found := s.images.Image(c.Param("id"), index)
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Image not found or expired",
+			"code":  "IMAGE_NOT_FOUND",
+		})
+		return
+	}
+	c.Header("Cache-Control", "private, max-age="+strconv.Itoa(int(s.config.ImageCacheTTL.Seconds())))
+	c.Data(http.StatusOK, contentType, image)
+}
+
+// getStoredImage serves an image from the image store. Its name is the hash
+// of its contents, so it never changes and may be cached for good.
+func (s *Server) getStoredImage(c *gin.Context) {
+	name := c.Param("id")
+	if !storedImageName.MatchString(name) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found", "code": "IMAGE_NOT_FOUND"})
+		return
+	}
+	image, contentType, err := s.imageStore.Get(c.Request.Context(), name)
+	if errors.Is(err, imagestore.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found", "code": "IMAGE_NOT_FOUND"})
+		return
+	}
+	if err != nil {
+		s.logger.Printf("Error reading image %s from IMAGE_STORE: %v", name, err)
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error": "Image store unavailable",
+			"code":  "IMAGE_STORE_ERROR",
+		})
+		return
+	}
+	c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	c.Data(http.StatusOK, contentType, image)
+}
+
+// imageBaseURL is where clients reach the proxy, for the image URLs it
+// hands out: IMAGE_CACHE_URL, or worked out from the request
+func (s *Server) imageBaseURL(c *gin.Context) string {
+	if s.config.ImageCacheURL != "" {
+		return strings.TrimSuffix(s.config.ImageCacheURL, "/")
+	}
+	proto := c.GetHeader("X-Forwarded-Proto")
+	if proto == "" {
+		proto = "http"
+		if c.Request.TLS != nil {
+			proto = "https"
+		}
+	}
+	host := c.GetHeader("X-Forwarded-Host")
+	if host == "" {
+		host = c.Request.Host
+	}
+	return proto + "://" + host
+}
+
+// withImageURLs replaces each image's b64_json or url with the URL given
+// for it
+func withImageURLs(body []byte, urls []string) ([]byte, error) {
+	var response map[string]json.RawMessage
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, err
+	}
+	var data []map[string]json.RawMessage
+	if err := json.Unmarshal(response["data"], &data); err != nil {
+		return nil, err
+	}
+	if len(data) != len(urls) {
+		return nil, fmt.Errorf("%d images but %d URLs", len(data), len(urls))
+	}
+	for i, image := range data {
+		delete(image, "b64_json")
+		url, _ := json.Marshal(urls[i])
+		image["url"] = url
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	response["data"] = encoded
+	return json.Marshal(response)
+}
+
+// parseImageRequest reads the fields imageRequest needs from a JSON body,
+// or from the form fields of a multipart one
+func parseImageRequest(contentType string, body []byte) imageRequest {
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	if mediaType != "multipart/form-data" {
+		var request struct {
+			Model          string `json:"model"`
+			ResponseFormat string `json:"response_format"`
+			Stream         bool   `json:"stream"`
+		}
+		json.Unmarshal(body, &request)
+		return imageRequest{Model: request.Model, ResponseFormat: request.ResponseFormat, Stream: request.Stream, JSON: true}
+	}
+
+	var request imageRequest
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return request
+		}
+		if part.FileName() != "" {
+			continue
+		}
+		value, _ := io.ReadAll(io.LimitReader(part, 256))
+		switch part.FormName() {
+		case "model":
+			request.Model = string(value)
+		case "response_format":
+			request.ResponseFormat = string(value)
+		case "stream":
+			request.Stream = string(value) == "true"
+		}
+	}
+}
+
+func isGPTImageModel(model string) bool {
+	return strings.HasPrefix(model, "gpt-image")
+}
+
+func imageCount(body []byte) (int, error) {
+	var response struct {
+		Data []json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return 0, err
+	}
+	return len(response.Data), nil
+}
+
+func hasBase64Images(body []byte) bool {
+	var response struct {
+		Data []struct {
+			B64JSON string `json:"b64_json"`
+		} `json:"data"`
+	}
+	if json.Unmarshal(body, &response) != nil || len(response.Data) == 0 {
+		return false
+	}
+	for _, image := range response.Data {
+		if image.B64JSON == "" {
+			return false
+		}
+	}
+	return true
+}
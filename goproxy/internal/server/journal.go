@@ -0,0 +1,50 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/billing"
+	"goproxyai/internal/clock"
+	"goproxyai/internal/dryrun"
+)
+
+// journalRequests journals every /v1 request once it's answered: who made
+// it, for which model, how it was answered and the tokens and cost it was
+// billed. Its ID is returned in X-Proxy-Request-Id, and upstream's own
+// request ID is kept alongside, so an entry can be traced both ways. It
+// runs ahead of the pipeline, so requests the pipeline refuses are
+// journaled too. Dry runs aren't.
+func (s *Server) journalRequests() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if dryrun.From(c.Request.Context()) != nil {
+			c.Next()
+			return
+		}
+		entry := billing.Entry{ID: newRequestID(), Time: clock.Now().UTC()}
+		c.Header("X-Proxy-Request-Id", entry.ID)
+
+		c.Next()
+
+		entry.Completed = clock.Now().UTC()
+		entry.Method = c.Request.Method
+		entry.Path = c.Request.URL.Path
+		entry.Status = c.Writer.Status()
+		entry.Cache = c.Writer.Header().Get("X-Cache")
+		entry.UpstreamRequestID = c.Writer.Header().Get("X-Request-Id")
+		u := usageOf(c)
+		entry.Tenant, entry.Key, entry.User, entry.Model = u.tenant, u.key, u.user, u.model
+		entry.PromptTokens, entry.CompletionTokens, entry.TotalTokens = u.promptTokens, u.completionTokens, u.totalTokens
+		entry.Cost, entry.Priced = s.pricing.Cost(entry.Model, entry.PromptTokens, entry.CompletionTokens)
+		s.journal.Write(entry)
+	}
+}
+
+// newRequestID makes the random ID a request is journaled under
+func newRequestID() string {
+	var id [12]byte
+	rand.Read(id[:])
+	return "req_" + hex.EncodeToString(id[:])
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/clock"
+	"goproxyai/internal/dryrun"
+	"goproxyai/internal/metrics"
+	"goproxyai/internal/proxy"
+	"goproxyai/internal/tenant"
+)
+
+// Context keys set by the /v1 middlewares for proxyHandler
+const (
+	ctxTenantID        = metrics.TenantKey
+	ctxUpstreamHeaders = "upstream_headers"
+	ctxCacheDisabled   = "cache_disabled"
+)
+
+// Set by proxyHandler to the end user a request is made for, when it names
+// one, and to the model it asks for
+const (
+	ctxUser  = metrics.UserKey
+	ctxModel = metrics.ModelKey
+)
+
+type mintKeyRequest struct {
+	Name       string                                `json:"name"`
+	Scopes     []string                              `json:"scopes"`
+	RateLimit  int                                   `json:"rate_limit"`
+	ExpiresIn  string                                `json:"expires_in"`
+	Defaults   map[string]map[string]json.RawMessage `json:"defaults"`
+	Tools      []string                              `json:"tools"`
+	StripTools bool                                  `json:"strip_tools"`
+	Upstream   string                                `json:"upstream"`
+}
+
+// mintSelfServiceKey lets a tenant admin issue virtual keys for their own
+// team without involving the proxy operator
+func (s *Server) mintSelfServiceKey(c *gin.Context) {
+	t, found := s.tenants.LookupAdmin(c.GetHeader("Authorization"))
+	if !found {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Invalid or missing tenant admin token",
+			"code":  "TENANT_UNAUTHORIZED",
+		})
+		return
+	}
+
+	var req mintKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	lifetime := s.config.KeyLifetime
+	if req.ExpiresIn != "" {
+		parsed, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || parsed <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid expires_in, expected a positive duration like 720h"})
+			return
+		}
+		lifetime = parsed
+	}
+
+	if maxLifetime := t.MaxLifetime(s.config.KeyMaxLifetime); maxLifetime > 0 && lifetime > maxLifetime {
+		if req.ExpiresIn != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expires_in exceeds the maximum key lifetime of " + maxLifetime.String()})
+			return
+		}
+		lifetime = maxLifetime
+	}
+
+	if err := checkDefaults(req.Defaults); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, found := s.upstreamTargets[req.Upstream]; req.Upstream != "" && !found {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown upstream %q", req.Upstream)})
+		return
+	}
+
+	key, err := s.tenants.Mint(t.ID, req.Name, req.Scopes, req.RateLimit, lifetime, req.Defaults, req.Tools, req.StripTools, req.Upstream)
+	if errors.Is(err, tenant.ErrScopeNotAllowed) || errors.Is(err, tenant.ErrRateLimitTooHigh) || errors.Is(err, tenant.ErrUpstreamPinned) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		s.logger.Printf("Error minting key for tenant %s: %v", t.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create key"})
+		return
+	}
+
+	s.logger.Printf("Tenant %s minted key %q expiring %s", t.ID, key.Name, key.ExpiresAt.Format(time.RFC3339))
+	c.JSON(http.StatusCreated, key)
+}
+
+// keyAuth runs authorizeKey for proxied requests and passes the resolved
+// tenant and upstream header overrides on through the context
+func (s *Server) keyAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tenantID, upstreamHeaders, ok := s.authorizeKey(c, c.GetHeader("Authorization"), c.Request.URL.Path)
+		if !ok {
+			c.Abort()
+			return
+		}
+
+		c.Set(ctxTenantID, tenantID)
+		c.Set(ctxUpstreamHeaders, upstreamHeaders)
+		c.Next()
+	}
+}
+
+// authorizeKey resolves the tenant for the presented API key and enforces
+// the key's expiry, scopes and rate limit, pinning the request to the
+// tenant's upstream when it has one. It also returns the headers to
+// override when forwarding: the upstream key for virtual keys and the
+// tenant's OpenAI organization and project. It writes the error response
+// itself when it returns false.
+func (s *Server) authorizeKey(c *gin.Context, authorization, path string) (string, map[string]string, bool) {
+	key, t, found := s.tenants.Lookup(authorization)
+	trace := dryrun.From(c.Request.Context())
+	if !found {
+		trace.Add("auth", "key isn't registered, forwarded as presented")
+		return "", nil, true
+	}
+	trace.Add("auth", "key %q of tenant %s, virtual %t", key.Name, t.ID, key.Virtual)
+
+	if expiry, expires := key.Expiry(t.MaxLifetime(s.config.KeyMaxLifetime)); expires {
+		remaining := clock.Until(expiry)
+		if remaining <= 0 {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": "API key has expired",
+				"code":  "KEY_EXPIRED",
+			})
+			return "", nil, false
+		}
+		if remaining <= s.config.KeyExpiryWarn {
+			c.Header("X-Key-Expires-At", expiry.UTC().Format(time.RFC3339))
+			c.Header("Warning", fmt.Sprintf(`299 goproxyai "API key expires in %s"`, remaining.Round(time.Minute)))
+		}
+	}
+
+	if !key.Allows(path) || !t.Allows(path) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "API key is not allowed to access " + path,
+			"code":  "KEY_SCOPE_DENIED",
+		})
+		return "", nil, false
+	}
+
+	rateLimit := key.RateLimit
+	if rateLimit == 0 {
+		rateLimit = t.RateLimit
+	}
+	if rateLimit > 0 && !allow(c, "auth", s.keyRateLimiter, key.Key, rateLimit) {
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error": "Rate limit exceeded for this API key. Please try again later.",
+			"code":  "KEY_RATE_LIMIT_EXCEEDED",
+		})
+		return "", nil, false
+	}
+
+	if t.Upstream != "" {
+		c.Request = c.Request.WithContext(proxy.WithUpstream(c.Request.Context(), s.upstreamTargets[t.Upstream]))
+		trace.Add("auth", "tenant %s is pinned to upstream %s", t.ID, t.Upstream)
+	} else if key.Upstream != "" {
+		c.Request = c.Request.WithContext(proxy.WithUpstream(c.Request.Context(), s.upstreamTargets[key.Upstream]))
+		trace.Add("auth", "key is sent to upstream %s", key.Upstream)
+	}
+
+	overrides := make(map[string]string)
+	if t.Organization != "" {
+		overrides["Openai-Organization"] = t.Organization
+	}
+	if t.Project != "" {
+		overrides["Openai-Project"] = t.Project
+	}
+
+	if key.Virtual {
+		upstreamKey := t.UpstreamAPIKey
+		if upstreamKey == "" {
+			upstreamKey = s.config.UpstreamAPIKey
+		}
+		if upstreamKey == "" {
+			s.logger.Printf("Virtual key used by tenant %s but no upstream API key is configured", t.ID)
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error": "Proxy has no upstream API key configured",
+				"code":  "UPSTREAM_KEY_MISSING",
+			})
+			return "", nil, false
+		}
+		overrides["Authorization"] = "Bearer " + upstreamKey
+	}
+
+	return t.ID, overrides, true
+}
+
+type expiringKey struct {
+	Key       string    `json:"key"`
+	Tenant    string    `json:"tenant"`
+	Name      string    `json:"name,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Expired   bool      `json:"expired"`
+}
+
+// listExpiringKeys reports keys that expire within the given window
+// (default 7 days), including ones that have already expired
+func (s *Server) listExpiringKeys(c *gin.Context) {
+	within := 7 * 24 * time.Hour
+	if value := c.Query("within"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid within, expected a duration like 168h"})
+			return
+		}
+		within = parsed
+	}
+
+	now := clock.Now()
+	keys := []expiringKey{}
+	for _, key := range s.tenants.Keys() {
+		var maxLifetime time.Duration
+		if t, found := s.tenants.Tenant(key.Tenant); found {
+			maxLifetime = t.MaxLifetime(s.config.KeyMaxLifetime)
+		}
+
+		expiry, expires := key.Expiry(maxLifetime)
+		if !expires || expiry.After(now.Add(within)) {
+			continue
+		}
+		keys = append(keys, expiringKey{
+			Key:       key.Masked(),
+			Tenant:    key.Tenant,
+			Name:      key.Name,
+			ExpiresAt: expiry.UTC(),
+			Expired:   !expiry.After(now),
+		})
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ExpiresAt.Before(keys[j].ExpiresAt) })
+
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
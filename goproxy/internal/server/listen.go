@@ -0,0 +1,136 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// listen opens a listener for each LISTEN_ADDRS entry, or a single
+// dual-stack listener on all interfaces when there are none. Entries are an
+// IP address, hostname or network interface name, optionally with a port;
+// entries without one use the given port. The gRPC frontend and HTTP/3 bind
+// the same hosts on their own ports, ignoring the entries' ports.
+//
+// An empty host and "::" listen on both IPv4 and IPv6. "0.0.0.0" listens on
+// IPv4 only and other IP addresses only on their own family, so IPv4-only
+// and IPv6-only hosts can be served by listing one address of each.
+func (s *Server) listen(port string, usePorts bool) ([]net.Listener, error) {
+	addresses, err := s.listenAddresses(port, usePorts)
+	if err != nil {
+		return nil, err
+	}
+
+	listeners := make([]net.Listener, 0, len(addresses))
+	for _, address := range addresses {
+		listener, err := net.Listen(listenNetwork(address), address)
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// listenPackets opens a UDP socket on each of the hosts listen binds, for
+// HTTP/3, ignoring the entries' ports
+func (s *Server) listenPackets(port string) ([]net.PacketConn, error) {
+	addresses, err := s.listenAddresses(port, false)
+	if err != nil {
+		return nil, err
+	}
+
+	conns := make([]net.PacketConn, 0, len(addresses))
+	for _, address := range addresses {
+		network := "udp" + strings.TrimPrefix(listenNetwork(address), "tcp")
+		conn, err := net.ListenPacket(network, address)
+		if err != nil {
+			for _, opened := range conns {
+				opened.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+// listenAddresses expands the LISTEN_ADDRS entries into host:port addresses
+func (s *Server) listenAddresses(port string, usePorts bool) ([]string, error) {
+	entries := s.config.ListenAddrs
+	if len(entries) == 0 {
+		entries = []string{""}
+	}
+
+	var addresses []string
+	for _, entry := range entries {
+		host, entryPort, err := net.SplitHostPort(entry)
+		if err != nil {
+			host, entryPort = strings.TrimSuffix(strings.TrimPrefix(entry, "["), "]"), port
+		} else if !usePorts {
+			entryPort = port
+		}
+		hosts, err := interfaceHosts(host)
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range hosts {
+			addresses = append(addresses, net.JoinHostPort(host, entryPort))
+		}
+	}
+	return addresses, nil
+}
+
+// interfaceHosts expands a network interface name into the addresses
+// assigned to it. Anything else is returned as it is.
+func interfaceHosts(host string) ([]string, error) {
+	if host == "" || net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	iface, err := net.InterfaceByName(host)
+	if err != nil {
+		// Not an interface, so leave it to be resolved as a hostname
+		return []string{host}, nil
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("reading addresses of interface %s: %w", host, err)
+	}
+	var hosts []string
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipNet.IP.String()
+		if ipNet.IP.IsLinkLocalUnicast() && ipNet.IP.To4() == nil {
+			// Link-local IPv6 addresses need the zone to be reachable
+			ip += "%" + iface.Name
+		}
+		hosts = append(hosts, ip)
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("interface %s has no addresses", host)
+	}
+	return hosts, nil
+}
+
+// listenNetwork picks the network for an address. Go listens dual-stack on
+// any wildcard address with "tcp", so the IPv4 wildcard has to ask for tcp4
+// explicitly.
+func listenNetwork(address string) string {
+	host, _, _ := net.SplitHostPort(address)
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil || ip.Equal(net.IPv6unspecified):
+		return "tcp"
+	case ip.To4() != nil:
+		return "tcp4"
+	default:
+		return "tcp6"
+	}
+}
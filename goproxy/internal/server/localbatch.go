@@ -0,0 +1,183 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+// Endpoints a local batch line may target, matching those the upstream
+// batch API accepts
+var localBatchPaths = map[string]bool{
+	"/v1/chat/completions": true,
+	"/v1/completions":      true,
+	"/v1/embeddings":       true,
+	"/v1/moderations":      true,
+}
+
+// localBatchLine is one request of the input NDJSON, in the same format as
+// an upstream batch input file
+type localBatchLine struct {
+	CustomID string          `json:"custom_id"`
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+}
+
+type localBatchResult struct {
+	ID       string              `json:"id"`
+	CustomID string              `json:"custom_id"`
+	Response *localBatchResponse `json:"response"`
+	Error    *localBatchError    `json:"error"`
+}
+
+type localBatchResponse struct {
+	StatusCode int             `json:"status_code"`
+	Body       json.RawMessage `json:"body"`
+}
+
+type localBatchError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// localBatch runs an NDJSON batch of requests through the proxy itself, for
+// upstreams that have no batch endpoint. Each line is dispatched as its own
+// /v1 request with the caller's headers, so keys, scopes, rate limits, the
+// cache and usage tracking all apply per line. Results are returned as
+// NDJSON in input order.
+func (s *Server) localBatch(c *gin.Context) {
+	maxBytes := s.config.MaxUploadSize * 1024 * 1024
+	scanner := bufio.NewScanner(http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes))
+	scanner.Buffer(make([]byte, 0, 64*1024), int(maxBytes))
+
+	var lines []localBatchLine
+	var results []localBatchResult
+	for scanner.Scan() {
+		raw := bytes.TrimSpace(scanner.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+		if len(lines) >= s.config.LocalBatchMaxRequests {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+				"error": fmt.Sprintf("Batch exceeds the limit of %d requests", s.config.LocalBatchMaxRequests),
+				"code":  "BATCH_TOO_LARGE",
+			})
+			return
+		}
+
+		var line localBatchLine
+		result := localBatchResult{ID: fmt.Sprintf("batch_req_%d", len(lines)+1)}
+		if err := json.Unmarshal(raw, &line); err != nil {
+			result.Error = &localBatchError{Code: "invalid_json", Message: "Line is not a valid JSON object"}
+		} else {
+			result.CustomID = line.CustomID
+			result.Error = validateLocalBatchLine(line)
+		}
+		lines = append(lines, line)
+		results = append(results, result)
+	}
+	if err := scanner.Err(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if len(lines) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Batch contains no requests"})
+		return
+	}
+
+	var limiter *rate.Limiter
+	if s.config.LocalBatchRate > 0 {
+		limiter = rate.NewLimiter(rate.Limit(float64(s.config.LocalBatchRate)/60.0), 1)
+	}
+	concurrency := s.config.LocalBatchConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, concurrency)
+	for i := range lines {
+		if results[i].Error != nil {
+			continue
+		}
+		if limiter != nil {
+			if err := limiter.Wait(c.Request.Context()); err != nil {
+				break
+			}
+		}
+
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			results[i].Response = s.dispatchLocalBatchLine(c.Request, lines[i])
+		}(i)
+	}
+	wg.Wait()
+
+	s.logger.Printf("Local batch of %d requests completed", len(lines))
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+	encoder := json.NewEncoder(c.Writer)
+	for _, result := range results {
+		if result.Response == nil && result.Error == nil {
+			result.Error = &localBatchError{Code: "cancelled", Message: "Batch was cancelled before the request ran"}
+		}
+		if err := encoder.Encode(result); err != nil {
+			s.logger.Printf("Error writing local batch results: %v", err)
+			return
+		}
+	}
+}
+
+func validateLocalBatchLine(line localBatchLine) *localBatchError {
+	if line.Method != http.MethodPost {
+		return &localBatchError{Code: "invalid_method", Message: "Only POST requests are supported"}
+	}
+	if !localBatchPaths[line.URL] {
+		return &localBatchError{Code: "invalid_url", Message: "Unsupported url " + line.URL}
+	}
+	if len(line.Body) == 0 || line.Body[0] != '{' {
+		return &localBatchError{Code: "invalid_body", Message: "body must be a JSON object"}
+	}
+
+	var body struct {
+		Stream bool `json:"stream"`
+	}
+	if err := json.Unmarshal(line.Body, &body); err != nil {
+		return &localBatchError{Code: "invalid_body", Message: "body must be a JSON object"}
+	}
+	if body.Stream {
+		return &localBatchError{Code: "invalid_body", Message: "Streaming is not supported in batches"}
+	}
+	return nil
+}
+
+// dispatchLocalBatchLine serves one batch line through the router with the
+// batch request's headers and client address
+func (s *Server) dispatchLocalBatchLine(batchReq *http.Request, line localBatchLine) *localBatchResponse {
+	header := batchReq.Header.Clone()
+	header.Del("Content-Length")
+
+	recorder := newBufferedResponse()
+	s.dispatch(batchReq.Context(), header, batchReq.RemoteAddr, line.URL, line.Body, recorder)
+
+	body := recorder.body.Bytes()
+	if !json.Valid(body) {
+		encoded, _ := json.Marshal(strings.TrimSpace(string(body)))
+		body = encoded
+	}
+	return &localBatchResponse{StatusCode: recorder.status, Body: body}
+}
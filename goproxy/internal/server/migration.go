@@ -0,0 +1,214 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/dryrun"
+	"goproxyai/internal/openai"
+	"goproxyai/internal/proxy"
+)
+
+// Set on requests migrated from functions to tools, whose answers are
+// turned back into function calls
+const ctxLegacyFunctions = "legacy_functions"
+
+// migrateRequest rewrites the deprecated parameters of a chat completion
+// request when REQUEST_MIGRATION is on, so clients written against an
+// older API keep working. Legacy engine paths were rewritten before
+// routing, and are only noted here.
+func (s *Server) migrateRequest(c *gin.Context, method, path string, body []byte) []byte {
+	if legacy, ok := engineRewrite(c); ok {
+		dryrun.From(c.Request.Context()).Add("migration", "rewrote %s to %s", legacy.From, path)
+		transformed(c, "migration")
+	}
+	if !s.config.RequestMigration || method != http.MethodPost || path != "/v1/chat/completions" {
+		return body
+	}
+	models := s.config.MaxCompletionTokensModels
+	if len(models) == 0 {
+		models = openai.MaxCompletionTokensModels
+	}
+	migrated, m, err := openai.MigrateChatRequest(body, models)
+	if err != nil {
+		s.logger.Printf("Could not migrate request body: %v", err)
+		return body
+	}
+	if !m.Any() {
+		return body
+	}
+	dryrun.From(c.Request.Context()).Add("migration", "rewrote %s", m)
+	transformed(c, "migration")
+	if m.Functions {
+		c.Set(ctxLegacyFunctions, true)
+	}
+	return migrated
+}
+
+// embeddingSuccessor is the model EMBEDDINGS_MODEL_MIGRATIONS serves a
+// retired embeddings model by, and the vector size to ask it for
+type embeddingSuccessor struct {
+	Model      string
+	Dimensions int // 0 leaves the successor's own
+}
+
+// parseEmbeddingMigrations reads old=new and old=new:dimensions entries
+func parseEmbeddingMigrations(entries []string) (map[string]embeddingSuccessor, error) {
+	successors := make(map[string]embeddingSuccessor, len(entries))
+	for _, entry := range entries {
+		retired, successor, found := strings.Cut(entry, "=")
+		model, dimensions, sized := strings.Cut(successor, ":")
+		if !found || retired == "" || model == "" {
+			return nil, fmt.Errorf("invalid entry %q, expected old=new or old=new:dimensions", entry)
+		}
+		migration := embeddingSuccessor{Model: model}
+		if sized {
+			n, err := strconv.Atoi(dimensions)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid dimensions in %q", entry)
+			}
+			migration.Dimensions = n
+		}
+		successors[retired] = migration
+	}
+	return successors, nil
+}
+
+// migrateEmbeddingModel serves an embeddings request for a retired model
+// by the successor EMBEDDINGS_MODEL_MIGRATIONS names, asking for the
+// dimensions given with it unless the request chose its own, and tells the
+// client in X-Model-Migrated-From. It returns the model the request is
+// now for, or "" when it's left alone.
+func (s *Server) migrateEmbeddingModel(c *gin.Context, method, path string, body []byte, model string) ([]byte, string) {
+	successor, found := s.successors[model]
+	if !found || method != http.MethodPost || path != "/v1/embeddings" {
+		return body, ""
+	}
+	migrated, err := openai.SetField(body, "model", successor.Model)
+	if err != nil {
+		return body, ""
+	}
+	var fields map[string]json.RawMessage
+	if successor.Dimensions > 0 && json.Unmarshal(migrated, &fields) == nil && fields["dimensions"] == nil {
+		if sized, err := openai.SetField(migrated, "dimensions", successor.Dimensions); err == nil {
+			migrated = sized
+		}
+	}
+	dryrun.From(c.Request.Context()).Add("migration", "served retired %s by %s", model, successor.Model)
+	transformed(c, "migration")
+	c.Header("X-Model-Migrated-From", model)
+	return migrated, successor.Model
+}
+
+// legacyResponse answers a migrated request's tool calls as function calls
+func legacyResponse(resp *proxy.ProxyResponse) {
+	if resp.StatusCode != http.StatusOK {
+		return
+	}
+	body, changed := openai.LegacyFunctionCall(resp.Body)
+	if !changed {
+		return
+	}
+	resp.Body = body
+	headers := http.Header(resp.Headers).Clone()
+	headers.Del("Content-Length")
+	resp.Headers = headers
+}
+
+// legacyEvent does the same for an event of a streamed answer, one line
+// at a time
+func legacyEvent(line []byte) []byte {
+	data, found := bytes.CutPrefix(line, []byte("data:"))
+	if !found {
+		return line
+	}
+	trimmed := bytes.TrimSpace(data)
+	if bytes.Equal(trimmed, []byte("[DONE]")) {
+		return line
+	}
+	rewritten, changed := openai.LegacyFunctionCall(trimmed)
+	if !changed {
+		return line
+	}
+	ending := line[len(bytes.TrimRight(line, "\r\n")):]
+	return append(append([]byte("data: "), rewritten...), ending...)
+}
+
+type legacyEngineKey struct{}
+
+// legacyEngine is a request to a legacy /v1/engines path, and where it was
+// sent instead
+type legacyEngine struct {
+	openai.EngineRoute
+	From string
+}
+
+// legacyEngines sends requests to the legacy /v1/engines paths, when
+// REQUEST_MIGRATION is on, to the current endpoints with the engine as
+// their model. That happens ahead of routing, so scopes, validation and
+// policies see the current path. Engine listings are answered as models
+// described as engines.
+func (s *Server) legacyEngines(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, ok := openai.ParseEnginePath(r.Method, r.URL.Path)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !route.Listing {
+			body, err := io.ReadAll(r.Body)
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				requestTooLarge(w, tooLarge.Limit)
+				return
+			}
+			if err != nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, `{"error":"Invalid request body"}`)
+				return
+			}
+			if updated, set := openai.SetEngineModel(body, route.Engine); set {
+				body = updated
+				r.ContentLength = int64(len(body))
+				r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		legacy := legacyEngine{EngineRoute: route, From: r.URL.Path}
+		r = r.WithContext(context.WithValue(r.Context(), legacyEngineKey{}, legacy))
+		r.URL.Path, r.URL.RawPath = route.Path, ""
+		next.ServeHTTP(w, r)
+	})
+}
+
+// engineRewrite returns the legacy engine path a request was sent from,
+// if it was
+func engineRewrite(c *gin.Context) (legacyEngine, bool) {
+	legacy, ok := c.Request.Context().Value(legacyEngineKey{}).(legacyEngine)
+	return legacy, ok
+}
+
+// enginesResponse answers an engine listing with engines rather than models
+func enginesResponse(resp *proxy.ProxyResponse) {
+	if resp.StatusCode != http.StatusOK {
+		return
+	}
+	body, changed := openai.ModelsAsEngines(resp.Body)
+	if !changed {
+		return
+	}
+	resp.Body = body
+	headers := http.Header(resp.Headers).Clone()
+	headers.Del("Content-Length")
+	resp.Headers = headers
+}
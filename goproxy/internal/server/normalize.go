@@ -0,0 +1,85 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/openai"
+	"goproxyai/internal/proxy"
+)
+
+// Endpoints whose answers RESPONSE_NORMALIZATION gives consistent fields
+var normalizedPaths = map[string]bool{
+	"/v1/chat/completions": true,
+	"/v1/completions":      true,
+	"/v1/embeddings":       true,
+}
+
+// Error bodies longer than this are relayed as they are
+const maxNormalizedError = 1 << 20
+
+// normalizeCompletion gives a completion the finish reasons and usage the
+// API answers with, whichever backend sent it
+func normalizeCompletion(c *gin.Context, req *proxy.ProxyRequest, model string, resp *proxy.ProxyResponse) {
+	if resp.StatusCode != http.StatusOK {
+		return
+	}
+	body, changed := openai.NormalizeCompletion(resp.Body, req.Body, model)
+	if !changed {
+		return
+	}
+	resp.Body = body
+	headers := http.Header(resp.Headers).Clone()
+	headers.Del("Content-Length")
+	resp.Headers = headers
+	transformed(c, "normalization")
+}
+
+// normalizeError puts an upstream error in the API's error envelope. The
+// response is returned as it is when it isn't an error or its body is too
+// long to be one.
+func (s *Server) normalizeError(resp *proxy.StreamResponse) *proxy.StreamResponse {
+	if resp.StatusCode < http.StatusBadRequest {
+		return resp
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxNormalizedError+1))
+	if err != nil || len(data) > maxNormalizedError {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), resp.Body), resp.Body}
+		return resp
+	}
+	resp.Body.Close()
+
+	headers := http.Header(resp.Headers)
+	if body, changed := openai.NormalizeError(resp.StatusCode, data); changed {
+		data = body
+		headers = headers.Clone()
+		headers.Set("Content-Type", "application/json")
+		headers.Del("Content-Length")
+	}
+	return streamResponse(&proxy.ProxyResponse{StatusCode: resp.StatusCode, Headers: headers, Body: data})
+}
+
+// normalizeEvent does the same as normalizeCompletion for an event of a
+// streamed answer, one line at a time
+func normalizeEvent(line []byte) []byte {
+	data, found := bytes.CutPrefix(line, []byte("data:"))
+	if !found {
+		return line
+	}
+	trimmed := bytes.TrimSpace(data)
+	if bytes.Equal(trimmed, []byte("[DONE]")) {
+		return line
+	}
+	rewritten, changed := openai.NormalizeChunk(trimmed)
+	if !changed {
+		return line
+	}
+	ending := line[len(bytes.TrimRight(line, "\r\n")):]
+	return append(append([]byte("data: "), rewritten...), ending...)
+}
@@ -0,0 +1,549 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiOperation describes one of the proxy's own endpoints for the OpenAPI
+// document. Path parameters are taken from the gin path.
+type apiOperation struct {
+	method      string
+	path        string
+	tag         string
+	summary     string
+	security    string // adminToken, tenantAdminToken or "" for none
+	query       []apiParam
+	requestBody gin.H
+	responses   map[string]gin.H
+}
+
+type apiParam struct {
+	name        string
+	description string
+}
+
+// Reusable component schemas, referenced as #/components/schemas/<name>
+var apiSchemas = gin.H{
+	"Error": object(gin.H{
+		"error": gin.H{"type": "string"},
+		"code":  gin.H{"type": "string", "description": "Machine-readable error code such as ADMIN_UNAUTHORIZED"},
+	}),
+	"Features": object(gin.H{
+		"streaming":           gin.H{"type": "boolean", "description": "Allow stream: true requests (default true)"},
+		"caching":             gin.H{"type": "boolean", "description": "Cache responses (default true)"},
+		"moderation_required": gin.H{"type": "boolean"},
+		"max_context_tokens":  gin.H{"type": "integer", "minimum": 0, "description": "0 means unlimited"},
+	}),
+	"Alert": object(gin.H{
+		"id":        gin.H{"type": "string", "readOnly": true},
+		"metric":    gin.H{"type": "string", "enum": []string{"requests", "tokens", "cost_usd"}},
+		"threshold": gin.H{"type": "number"},
+		"window":    gin.H{"type": "string", "enum": []string{"day", "month"}},
+		"webhook":   gin.H{"type": "string", "format": "uri"},
+		"email":     gin.H{"type": "string", "format": "email"},
+	}),
+	"Key": object(gin.H{
+		"key":        gin.H{"type": "string"},
+		"tenant":     gin.H{"type": "string"},
+		"name":       gin.H{"type": "string"},
+		"virtual":    gin.H{"type": "boolean"},
+		"scopes":     gin.H{"type": "array", "items": gin.H{"type": "string"}},
+		"rate_limit": gin.H{"type": "integer"},
+		"created_at": gin.H{"type": "string", "format": "date-time"},
+		"expires_at": gin.H{"type": "string", "format": "date-time"},
+		"defaults": gin.H{
+			"type":                 "object",
+			"description":          "Body parameters filled in for requests that leave them out, by route",
+			"additionalProperties": gin.H{"type": "object"},
+		},
+		"tools": gin.H{
+			"type":        "array",
+			"items":       gin.H{"type": "string"},
+			"description": "Tools requests may declare, by function name or built-in tool type; a trailing * matches any suffix",
+		},
+		"strip_tools": gin.H{"type": "boolean", "description": "Drop disallowed tools instead of refusing the request"},
+	}),
+}
+
+var apiOperations = []apiOperation{
+	{
+		method: http.MethodGet, path: "/health", tag: "health",
+		summary:   "Report that the proxy is up",
+		responses: map[string]gin.H{"200": jsonResponse("Healthy", gin.H{"type": "object"})},
+	},
+	{
+		method: http.MethodGet, path: "/stats", tag: "stats",
+		summary:   "Cache statistics and proxy configuration",
+		responses: map[string]gin.H{"200": jsonResponse("Statistics", gin.H{"type": "object"})},
+	},
+	{
+		method: http.MethodGet, path: "/metrics", tag: "stats",
+		summary:   "Prometheus request and cache counters, and histograms of tokens, body sizes and stream durations by model",
+		responses: map[string]gin.H{"200": {"description": "Metrics in the Prometheus text format", "content": gin.H{"text/plain": gin.H{"schema": gin.H{"type": "string"}}}}},
+	},
+	{
+		method: http.MethodDelete, path: "/cache", tag: "stats",
+		summary:   "Clear the response cache",
+		responses: map[string]gin.H{"200": jsonResponse("Cache cleared", gin.H{"type": "object"})},
+	},
+	{
+		method: http.MethodPost, path: "/cache/restore", tag: "stats",
+		summary: "Restore what the last cache clear removed, within CACHE_TRASH_GRACE",
+		responses: map[string]gin.H{
+			"200": jsonResponse("Entries restored, per cache", gin.H{"type": "object"}),
+			"404": jsonResponse("Nothing was cleared within the grace period", schemaRef("Error")),
+		},
+	},
+	{
+		method: http.MethodGet, path: "/admin/traffic", tag: "admin", security: "adminToken",
+		summary:   "Live traffic summary, top endpoints, models and clients, and active runs",
+		responses: map[string]gin.H{"200": jsonResponse("Traffic summary", gin.H{"type": "object"})},
+	},
+	{
+		method: http.MethodGet, path: "/admin/errors", tag: "admin", security: "adminToken",
+		summary:   "Recent upstream and proxy errors",
+		responses: map[string]gin.H{"200": jsonResponse("Recent errors", gin.H{"type": "object"})},
+	},
+	{
+		method: http.MethodGet, path: "/admin/slow", tag: "admin", security: "adminToken",
+		summary: "Recent requests upstream was slow to answer, with redacted prompt excerpts",
+		responses: map[string]gin.H{
+			"200": jsonResponse("Slow requests", gin.H{"type": "object"}),
+			"404": jsonResponse("The slow log is not enabled", schemaRef("Error")),
+		},
+	},
+	{
+		method: http.MethodGet, path: "/admin/captures", tag: "admin", security: "adminToken",
+		summary:   "List traffic captures, newest first",
+		responses: map[string]gin.H{"200": jsonResponse("Captures", gin.H{"type": "object"})},
+	},
+	{
+		method: http.MethodPost, path: "/admin/captures", tag: "admin", security: "adminToken",
+		summary: "Record all /v1 traffic for a number of seconds into a HAR or NDJSON file",
+		requestBody: jsonBody(object(gin.H{
+			"seconds":       gin.H{"type": "integer", "description": "Up to CAPTURE_MAX_DURATION"},
+			"format":        gin.H{"type": "string", "enum": []string{"har", "ndjson"}},
+			"tenant":        gin.H{"type": "string", "description": "Only record this tenant's traffic"},
+			"redact_bodies": gin.H{"type": "boolean", "description": "Defaults to true"},
+		})),
+		responses: map[string]gin.H{
+			"201": jsonResponse("The capture, running", gin.H{"type": "object"}),
+			"400": jsonResponse("Invalid duration, format or tenant", schemaRef("Error")),
+			"409": jsonResponse("A capture is already running", schemaRef("Error")),
+		},
+	},
+	{
+		method: http.MethodGet, path: "/admin/captures/:id", tag: "admin", security: "adminToken",
+		summary: "Download a finished capture",
+		responses: map[string]gin.H{
+			"200": {"description": "The HAR or NDJSON file", "content": gin.H{"application/json": gin.H{"schema": gin.H{"type": "object"}}, "application/x-ndjson": gin.H{"schema": gin.H{"type": "string"}}}},
+			"409": jsonResponse("The capture is still running", schemaRef("Error")),
+		},
+	},
+	{
+		method: http.MethodDelete, path: "/admin/captures/:id", tag: "admin", security: "adminToken",
+		summary:   "Delete a capture and its file, stopping it if it's running",
+		responses: map[string]gin.H{"204": {"description": "Capture deleted"}},
+	},
+	{
+		method: http.MethodGet, path: "/admin/usage", tag: "usage", security: "adminToken",
+		summary: "Token usage broken down by tenant, key, user and model",
+		query: []apiParam{
+			{"from", "First day to include, YYYY-MM-DD"},
+			{"to", "Last day to include, YYYY-MM-DD"},
+		},
+		responses: map[string]gin.H{"200": jsonResponse("Usage breakdown", gin.H{"type": "object"})},
+	},
+	{
+		method: http.MethodGet, path: "/admin/reports/shadow", tag: "usage", security: "adminToken",
+		summary:   "Comparisons of primary and shadow answers, for the open window and recent ones",
+		responses: map[string]gin.H{"200": jsonResponse("Shadow reports", gin.H{"type": "object"}), "404": jsonResponse("Shadow traffic is not enabled", schemaRef("Error"))},
+	},
+	{
+		method: http.MethodGet, path: "/admin/reports/deprecations", tag: "usage", security: "adminToken",
+		summary:   "Models upstream has said are deprecated, and the keys still calling them",
+		responses: map[string]gin.H{"200": jsonResponse("Deprecated models", gin.H{"type": "object"})},
+	},
+	{
+		method: http.MethodGet, path: "/admin/reports/chargeback", tag: "usage", security: "adminToken",
+		summary: "Monthly cost report per tenant",
+		query: []apiParam{
+			{"month", "Month to report on, YYYY-MM (default the current month)"},
+			{"format", "csv for a CSV download instead of JSON"},
+		},
+		responses: map[string]gin.H{"200": {
+			"description": "Chargeback report",
+			"content": gin.H{
+				"application/json": gin.H{"schema": gin.H{"type": "object"}},
+				"text/csv":         gin.H{"schema": gin.H{"type": "string"}},
+			},
+		}},
+	},
+	{
+		method: http.MethodGet, path: "/admin/keys/expiring", tag: "admin", security: "adminToken",
+		summary:   "Keys expiring within a window, including already expired ones",
+		query:     []apiParam{{"within", "Window as a duration such as 168h (default 7 days)"}},
+		responses: map[string]gin.H{"200": jsonResponse("Expiring keys", gin.H{"type": "object"})},
+	},
+	{
+		method: http.MethodGet, path: "/admin/policy", tag: "admin", security: "adminToken",
+		summary:   "The Rego policy bundle in force",
+		responses: map[string]gin.H{"200": jsonResponse("Policy status", gin.H{"type": "object"})},
+	},
+	{
+		method: http.MethodPost, path: "/admin/policy/reload", tag: "admin", security: "adminToken",
+		summary: "Reload the Rego policy bundle",
+		responses: map[string]gin.H{
+			"200": jsonResponse("Policy status", gin.H{"type": "object"}),
+			"422": jsonResponse("The bundle failed to load and the previous policy stays in force", schemaRef("Error")),
+		},
+	},
+	{
+		method: http.MethodGet, path: "/admin/finetunes", tag: "admin", security: "adminToken",
+		summary: "List fine-tuning jobs created through the proxy",
+		query: []apiParam{
+			{"tenant", "Only this tenant's jobs"},
+			{"status", "Only jobs in this status"},
+		},
+		responses: map[string]gin.H{"200": jsonResponse("Jobs, newest first", object(gin.H{
+			"jobs": gin.H{"type": "array", "items": object(gin.H{
+				"id":               gin.H{"type": "string"},
+				"tenant":           gin.H{"type": "string"},
+				"key_id":           gin.H{"type": "string"},
+				"model":            gin.H{"type": "string"},
+				"fine_tuned_model": gin.H{"type": "string"},
+				"status":           gin.H{"type": "string", "enum": []string{"validating_files", "queued", "running", "succeeded", "failed", "cancelled"}},
+				"error":            gin.H{"type": "string"},
+				"created_at":       gin.H{"type": "string", "format": "date-time"},
+				"updated_at":       gin.H{"type": "string", "format": "date-time"},
+				"finished_at":      gin.H{"type": "string", "format": "date-time"},
+			})},
+		}))},
+	},
+	{
+		method: http.MethodDelete, path: "/admin/data", tag: "admin", security: "adminToken",
+		summary: "Delete the usage records, request records, cached responses and sessions of a tenant or end user",
+		query: []apiParam{
+			{"tenant", "Tenant whose data to delete"},
+			{"user", "End user whose data to delete, within the tenant when both are given"},
+		},
+		responses: map[string]gin.H{
+			"200": jsonResponse("How much was deleted", object(gin.H{
+				"usage_records":       gin.H{"type": "integer"},
+				"request_logs":        gin.H{"type": "integer"},
+				"slow_requests":       gin.H{"type": "integer"},
+				"cache_entries":       gin.H{"type": "integer"},
+				"images":              gin.H{"type": "integer"},
+				"embeddings":          gin.H{"type": "integer"},
+				"sessions":            gin.H{"type": "integer"},
+				"unreachable_members": gin.H{"type": "array", "items": gin.H{"type": "string"}},
+			})),
+			"400": jsonResponse("Neither tenant nor user was given", schemaRef("Error")),
+		},
+	},
+	{
+		method: http.MethodGet, path: "/admin/tenants/:id/features", tag: "tenants", security: "adminToken",
+		summary:   "Get a tenant's feature flags",
+		responses: map[string]gin.H{"200": jsonResponse("Feature flags", schemaRef("Features"))},
+	},
+	{
+		method: http.MethodPut, path: "/admin/tenants/:id/features", tag: "tenants", security: "adminToken",
+		summary:     "Replace a tenant's feature flags",
+		requestBody: jsonBody(schemaRef("Features")),
+		responses:   map[string]gin.H{"200": jsonResponse("Updated feature flags", schemaRef("Features"))},
+	},
+	{
+		method: http.MethodGet, path: "/admin/tenants/:id/alerts", tag: "tenants", security: "tenantAdminToken",
+		summary: "List a tenant's usage alerts",
+		responses: map[string]gin.H{"200": jsonResponse("Alerts", object(gin.H{
+			"alerts": gin.H{"type": "array", "items": schemaRef("Alert")},
+		}))},
+	},
+	{
+		method: http.MethodPost, path: "/admin/tenants/:id/alerts", tag: "tenants", security: "tenantAdminToken",
+		summary:     "Create a usage alert",
+		requestBody: jsonBody(schemaRef("Alert")),
+		responses:   map[string]gin.H{"201": jsonResponse("Created alert", schemaRef("Alert"))},
+	},
+	{
+		method: http.MethodDelete, path: "/admin/tenants/:id/alerts/:alert", tag: "tenants", security: "tenantAdminToken",
+		summary:   "Remove a usage alert",
+		responses: map[string]gin.H{"200": jsonResponse("Alert removed", gin.H{"type": "object"})},
+	},
+	{
+		method: http.MethodPost, path: "/debug/trace", tag: "admin", security: "adminToken",
+		summary: "Dry-run a /v1 request through the pipeline and trace each step, without calling upstream",
+		requestBody: jsonBody(object(gin.H{
+			"method":  gin.H{"type": "string", "description": "Defaults to POST"},
+			"path":    gin.H{"type": "string", "description": "A /v1 path such as /v1/chat/completions"},
+			"headers": gin.H{"type": "object", "additionalProperties": gin.H{"type": "string"}},
+			"body":    gin.H{"type": "object"},
+		})),
+		responses: map[string]gin.H{"200": jsonResponse("The trace, with the proxy's own response or the request it would have sent upstream", object(gin.H{
+			"steps": gin.H{"type": "array", "items": object(gin.H{
+				"stage":  gin.H{"type": "string"},
+				"detail": gin.H{"type": "string"},
+			})},
+			"response": object(gin.H{
+				"status": gin.H{"type": "integer"},
+				"body":   gin.H{},
+			}),
+			"upstream": object(gin.H{
+				"method":     gin.H{"type": "string"},
+				"url":        gin.H{"type": "string"},
+				"headers":    gin.H{"type": "object", "additionalProperties": gin.H{"type": "string"}},
+				"added":      gin.H{"type": "array", "items": gin.H{"type": "string"}},
+				"changed":    gin.H{"type": "array", "items": gin.H{"type": "string"}},
+				"removed":    gin.H{"type": "array", "items": gin.H{"type": "string"}},
+				"body_bytes": gin.H{"type": "integer"},
+			}),
+		}))},
+	},
+	{
+		method: http.MethodPost, path: "/v1/keys/self", tag: "keys", security: "tenantAdminToken",
+		summary: "Mint a virtual key for the calling tenant",
+		requestBody: jsonBody(object(gin.H{
+			"name":       gin.H{"type": "string"},
+			"scopes":     gin.H{"type": "array", "items": gin.H{"type": "string"}},
+			"rate_limit": gin.H{"type": "integer"},
+			"expires_in": gin.H{"type": "string", "description": "Lifetime as a duration such as 720h"},
+			"defaults": gin.H{
+				"type":                 "object",
+				"description":          "Body parameters filled in for requests that leave them out, by route",
+				"additionalProperties": gin.H{"type": "object"},
+			},
+			"tools": gin.H{
+				"type":        "array",
+				"items":       gin.H{"type": "string"},
+				"description": "Tools requests may declare, by function name or built-in tool type; a trailing * matches any suffix",
+			},
+			"strip_tools": gin.H{"type": "boolean", "description": "Drop disallowed tools instead of refusing the request"},
+		})),
+		responses: map[string]gin.H{"201": jsonResponse("Minted key", schemaRef("Key"))},
+	},
+	{
+		method: http.MethodPost, path: "/proxy/v1/local-batch", tag: "batch",
+		summary: "Run a Batch API style JSONL file through the proxy synchronously",
+		requestBody: gin.H{"required": true, "content": gin.H{
+			"application/jsonl": gin.H{"schema": gin.H{"type": "string"}},
+		}},
+		responses: map[string]gin.H{"200": {
+			"description": "One JSONL result per input line",
+			"content":     gin.H{"application/jsonl": gin.H{"schema": gin.H{"type": "string"}}},
+		}},
+	},
+	{
+		method: http.MethodPost, path: "/proxy/v1/fanout", tag: "batch",
+		summary: "Send the same request to several models concurrently",
+		requestBody: jsonBody(object(gin.H{
+			"models":  gin.H{"type": "array", "items": gin.H{"type": "string"}, "description": "Defaults to FANOUT_MODELS"},
+			"url":     gin.H{"type": "string", "enum": []string{"/v1/chat/completions", "/v1/completions", "/v1/responses"}},
+			"body":    gin.H{"type": "object", "description": "Request body sent to every model, with model filled in"},
+			"timeout": gin.H{"type": "string", "description": "Shortens FANOUT_TIMEOUT, e.g. 20s"},
+		})),
+		responses: map[string]gin.H{"200": jsonResponse("One result per model, in request order", object(gin.H{
+			"object":     gin.H{"type": "string"},
+			"url":        gin.H{"type": "string"},
+			"latency_ms": gin.H{"type": "integer"},
+			"results": gin.H{"type": "array", "items": object(gin.H{
+				"model":       gin.H{"type": "string"},
+				"status_code": gin.H{"type": "integer"},
+				"latency_ms":  gin.H{"type": "integer"},
+				"usage":       gin.H{"type": "object"},
+				"cost_usd":    gin.H{"type": "number"},
+				"body":        gin.H{"type": "object"},
+				"error":       gin.H{"type": "object", "nullable": true},
+			})},
+		}))},
+	},
+	{
+		method: http.MethodPost, path: "/proxy/v1/tokenize", tag: "batch",
+		summary: "Count tokens for a model without calling upstream",
+		requestBody: jsonBody(object(gin.H{
+			"model":    gin.H{"type": "string"},
+			"input":    gin.H{"description": "A string or an array of strings"},
+			"messages": gin.H{"type": "array", "items": gin.H{"type": "object"}, "description": "Chat messages, counted with per-message overhead"},
+		})),
+		responses: map[string]gin.H{"200": jsonResponse("Token counts", object(gin.H{
+			"object":   gin.H{"type": "string"},
+			"model":    gin.H{"type": "string"},
+			"encoding": gin.H{"type": "string"},
+			"tokens":   gin.H{"type": "integer"},
+			"counts":   gin.H{"type": "array", "items": gin.H{"type": "integer"}, "description": "Per string, when input is an array"},
+		}))},
+	},
+}
+
+// getOpenAPI serves an OpenAPI 3 document for the proxy's own endpoints.
+// The proxied OpenAI API is described by OpenAI's own spec.
+func (s *Server) getOpenAPI(c *gin.Context) {
+	operations := apiOperations
+	if s.config.WebhookSecret != "" {
+		operations = append(operations[:len(operations):len(operations)], apiOperation{
+			method: http.MethodPost, path: "/proxy/v1/webhooks/openai", tag: "webhooks",
+			summary:     "Receive a signed OpenAI webhook and forward it to internal endpoints",
+			requestBody: jsonBody(gin.H{"type": "object"}),
+			responses: map[string]gin.H{
+				"200": jsonResponse("Event accepted", object(gin.H{"received": gin.H{"type": "boolean"}})),
+			},
+		})
+	}
+	if s.imageStore != nil {
+		operations = append(operations[:len(operations):len(operations)], apiOperation{
+			method: http.MethodGet, path: "/proxy/v1/images/:id", tag: "images",
+			summary: "An image kept in the image store, as linked from its url",
+			responses: map[string]gin.H{
+				"200": {"description": "The image", "content": gin.H{"image/png": gin.H{}, "image/jpeg": gin.H{}, "image/webp": gin.H{}}},
+				"404": jsonResponse("No such image", schemaRef("Error")),
+				"502": jsonResponse("The image store couldn't be reached", schemaRef("Error")),
+			},
+		})
+	}
+	if s.images != nil {
+		operations = append(operations[:len(operations):len(operations)], apiOperation{
+			method: http.MethodGet, path: "/proxy/v1/images/:id/:index", tag: "images",
+			summary: "An image from a cached generation, as linked from its url",
+			responses: map[string]gin.H{
+				"200": {"description": "The image", "content": gin.H{"image/png": gin.H{}, "image/jpeg": gin.H{}, "image/webp": gin.H{}}},
+				"404": jsonResponse("No such image, or its generation is no longer cached", schemaRef("Error")),
+			},
+		})
+	}
+	if s.sessions != nil {
+		operations = append(operations[:len(operations):len(operations)],
+			apiOperation{
+				method: http.MethodGet, path: "/proxy/v1/sessions/:id", tag: "sessions",
+				summary: "The history of a session of the calling key",
+				responses: map[string]gin.H{
+					"200": jsonResponse("The session", object(gin.H{
+						"id":       gin.H{"type": "string"},
+						"messages": gin.H{"type": "array", "items": gin.H{"type": "object"}},
+					})),
+					"404": jsonResponse("No such session, or it expired", schemaRef("Error")),
+					"502": jsonResponse("The session store couldn't be reached", schemaRef("Error")),
+				},
+			},
+			apiOperation{
+				method: http.MethodDelete, path: "/proxy/v1/sessions/:id", tag: "sessions",
+				summary: "Forget a session of the calling key",
+				responses: map[string]gin.H{
+					"200": jsonResponse("Deleted", gin.H{"type": "object"}),
+					"502": jsonResponse("The session store couldn't be reached", schemaRef("Error")),
+				},
+			},
+		)
+	}
+
+	c.JSON(http.StatusOK, openAPIDocument(operations))
+}
+
+func openAPIDocument(operations []apiOperation) gin.H {
+	paths := gin.H{}
+	for _, op := range operations {
+		var parameters []gin.H
+		segments := strings.Split(op.path, "/")
+		for i, segment := range segments {
+			if name, found := strings.CutPrefix(segment, ":"); found {
+				segments[i] = "{" + name + "}"
+				parameters = append(parameters, gin.H{
+					"name": name, "in": "path", "required": true, "schema": gin.H{"type": "string"},
+				})
+			}
+		}
+		for _, param := range op.query {
+			parameters = append(parameters, gin.H{
+				"name": param.name, "in": "query", "description": param.description, "schema": gin.H{"type": "string"},
+			})
+		}
+
+		responses := gin.H{}
+		for status, response := range op.responses {
+			responses[status] = response
+		}
+		if op.query != nil || op.requestBody != nil {
+			responses["400"] = jsonResponse("Invalid request", schemaRef("Error"))
+		}
+
+		operation := gin.H{
+			"tags":        []string{op.tag},
+			"summary":     op.summary,
+			"operationId": operationID(op.method, op.path),
+			"responses":   responses,
+		}
+		if parameters != nil {
+			operation["parameters"] = parameters
+		}
+		if op.requestBody != nil {
+			operation["requestBody"] = op.requestBody
+		}
+		if op.security != "" {
+			// An empty admin token disables admin auth, so this is only
+			// enforced when ADMIN_TOKEN is set
+			operation["security"] = []gin.H{{op.security: []string{}}}
+			responses["401"] = jsonResponse("Missing or invalid token", schemaRef("Error"))
+		}
+
+		path := strings.Join(segments, "/")
+		item, _ := paths[path].(gin.H)
+		if item == nil {
+			item = gin.H{}
+			paths[path] = item
+		}
+		item[strings.ToLower(op.method)] = operation
+	}
+
+	return gin.H{
+		"openapi": "3.0.3",
+		"info": gin.H{
+			"title":       "goproxyai management API",
+			"description": "Endpoints served by the proxy itself. Requests under /v1 are forwarded to the OpenAI API.",
+			"version":     "1.0.0",
+		},
+		"paths": paths,
+		"components": gin.H{
+			"schemas": apiSchemas,
+			"securitySchemes": gin.H{
+				"adminToken": gin.H{
+					"type": "http", "scheme": "bearer",
+					"description": "ADMIN_TOKEN, also accepted in the X-Admin-Token header",
+				},
+				"tenantAdminToken": gin.H{
+					"type": "http", "scheme": "bearer",
+					"description": "A tenant's admin token, or ADMIN_TOKEN",
+				},
+			},
+		},
+	}
+}
+
+// operationID turns "GET /admin/tenants/:id/features" into
+// "getAdminTenantsIdFeatures"
+func operationID(method, path string) string {
+	var id strings.Builder
+	id.WriteString(strings.ToLower(method))
+	for _, word := range strings.FieldsFunc(path, func(r rune) bool {
+		return r == '/' || r == ':' || r == '-'
+	}) {
+		id.WriteString(strings.ToUpper(word[:1]) + word[1:])
+	}
+	return id.String()
+}
+
+func object(properties gin.H) gin.H {
+	return gin.H{"type": "object", "properties": properties}
+}
+
+func schemaRef(name string) gin.H {
+	return gin.H{"$ref": "#/components/schemas/" + name}
+}
+
+func jsonBody(schema gin.H) gin.H {
+	return gin.H{"required": true, "content": gin.H{"application/json": gin.H{"schema": schema}}}
+}
+
+func jsonResponse(description string, schema gin.H) gin.H {
+	return gin.H{"description": description, "content": gin.H{"application/json": gin.H{"schema": schema}}}
+}
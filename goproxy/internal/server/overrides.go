@@ -0,0 +1,208 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/dryrun"
+	"goproxyai/internal/proxy"
+	"goproxyai/internal/tenant"
+)
+
+// Request headers that override proxy behaviour for one request, and the
+// names keys are given permission to use them by
+var overrideHeaders = map[string]string{
+	"X-Proxy-Timeout":   "timeout",
+	"X-Proxy-Cache-Ttl": "cache_ttl",
+	"X-Proxy-Cache":     "cache",
+	"X-Proxy-Upstream":  "upstream",
+	"X-Proxy-No-Retry":  "no_retry",
+}
+
+const overrideHeaderPrefix = "X-Proxy-"
+
+// Context keys for the overrides a request asked for
+const (
+	ctxTimeout    = "timeout"
+	ctxCacheTTL   = "cache_ttl"
+	ctxCacheOptIn = "cache_opt_in"
+	ctxNoRetry    = "no_retry"
+)
+
+// parseUpstreamTargets reads UPSTREAM_TARGETS entries of the form name=url
+func parseUpstreamTargets(entries []string) (map[string]string, error) {
+	targets := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		name, url, found := strings.Cut(entry, "=")
+		if !found || name == "" || !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			return nil, fmt.Errorf("invalid upstream target %q, expected name=url", entry)
+		}
+		targets[name] = strings.TrimSuffix(url, "/")
+	}
+	return targets, nil
+}
+
+// pinnedUpstream returns the URL of the upstream a tenant's traffic is
+// pinned to, if it is
+func (s *Server) pinnedUpstream(tenantID string) (string, bool) {
+	t, found := s.tenants.Tenant(tenantID)
+	if !found || t.Upstream == "" {
+		return "", false
+	}
+	return s.upstreamTargets[t.Upstream], true
+}
+
+// pinned reports whether a tenant's traffic is pinned to an upstream, so
+// nothing of it may be copied to another, such as the shadow upstream
+func (s *Server) pinned(tenantID string) bool {
+	_, pinned := s.pinnedUpstream(tenantID)
+	return pinned
+}
+
+// applyOverrides reads the X-Proxy-* headers of a request, checks the key
+// may use them and records what they ask for. They're never forwarded
+// upstream. It writes the error response itself when it returns false.
+func (s *Server) applyOverrides(c *gin.Context) bool {
+	requested := make(map[string]string)
+	for name, values := range c.Request.Header {
+		if strings.HasPrefix(name, overrideHeaderPrefix) {
+			requested[name] = strings.TrimSpace(values[0])
+		}
+	}
+	if len(requested) == 0 {
+		return true
+	}
+
+	allowed := s.config.ProxyOverrides
+	key, t, found := s.tenants.Lookup(c.GetHeader("Authorization"))
+	if found && key.Overrides != nil {
+		allowed = key.Overrides
+	}
+	for name, value := range requested {
+		permission, known := overrideHeaders[name]
+		if !known {
+			invalidOverride(c, name, "unknown override header")
+			return false
+		}
+		if !contains(allowed, permission) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "API key is not allowed to use " + name,
+				"code":  "OVERRIDE_NOT_ALLOWED",
+			})
+			c.Abort()
+			return false
+		}
+		if name == "X-Proxy-Upstream" && found && t.Upstream != "" && value != t.Upstream {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "Tenant traffic is pinned to upstream " + strconv.Quote(t.Upstream),
+				"code":  "UPSTREAM_PINNED",
+			})
+			c.Abort()
+			return false
+		}
+		if err := s.applyOverride(c, key, name, value); err != nil {
+			invalidOverride(c, name, err.Error())
+			return false
+		}
+		dryrun.From(c.Request.Context()).Add("overrides", "%s: %s", name, value)
+	}
+	return true
+}
+
+// applyOverride records one override, checked against the key's own limits
+// when the proxy knows it
+func (s *Server) applyOverride(c *gin.Context, key *tenant.Key, name, value string) error {
+	switch name {
+	case "X-Proxy-Timeout":
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 || timeout > s.config.RequestTimeout {
+			return fmt.Errorf("expected a duration up to %v", s.config.RequestTimeout)
+		}
+		c.Set(ctxTimeout, timeout)
+	case "X-Proxy-Cache-Ttl":
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl < 0 || ttl > s.config.CacheTTL {
+			return fmt.Errorf("expected a duration up to %v, or 0 to bypass the cache", s.config.CacheTTL)
+		}
+		if ttl == 0 {
+			c.Set(ctxCacheDisabled, true)
+		} else {
+			c.Set(ctxCacheTTL, ttl)
+		}
+	case "X-Proxy-Cache":
+		// Caching what the proxy wouldn't is the client's call, but only for
+		// as long as the key's policy allows
+		maxTTL := s.config.CacheTTL
+		if key != nil && key.CacheMaxTTL > 0 {
+			maxTTL = time.Duration(key.CacheMaxTTL) * time.Second
+		}
+		directive, seconds, _ := strings.Cut(value, "=")
+		ttl, err := strconv.Atoi(seconds)
+		if strings.TrimSpace(directive) != "ttl" || err != nil || ttl <= 0 || time.Duration(ttl)*time.Second > maxTTL {
+			return fmt.Errorf("expected ttl=<seconds> up to %d", int(maxTTL.Seconds()))
+		}
+		if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodPost {
+			return fmt.Errorf("only GET and POST requests can be cached")
+		}
+		if c.GetHeader("X-Proxy-Cache-Ttl") != "" {
+			return fmt.Errorf("can't be combined with X-Proxy-Cache-Ttl")
+		}
+		c.Set(ctxCacheOptIn, true)
+		c.Set(ctxCacheTTL, time.Duration(ttl)*time.Second)
+	case "X-Proxy-Upstream":
+		url, found := s.upstreamTargets[value]
+		if !found {
+			return fmt.Errorf("unknown upstream %q", value)
+		}
+		c.Request = c.Request.WithContext(proxy.WithUpstream(c.Request.Context(), url))
+	case "X-Proxy-No-Retry":
+		noRetry, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("expected true or false")
+		}
+		c.Set(ctxNoRetry, noRetry)
+	}
+	return nil
+}
+
+func invalidOverride(c *gin.Context, name, reason string) {
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error": "Invalid " + name + " header: " + reason,
+		"code":  "OVERRIDE_INVALID",
+	})
+	c.Abort()
+}
+
+// removeOverrideHeaders strips the X-Proxy-* headers from headers going
+// upstream
+func removeOverrideHeaders(headers http.Header) {
+	for name := range headers {
+		if strings.HasPrefix(textproto.CanonicalMIMEHeaderKey(name), overrideHeaderPrefix) {
+			delete(headers, name)
+		}
+	}
+}
+
+// requestTimeout is how long the request may wait for upstream to answer:
+// REQUEST_TIMEOUT, or the shorter X-Proxy-Timeout it asked for
+func (s *Server) requestTimeout(c *gin.Context) time.Duration {
+	if timeout := c.GetDuration(ctxTimeout); timeout > 0 {
+		return timeout
+	}
+	return s.config.RequestTimeout
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
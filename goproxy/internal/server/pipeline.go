@@ -0,0 +1,116 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/dryrun"
+	"goproxyai/internal/middleware"
+)
+
+// Request pipeline stages in the order they run unless PIPELINE says
+// otherwise
+var defaultPipeline = []string{
+	"logging", "compression", "metrics", "geoip", "ratelimit",
+	"chaos", "auth", "compaction", "features", "validation", "tools",
+	"moderation", "authz", "policy", "cache", "postprocess",
+}
+
+// Stages that run for every route; the rest only run for /v1
+var globalStages = map[string]bool{"logging": true, "compression": true, "metrics": true, "geoip": true, "ratelimit": true}
+
+// pipeline resolves PIPELINE into the middlewares every route runs and the
+// ones /v1 requests run, in the order given. cache and postprocess work
+// inside proxyHandler rather than as middlewares, so only whether they're
+// listed matters: a pipeline without them has the cache bypassed and the
+// post-processors dropped.
+func (s *Server) pipeline(names []string) (global, v1 []gin.HandlerFunc, err error) {
+	if len(names) == 0 {
+		names = defaultPipeline
+	}
+
+	stages := map[string]gin.HandlerFunc{
+		"logging":    middleware.RequestLogger(),
+		"metrics":    s.metrics.Middleware(),
+		"ratelimit":  s.rateLimiter.Middleware(),
+		"chaos":      s.chaos,
+		"auth":       s.keyAuth(),
+		"features":   s.tenantFeatures(),
+		"tools":      s.enforceTools(),
+		"moderation": s.tenantModeration(),
+		"authz":      s.extAuthz(),
+		"policy":     s.enforcePolicy(),
+	}
+	if s.config.Compression {
+		stages["compression"] = middleware.Compression(s.config.CompressionMinSize)
+	}
+	if s.config.PromptCompaction {
+		stages["compaction"] = s.compactPrompts()
+	}
+	if s.schemas != nil {
+		stages["validation"] = s.validateRequest()
+	}
+	if s.geo != nil {
+		stages["geoip"] = s.locateClient()
+	}
+
+	listed := make(map[string]bool, len(names))
+	captured := false
+	for _, name := range names {
+		known := name == "compression" || name == "compaction" || name == "validation" || name == "geoip" || name == "cache" || name == "postprocess" || stages[name] != nil
+		if !known {
+			return nil, nil, fmt.Errorf("unknown stage %q (stages: %s)", name, strings.Join(defaultPipeline, ", "))
+		}
+		if listed[name] {
+			return nil, nil, fmt.Errorf("stage %q listed twice", name)
+		}
+		listed[name] = true
+
+		if handler := stages[name]; handler != nil {
+			handler = traced(name, handler)
+			if globalStages[name] {
+				global = append(global, handler)
+			}
+			v1 = append(v1, handler)
+		}
+		if name == "compression" {
+			// Captures are taken inside compression, so they hold bodies
+			// as the proxy wrote them
+			v1 = append(v1, s.captureTraffic())
+			captured = true
+		}
+	}
+	if !captured {
+		v1 = append([]gin.HandlerFunc{s.captureTraffic()}, v1...)
+	}
+
+	if !listed["cache"] {
+		v1 = append(v1, func(c *gin.Context) {
+			c.Set(ctxCacheDisabled, true)
+		})
+	}
+	if !listed["postprocess"] {
+		s.postProcessors = nil
+	}
+	if !listed["auth"] {
+		s.logger.Printf("PIPELINE leaves out auth: virtual keys, key scopes and tenants aren't enforced")
+	}
+	return global, v1, nil
+}
+
+// traced records a stage in a dry run's trace, and whether it answered the
+// request itself rather than passing it on
+func traced(name string, handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		t := dryrun.From(c.Request.Context())
+		if t == nil {
+			handler(c)
+			return
+		}
+		step := t.Enter(name)
+		handler(c)
+		t.Leave(step, c.Writer.Status())
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/plugins"
+	"goproxyai/internal/proxy"
+)
+
+// preRoute runs the pre_route plugins ahead of routing, so they can rewrite
+// the method, path, query and headers a request is routed by, or answer it
+// themselves
+func (s *Server) preRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &plugins.Request{Method: r.Method, Path: r.URL.Path, Query: r.URL.RawQuery, Header: r.Header}
+		answer, err := s.plugins.Request(r.Context(), plugins.PreRoute, req)
+		if err != nil {
+			s.logger.Printf("Error running plugins for %s %s: %v", r.Method, r.URL.Path, err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(pluginFailed)
+			return
+		}
+		if answer != nil {
+			writePluginAnswer(w, answer)
+			return
+		}
+
+		r.Method = req.Method
+		if req.Path != r.URL.Path {
+			r.URL.Path = req.Path
+			r.URL.RawPath = ""
+		}
+		r.URL.RawQuery = req.Query
+		next.ServeHTTP(w, r)
+	})
+}
+
+var pluginFailed = gin.H{
+	"error": "A plugin failed to handle the request",
+	"code":  "PLUGIN_FAILED",
+}
+
+// preForward runs the pre_forward plugins on a request about to go
+// upstream. It writes the response itself and returns false when a plugin
+// answers the request or fails.
+func (s *Server) preForward(c *gin.Context, req *plugins.Request) bool {
+	answer, err := s.plugins.Request(c.Request.Context(), plugins.PreForward, req)
+	if err != nil {
+		s.logger.Printf("Error running plugins for %s %s: %v", req.Method, req.Path, err)
+		c.JSON(http.StatusInternalServerError, pluginFailed)
+		return false
+	}
+	if answer != nil {
+		writePluginAnswer(c.Writer, answer)
+		return false
+	}
+	return true
+}
+
+// postResponse reads an upstream response in full and runs the
+// post_response plugins on it. It writes an error response itself and
+// returns nil when that fails.
+func (s *Server) postResponse(c *gin.Context, req *plugins.Request, resp *proxy.StreamResponse) *proxy.StreamResponse {
+	data, err := io.ReadAll(proxy.LimitBody(resp.Body, s.config.MaxResponseBodySize*1024*1024))
+	if err != nil {
+		s.logger.Printf("Error reading response for %s %s: %v", req.Method, req.Path, err)
+		c.Error(err)
+		s.forwardFailed(c, err)
+		return nil
+	}
+
+	processed := &plugins.Response{StatusCode: resp.StatusCode, Header: http.Header(resp.Headers), Body: data}
+	if err := s.plugins.Response(c.Request.Context(), req, processed); err != nil {
+		s.logger.Printf("Error running plugins for %s %s: %v", req.Method, req.Path, err)
+		c.JSON(http.StatusInternalServerError, pluginFailed)
+		return nil
+	}
+	return streamResponse(&proxy.ProxyResponse{
+		StatusCode: processed.StatusCode,
+		Headers:    processed.Header,
+		Body:       processed.Body,
+	})
+}
+
+func writePluginAnswer(w http.ResponseWriter, answer *plugins.Response) {
+	for name, values := range answer.Header {
+		w.Header()[name] = values
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(answer.StatusCode)
+	w.Write(answer.Body)
+}
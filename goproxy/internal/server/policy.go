@@ -0,0 +1,148 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/clock"
+	"goproxyai/internal/openai"
+	"goproxyai/internal/policy"
+	"goproxyai/internal/usage"
+)
+
+// enforcePolicy runs the Rego policy on each /v1 request once the key and
+// tenant are known. Denied requests are answered here; allowed ones go on
+// with the body fields and upstream headers the policy set.
+func (s *Server) enforcePolicy() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.policy == nil {
+			c.Next()
+			return
+		}
+
+		body, ok := peekBody(c)
+		if !ok {
+			return
+		}
+		input := s.policyInput(c, body)
+
+		decision, err := s.policy.Evaluate(c.Request.Context(), input)
+		if err != nil {
+			s.logger.Printf("Policy evaluation failed for %s %s: %v", input.Method, input.Path, err)
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Policy evaluation failed",
+				"code":  "POLICY_ERROR",
+			})
+			c.Abort()
+			return
+		}
+		if !decision.Allow {
+			if decision.RetryAfter > 0 {
+				c.Header("Retry-After", strconv.Itoa(decision.RetryAfter))
+			}
+			deny(c, decision.Status, decision.Reason, "POLICY_DENIED")
+			return
+		}
+		if decision.RateLimit > 0 && !allow(c, "policy", s.policyLimiter, input.KeyID, decision.RateLimit) {
+			c.JSON(http.StatusTooManyRequests, gin.H{
+				"error": "Rate limit exceeded for this API key under the current policy. Please try again later.",
+				"code":  "POLICY_RATE_LIMIT_EXCEEDED",
+			})
+			c.Abort()
+			return
+		}
+
+		if len(decision.Set) > 0 {
+			if body == nil {
+				s.logger.Printf("Policy set fields on %s %s, but uploads aren't changed", input.Method, input.Path)
+			} else if body, err = setFields(body, decision.Set); err != nil {
+				s.logger.Printf("Could not apply policy to %s %s: %v", input.Method, input.Path, err)
+			} else {
+				c.Request.Body = io.NopCloser(bytes.NewReader(body))
+				c.Request.ContentLength = int64(len(body))
+				c.Request.Header.Set("Content-Length", strconv.Itoa(len(body)))
+				transformed(c, "policy")
+			}
+		}
+		annotate(c, decision.Headers)
+		c.Next()
+	}
+}
+
+func (s *Server) policyInput(c *gin.Context, body []byte) policy.Input {
+	input := policy.Input{
+		KeyID:  usage.KeyID(c.GetHeader("Authorization")),
+		Tenant: c.GetString(ctxTenantID),
+		Method: c.Request.Method,
+		Path:   c.Request.URL.Path,
+		Time:   policy.NewTime(clock.Now().In(s.policyZone), s.policySchedules),
+	}
+	if s.config.UserIDHeader != "" {
+		input.User = c.GetHeader(s.config.UserIDHeader)
+	}
+
+	info := openai.ParseRequest(body)
+	input.Model = info.Model
+	input.Stream = info.Stream
+	if info.User != "" {
+		input.User = info.User
+	}
+	var limits struct {
+		MaxTokens           int `json:"max_tokens"`
+		MaxCompletionTokens int `json:"max_completion_tokens"`
+		MaxOutputTokens     int `json:"max_output_tokens"`
+	}
+	if json.Unmarshal(body, &limits) == nil {
+		input.MaxTokens = max(limits.MaxTokens, limits.MaxCompletionTokens, limits.MaxOutputTokens)
+	}
+	return input
+}
+
+// setFields replaces top-level fields of a JSON request body, in name order
+// so the result doesn't vary between runs
+func setFields(body []byte, fields map[string]interface{}) ([]byte, error) {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var err error
+		if body, err = openai.SetField(body, name, fields[name]); err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+func (s *Server) getPolicy(c *gin.Context) {
+	if s.policy == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No policy bundle is configured"})
+		return
+	}
+	c.JSON(http.StatusOK, s.policy.Status())
+}
+
+func (s *Server) reloadPolicy(c *gin.Context) {
+	if s.policy == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No policy bundle is configured"})
+		return
+	}
+	if err := s.policy.Reload(c.Request.Context()); err != nil {
+		s.logger.Printf("Error reloading policy bundle: %v", err)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": "Policy bundle failed to load, the previous policy stays in force: " + err.Error(),
+			"code":  "POLICY_INVALID",
+		})
+		return
+	}
+	s.logger.Printf("Reloaded policy bundle %s", s.config.PolicyBundle)
+	c.JSON(http.StatusOK, s.policy.Status())
+}
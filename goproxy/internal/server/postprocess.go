@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/openai"
+	"goproxyai/internal/proxy"
+	"goproxyai/internal/servertools"
+	"goproxyai/postprocess"
+)
+
+// Completion endpoints whose responses are post-processed
+var postProcessPaths = map[string]bool{
+	"/v1/chat/completions": true,
+	"/v1/completions":      true,
+}
+
+// readsCompletion reports whether a request's response has to be read in
+// full before it's relayed, to be retried when empty, post-processed or
+// given its provenance or normalized
+func (s *Server) readsCompletion(method, path string) bool {
+	if method != http.MethodPost {
+		return false
+	}
+	return s.config.EmptyCompletionRetry && path == "/v1/chat/completions" ||
+		len(s.postProcessors) > 0 && postProcessPaths[path] ||
+		s.config.Provenance != "" && provenancePaths[path] ||
+		s.config.ResponseNormalization && normalizedPaths[path]
+}
+
+// forwardCompletion sends a completion upstream and reads the answer in
+// full, running the server tools it calls or retrying it if it's empty,
+// normalizing it, answering migrated function calls and engine listings in
+// their legacy form and running the post-processors on it, so the cache and
+// the client only ever see the final answer
+func (s *Server) forwardCompletion(ctx context.Context, c *gin.Context, req *proxy.ProxyRequest, tenantID, keyID string, info *openai.RequestInfo) (*proxy.StreamResponse, error) {
+	var resp *proxy.ProxyResponse
+	var err error
+	if tools, _ := c.Value(ctxServerTools).([]servertools.Tool); tools != nil {
+		resp, err = s.forwardServerTools(ctx, c, req, tools)
+	} else if s.config.EmptyCompletionRetry && req.Path == "/v1/chat/completions" && !c.GetBool(ctxNoRetry) {
+		resp, err = s.forwardRetryingEmpty(ctx, c, req, tenantID, keyID, info)
+	} else {
+		resp, err = s.proxyClient.Forward(ctx, req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.config.ResponseNormalization && normalizedPaths[req.Path] {
+		normalizeCompletion(c, req, info.Model, resp)
+	}
+	if c.GetBool(ctxLegacyFunctions) {
+		legacyResponse(resp)
+	}
+	if legacy, _ := engineRewrite(c); legacy.Listing {
+		enginesResponse(resp)
+	}
+	if len(s.postProcessors) > 0 && resp.StatusCode == http.StatusOK && postProcessPaths[req.Path] {
+		if s.postProcess(req.Path, info.Model, resp) {
+			transformed(c, "postprocess")
+		}
+	}
+	if s.config.Provenance != "" && resp.StatusCode == http.StatusOK {
+		if served := openai.ParseRequest(resp.Body).Model; served != "" {
+			c.Set(ctxServedModel, served)
+		}
+		if stamped, ok := s.stampProvenance(c, req.Path, resp.Body, "MISS"); ok {
+			resp.Body = stamped
+			headers := http.Header(resp.Headers).Clone()
+			headers.Del("Content-Length")
+			resp.Headers = headers
+		}
+	}
+	return streamResponse(resp), nil
+}
+
+// postProcess runs the post-processors on a response, reporting whether
+// they did. It's left as it came from upstream if it isn't JSON or a
+// processor fails.
+func (s *Server) postProcess(path, model string, resp *proxy.ProxyResponse) bool {
+	var body map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(resp.Body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&body); err != nil {
+		return false
+	}
+	if err := s.postProcessors.Process(&postprocess.Response{Path: path, Model: model, Body: body}); err != nil {
+		s.logger.Printf("Post-processing %s failed, returning the response unprocessed: %v", path, err)
+		return false
+	}
+
+	var encoded bytes.Buffer
+	encoder := json.NewEncoder(&encoded)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(body); err != nil {
+		s.logger.Printf("Post-processing %s failed, returning the response unprocessed: %v", path, err)
+		return false
+	}
+	resp.Body = bytes.TrimSuffix(encoded.Bytes(), []byte("\n"))
+	headers := http.Header(resp.Headers).Clone()
+	headers.Del("Content-Length")
+	resp.Headers = headers
+	return true
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/cache"
+	"goproxyai/internal/openai"
+)
+
+// Context keys for what PROVENANCE reports
+const (
+	// The []string of ways the proxy changed the request or its answer
+	ctxTransforms = "transforms"
+	// The model upstream says answered, when the answer was read in full
+	ctxServedModel = "served_model"
+)
+
+// Responses that carry provenance in their body with PROVENANCE=body
+var provenancePaths = map[string]bool{
+	"/v1/chat/completions": true,
+	"/v1/completions":      true,
+	"/v1/responses":        true,
+}
+
+// provenance says where an answer came from, for downstream systems to
+// audit
+type provenance struct {
+	Proxy      string   `json:"proxy"`
+	Model      string   `json:"model,omitempty"`
+	Cache      string   `json:"cache"`
+	Transforms []string `json:"transforms"`
+}
+
+// transformed notes a way the proxy changed the request or its answer,
+// such as "defaults" or "migration", for PROVENANCE to report
+func transformed(c *gin.Context, name string) {
+	transforms, _ := c.Value(ctxTransforms).([]string)
+	for _, t := range transforms {
+		if t == name {
+			return
+		}
+	}
+	c.Set(ctxTransforms, append(transforms, name))
+}
+
+func (s *Server) provenance(c *gin.Context, cacheStatus string) provenance {
+	transforms, _ := c.Value(ctxTransforms).([]string)
+	if transforms == nil {
+		transforms = []string{}
+	}
+	return provenance{
+		Proxy:      s.config.ProxyID,
+		Model:      c.GetString(ctxServedModel),
+		Cache:      cacheStatus,
+		Transforms: transforms,
+	}
+}
+
+// provenanceHeaders sets X-Proxy-Id, X-Proxy-Model and X-Proxy-Transforms
+// when PROVENANCE asks for headers; X-Cache already tells the cache status
+func (s *Server) provenanceHeaders(c *gin.Context) {
+	if s.config.Provenance != "headers" && s.config.Provenance != "both" {
+		return
+	}
+	p := s.provenance(c, "")
+	c.Header("X-Proxy-Id", p.Proxy)
+	if p.Model != "" {
+		c.Header("X-Proxy-Model", p.Model)
+	}
+	transforms := "none"
+	if len(p.Transforms) > 0 {
+		transforms = strings.Join(p.Transforms, ", ")
+	}
+	c.Header("X-Proxy-Transforms", transforms)
+}
+
+// stampProvenance adds the provenance of a completion to its body under
+// PROVENANCE_FIELD when PROVENANCE asks for the body, replacing any it
+// carried from the cache. It returns false for other bodies.
+func (s *Server) stampProvenance(c *gin.Context, path string, body []byte, cacheStatus string) ([]byte, bool) {
+	if s.config.Provenance != "body" && s.config.Provenance != "both" || !provenancePaths[path] {
+		return body, false
+	}
+	stamped, err := openai.SetField(body, s.config.ProvenanceField, s.provenance(c, cacheStatus))
+	if err != nil {
+		return body, false
+	}
+	return stamped, true
+}
+
+// stampedEntry is a cache entry as it's served with its provenance, leaving
+// the cached one untouched
+func (s *Server) stampedEntry(c *gin.Context, path string, entry *cache.CacheEntry) *cache.CacheEntry {
+	if s.config.Provenance == "" {
+		return entry
+	}
+	var answer struct {
+		Model string `json:"model"`
+	}
+	if json.Unmarshal(entry.Body, &answer) == nil && answer.Model != "" {
+		c.Set(ctxServedModel, answer.Model)
+	}
+	body, ok := s.stampProvenance(c, path, entry.Body, "HIT")
+	if !ok {
+		return entry
+	}
+	stamped := *entry
+	stamped.Body = body
+	return &stamped
+}
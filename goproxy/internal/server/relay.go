@@ -0,0 +1,260 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/dryrun"
+	"goproxyai/internal/proxy"
+)
+
+const (
+	copyBufferSize = 32 * 1024
+	// Request body buffers that grew past this aren't pooled, so one large
+	// request doesn't pin its memory for the life of the process
+	maxPooledBodySize = 1024 * 1024
+)
+
+var (
+	copyBuffers = sync.Pool{New: func() any {
+		buf := make([]byte, copyBufferSize)
+		return &buf
+	}}
+	bodyBuffers = sync.Pool{New: func() any {
+		return new(bytes.Buffer)
+	}}
+	eventReaders = sync.Pool{New: func() any {
+		return bufio.NewReaderSize(nil, copyBufferSize)
+	}}
+)
+
+// readBody reads a request body into a pooled buffer. The caller must hand
+// the buffer back with releaseBody once nothing refers to its bytes.
+func readBody(r *http.Request) (*bytes.Buffer, error) {
+	buf := bodyBuffers.Get().(*bytes.Buffer)
+	if r.ContentLength > 0 && r.ContentLength <= maxPooledBodySize {
+		buf.Grow(int(r.ContentLength))
+	}
+	if _, err := buf.ReadFrom(r.Body); err != nil {
+		releaseBody(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+// limitRequestBodies caps the /v1 bodies read in full at
+// MAX_REQUEST_BODY_SIZE, ahead of the middlewares that peek at them.
+// Streamed uploads are bounded by MAX_UPLOAD_SIZE instead.
+func (s *Server) limitRequestBodies(next http.Handler) http.Handler {
+	limit := s.config.MaxRequestBodySize * 1024 * 1024
+	if limit <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/v1/") && r.Body != nil && r.Body != http.NoBody &&
+			!isStreamedUpload(r.URL.Path, r.Header.Get("Content-Type")) {
+			if r.ContentLength > limit {
+				requestTooLarge(w, limit)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestTooLarge answers 413 ahead of routing, where there's no gin context
+func requestTooLarge(w http.ResponseWriter, limit int64) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	fmt.Fprintf(w, `{"error":"Request body exceeds the %d MB limit","code":"REQUEST_TOO_LARGE"}`, limit/(1024*1024))
+}
+
+// bodyReadFailed answers a request whose body couldn't be read, with 413
+// when it went past MAX_REQUEST_BODY_SIZE
+func bodyReadFailed(c *gin.Context, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error": fmt.Sprintf("Request body exceeds the %d MB limit", tooLarge.Limit/(1024*1024)),
+			"code":  "REQUEST_TOO_LARGE",
+		})
+		return
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+}
+
+func releaseBody(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBodySize {
+		return
+	}
+	buf.Reset()
+	bodyBuffers.Put(buf)
+}
+
+// copyBuffered is io.Copy with a pooled buffer
+func copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+// relay writes an upstream response to the client as it arrives. The body
+// is teed into memory only when captureLimit is positive and only while it
+// stays within it; the returned buffer is nil or overflowed otherwise.
+//
+// Under the abort size policy, a response that declares a length over
+// MAX_RESPONSE_BODY_SIZE gets a 502 instead, and one that outgrows it on the
+// way through has its connection cut so the client can't mistake it for a
+// complete body.
+func (s *Server) relay(c *gin.Context, resp *proxy.StreamResponse, cacheStatus string, captureLimit int64) (*cappedBuffer, int64, error) {
+	body := io.Reader(resp.Body)
+	if limit := s.config.MaxResponseBodySize * 1024 * 1024; limit > 0 && s.config.ResponseSizePolicy == "abort" {
+		if resp.ContentLength > limit {
+			s.responseTooLarge(c)
+			return nil, 0, proxy.ErrResponseTooLarge
+		}
+		body = proxy.LimitBody(body, limit)
+	}
+
+	s.copyHeaders(c, resp.Headers)
+	if c.Writer.Header().Get("Content-Type") == "" {
+		c.Header("Content-Type", "application/json")
+	}
+	c.Header("X-Cache", cacheStatus)
+	c.Header("X-Proxy", "goproxyai")
+	s.provenanceHeaders(c)
+	c.Status(resp.StatusCode)
+
+	var capture *cappedBuffer
+	writer := io.Writer(c.Writer)
+	if captureLimit > 0 && resp.ContentLength <= captureLimit {
+		capture = &cappedBuffer{limit: captureLimit}
+		if resp.ContentLength > 0 {
+			capture.buf.Grow(int(resp.ContentLength))
+		}
+		writer = io.MultiWriter(c.Writer, capture)
+	}
+
+	written, err := copyBuffered(writer, body)
+	if errors.Is(err, proxy.ErrResponseTooLarge) {
+		abortResponse(c)
+	}
+	return capture, written, err
+}
+
+// copyHeaders sets upstream's response headers RESPONSE_HEADERS allows on
+// the client's response, keeping every value of a repeated header and
+// replacing any the proxy set under the same name before
+func (s *Server) copyHeaders(c *gin.Context, headers map[string][]string) {
+	for key, values := range headers {
+		if key = http.CanonicalHeaderKey(key); s.responseHeaders.allows(key) {
+			c.Writer.Header()[key] = append([]string(nil), values...)
+		}
+	}
+}
+
+// forwardFailed answers a request that never got an upstream response
+func (s *Server) forwardFailed(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, dryrun.ErrDryRun):
+		// Nothing to answer: debugTrace reports what would have been sent
+	case errors.Is(err, proxy.ErrResponseTooLarge):
+		s.responseTooLarge(c)
+	case errors.Is(err, proxy.ErrShuttingDown):
+		s.shuttingDown(c)
+	case errors.Is(err, proxy.ErrOverloaded):
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": "Upstream is at its concurrency limit. Please retry shortly.",
+			"code":  "UPSTREAM_OVERLOADED",
+		})
+	default:
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error": "Failed to forward request to OpenAI API",
+			"code":  "PROXY_ERROR",
+		})
+	}
+}
+
+func (s *Server) responseTooLarge(c *gin.Context) {
+	c.JSON(http.StatusBadGateway, gin.H{
+		"error": fmt.Sprintf("Upstream response exceeds the %d MB limit", s.config.MaxResponseBodySize),
+		"code":  "RESPONSE_TOO_LARGE",
+	})
+}
+
+// abortResponse drops the client connection mid-response. Over HTTP/1.1
+// that's the only way to signal a truncated body; HTTP/2 connections can't
+// be taken over, so their stream just ends early.
+func abortResponse(c *gin.Context) {
+	if c.Request.ProtoMajor != 1 {
+		return
+	}
+	if conn, _, err := c.Writer.Hijack(); err == nil {
+		conn.Close()
+	}
+}
+
+// isJSON reports whether a response body may carry token usage
+func isJSON(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "application/json"
+}
+
+// Request media types that are never inspected, so their bodies are
+// streamed upstream instead of being read into memory
+var streamedMediaTypes = []string{"application/octet-stream", "audio/", "image/", "video/"}
+
+// isStreamedUpload reports whether a request body goes upstream untouched:
+// multipart uploads and raw binary bodies
+func isStreamedUpload(path, contentType string) bool {
+	if isMultipartUpload(path, contentType) {
+		return true
+	}
+	contentType = strings.ToLower(contentType)
+	for _, mediaType := range streamedMediaTypes {
+		if strings.HasPrefix(contentType, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// cappedBuffer collects writes until they exceed limit, after which it
+// discards everything but keeps accepting writes so the stream continues
+type cappedBuffer struct {
+	buf        bytes.Buffer
+	limit      int64
+	overflowed bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if b.overflowed {
+		return len(p), nil
+	}
+	if int64(b.buf.Len()+len(p)) > b.limit {
+		b.overflowed = true
+		b.buf = bytes.Buffer{}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+// complete returns the captured body, or false if nothing was captured or
+// the body outgrew the limit
+func (b *cappedBuffer) complete() ([]byte, bool) {
+	if b == nil || b.overflowed {
+		return nil, false
+	}
+	return b.buf.Bytes(), true
+}
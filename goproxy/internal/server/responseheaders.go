@@ -0,0 +1,75 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Upstream response headers clients are sent when RESPONSE_HEADERS is
+// empty: the request ID OpenAI support asks for, rate-limit hints,
+// upstream's deprecation notices, and Cache-Control, which keeps event
+// streams from being buffered. The rest, such as cf-ray, Set-Cookie or
+// the organization the proxy's key belongs to, only say something about
+// upstream.
+var defaultResponseHeaders = []string{
+	"X-Request-Id",
+	"Openai-Processing-Ms",
+	"Openai-Version",
+	"X-Ratelimit-*",
+	"Retry-After",
+	"Deprecation",
+	"Sunset",
+	"Cache-Control",
+}
+
+// Headers that describe the body, or that the proxy puts on upstream's
+// response itself, are always sent
+var framingHeaders = []string{
+	"Content-Type",
+	"Content-Length",
+	"Content-Encoding",
+	"Content-Disposition",
+	"Via",
+	"Warning",
+	"X-Coalesced",
+	"X-Embeddings-Cached",
+}
+
+// headerAllowlist is which upstream response headers reach clients, by
+// name or, with a trailing *, by prefix. * alone lets them all through.
+type headerAllowlist struct {
+	all      bool
+	names    map[string]bool
+	prefixes []string
+}
+
+func newHeaderAllowlist(allowed []string) *headerAllowlist {
+	if len(allowed) == 0 {
+		allowed = defaultResponseHeaders
+	}
+	a := &headerAllowlist{names: make(map[string]bool)}
+	for _, name := range append(allowed, framingHeaders...) {
+		switch {
+		case name == "*":
+			a.all = true
+		case strings.HasSuffix(name, "*"):
+			a.prefixes = append(a.prefixes, http.CanonicalHeaderKey(strings.TrimSuffix(name, "*")))
+		default:
+			a.names[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+	return a
+}
+
+// allows reports whether a canonical header name may be sent to clients
+func (a *headerAllowlist) allows(name string) bool {
+	if a.all || a.names[name] {
+		return true
+	}
+	for _, prefix := range a.prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/clock"
+	"goproxyai/internal/cluster"
+	"goproxyai/internal/usage"
+)
+
+const (
+	// How often stored data past its retention is purged
+	retentionInterval = time.Hour
+	// How long a member has to carry out a deletion request passed on to it
+	memberDeletionTimeout = 10 * time.Second
+)
+
+// deletedData counts what a deletion request removed
+type deletedData struct {
+	UsageRecords int `json:"usage_records"`
+	RequestLogs  int `json:"request_logs"`
+	SlowRequests int `json:"slow_requests"`
+	CacheEntries int `json:"cache_entries"`
+	Images       int `json:"images"`
+	Embeddings   int `json:"embeddings"`
+	Sessions     int `json:"sessions"`
+
+	// Members of the cluster the request couldn't be passed on to
+	UnreachableMembers []string `json:"unreachable_members,omitempty"`
+}
+
+func (d *deletedData) add(other deletedData) {
+	d.UsageRecords += other.UsageRecords
+	d.RequestLogs += other.RequestLogs
+	d.SlowRequests += other.SlowRequests
+	d.CacheEntries += other.CacheEntries
+	d.Images += other.Images
+	d.Embeddings += other.Embeddings
+	d.Sessions += other.Sessions
+}
+
+// watchRetention purges stored data past its retention at startup and
+// every interval after, when there's any to purge
+func (s *Server) watchRetention(interval time.Duration) {
+	cassettes := s.cassettes != nil && s.config.CassetteRetention > 0
+	if s.config.UsageRetention == 0 && s.config.LogRetention == 0 && !cassettes && s.sessions == nil {
+		return
+	}
+	go func() {
+		s.purgeExpired()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.purgeExpired()
+		}
+	}()
+}
+
+func (s *Server) purgeExpired() {
+	now := clock.Now()
+	if s.config.UsageRetention > 0 {
+		if purged := s.usage.Purge(now.Add(-s.config.UsageRetention)); purged > 0 {
+			s.logger.Printf("Purged %d usage records past USAGE_RETENTION", purged)
+		}
+	}
+	if s.config.LogRetention > 0 {
+		before := now.Add(-s.config.LogRetention)
+		purged := s.metrics.Purge(before)
+		if s.slowRequests != nil {
+			purged += s.slowRequests.remove(func(record slowRequest) bool { return record.Timestamp.Before(before) })
+		}
+		if purged > 0 {
+			s.logger.Printf("Purged %d request records past LOG_RETENTION", purged)
+		}
+	}
+	if s.cassettes != nil && s.config.CassetteRetention > 0 {
+		// Cassettes are dated by their files, on the system clock
+		purged, err := s.cassettes.Purge(time.Now().Add(-s.config.CassetteRetention))
+		if err != nil {
+			s.logger.Printf("Error purging cassettes past CASSETTE_RETENTION: %v", err)
+		} else if purged > 0 {
+			s.logger.Printf("Purged %d cassettes past CASSETTE_RETENTION", purged)
+		}
+	}
+	if s.sessions != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), s.config.RequestTimeout)
+		if err := s.sessions.Expire(ctx); err != nil {
+			s.logger.Printf("Error purging expired sessions from SESSION_STORE: %v", err)
+		}
+		cancel()
+	}
+}
+
+// deleteData honours a deletion request for the data the proxy keeps about
+// a tenant, an end user, or a user within a tenant: their usage records,
+// recent and slow request records, cached responses and images, and for a tenant
+// the sessions of its keys. Sessions belong to API keys rather than end
+// users, so a user's can't be told apart from the rest of their key's.
+// Every replica keeps its own, and with CLUSTER_CACHE most cache entries
+// live on the member their key hashes to, so in a cluster the deletion is
+// passed on to the other members too.
+func (s *Server) deleteData(c *gin.Context) {
+	tenantID, user := c.Query("tenant"), c.Query("user")
+	if tenantID == "" && user == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Specify the tenant, the user or both to delete the data of"})
+		return
+	}
+
+	deleted, ok := s.deleteLocal(c, tenantID, user)
+	if !ok {
+		return
+	}
+	if s.cluster != nil {
+		s.deleteOnMembers(tenantID, user, &deleted)
+	}
+
+	// Who the data was about stays out of the log
+	s.logger.Printf("Deleted data on request: %d usage records, %d request records, %d slow requests, %d cache entries, %d images, %d embeddings, %d sessions, %d members unreachable",
+		deleted.UsageRecords, deleted.RequestLogs, deleted.SlowRequests, deleted.CacheEntries, deleted.Images, deleted.Embeddings, deleted.Sessions, len(deleted.UnreachableMembers))
+	c.JSON(http.StatusOK, deleted)
+}
+
+// deleteMemberData runs a deletion request another member passed on
+func (s *Server) deleteMemberData(c *gin.Context) {
+	tenantID, user := c.Query("tenant"), c.Query("user")
+	if tenantID == "" && user == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Specify the tenant, the user or both to delete the data of"})
+		return
+	}
+	if deleted, ok := s.deleteLocal(c, tenantID, user); ok {
+		c.JSON(http.StatusOK, deleted)
+	}
+}
+
+// deleteLocal deletes what this replica keeps about the tenant or user. It
+// writes the error response itself when it returns false.
+func (s *Server) deleteLocal(c *gin.Context, tenantID, user string) (deletedData, bool) {
+	deleted := deletedData{
+		UsageRecords: s.usage.Delete(tenantID, user),
+		RequestLogs:  s.metrics.Delete(tenantID, user),
+		CacheEntries: s.cache.Delete(tenantID, user),
+	}
+	if s.slowRequests != nil {
+		deleted.SlowRequests = s.slowRequests.remove(func(record slowRequest) bool {
+			return (tenantID == "" || record.Tenant == tenantID) && (user == "" || record.User == user)
+		})
+	}
+	if s.images != nil {
+		deleted.Images = s.images.Delete(tenantID, user)
+	}
+	if s.vectors != nil {
+		deleted.Embeddings = s.vectors.Delete(tenantID, user)
+	}
+	if s.sessions != nil && tenantID != "" && user == "" {
+		for _, key := range s.tenants.Keys() {
+			if key.Tenant != tenantID {
+				continue
+			}
+			count, err := s.sessions.DeletePrefix(c.Request.Context(), usage.KeyID(key.Key)+"-")
+			if err != nil {
+				s.logger.Printf("Error deleting sessions from SESSION_STORE: %v", err)
+				c.JSON(http.StatusBadGateway, gin.H{
+					"error": "Session store unavailable",
+					"code":  "SESSION_STORE_ERROR",
+				})
+				return deletedData{}, false
+			}
+			deleted.Sessions += count
+		}
+	}
+	return deleted, true
+}
+
+// deleteOnMembers passes a deletion request on to the other members of the
+// cluster, adding what they deleted to deleted. Members that are down or
+// can't be reached are listed in it instead, for the request to be retried.
+func (s *Server) deleteOnMembers(tenantID, user string, deleted *deletedData) {
+	query := url.Values{}
+	if tenantID != "" {
+		query.Set("tenant", tenantID)
+	}
+	if user != "" {
+		query.Set("user", user)
+	}
+	client := &http.Client{Timeout: memberDeletionTimeout}
+
+	for _, member := range s.cluster.Members() {
+		if member.Self {
+			continue
+		}
+		if !member.Up || member.URL == "" {
+			deleted.UnreachableMembers = append(deleted.UnreachableMembers, member.ID)
+			continue
+		}
+		theirs, err := s.deleteOnMember(client, member.URL+cluster.DeletionPath+"?"+query.Encode())
+		if err != nil {
+			s.logger.Printf("Could not pass deletion request on to %s: %v", member.ID, err)
+			deleted.UnreachableMembers = append(deleted.UnreachableMembers, member.ID)
+			continue
+		}
+		deleted.add(theirs)
+	}
+}
+
+func (s *Server) deleteOnMember(client *http.Client, target string) (deletedData, error) {
+	req, err := http.NewRequest(http.MethodPost, target, nil)
+	if err != nil {
+		return deletedData{}, err
+	}
+	req.Header.Set(cluster.SecretHeader, s.config.ClusterSecret)
+	resp, err := client.Do(req)
+	if err != nil {
+		return deletedData{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return deletedData{}, fmt.Errorf("returned %d", resp.StatusCode)
+	}
+	var theirs deletedData
+	err = json.NewDecoder(resp.Body).Decode(&theirs)
+	return theirs, err
+}
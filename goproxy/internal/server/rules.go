@@ -0,0 +1,189 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/dryrun"
+)
+
+// rule is one entry of REQUEST_RULES_FILE: what it matches, and how it
+// rewrites the requests it matches
+type rule struct {
+	Name  string    `json:"name,omitempty"`
+	Match ruleMatch `json:"match"`
+
+	Set         map[string]json.RawMessage `json:"set,omitempty"`    // body fields, replacing what the request sent
+	Remove      []string                   `json:"remove,omitempty"` // body fields
+	RewritePath string                     `json:"rewrite_path,omitempty"`
+	AddHeaders  map[string]string          `json:"add_headers,omitempty"`
+}
+
+// ruleMatch is what a request has to match for a rule to apply, every
+// condition given. Paths and models ending in * match every value they
+// start, and a header value of * matches any value.
+type ruleMatch struct {
+	Method string            `json:"method,omitempty"`
+	Path   string            `json:"path,omitempty"`
+	Model  string            `json:"model,omitempty"`
+	Header map[string]string `json:"header,omitempty"`
+}
+
+// loadRules reads REQUEST_RULES_FILE, a JSON array of rules applied in
+// order
+func loadRules(path string) ([]rule, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for i := range rules {
+		if err := rules[i].check(); err != nil {
+			return nil, fmt.Errorf("rule %s: %w", rules[i].label(i), err)
+		}
+	}
+	return rules, nil
+}
+
+func (r *rule) check() error {
+	if len(r.Set) == 0 && len(r.Remove) == 0 && r.RewritePath == "" && len(r.AddHeaders) == 0 {
+		return errors.New("it has no set, remove, rewrite_path or add_headers")
+	}
+	if r.Match.Path != "" && !strings.HasPrefix(r.Match.Path, "/v1/") {
+		return fmt.Errorf("invalid path %q, expected a /v1 path", r.Match.Path)
+	}
+	if r.RewritePath != "" && !strings.HasPrefix(r.RewritePath, "/v1/") {
+		return fmt.Errorf("invalid rewrite_path %q, expected a /v1 path", r.RewritePath)
+	}
+	r.Match.Method = strings.ToUpper(r.Match.Method)
+	return nil
+}
+
+// label names a rule in logs and dry runs, by its position when it has no
+// name
+func (r *rule) label(i int) string {
+	if r.Name != "" {
+		return fmt.Sprintf("%q", r.Name)
+	}
+	return fmt.Sprintf("#%d", i+1)
+}
+
+func (m ruleMatch) matches(method, path, model string, header http.Header) bool {
+	if m.Method != "" && m.Method != method {
+		return false
+	}
+	if m.Path != "" && !matchesPattern(m.Path, path) {
+		return false
+	}
+	if m.Model != "" && (model == "" || !matchesPattern(m.Model, model)) {
+		return false
+	}
+	for name, want := range m.Header {
+		got := header.Get(name)
+		if got == "" || want != "*" && got != want {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesPattern reports whether value is pattern, or starts with it when
+// it ends in *
+func matchesPattern(pattern, value string) bool {
+	if prefix, wildcard := strings.CutSuffix(pattern, "*"); wildcard {
+		return strings.HasPrefix(value, prefix)
+	}
+	return pattern == value
+}
+
+// applyRules runs REQUEST_RULES_FILE over a request before it's routed, in
+// order, each rule matching the request as the ones before it left it. It
+// returns the path and body to go on with, and sets the rules' headers on
+// the upstream headers. Body fields are only edited on JSON object bodies.
+func (s *Server) applyRules(c *gin.Context, method, path string, headers http.Header, body []byte) (string, []byte) {
+	if len(s.rules) == 0 {
+		return path, body
+	}
+
+	var fields map[string]json.RawMessage
+	if len(body) > 0 && json.Unmarshal(body, &fields) != nil {
+		fields = nil
+	}
+	var model string
+	if raw, found := fields["model"]; found {
+		json.Unmarshal(raw, &model)
+	}
+
+	trace := dryrun.From(c.Request.Context())
+	edited := false
+	for i := range s.rules {
+		r := &s.rules[i]
+		if !r.Match.matches(method, path, model, c.Request.Header) {
+			continue
+		}
+
+		var done []string
+		if (len(r.Set) > 0 || len(r.Remove) > 0) && fields == nil {
+			s.logger.Printf("Rule %s matched %s %s, but its body isn't a JSON object to edit", r.label(i), method, path)
+		} else if fields != nil {
+			for _, name := range sortedKeys(r.Set) {
+				fields[name] = r.Set[name]
+				done = append(done, "set "+name)
+			}
+			for _, name := range r.Remove {
+				if _, found := fields[name]; found {
+					delete(fields, name)
+					done = append(done, "removed "+name)
+				}
+			}
+			if raw, found := r.Set["model"]; found {
+				json.Unmarshal(raw, &model)
+			}
+			edited = edited || len(done) > 0
+		}
+		if r.RewritePath != "" && r.RewritePath != path {
+			done = append(done, "rewrote "+path+" to "+r.RewritePath)
+			path = r.RewritePath
+		}
+		for _, name := range sortedKeys(r.AddHeaders) {
+			headers.Set(name, r.AddHeaders[name])
+			done = append(done, "added header "+name)
+		}
+		if len(done) > 0 {
+			trace.Add("rules", "rule %s %s", r.label(i), strings.Join(done, ", "))
+			transformed(c, "rules")
+		}
+	}
+
+	if edited {
+		updated, err := json.Marshal(fields)
+		if err != nil {
+			s.logger.Printf("Could not apply rules to request body: %v", err)
+			return path, body
+		}
+		body = updated
+	}
+	return path, body
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
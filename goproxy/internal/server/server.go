@@ -1,55 +1,536 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
 
+	"goproxyai/internal/admin"
+	"goproxyai/internal/alerting"
+	"goproxyai/internal/authz"
+	"goproxyai/internal/batching"
+	"goproxyai/internal/billing"
 	"goproxyai/internal/cache"
+	"goproxyai/internal/clock"
+	"goproxyai/internal/cluster"
 	"goproxyai/internal/config"
+	"goproxyai/internal/deprecation"
+	"goproxyai/internal/dryrun"
+	"goproxyai/internal/encryption"
+	"goproxyai/internal/finetune"
+	"goproxyai/internal/geoip"
+	"goproxyai/internal/imagestore"
+	"goproxyai/internal/metrics"
 	"goproxyai/internal/middleware"
+	"goproxyai/internal/openai"
+	"goproxyai/internal/plugins"
+	"goproxyai/internal/policy"
 	"goproxyai/internal/proxy"
+	"goproxyai/internal/schema"
+	"goproxyai/internal/servertools"
+	"goproxyai/internal/session"
+	"goproxyai/internal/shadow"
+	"goproxyai/internal/tenant"
+	"goproxyai/internal/tlspolicy"
+	"goproxyai/internal/usage"
+	"goproxyai/internal/webhooks"
+	"goproxyai/postprocess"
+	"goproxyai/streamhooks"
 )
 
 type Server struct {
-	config      *config.Config
-	proxyClient *proxy.Client
-	cache       *cache.Cache
-	rateLimiter *middleware.RateLimiter
-	router      *gin.Engine
-	logger      *log.Logger
+	config          *config.Config
+	proxyClient     *proxy.Client
+	shadowClient    *proxy.Client
+	concurrency     *proxy.ConcurrencyLimiter
+	cache           *cache.Cache
+	rateLimiter     *middleware.RateLimiter
+	userRateLimiter *middleware.RateLimiter
+	keyRateLimiter  *middleware.RateLimiter
+	policyLimiter   *middleware.RateLimiter
+	cluster         *cluster.Node
+	clusterCache    *clusterCache
+	metrics         *metrics.Recorder
+	runs            *metrics.RunTracker
+	streams         *metrics.StreamTracker
+	streamLimits    *streamLimits
+	duplicates      *duplicates
+	guards          *guards
+	draining        draining
+	deprecations    *deprecation.Tracker
+	load            *metrics.LoadMonitor
+	embeddings      *batching.EmbeddingBatcher
+	vectors         *cache.EmbeddingCache
+	uploadParts     *uploadParts
+	shadows         *shadow.Comparator
+	shadowSlots     chan struct{}
+	postProcessors  postprocess.Pipeline
+	streamHooks     streamhooks.Chain
+	plugins         *plugins.Host
+	authz           *authz.Client
+	policy          *policy.Engine
+	policyZone      *time.Location
+	policySchedules policy.Schedules
+	successors      map[string]embeddingSuccessor
+	upstreamTargets map[string]string
+	upstreamChecked []*upstreamCheck
+	responseHeaders *headerAllowlist
+	geo             *geoRules
+	webhooks        *webhooks.Dispatcher
+	finetunes       *finetune.Tracker
+	images          *cache.ImageCache
+	imageStore      imagestore.Store
+	schemas         map[string]*schema.Schema
+	routeDefaults   map[string]map[string]json.RawMessage
+	rules           []rule
+	sessions        session.Store
+	cassettes       *proxy.CassetteTransport
+	serverTools     *servertools.Registry
+	finetuneHooks   *webhooks.Dispatcher
+	usage           *usage.Tracker
+	tenants         *tenant.Registry
+	pricing         *billing.Pricing
+	reporter        *billing.Reporter
+	journal         *billing.Journal
+	slowRequests    *slowRequests
+	captures        *captures
+	alerts          *alerting.Evaluator
+	router          *gin.Engine
+	localRoutes     map[string]gin.HandlerFunc
+	chaos           gin.HandlerFunc
+	logger          *log.Logger
 }
 
 func New(cfg *config.Config) *Server {
 	logger := log.New(os.Stdout, "[PROXY] ", log.LstdFlags|log.Lshortfile)
 
-	proxyClient := proxy.NewClient(cfg.ProxyURL, cfg.OpenAIAPIURL, cfg.RequestTimeout)
-	cacheInstance := cache.New(cfg.CacheTTL, cfg.MaxCacheSize)
+	if cfg.ResponseSizePolicy != "stream" && cfg.ResponseSizePolicy != "abort" {
+		logger.Fatalf("Invalid RESPONSE_SIZE_POLICY %q, expected stream or abort", cfg.ResponseSizePolicy)
+	}
+	var concurrency *proxy.ConcurrencyLimiter
+	if cfg.UpstreamConcurrencyMax > 0 {
+		concurrency = proxy.NewConcurrencyLimiter(cfg.UpstreamConcurrencyMin, cfg.UpstreamConcurrencyMax, cfg.UpstreamLatencyTarget, cfg.UpstreamQueueTimeout)
+	}
+	tlsPolicy, err := tlspolicy.Lookup(cfg.TLSPolicy)
+	if err != nil {
+		logger.Fatalf("Invalid TLS_POLICY: %v", err)
+	}
+	tlspolicy.Use(tlsPolicy)
+	if cfg.HTTP3 {
+		switch {
+		case !http3Built:
+			logger.Fatalf("HTTP3 is set, but this build has no HTTP/3 support: build with -tags http3")
+		case cfg.TLSCertFile == "":
+			logger.Fatalf("HTTP3 needs TLS_CERT_FILE and TLS_KEY_FILE, since HTTP/3 is always encrypted")
+		case tlsPolicy.MaxVersion != 0 && tlsPolicy.MaxVersion < tls.VersionTLS13:
+			logger.Fatalf("HTTP3 needs TLS 1.3, which TLS_POLICY %s doesn't allow", tlsPolicy.Name)
+		}
+	}
+	upstreamTLS, err := proxy.UpstreamTLS{
+		CAFile:             cfg.UpstreamCAFile,
+		CertFile:           cfg.UpstreamCertFile,
+		KeyFile:            cfg.UpstreamKeyFile,
+		MinVersion:         cfg.UpstreamTLSMinVersion,
+		InsecureSkipVerify: cfg.UpstreamTLSInsecure,
+	}.Config()
+	if err != nil {
+		logger.Fatalf("Invalid upstream TLS settings: %v", err)
+	}
+	if upstreamTLS != nil && tlsPolicy.MaxVersion != 0 && upstreamTLS.MinVersion > tlsPolicy.MaxVersion {
+		logger.Fatalf("Invalid UPSTREAM_TLS_MIN_VERSION: TLS_POLICY %s allows nothing above %s", tlsPolicy.Name, tls.VersionName(tlsPolicy.MaxVersion))
+	}
+	proxyClient := proxy.NewClient(cfg.ProxyURL, cfg.OpenAIAPIURL, cfg.RequestTimeout, cfg.MaxResponseBodySize*1024*1024, concurrency, upstreamTLS)
+	tlsPolicy.Restrict(proxyClient.Transport())
+	sealer, err := encryption.Load(cfg.StorageEncryptionKey, cfg.StorageEncryptionKeyFile)
+	if err != nil {
+		logger.Fatalf("Invalid STORAGE_ENCRYPTION_KEY: %v", err)
+	}
+	var cassettes *proxy.CassetteTransport
+	switch cfg.UpstreamMode {
+	case "live":
+	case "mock":
+		mock, err := proxy.NewMockTransport(cfg.MockResponsesFile, cfg.MockLatency, cfg.MockChunkDelay)
+		if err != nil {
+			logger.Fatalf("Failed to load mock responses: %v", err)
+		}
+		proxyClient.SetTransport(mock)
+	case "record":
+		recorder, err := proxy.NewRecordingTransport(cfg.CassetteDir, proxyClient.Transport(), logger, sealer)
+		if err != nil {
+			logger.Fatalf("Failed to open cassette directory: %v", err)
+		}
+		proxyClient.SetTransport(recorder)
+		cassettes = recorder
+	case "replay":
+		player, err := proxy.NewReplayTransport(cfg.CassetteDir, sealer)
+		if err != nil {
+			logger.Fatalf("Failed to open cassette directory: %v", err)
+		}
+		proxyClient.SetTransport(player)
+	default:
+		logger.Fatalf("Invalid UPSTREAM_MODE %q, expected live, mock, record or replay", cfg.UpstreamMode)
+	}
+	cacheInstance := cache.New(cfg.CacheTTL, cfg.MaxCacheSize, cfg.TTSCacheSize, cfg.CacheMaxEntrySize)
+	cacheInstance.KeepCleared(cfg.CacheTrashGrace)
 	rateLimiter := middleware.NewRateLimiter(cfg.RateLimit)
+	recorder := metrics.New()
+	usageTracker := usage.NewTracker()
+
+	tenants, err := tenant.Load(cfg.TenantsFile)
+	if err != nil {
+		logger.Fatalf("Failed to load tenants: %v", err)
+	}
+	pricing, err := billing.LoadPricing(cfg.PricingFile)
+	if err != nil {
+		logger.Fatalf("Failed to load pricing: %v", err)
+	}
+	reporter := billing.NewReporter(usageTracker, pricing)
+	if cfg.ReportDir != "" {
+		reporter.StartSchedule(cfg.ReportDir, time.Hour, logger)
+	}
+	alerts := alerting.NewEvaluator(tenants, usageTracker, pricing, alerting.SMTPConfig{
+		Addr:     cfg.SMTPAddr,
+		From:     cfg.SMTPFrom,
+		Username: cfg.SMTPUsername,
+		Password: cfg.SMTPPassword,
+	}, logger)
+	if cfg.AlertInterval <= 0 {
+		logger.Fatalf("ALERT_INTERVAL must be positive")
+	}
+	alerts.Start(cfg.AlertInterval)
+	webhookTargets, err := webhooks.ParseTargets(cfg.WebhookTargets)
+	if err != nil {
+		logger.Fatalf("Failed to load webhook targets: %v", err)
+	}
+
+	chaos := middleware.ChaosConfig{
+		Latency:      cfg.ChaosLatency,
+		LatencyRate:  cfg.ChaosLatencyRate,
+		ErrorRate:    cfg.ChaosErrorRate,
+		TruncateRate: cfg.ChaosTruncateRate,
+		DropRate:     cfg.ChaosDropRate,
+		AllowHeader:  cfg.ChaosHeader,
+	}
+	for _, rate := range []float64{chaos.LatencyRate, chaos.ErrorRate, chaos.TruncateRate, chaos.DropRate} {
+		if rate < 0 || rate > 1 {
+			logger.Fatalf("Invalid CHAOS_*_RATE %v, expected a probability from 0 to 1", rate)
+		}
+	}
+	for _, value := range cfg.ChaosErrorStatus {
+		status, err := strconv.Atoi(value)
+		if err != nil || status < 400 || status > 599 {
+			logger.Fatalf("Invalid CHAOS_ERROR_STATUS %q, expected 4xx or 5xx statuses", value)
+		}
+		chaos.ErrorStatus = append(chaos.ErrorStatus, status)
+	}
 
 	if cfg.Port == "8080" {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
 	router := gin.New()
+	// Clients otherwise pick their own address, and with it their rate
+	// limit and country, by sending X-Forwarded-For
+	if err := router.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		logger.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
 
-	// midlewares:
-	router.Use(middleware.RequestLogger())
+	// Panics are recovered ahead of everything; the other middlewares run
+	// in the order PIPELINE gives, see setupRoutes
 	router.Use(gin.Recovery())
-	router.Use(rateLimiter.Middleware())
 
 	srv := &Server{
-		config:      cfg,
-		proxyClient: proxyClient,
-		cache:       cacheInstance,
-		rateLimiter: rateLimiter,
-		router:      router,
-		logger:      logger,
+		config:         cfg,
+		proxyClient:    proxyClient,
+		concurrency:    concurrency,
+		cache:          cacheInstance,
+		rateLimiter:    rateLimiter,
+		keyRateLimiter: middleware.NewRateLimiter(cfg.RateLimit),
+		policyLimiter:  middleware.NewRateLimiter(cfg.RateLimit),
+		metrics:        recorder,
+		runs:           metrics.NewRunTracker(),
+		streams:        metrics.NewStreamTracker(),
+		streamLimits:   newStreamLimits(),
+		deprecations:   deprecation.NewTracker(),
+		uploadParts:    newUploadParts(),
+		cassettes:      cassettes,
+		usage:          usageTracker,
+		tenants:        tenants,
+		pricing:        pricing,
+		reporter:       reporter,
+		alerts:         alerts,
+		webhooks:       webhooks.NewDispatcher(webhookTargets, logger),
+		router:         router,
+		logger:         logger,
+	}
+
+	srv.responseHeaders = newHeaderAllowlist(cfg.ResponseHeaders)
+	srv.streams.Watch(cfg.StreamMaxDuration, logger)
+	if cfg.LoadShedMaxMemory > 0 || cfg.LoadShedMaxGoroutines > 0 {
+		srv.load = metrics.NewLoadMonitor(cfg.LoadShedMaxMemory, cfg.LoadShedMaxGoroutines, time.Second, logger)
+	}
+	if cfg.MaxConnections > 0 || cfg.MaxConnectionsPerIP > 0 || cfg.MaxInFlight > 0 {
+		srv.guards = newGuards(cfg.MaxConnections, cfg.MaxConnectionsPerIP, cfg.MaxInFlight)
+	}
+	if cfg.UserRateLimit > 0 {
+		srv.userRateLimiter = middleware.NewRateLimiter(cfg.UserRateLimit)
+	}
+	if cfg.EmbeddingsBatchWindow > 0 {
+		srv.embeddings = batching.NewEmbeddingBatcher(proxyClient, cfg.EmbeddingsBatchWindow, cfg.EmbeddingsBatchMaxInputs, cfg.RequestTimeout)
+	}
+	if cfg.EmbeddingsCache {
+		srv.vectors = cache.NewEmbeddingCache(cfg.EmbeddingsCacheTTL, cfg.EmbeddingsCacheSize)
+		srv.vectors.KeepCleared(cfg.CacheTrashGrace)
+	}
+
+	srv.chaos = middleware.Chaos(chaos)
+	if cfg.ShadowURL != "" || cfg.ShadowModel != "" {
+		if cfg.ShadowSampleRate <= 0 || cfg.ShadowSampleRate > 1 {
+			logger.Fatalf("Invalid SHADOW_SAMPLE_RATE %v, expected a probability above 0 and up to 1", cfg.ShadowSampleRate)
+		}
+		srv.shadowClient = proxyClient
+		if cfg.ShadowURL != "" {
+			srv.shadowClient = proxy.NewClient(cfg.ProxyURL, cfg.ShadowURL, cfg.RequestTimeout, cfg.MaxResponseBodySize*1024*1024, nil, upstreamTLS)
+			tlsPolicy.Restrict(srv.shadowClient.Transport())
+			if cfg.UpstreamMode == "mock" || cfg.UpstreamMode == "replay" {
+				srv.shadowClient.SetTransport(proxyClient.Transport())
+			}
+		}
+		similarity := "lexical"
+		if cfg.ShadowSimilarityModel != "" {
+			similarity = "embeddings:" + cfg.ShadowSimilarityModel
+		}
+		srv.shadows = shadow.NewComparator(similarity)
+		srv.shadows.StartSchedule(cfg.ShadowReportInterval, cfg.ShadowReportDir, logger)
+		srv.shadowSlots = make(chan struct{}, max(cfg.ShadowMaxInFlight, 1))
+	}
+
+	if srv.postProcessors, err = postprocess.Build(cfg.PostProcessors, cfg.Getenv); err != nil {
+		logger.Fatalf("Invalid POSTPROCESSORS: %v (registered: %s)", err, strings.Join(postprocess.Names(), ", "))
+	}
+	if srv.streamHooks, err = streamhooks.Build(cfg.StreamHooks, cfg.Getenv); err != nil {
+		logger.Fatalf("Invalid STREAM_HOOKS: %v (registered: %s)", err, strings.Join(streamhooks.Names(), ", "))
+	}
+	if len(cfg.Plugins) > 0 {
+		if srv.plugins, err = plugins.Load(cfg.Plugins, cfg.PluginTimeout, logger); err != nil {
+			logger.Fatalf("Failed to load plugins: %v", err)
+		}
+		logger.Printf("Plugins loaded: %s", strings.Join(srv.plugins.Names(), ", "))
+	}
+	if cfg.ExtAuthzURL != "" {
+		if srv.authz, err = authz.New(cfg.ExtAuthzURL, cfg.ExtAuthzTimeout, cfg.ExtAuthzCacheTTL); err != nil {
+			logger.Fatalf("Invalid EXT_AUTHZ_URL: %v", err)
+		}
+	}
+	if srv.upstreamTargets, err = parseUpstreamTargets(cfg.UpstreamTargets); err != nil {
+		logger.Fatalf("Invalid UPSTREAM_TARGETS: %v", err)
+	}
+	for _, t := range tenants.Tenants() {
+		if _, found := srv.upstreamTargets[t.Upstream]; t.Upstream != "" && !found {
+			logger.Fatalf("Tenant %s is pinned to upstream %q, which UPSTREAM_TARGETS doesn't name", t.ID, t.Upstream)
+		}
+	}
+	for _, k := range tenants.Keys() {
+		if k.Upstream == "" {
+			continue
+		}
+		if _, found := srv.upstreamTargets[k.Upstream]; !found {
+			logger.Fatalf("Key %s is sent to upstream %q, which UPSTREAM_TARGETS doesn't name", k.Masked(), k.Upstream)
+		}
+		if t, found := tenants.Tenant(k.Tenant); found && t.Upstream != "" && t.Upstream != k.Upstream {
+			logger.Fatalf("Key %s is sent to upstream %q, but tenant %s is pinned to %q", k.Masked(), k.Upstream, t.ID, t.Upstream)
+		}
+	}
+	srv.captures = newCaptures(cfg.CaptureDir, cfg.CaptureMaxSize, sealer, logger)
+	if cfg.SlowLogThreshold > 0 {
+		if srv.slowRequests, err = newSlowRequests(cfg.SlowLogFile); err != nil {
+			logger.Fatalf("Failed to open SLOW_LOG_FILE: %v", err)
+		}
+	}
+	switch cfg.StreamUsageReport {
+	case "none", "comment", "trailer", "both":
+	default:
+		logger.Fatalf("Invalid STREAM_USAGE_REPORT %q, expected none, comment, trailer or both", cfg.StreamUsageReport)
+	}
+	if cfg.DuplicateThreshold > 0 {
+		if cfg.DuplicateWindow <= 0 {
+			logger.Fatalf("Invalid DUPLICATE_WINDOW: %v", cfg.DuplicateWindow)
+		}
+		if cfg.DuplicateAction != "warn" && cfg.DuplicateAction != "throttle" {
+			logger.Fatalf("Invalid DUPLICATE_ACTION %q, expected warn or throttle", cfg.DuplicateAction)
+		}
+		srv.duplicates = newDuplicates(cfg.DuplicateThreshold, cfg.DuplicateWindow)
+	}
+	if cfg.JournalDir != "" {
+		if cfg.JournalSyncInterval <= 0 {
+			logger.Fatalf("Invalid JOURNAL_SYNC_INTERVAL: %v", cfg.JournalSyncInterval)
+		}
+		if srv.journal, err = billing.OpenJournal(cfg.JournalDir, cfg.JournalSyncInterval, logger); err != nil {
+			logger.Fatalf("Failed to open JOURNAL_DIR: %v", err)
+		}
+	}
+	if srv.successors, err = parseEmbeddingMigrations(cfg.EmbeddingsMigrations); err != nil {
+		logger.Fatalf("Invalid EMBEDDINGS_MODEL_MIGRATIONS: %v", err)
+	}
+	if cfg.GeoIPDB != "" {
+		db, err := geoip.Open(cfg.GeoIPDB)
+		if err != nil {
+			logger.Fatalf("Failed to load GEOIP_DB: %v", err)
+		}
+		srv.geo = &geoRules{
+			db:      db,
+			allowed: countrySet(cfg.GeoIPAllowedCountries),
+			blocked: countrySet(cfg.GeoIPBlockedCountries),
+		}
+		if srv.geo.upstreams, err = parseGeoUpstreams(cfg.GeoIPUpstreams, srv.upstreamTargets); err != nil {
+			logger.Fatalf("Invalid GEOIP_UPSTREAMS: %v", err)
+		}
+		logger.Printf("GeoIP database %s loaded from %s, built %s", db.Type, cfg.GeoIPDB, db.BuiltAt.Format("2006-01-02"))
+	}
+	if srv.policyZone, err = time.LoadLocation(cfg.PolicyTimezone); err != nil {
+		logger.Fatalf("Invalid POLICY_TIMEZONE: %v", err)
+	}
+	if srv.policySchedules, err = policy.LoadSchedules(cfg.PolicySchedulesFile); err != nil {
+		logger.Fatalf("Invalid POLICY_SCHEDULES_FILE: %v", err)
+	}
+	if cfg.PolicyBundle != "" {
+		if srv.policy, err = policy.Load(cfg.PolicyBundle, cfg.PolicyQuery); err != nil {
+			logger.Fatalf("Failed to load POLICY_BUNDLE: %v", err)
+		}
+		if cfg.PolicyReloadInterval > 0 {
+			srv.policy.Watch(cfg.PolicyReloadInterval, logger)
+		}
+		logger.Printf("Policy bundle loaded from %s, evaluating %s", cfg.PolicyBundle, cfg.PolicyQuery)
+	}
+	if cfg.ImageCache {
+		srv.images = cache.NewImageCache(cfg.ImageCacheTTL, cfg.ImageCacheSize)
+		srv.images.KeepCleared(cfg.CacheTrashGrace)
+	}
+	if cfg.ImageStore != "" {
+		srv.imageStore, err = imagestore.Open(cfg.ImageStore, imagestore.Credentials{
+			Endpoint:  cfg.ImageStoreEndpoint,
+			Region:    cfg.ImageStoreRegion,
+			AccessKey: cfg.ImageStoreAccessKey,
+			SecretKey: cfg.ImageStoreSecretKey,
+		})
+		if err != nil {
+			logger.Fatalf("Invalid IMAGE_STORE: %v", err)
+		}
+		if sealer != nil {
+			srv.imageStore = imagestore.NewSealed(srv.imageStore, sealer)
+		}
+	}
+	if srv.routeDefaults, err = loadDefaults(cfg.RequestDefaultsFile); err != nil {
+		logger.Fatalf("Failed to load REQUEST_DEFAULTS_FILE: %v", err)
+	}
+	if srv.rules, err = loadRules(cfg.RequestRulesFile); err != nil {
+		logger.Fatalf("Failed to load REQUEST_RULES_FILE: %v", err)
+	}
+	if cfg.SessionStore != "" {
+		if cfg.SessionTTL <= 0 || cfg.SessionMaxTokens <= 0 {
+			logger.Fatalf("SESSION_TTL and SESSION_MAX_TOKENS must be positive")
+		}
+		if srv.sessions, err = session.Open(cfg.SessionStore, cfg.SessionTTL, sealer); err != nil {
+			logger.Fatalf("Invalid SESSION_STORE: %v", err)
+		}
+	}
+	switch cfg.Provenance {
+	case "", "headers", "body", "both":
+	default:
+		logger.Fatalf("Invalid PROVENANCE %q, expected headers, body or both", cfg.Provenance)
+	}
+	if cfg.KeyLifetime <= 0 {
+		logger.Fatalf("KEY_DEFAULT_LIFETIME must be positive")
+	}
+	if cfg.ProxyID == "" {
+		// Tells the replicas of a deployment apart
+		cfg.ProxyID, _ = os.Hostname()
+	}
+	if len(cfg.TunnelAllowlist) > 0 && cfg.TunnelToken == "" {
+		logger.Fatalf("TUNNEL_ALLOWLIST needs TUNNEL_TOKEN, or anyone could tunnel through the proxy host")
+	}
+	if len(cfg.ClusterPeers) > 0 {
+		if cfg.ClusterSecret == "" {
+			logger.Fatalf("CLUSTER_PEERS needs CLUSTER_SECRET, or anyone could gossip counters in")
+		}
+		if cfg.ClusterGossipInterval <= 0 {
+			logger.Fatalf("CLUSTER_GOSSIP_INTERVAL must be positive")
+		}
+		srv.joinCluster()
+	}
+	if cfg.ServerToolsFile != "" {
+		if cfg.ServerToolsMaxRounds <= 0 || cfg.ServerToolsTimeout <= 0 {
+			logger.Fatalf("SERVER_TOOLS_MAX_ROUNDS and SERVER_TOOLS_TIMEOUT must be positive")
+		}
+		if srv.serverTools, err = servertools.Load(cfg.ServerToolsFile, cfg.ServerToolsTimeout); err != nil {
+			logger.Fatalf("Failed to load SERVER_TOOLS_FILE: %v", err)
+		}
+	}
+	if cfg.PromptCompaction && (cfg.PromptCompactionThreshold <= 0 || cfg.PromptCompactionKeepMessages <= 0) {
+		logger.Fatalf("PROMPT_COMPACTION_THRESHOLD and PROMPT_COMPACTION_KEEP_MESSAGES must be positive")
+	}
+	if cfg.RequestValidation {
+		if srv.schemas, err = schema.Load(); err != nil {
+			logger.Fatalf("Failed to load request schemas: %v", err)
+		}
+	}
+	if srv.finetunes, err = finetune.Load(cfg.FineTuneStateFile); err != nil {
+		logger.Fatalf("Failed to load FINETUNE_STATE_FILE: %v", err)
+	}
+	finetuneTargets, err := webhooks.ParseTargets(cfg.FineTuneWebhooks)
+	if err != nil {
+		logger.Fatalf("Invalid FINETUNE_WEBHOOKS: %v", err)
+	}
+	srv.finetuneHooks = webhooks.NewDispatcher(finetuneTargets, logger)
+	if cfg.FineTunePollInterval > 0 {
+		srv.watchFineTunes(cfg.FineTunePollInterval)
+	}
+	if cfg.UsageRetention < 0 || cfg.LogRetention < 0 || cfg.CassetteRetention < 0 {
+		logger.Fatalf("USAGE_RETENTION, LOG_RETENTION and CASSETTE_RETENTION can't be negative")
+	}
+	srv.watchRetention(retentionInterval)
+	if cfg.StatsExport != "" {
+		if cfg.StatsExportInterval <= 0 {
+			logger.Fatalf("STATS_EXPORT_INTERVAL must be positive")
+		}
+		export, err := srv.statsExport(cfg.StatsExport)
+		if err != nil {
+			logger.Fatalf("Invalid STATS_EXPORT: %v", err)
+		}
+		srv.watchStatsExport(export, cfg.StatsExportInterval)
+	}
+	if cfg.VerifyUpstreamOnStart {
+		if cfg.VerifyUpstreamPolicy != "refuse" && cfg.VerifyUpstreamPolicy != "degraded" {
+			logger.Fatalf("Invalid VERIFY_UPSTREAM_POLICY %q, expected refuse or degraded", cfg.VerifyUpstreamPolicy)
+		}
+		if cfg.UpstreamMode != "live" {
+			logger.Printf("VERIFY_UPSTREAM_ON_START is skipped with UPSTREAM_MODE=%s", cfg.UpstreamMode)
+		} else {
+			srv.verifyUpstreams()
+			if failed := srv.failedUpstreamChecks(); len(failed) > 0 {
+				if cfg.VerifyUpstreamPolicy == "refuse" {
+					logger.Fatalf("%d of %d upstream API keys failed verification, refusing to start", len(failed), len(srv.upstreamChecked))
+				}
+				logger.Printf("%d of %d upstream API keys failed verification, starting degraded", len(failed), len(srv.upstreamChecked))
+			}
+		}
 	}
 
 	srv.setupRoutes()
@@ -57,17 +538,127 @@ func New(cfg *config.Config) *Server {
 }
 
 func (s *Server) setupRoutes() {
-	s.router.GET("/health", s.healthCheck)
+	global, v1, err := s.pipeline(s.config.Pipeline)
+	if err != nil {
+		s.logger.Fatalf("Invalid PIPELINE: %v", err)
+	}
+	base := s.router.Group("", global...)
+	s.router.NoRoute(global...)
+
+	base.GET("/health", s.healthCheck)
+
+	base.GET("/stats", s.getStats)
+	base.GET("/metrics", s.getMetrics)
+
+	base.DELETE("/cache", s.clearCache)
+	base.POST("/cache/restore", s.restoreCache)
+
+	base.GET("/openapi.json", s.getOpenAPI)
+
+	base.GET("/admin", func(c *gin.Context) {
+		c.Redirect(http.StatusMovedPermanently, "/admin/ui/")
+	})
+	base.GET("/admin/ui/*filepath", gin.WrapH(http.StripPrefix("/admin/ui", admin.UIHandler())))
+
+	adminGroup := base.Group("/admin", middleware.AdminAuth(s.config.AdminToken))
+	adminGroup.GET("/traffic", s.getTraffic)
+	adminGroup.GET("/errors", s.getErrors)
+	adminGroup.GET("/slow", s.getSlowRequests)
+	adminGroup.GET("/captures", s.listCaptures)
+	adminGroup.POST("/captures", s.startCapture)
+	adminGroup.GET("/captures/:id", s.downloadCapture)
+	adminGroup.DELETE("/captures/:id", s.deleteCapture)
+	adminGroup.GET("/usage", s.getUsage)
+	adminGroup.GET("/reports/chargeback", s.getChargebackReport)
+	adminGroup.GET("/reports/shadow", s.getShadowReports)
+	adminGroup.GET("/reports/deprecations", s.getDeprecationReport)
+	adminGroup.GET("/keys/expiring", s.listExpiringKeys)
+	adminGroup.GET("/policy", s.getPolicy)
+	adminGroup.POST("/policy/reload", s.reloadPolicy)
+	adminGroup.GET("/finetunes", s.listFineTunes)
+	adminGroup.GET("/tenants/:id/features", s.getTenantFeatures)
+	adminGroup.PUT("/tenants/:id/features", s.updateTenantFeatures)
+	adminGroup.DELETE("/data", s.deleteData)
+	adminGroup.GET("/cluster", s.getCluster)
+
+	base.POST("/debug/trace", middleware.AdminAuth(s.config.AdminToken), s.debugTrace)
+
+	if s.cluster != nil {
+		// Replicas aren't clients, so what they send each other skips the
+		// rate limits they share
+		members := s.router.Group("", s.clusterAuth())
+		members.POST(cluster.GossipPath, s.receiveGossip)
+		members.POST(cluster.DeletionPath, s.deleteMemberData)
+		if s.config.ClusterCache {
+			members.GET(cluster.CachePath+":key", s.getOwnedEntry)
+			members.PUT(cluster.CachePath+":key", s.putOwnedEntry)
+		}
+	}
 
-	s.router.GET("/stats", s.getStats)
+	// Tenant-scoped admin APIs accept the tenant's own admin token as well
+	tenantGroup := base.Group("/admin/tenants/:id", s.tenantAdminAuth())
+	tenantGroup.GET("/alerts", s.listAlerts)
+	tenantGroup.POST("/alerts", s.createAlert)
+	tenantGroup.DELETE("/alerts/:alert", s.deleteAlert)
 
-	s.router.DELETE("/cache", s.clearCache)
+	base.POST("/proxy/v1/local-batch", s.localBatch)
+	base.POST("/proxy/v1/fanout", s.fanout)
+	base.POST("/proxy/v1/tokenize", s.tokenize)
+	if s.imageStore != nil {
+		base.GET("/proxy/v1/images/:id", s.getStoredImage)
+	}
+	if s.images != nil {
+		base.GET("/proxy/v1/images/:id/:index", s.getCachedImage)
+	}
+	if s.sessions != nil {
+		base.GET("/proxy/v1/sessions/:id", s.getSession)
+		base.DELETE("/proxy/v1/sessions/:id", s.deleteSession)
+	}
+	if s.config.WebhookSecret != "" {
+		base.POST("/proxy/v1/webhooks/openai", s.receiveOpenAIWebhook)
+	}
+
+	// Proxy-native endpoints under /v1 can't be registered next to the
+	// catch-all, so proxyHandler dispatches them from this table
+	s.localRoutes = map[string]gin.HandlerFunc{
+		"POST /v1/keys/self": s.mintSelfServiceKey,
+	}
 
-	s.router.Any("/v1/*path", s.proxyHandler)
-	s.router.Any("/v1", s.proxyHandler)
+	if s.slowRequests != nil {
+		v1 = append([]gin.HandlerFunc{s.logSlowRequests()}, v1...)
+	}
+	if s.guards != nil && s.guards.maxInFlight > 0 {
+		v1 = append([]gin.HandlerFunc{s.limitInFlight()}, v1...)
+	}
+	v1 = append([]gin.HandlerFunc{s.drainRequests()}, v1...)
+	if s.journal != nil {
+		v1 = append([]gin.HandlerFunc{s.journalRequests()}, v1...)
+	}
+	v1 = append(v1, traced("proxy", s.proxyHandler))
+	s.router.Any("/v1/*path", v1...)
+	s.router.Any("/v1", v1...)
 }
 
 func (s *Server) healthCheck(c *gin.Context) {
+	// Load balancers still connected stop sending traffic
+	if s.draining.started.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "shutting_down",
+			"service": "openai-proxy",
+		})
+		return
+	}
+	// Keys that failed VERIFY_UPSTREAM_ON_START leave the proxy serving
+	// the others
+	if failed := s.failedUpstreamChecks(); len(failed) > 0 {
+		c.JSON(http.StatusOK, gin.H{
+			"status":    "degraded",
+			"service":   "openai-proxy",
+			"timestamp": fmt.Sprintf("%d", c.Request.Context().Value("timestamp")),
+			"upstreams": failed,
+		})
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{
 		"status":    "healthy",
 		"service":   "openai-proxy",
@@ -76,25 +667,190 @@ func (s *Server) healthCheck(c *gin.Context) {
 }
 
 func (s *Server) getStats(c *gin.Context) {
-	stats := s.cache.Stats()
+	c.JSON(http.StatusOK, s.stats())
+}
 
-	c.JSON(http.StatusOK, gin.H{
-		"cache":      stats,
-		"rate_limit": s.config.RateLimit,
-		"proxy_url":  s.config.ProxyURL,
-		"openai_url": s.config.OpenAIAPIURL,
-	})
+// stats is what /stats serves, and STATS_EXPORT snapshots
+func (s *Server) stats() gin.H {
+	response := gin.H{
+		"cache":                s.cache.Stats(),
+		"streams":              s.streams.Stats(s.config.StreamMaxDuration),
+		"upstream_connections": s.proxyClient.ConnectionStats(),
+		"rate_limit":           s.config.RateLimit,
+		"proxy_url":            s.config.ProxyURL,
+		"openai_url":           s.config.OpenAIAPIURL,
+		"upstream_mode":        s.config.UpstreamMode,
+	}
+	if s.images != nil {
+		response["image_cache"] = s.images.Stats()
+	}
+	if s.vectors != nil {
+		response["embeddings_cache"] = s.vectors.Stats()
+	}
+	if s.concurrency != nil {
+		response["upstream_concurrency"] = s.concurrency.Stats()
+	}
+	if s.load != nil {
+		response["load"] = s.load.Stats()
+	}
+	if s.duplicates != nil {
+		response["duplicates"] = s.duplicates.stats()
+	}
+	if s.guards != nil {
+		response["guards"] = s.guards.stats()
+	}
+	if s.cluster != nil {
+		response["cluster"] = s.cluster.Members()
+	}
+	if s.clusterCache != nil {
+		response["cluster_cache"] = s.clusterCache.stats()
+	}
+	if s.upstreamChecked != nil {
+		response["upstream_checks"] = s.upstreamChecked
+	}
+	return response
+}
+
+// getMetrics serves request and cache counters and the histograms of sizes,
+// tokens and stream durations by model in the Prometheus text format
+func (s *Server) getMetrics(c *gin.Context) {
+	c.Header("Content-Type", metrics.PrometheusContentType)
+	c.Status(http.StatusOK)
+	s.writeMetrics(c.Writer)
+}
+
+func (s *Server) writeMetrics(w io.Writer) {
+	s.metrics.WritePrometheus(w)
+	metrics.WriteGauge(w, "goproxyai_cache_items", "Responses in the cache", float64(s.cache.ItemCount()))
+	metrics.WriteGauge(w, "goproxyai_streams_active", "Event streams and CONNECT tunnels open", float64(s.streams.Active()))
+	if s.duplicates != nil {
+		flagged, throttled := s.duplicates.counts()
+		metrics.WriteCounter(w, "goproxyai_duplicate_requests_total", "Requests past DUPLICATE_THRESHOLD identical copies from their key", flagged)
+		metrics.WriteCounter(w, "goproxyai_duplicate_requests_throttled_total", "Duplicate requests refused with DUPLICATE_REQUEST", throttled)
+	}
+	if s.guards != nil {
+		open, _ := s.guards.connections()
+		metrics.WriteGauge(w, "goproxyai_connections_open", "Client connections the listeners hold open", float64(open))
+		metrics.WriteGauge(w, "goproxyai_requests_in_flight", "/v1 requests being answered", float64(s.guards.inFlight.Load()))
+		metrics.WriteCounter(w, "goproxyai_connections_rejected_total", "Connections closed on accept past MAX_CONNECTIONS", s.guards.rejectedConnections.Load())
+		metrics.WriteCounter(w, "goproxyai_connections_rejected_per_ip_total", "Connections closed on accept past MAX_CONNECTIONS_PER_IP", s.guards.rejectedPerIP.Load())
+		metrics.WriteCounter(w, "goproxyai_requests_in_flight_rejected_total", "Requests refused with OVERLOADED past MAX_IN_FLIGHT_REQUESTS", s.guards.rejectedInFlight.Load())
+	}
 }
 
 func (s *Server) clearCache(c *gin.Context) {
 	s.cache.Clear()
+	if s.images != nil {
+		s.images.Clear()
+	}
+	if s.vectors != nil {
+		s.vectors.Clear()
+	}
 	s.logger.Println("Cache cleared manually")
 
-	c.JSON(http.StatusOK, gin.H{
+	response := gin.H{
 		"message": "Cache cleared successfully",
+	}
+	if s.config.CacheTrashGrace > 0 {
+		response["restorable_until"] = clock.Now().Add(s.config.CacheTrashGrace).UTC()
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// restoreCache brings back what the last DELETE /cache cleared, while
+// that's within CACHE_TRASH_GRACE
+func (s *Server) restoreCache(c *gin.Context) {
+	restored := gin.H{}
+	responses, found := s.cache.Restore()
+	if found {
+		restored["responses"] = responses
+	}
+	if s.images != nil {
+		if images, ok := s.images.Restore(); ok {
+			restored["images"], found = images, true
+		}
+	}
+	if s.vectors != nil {
+		if embeddings, ok := s.vectors.Restore(); ok {
+			restored["embeddings"], found = embeddings, true
+		}
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Nothing to restore: the cache wasn't cleared within CACHE_TRASH_GRACE",
+			"code":  "CACHE_TRASH_EMPTY",
+		})
+		return
+	}
+	s.logger.Printf("Cache restored manually: %v", restored)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "Cache restored successfully",
+		"restored": restored,
 	})
 }
 
+func (s *Server) getTraffic(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"summary": s.metrics.Stats(),
+		"runs":    s.runs.Stats(),
+		"recent":  s.metrics.Recent(),
+	})
+}
+
+func (s *Server) getErrors(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"errors": s.metrics.Errors(),
+	})
+}
+
+func (s *Server) getUsage(c *gin.Context) {
+	from, err := parseDateParam(c.Query("from"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from date, expected YYYY-MM-DD"})
+		return
+	}
+	to, err := parseDateParam(c.Query("to"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to date, expected YYYY-MM-DD"})
+		return
+	}
+
+	c.JSON(http.StatusOK, s.usage.Breakdown(from, to))
+}
+
+func (s *Server) getChargebackReport(c *gin.Context) {
+	month := clock.Now().UTC()
+	if value := c.Query("month"); value != "" {
+		parsed, err := billing.ParseMonth(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid month, expected YYYY-MM"})
+			return
+		}
+		month = parsed
+	}
+
+	report := s.reporter.Chargeback(month)
+
+	if c.Query("format") == "csv" {
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=chargeback-%s.csv", report.Month))
+		c.Header("Content-Type", "text/csv")
+		if err := report.WriteCSV(c.Writer); err != nil {
+			s.logger.Printf("Error writing chargeback CSV: %v", err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+func parseDateParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
 func (s *Server) proxyHandler(c *gin.Context) {
 	method := c.Request.Method
 	path := "/v1" + c.Param("path")
@@ -102,90 +858,507 @@ func (s *Server) proxyHandler(c *gin.Context) {
 		path = "/v1/"
 	}
 
-	bodyBytes, err := io.ReadAll(c.Request.Body)
+	trace := dryrun.From(c.Request.Context())
+	if handler, found := s.localRoutes[method+" "+path]; found {
+		// Local routes act on the proxy's own state, which a dry run mustn't
+		if trace != nil {
+			trace.Add("route", "%s %s is served by the proxy itself, not run in a dry run", method, path)
+			return
+		}
+		handler(c)
+		return
+	}
+
+	if !s.applyOverrides(c) {
+		return
+	}
+
+	if isStreamedUpload(path, c.GetHeader("Content-Type")) {
+		trace.Add("route", "%s %s is a streamed upload", method, path)
+		if s.shedLoad(c, method, path, false) {
+			return
+		}
+		if isUploadPartPath(path) {
+			s.uploadPartHandler(c, path)
+			return
+		}
+		s.uploadHandler(c, path)
+		return
+	}
+
+	bodyBuffer, err := readBody(c.Request)
 	if err != nil {
 		s.logger.Printf("Error reading request body: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		bodyReadFailed(c, err)
 		return
 	}
+	defer releaseBody(bodyBuffer)
+	bodyBytes := bodyBuffer.Bytes()
+	if s.slowRequests != nil {
+		defer func() { s.excerptSlowPrompt(c, bodyBytes) }()
+	}
 
-	headers := make(map[string]string)
-	for key, values := range c.Request.Header {
-		if len(values) > 0 {
-			headers[key] = values[0]
+	headers := outgoingHeaders(c.Request)
+	forwarded := &plugins.Request{Method: method, Path: path, Header: headers, Body: bodyBytes}
+	if s.plugins.Has(plugins.PreForward) {
+		if forwarded.Body == nil {
+			forwarded.Body = []byte{}
 		}
+		if !s.preForward(c, forwarded) {
+			return
+		}
+		// The method is only theirs to change before routing
+		forwarded.Method = method
+		path, bodyBytes = forwarded.Path, forwarded.Body
 	}
+	path, bodyBytes = s.applyRules(c, method, path, headers, bodyBytes)
 
-	if cacheEntry, found := s.cache.Get(method, path, headers, bodyBytes); found {
-		s.logger.Printf("Cache hit for %s %s", method, path)
+	keyID := usage.KeyID(headers.Get("Authorization"))
+	tenantID := c.GetString(ctxTenantID)
+	upstreamHeaders, _ := c.Value(ctxUpstreamHeaders).(map[string]string)
+	cacheDisabled := c.GetBool(ctxCacheDisabled)
+	requestInfo := openai.ParseRequest(bodyBytes)
+	if method == http.MethodPost && openai.SupportsUserField(path) {
+		given := requestInfo.User
+		if bodyBytes, requestInfo = s.injectUser(headers, bodyBytes, requestInfo); requestInfo.User != given {
+			transformed(c, "user")
+		}
+	}
+	if method == http.MethodPost {
+		var filled bool
+		if bodyBytes, filled = s.applyDefaults(c, path, bodyBytes); filled {
+			requestInfo = openai.ParseRequest(bodyBytes)
+		}
+	}
+	if requestInfo.User != "" {
+		c.Set(ctxUser, requestInfo.User)
+	}
+	if requestInfo.Model != "" {
+		c.Set(ctxModel, requestInfo.Model)
+	}
+	bodyBytes, turn, ok := s.openSession(c, method, path, headers, bodyBytes)
+	if !ok {
+		return
+	}
+	if turn != nil {
+		// The same messages mean something else as the session goes on
+		cacheDisabled = true
+	}
+	if bodyBytes, ok = s.selectServerTools(c, method, path, headers, bodyBytes, requestInfo); !ok {
+		return
+	}
+	if c.Value(ctxServerTools) != nil {
+		// The tools' answers change from one call to the next
+		cacheDisabled = true
+	}
+	// Responses are cached by the request as the client sent it, since a
+	// migrated one is answered in the older form
+	cacheBody := bodyBytes
+	bodyBytes = s.migrateRequest(c, method, path, bodyBytes)
+	if migrated, successor := s.migrateEmbeddingModel(c, method, path, bodyBytes, requestInfo.Model); successor != "" {
+		bodyBytes, requestInfo.Model = migrated, successor
+		c.Set(ctxModel, successor)
+	}
 
-		for key, values := range cacheEntry.Headers {
-			for _, value := range values {
-				c.Header(key, value)
-			}
+	// Pagination parameters and the like make a different request, so the
+	// query is part of what's cached
+	query := c.Request.URL.RawQuery
+	cachePath := path
+	legacy, _ := engineRewrite(c)
+	if legacy.Listing {
+		// Models described as engines are cached apart from the models
+		cachePath = legacy.From
+	}
+	if query != "" {
+		cachePath += "?" + query
+	}
+	// X-Proxy-Cache caches what the proxy otherwise wouldn't
+	optIn := c.GetBool(ctxCacheOptIn)
+	mayCache := !cacheDisabled && !requestInfo.Stream && (optIn || s.cache.Cacheable(method, cachePath, http.StatusOK))
+	if s.shedLoad(c, method, path, mayCache) {
+		return
+	}
+	if !mayCache && !s.checkDuplicate(c, method, cachePath, keyID, cacheBody) {
+		return
+	}
+
+	if requestInfo.User != "" && s.userRateLimiter != nil && !allow(c, "user_ratelimit", s.userRateLimiter, keyID+"/"+requestInfo.User, s.config.UserRateLimit) {
+		if trace == nil {
+			s.usage.RecordRateLimited(tenantID, requestInfo.User)
 		}
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error": "Rate limit exceeded for this user. Please try again later.",
+			"code":  "USER_RATE_LIMIT_EXCEEDED",
+		})
+		return
+	}
 
-		c.Header("X-Cache", "HIT")
-		c.Header("X-Cache-Timestamp", cacheEntry.Timestamp.Format("2006-01-02T15:04:05Z07:00"))
+	if image, ok := s.handlesImages(method, path, headers, bodyBytes, cacheDisabled); ok {
+		trace.Add("route", "%s %s through the image cache or store for model %q", method, path, image.Model)
+		s.imageHandler(c, path, image, headers, upstreamHeaders, bodyBytes, cacheDisabled, tenantID, keyID, requestInfo)
+		return
+	}
 
-		c.Data(cacheEntry.StatusCode, c.GetHeader("Content-Type"), cacheEntry.Body)
+	if isBinaryEndpoint(method, path) {
+		trace.Add("route", "%s %s has a binary response, cache bypass %t", method, path, cacheDisabled)
+		s.binaryHandler(c, path, headers, upstreamHeaders, bodyBytes, cacheDisabled)
+		return
+	}
+
+	if requestInfo.Stream {
+		trace.Add("route", "%s %s streams its response for model %q", method, path, requestInfo.Model)
+		s.streamHandler(c, path, headers, upstreamHeaders, bodyBytes, tenantID, keyID, requestInfo)
+		return
+	}
+
+	trace.Add("route", "%s %s for model %q", method, path, requestInfo.Model)
+	if cacheEntry, found := s.cacheGet(c, cacheDisabled, method, cachePath, headers, cacheBody); found {
+		s.logger.Printf("Cache hit for %s %s", method, path)
+		cacheEntry = s.stampedEntry(c, path, cacheEntry)
+		cacheEntry = s.deprecatedEntry(c, tenantID, keyID, requestInfo.Model, cacheEntry)
+		s.provenanceHeaders(c)
+		s.writeCached(c, cacheEntry)
 		return
 	}
 
 	proxyReq := &proxy.ProxyRequest{
 		Method:  method,
 		Path:    path,
-		Headers: headers,
+		Query:   query,
+		Headers: withUpstreamHeaders(headers, upstreamHeaders),
 		Body:    bodyBytes,
 	}
 
-	ctx, cancel := context.WithTimeout(c.Request.Context(), s.config.RequestTimeout)
+	ctx, cancel := context.WithTimeout(c.Request.Context(), s.requestTimeout(c))
 	defer cancel()
-	proxyResp, err := s.proxyClient.Forward(ctx, proxyReq)
+	start := time.Now()
+	var resp *proxy.StreamResponse
+	if (s.embeddings != nil || s.vectors != nil) && method == http.MethodPost && path == "/v1/embeddings" && trace == nil {
+		resp, err = s.forwardEmbeddings(ctx, c, proxyReq, cacheDisabled, tenantID, keyID, &requestInfo)
+	} else if s.readsCompletion(method, path) || c.GetBool(ctxLegacyFunctions) || legacy.Listing || c.Value(ctxServerTools) != nil {
+		resp, err = s.forwardCompletion(ctx, c, proxyReq, tenantID, keyID, &requestInfo)
+	} else {
+		resp, err = s.proxyClient.Stream(ctx, proxyReq)
+	}
 	if err != nil {
 		s.logger.Printf("Error forwarding request: %v", err)
-		c.JSON(http.StatusBadGateway, gin.H{
-			"error": "Failed to forward request to OpenAI API",
-			"code":  "PROXY_ERROR",
-		})
+		c.Error(err)
+		s.forwardFailed(c, err)
 		return
 	}
+	defer resp.Body.Close()
+	if s.config.ResponseNormalization {
+		resp = s.normalizeError(resp)
+	}
+	if s.plugins.Has(plugins.PostResponse) {
+		if resp = s.postResponse(c, forwarded, resp); resp == nil {
+			return
+		}
+	}
+	// The cache keeps upstream's headers, without a deprecation Warning
+	received := resp.Headers
+	resp.Headers = s.checkDeprecation(c, tenantID, keyID, requestInfo.Model, resp.Headers)
 
-	for key, values := range proxyResp.Headers {
-		for _, value := range values {
-			c.Header(key, value)
+	// The body is only held in memory when it's going into the cache or
+	// may carry token usage, and never beyond the cache's entry size cap
+	cacheable := !cacheDisabled && s.cache.Cacheable(method, cachePath, resp.StatusCode)
+	if optIn {
+		cacheable = !cacheDisabled && cache.OptInCacheable(resp.StatusCode)
+	}
+	var captureLimit int64
+	if cacheable || isJSON(http.Header(resp.Headers).Get("Content-Type")) {
+		captureLimit = s.cache.EntryLimit(path)
+	}
+	captured, written, err := s.relay(c, resp, "MISS", captureLimit)
+	if err != nil {
+		// Headers are already sent, so all that's left is to log it
+		s.logger.Printf("Error relaying %s %s after %d bytes: %v", method, path, written, err)
+		c.Error(err)
+		return
+	}
+
+	respBody, complete := captured.complete()
+	if complete {
+		if cacheable {
+			entry := &cache.CacheEntry{
+				StatusCode: resp.StatusCode,
+				Headers:    received,
+				Body:       respBody,
+				TTL:        c.GetDuration(ctxCacheTTL),
+				Tenant:     tenantID,
+				User:       requestInfo.User,
+			}
+			if optIn {
+				s.cache.SetOptIn(method, cachePath, headers, cacheBody, entry)
+			} else {
+				s.cache.Set(method, cachePath, headers, cacheBody, entry)
+			}
+		}
+		s.recordResponse(c, tenantID, keyID, requestInfo, respBody)
+		s.checkDeprecatedError(c, tenantID, keyID, requestInfo.Model, resp.StatusCode, respBody)
+		if turn != nil && resp.StatusCode == http.StatusOK {
+			s.answered(turn, respBody)
+		}
+		if resp.StatusCode == http.StatusOK && strings.HasPrefix(path, fineTuningJobsPath) {
+			s.trackFineTunes(path, tenantID, keyID, proxyReq.Headers, respBody)
+		}
+		if resp.StatusCode == http.StatusOK && strings.HasPrefix(path, vectorStoresPath) {
+			s.trackVectorStores(method, tenantID, respBody)
 		}
+		if s.shadows != nil && method == http.MethodPost && shadowPaths[path] && !s.pinned(tenantID) {
+			s.mirror(path, proxyReq.Headers, bodyBytes, requestInfo.Model, resp.StatusCode, respBody, time.Since(start))
+		}
+	} else if captureLimit > 0 {
+		s.logger.Printf("%s %s response exceeded %d bytes, not cached or metered", method, path, captureLimit)
+	}
+
+	if resp.StatusCode == http.StatusOK && isUploadFinishPath(method, path) {
+		s.uploadParts.forget(uploadID(path))
+	}
+
+	s.logger.Printf("%s %s -> %d (%d bytes)", method, path, resp.StatusCode, written)
+}
+
+// streamResponse presents a response that has already been read in full
+// like one straight from upstream
+func streamResponse(resp *proxy.ProxyResponse) *proxy.StreamResponse {
+	return &proxy.StreamResponse{
+		StatusCode:    resp.StatusCode,
+		Headers:       resp.Headers,
+		ContentLength: int64(len(resp.Body)),
+		Body:          io.NopCloser(bytes.NewReader(resp.Body)),
+	}
+}
+
+// outgoingHeaders copies the client's headers for forwarding upstream,
+// leaving out hop-by-hop headers and recording the proxy in Via and
+// X-Forwarded-*. The copy can be changed without touching the request.
+func outgoingHeaders(r *http.Request) http.Header {
+	headers := r.Header.Clone()
+	proxy.RemoveHopByHop(headers)
+	removeOverrideHeaders(headers)
+	proxy.AddVia(headers, r.ProtoMajor, r.ProtoMinor)
+
+	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := headers.Values("X-Forwarded-For"); len(prior) > 0 {
+			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		headers.Set("X-Forwarded-For", clientIP)
+	}
+	if headers.Get("X-Forwarded-Proto") == "" {
+		proto := "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+		headers.Set("X-Forwarded-Proto", proto)
+	}
+	if headers.Get("X-Forwarded-Host") == "" && r.Host != "" {
+		headers.Set("X-Forwarded-Host", r.Host)
+	}
+	return headers
+}
+
+// withUpstreamHeaders returns the headers to forward. The client's own
+// headers are left untouched so cache entries remain keyed per client key.
+func withUpstreamHeaders(headers http.Header, upstreamHeaders map[string]string) http.Header {
+	if len(upstreamHeaders) == 0 {
+		return headers
+	}
+
+	forwardHeaders := headers.Clone()
+	for key, value := range upstreamHeaders {
+		forwardHeaders.Set(key, value)
 	}
+	return forwardHeaders
+}
 
-	c.Header("X-Cache", "MISS")
-	c.Header("X-Proxy", "goproxyai")
+// cacheGet looks the request up in the cache, taking only entries younger
+// than the X-Proxy-Cache-TTL it asked for
+func (s *Server) cacheGet(c *gin.Context, disabled bool, method, path string, headers http.Header, body []byte) (*cache.CacheEntry, bool) {
+	trace := dryrun.From(c.Request.Context())
+	if disabled {
+		trace.Add("cache", "bypassed")
+		return nil, false
+	}
+	get := s.cache.Get
+	if c.GetBool(ctxCacheOptIn) {
+		get = s.cache.GetOptIn
+	}
+	entry, found := get(method, path, headers, body)
+	if !found {
+		trace.Add("cache", "miss")
+		return nil, false
+	}
+	if maxAge := c.GetDuration(ctxCacheTTL); maxAge > 0 && clock.Since(entry.Timestamp) >= maxAge {
+		trace.Add("cache", "entry from %s is older than the requested TTL %v", entry.Timestamp.Format(time.RFC3339), maxAge)
+		return nil, false
+	}
+	trace.Add("cache", "hit, stored %s", entry.Timestamp.Format(time.RFC3339))
+	return entry, true
+}
 
-	cacheEntry := &cache.CacheEntry{
-		StatusCode: proxyResp.StatusCode,
-		Headers:    proxyResp.Headers,
-		Body:       proxyResp.Body,
+// writeCached answers with a cache entry as upstream sent it: the same
+// status and the headers RESPONSE_HEADERS allows, every value of each,
+// and the body's own length
+func (s *Server) writeCached(c *gin.Context, entry *cache.CacheEntry) {
+	s.copyHeaders(c, entry.Headers)
+	c.Header("Content-Length", strconv.Itoa(len(entry.Body)))
+	c.Header("X-Cache", "HIT")
+	c.Header("X-Cache-Timestamp", entry.Timestamp.Format("2006-01-02T15:04:05Z07:00"))
+
+	contentType := http.Header(entry.Headers).Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/json"
 	}
-	s.cache.Set(method, path, headers, bodyBytes, cacheEntry)
+	c.Data(entry.StatusCode, contentType, entry.Body)
+}
 
-	s.logger.Printf("%s %s -> %d (%d bytes)", method, path, proxyResp.StatusCode, len(proxyResp.Body))
+// injectUser fills the request's user field from the configured header when
+// the client didn't set one, so usage can be attributed to end users without
+// changing client payloads. The header itself is not forwarded upstream.
+func (s *Server) injectUser(headers http.Header, body []byte, info openai.RequestInfo) ([]byte, openai.RequestInfo) {
+	if s.config.UserIDHeader == "" {
+		return body, info
+	}
 
-	contentType := "application/json"
-	if ct := c.GetHeader("Content-Type"); ct != "" {
-		contentType = ct
+	userID := headers.Get(s.config.UserIDHeader)
+	headers.Del(s.config.UserIDHeader)
+	if userID == "" || info.User != "" {
+		return body, info
 	}
 
-	c.Data(proxyResp.StatusCode, contentType, proxyResp.Body)
+	updated, err := openai.SetField(body, "user", userID)
+	if err != nil {
+		s.logger.Printf("Could not inject user into request body: %v", err)
+		return body, info
+	}
+
+	info.User = userID
+	return updated, info
 }
 
 func (s *Server) Run() error {
-	address := ":" + s.config.Port
-	s.logger.Printf("Server starting on %s", address)
+	listeners, err := s.listen(s.config.Port, true)
+	if err != nil {
+		return err
+	}
+	for i, listener := range listeners {
+		s.logger.Printf("Server starting on %s", listener.Addr())
+		if s.guards != nil {
+			listeners[i] = s.guards.listener(listener)
+		}
+	}
 	s.logger.Printf("Proxy URL: %s", s.getProxyDisplay())
-	s.logger.Printf("OpenAI API URL: %s", s.config.OpenAIAPIURL)
+	switch s.config.UpstreamMode {
+	case "mock":
+		s.logger.Printf("Upstream mode: mock, no requests leave the proxy")
+	case "replay":
+		s.logger.Printf("Upstream mode: replaying cassettes from %s, no requests leave the proxy", s.config.CassetteDir)
+	case "record":
+		s.logger.Printf("OpenAI API URL: %s, recording cassettes to %s", s.config.OpenAIAPIURL, s.config.CassetteDir)
+	default:
+		s.logger.Printf("OpenAI API URL: %s", s.config.OpenAIAPIURL)
+	}
+	if s.config.UpstreamMode == "live" || s.config.UpstreamMode == "record" {
+		s.logger.Printf("Upstream TLS policy: %s", tlspolicy.Current())
+		if s.config.UpstreamTLSInsecure {
+			s.logger.Printf("UPSTREAM_TLS_INSECURE_SKIP_VERIFY is set: upstream certificates aren't verified")
+		}
+	}
 	s.logger.Printf("Rate limit: %d requests/minute", s.config.RateLimit)
 	s.logger.Printf("Cache TTL: %v", s.config.CacheTTL)
 
-	return s.router.Run(address)
+	var grpcServer *grpc.Server
+	if s.config.GRPCPort != "" {
+		grpcServer = s.newGRPCServer()
+		go s.runGRPC(grpcServer)
+	}
+
+	// HTTP/2 lets SDK clients multiplex many streams over a few connections.
+	// It's negotiated automatically over TLS; h2c serves it in cleartext for
+	// in-cluster traffic behind a TLS-terminating load balancer.
+	h2Server := &http2.Server{
+		MaxConcurrentStreams: s.config.HTTP2MaxStreams,
+		IdleTimeout:          s.config.HTTPIdleTimeout,
+	}
+	if len(s.config.TunnelAllowlist) > 0 {
+		s.logger.Printf("CONNECT tunneling enabled for %s", strings.Join(s.config.TunnelAllowlist, ", "))
+	}
+	handler := s.Handler()
+	httpServer := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: s.config.HTTPReadHeaderTimeout,
+		IdleTimeout:       s.config.HTTPIdleTimeout,
+		MaxHeaderBytes:    s.config.HTTPMaxHeaderBytes,
+	}
+	if s.config.TLSCertFile != "" {
+		httpServer.TLSConfig = &tls.Config{}
+		tlspolicy.Current().Apply(httpServer.TLSConfig)
+	}
+	if err := http2.ConfigureServer(httpServer, h2Server); err != nil {
+		return err
+	}
+
+	serve := httpServer.Serve
+	if s.config.TLSCertFile != "" {
+		s.logger.Printf("Serving HTTPS with HTTP/2")
+		s.logger.Printf("Listener TLS policy: %s", tlspolicy.Current())
+		serve = func(listener net.Listener) error {
+			return httpServer.ServeTLS(listener, s.config.TLSCertFile, s.config.TLSKeyFile)
+		}
+	} else if s.config.H2C {
+		s.logger.Printf("Serving HTTP/1.1 and h2c")
+		httpServer.Handler = h2c.NewHandler(handler, h2Server)
+	}
+
+	var h3Server http3Server
+	if s.config.HTTP3 {
+		if h3Server, err = s.startHTTP3(handler); err != nil {
+			return err
+		}
+		httpServer.Handler = s.advertiseHTTP3(handler)
+	}
+
+	// All listeners share the server, and the first to fail stops it
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			errs <- serve(listener)
+		}(listener)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(signals)
+	select {
+	case err = <-errs:
+		httpServer.Close()
+		if h3Server != nil {
+			h3Server.Close()
+		}
+		return err
+	case received := <-signals:
+		s.logger.Printf("Received %v, shutting down", received)
+	}
+	s.shutdown(httpServer, grpcServer, h3Server)
+	return nil
+}
+
+// Handler serves everything Run serves over HTTP/1.1, for embedding the
+// proxy in another server or an httptest.Server
+func (s *Server) Handler() http.Handler {
+	handler := http.Handler(s.router)
+	if s.config.RequestMigration {
+		handler = s.legacyEngines(handler)
+	}
+	if s.plugins.Has(plugins.PreRoute) {
+		handler = s.preRoute(handler)
+	}
+	handler = s.limitRequestBodies(handler)
+	handler = s.connDeadlines(handler)
+	if len(s.config.TunnelAllowlist) > 0 {
+		return s.tunnelHandler(handler)
+	}
+	return handler
 }
 
 func (s *Server) getProxyDisplay() string {
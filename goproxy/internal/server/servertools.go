@@ -0,0 +1,251 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/dryrun"
+	"goproxyai/internal/openai"
+	"goproxyai/internal/proxy"
+	"goproxyai/internal/servertools"
+)
+
+const serverToolsHeader = "X-Server-Tools"
+
+// Set to the []servertools.Tool a chat completion declared through
+// X-Server-Tools
+const ctxServerTools = "server_tools"
+
+// selectServerTools declares the server tools a chat completion names in
+// X-Server-Tools, or all of them for *, alongside its own tools. It writes
+// the error response itself when it returns false.
+func (s *Server) selectServerTools(c *gin.Context, method, path string, headers http.Header, body []byte, info openai.RequestInfo) ([]byte, bool) {
+	if s.serverTools == nil {
+		return body, true
+	}
+	requested := headers.Get(serverToolsHeader)
+	headers.Del(serverToolsHeader)
+	if requested == "" || method != http.MethodPost || path != "/v1/chat/completions" {
+		return body, true
+	}
+	if info.Stream {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "X-Server-Tools can't be used with streaming",
+			"code":  "SERVER_TOOLS_STREAMING",
+		})
+		return nil, false
+	}
+
+	names := s.serverTools.Names()
+	if strings.TrimSpace(requested) != "*" {
+		names = nil
+		for _, name := range strings.Split(requested, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	declared := make(map[string]bool)
+	for _, tool := range openai.ParseTools(body) {
+		declared[tool.Name] = true
+	}
+	key, _, keyFound := s.tenants.Lookup(c.GetHeader("Authorization"))
+
+	var tools []servertools.Tool
+	var definitions []json.RawMessage
+	for _, name := range names {
+		tool, found := s.serverTools.Get(name)
+		if !found {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Unknown server tool " + strconv.Quote(name) + ", available: " + strings.Join(s.serverTools.Names(), ", "),
+				"code":  "UNKNOWN_SERVER_TOOL",
+			})
+			return nil, false
+		}
+		if keyFound && !key.AllowsTool(name) {
+			s.refuseTool(c, name, serverToolsHeader)
+			return nil, false
+		}
+		if declared[name] {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Tool " + strconv.Quote(name) + " is declared by the request and named in X-Server-Tools",
+				"code":  "SERVER_TOOL_CONFLICT",
+			})
+			return nil, false
+		}
+		tools = append(tools, tool)
+		definitions = append(definitions, tool.Definition())
+	}
+	if len(tools) == 0 {
+		return body, true
+	}
+
+	var fields map[string]json.RawMessage
+	var existing []json.RawMessage
+	if json.Unmarshal(body, &fields) != nil || (isSet(fields["tools"]) && json.Unmarshal(fields["tools"], &existing) != nil) {
+		// Upstream says what's wrong with it
+		return body, true
+	}
+	encoded, err := json.Marshal(append(existing, definitions...))
+	if err != nil {
+		return body, true
+	}
+	fields["tools"] = encoded
+	updated, err := json.Marshal(fields)
+	if err != nil {
+		return body, true
+	}
+	dryrun.From(c.Request.Context()).Add("server_tools", "declared %s", strings.Join(names, ", "))
+	transformed(c, "server_tools")
+	c.Set(ctxServerTools, tools)
+	return updated, true
+}
+
+// forwardServerTools sends a chat completion upstream and, for as long as
+// the model only calls server tools, runs them and sends their results
+// back in another round, until it answers or SERVER_TOOLS_MAX_ROUNDS is
+// reached. The last round has tool_choice none, so the model must answer.
+// The answer carries the usage of every round, and how many calls were
+// run in X-Server-Tool-Calls.
+func (s *Server) forwardServerTools(ctx context.Context, c *gin.Context, req *proxy.ProxyRequest, tools []servertools.Tool) (*proxy.ProxyResponse, error) {
+	byName := make(map[string]servertools.Tool, len(tools))
+	for _, tool := range tools {
+		byName[tool.Name()] = tool
+	}
+	trace := dryrun.From(c.Request.Context())
+
+	var fields map[string]json.RawMessage
+	var messages []json.RawMessage
+	if json.Unmarshal(req.Body, &fields) != nil || json.Unmarshal(fields["messages"], &messages) != nil {
+		return s.proxyClient.Forward(ctx, req)
+	}
+
+	var total openai.Usage
+	calls := 0
+	round := *req
+	for rounds := 0; ; rounds++ {
+		resp, err := s.proxyClient.Forward(ctx, &round)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return resp, nil
+		}
+		if usage, ok := openai.ParseUsage(resp.Body); ok {
+			total.PromptTokens += usage.PromptTokens
+			total.CompletionTokens += usage.CompletionTokens
+			total.TotalTokens += usage.TotalTokens
+		}
+
+		message, toolCalls := firstToolCalls(resp.Body)
+		runnable := len(toolCalls) > 0 && rounds < s.config.ServerToolsMaxRounds
+		for _, call := range toolCalls {
+			if byName[call.Function.Name] == nil {
+				// The client's own tool, for the client to run
+				runnable = false
+			}
+		}
+		if runnable && trace != nil {
+			trace.Add("server_tools", "would run %d tool calls, skipped in a dry run", len(toolCalls))
+			runnable = false
+		}
+		if !runnable {
+			if rounds > 0 {
+				c.Header("X-Server-Tool-Calls", strconv.Itoa(calls))
+				setUsage(resp, total)
+			}
+			return resp, nil
+		}
+
+		messages = append(messages, message)
+		for _, call := range toolCalls {
+			result := s.callServerTool(ctx, byName[call.Function.Name], call.Function.Arguments)
+			answer, err := json.Marshal(map[string]string{"role": "tool", "tool_call_id": call.ID, "content": result})
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, answer)
+			calls++
+		}
+		if fields["messages"], err = json.Marshal(messages); err != nil {
+			return nil, err
+		}
+		if rounds+1 == s.config.ServerToolsMaxRounds {
+			fields["tool_choice"] = json.RawMessage(`"none"`)
+		}
+		if round.Body, err = json.Marshal(fields); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// callServerTool runs one tool call, with SERVER_TOOLS_TIMEOUT, telling the
+// model what went wrong if it fails so it can try something else
+func (s *Server) callServerTool(ctx context.Context, tool servertools.Tool, arguments string) string {
+	ctx, cancel := context.WithTimeout(ctx, s.config.ServerToolsTimeout)
+	defer cancel()
+	result, err := tool.Call(ctx, json.RawMessage(arguments))
+	if err != nil {
+		s.logger.Printf("Server tool %s failed: %v", tool.Name(), err)
+		return "Error: " + err.Error()
+	}
+	return result
+}
+
+type toolCall struct {
+	ID       string `json:"id"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+// firstToolCalls returns the message of a chat completion's first choice
+// and the tool calls it makes
+func firstToolCalls(body []byte) (json.RawMessage, []toolCall) {
+	var completion struct {
+		Choices []struct {
+			Message json.RawMessage `json:"message"`
+		} `json:"choices"`
+	}
+	if json.Unmarshal(body, &completion) != nil || len(completion.Choices) == 0 {
+		return nil, nil
+	}
+	var message struct {
+		ToolCalls []toolCall `json:"tool_calls"`
+	}
+	if json.Unmarshal(completion.Choices[0].Message, &message) != nil {
+		return nil, nil
+	}
+	return completion.Choices[0].Message, message.ToolCalls
+}
+
+// setUsage replaces a chat completion's usage with the total of every round
+func setUsage(resp *proxy.ProxyResponse, total openai.Usage) {
+	var body map[string]json.RawMessage
+	if json.Unmarshal(resp.Body, &body) != nil {
+		return
+	}
+	usage, err := json.Marshal(map[string]int{
+		"prompt_tokens":     total.PromptTokens,
+		"completion_tokens": total.CompletionTokens,
+		"total_tokens":      total.TotalTokens,
+	})
+	if err != nil {
+		return
+	}
+	body["usage"] = usage
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return
+	}
+	resp.Body = encoded
+	headers := http.Header(resp.Headers).Clone()
+	headers.Del("Content-Length")
+	resp.Headers = headers
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/dryrun"
+	"goproxyai/internal/session"
+	"goproxyai/internal/usage"
+)
+
+const sessionHeader = "X-Session-ID"
+
+// Set to the *sessionTurn of requests that are part of a session
+const ctxSession = "session"
+
+const maxSessionIDLength = 128
+
+// sessionTurn is a chat completion made in a session: the history it was
+// sent with and the messages the client added, saved together with the
+// answer once it's in
+type sessionTurn struct {
+	name     string
+	model    string
+	history  []json.RawMessage
+	messages []json.RawMessage
+
+	// What a streamed answer has said so far
+	content   strings.Builder
+	toolCalls bool
+	finished  bool
+}
+
+// openSession prepends the history of the session a chat completion names
+// in X-Session-ID to its messages, after any system messages it opens
+// with. It writes the error response itself when it returns false.
+func (s *Server) openSession(c *gin.Context, method, path string, headers http.Header, body []byte) ([]byte, *sessionTurn, bool) {
+	if s.sessions == nil {
+		return body, nil, true
+	}
+	id := headers.Get(sessionHeader)
+	headers.Del(sessionHeader)
+	if id == "" || method != http.MethodPost || path != "/v1/chat/completions" {
+		return body, nil, true
+	}
+	if !validSessionID(id) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid X-Session-ID, expected up to 128 printable characters",
+			"code":  "INVALID_SESSION_ID",
+		})
+		return nil, nil, false
+	}
+
+	var fields map[string]json.RawMessage
+	var messages []json.RawMessage
+	var model string
+	if json.Unmarshal(body, &fields) != nil || json.Unmarshal(fields["messages"], &messages) != nil {
+		// Upstream says what's wrong with it
+		return body, nil, true
+	}
+	_ = json.Unmarshal(fields["model"], &model)
+
+	turn := &sessionTurn{name: sessionName(c.GetHeader("Authorization"), id), model: model}
+	history, err := s.sessions.Load(c.Request.Context(), turn.name)
+	if err != nil {
+		s.logger.Printf("Error loading session from SESSION_STORE: %v", err)
+		c.Error(err)
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error": "Session store unavailable",
+			"code":  "SESSION_STORE_ERROR",
+		})
+		return nil, nil, false
+	}
+	turn.history = session.Window(model, history, s.config.SessionMaxTokens)
+
+	system := 0
+	for system < len(messages) && isSystemRole(session.Role(messages[system])) {
+		system++
+	}
+	turn.messages = messages[system:]
+	combined := make([]json.RawMessage, 0, len(turn.history)+len(messages))
+	combined = append(combined, messages[:system]...)
+	combined = append(combined, turn.history...)
+	combined = append(combined, turn.messages...)
+
+	encoded, err := json.Marshal(combined)
+	if err != nil {
+		return body, nil, true
+	}
+	fields["messages"] = encoded
+	updated, err := json.Marshal(fields)
+	if err != nil {
+		return body, nil, true
+	}
+	dryrun.From(c.Request.Context()).Add("session", "%d earlier messages prepended", len(turn.history))
+	transformed(c, "session")
+	c.Set(ctxSession, turn)
+	return updated, turn, true
+}
+
+// saveSession adds a turn and its answer to the session's history
+func (s *Server) saveSession(turn *sessionTurn, answer json.RawMessage) {
+	messages := make([]json.RawMessage, 0, len(turn.history)+len(turn.messages)+1)
+	messages = append(messages, turn.history...)
+	messages = append(messages, turn.messages...)
+	messages = append(messages, answer)
+	messages = session.Window(turn.model, messages, s.config.SessionMaxTokens)
+	// The client has its answer already, so the save outlives the request
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.RequestTimeout)
+	defer cancel()
+	if err := s.sessions.Save(ctx, turn.name, messages); err != nil {
+		s.logger.Printf("Error saving session to SESSION_STORE: %v", err)
+	}
+}
+
+// answered saves a turn with the first choice of a chat completion
+func (s *Server) answered(turn *sessionTurn, body []byte) {
+	var completion struct {
+		Choices []struct {
+			Message json.RawMessage `json:"message"`
+		} `json:"choices"`
+	}
+	if json.Unmarshal(body, &completion) != nil || len(completion.Choices) == 0 || !isSet(completion.Choices[0].Message) {
+		return
+	}
+	s.saveSession(turn, completion.Choices[0].Message)
+}
+
+// observe follows the first choice of a streamed answer
+func (t *sessionTurn) observe(data []byte) {
+	var chunk struct {
+		Choices []struct {
+			Index int `json:"index"`
+			Delta struct {
+				Content      string          `json:"content"`
+				ToolCalls    json.RawMessage `json:"tool_calls"`
+				FunctionCall json.RawMessage `json:"function_call"`
+			} `json:"delta"`
+			FinishReason *string `json:"finish_reason"`
+		} `json:"choices"`
+	}
+	if json.Unmarshal(data, &chunk) != nil {
+		return
+	}
+	for _, choice := range chunk.Choices {
+		if choice.Index != 0 {
+			continue
+		}
+		t.content.WriteString(choice.Delta.Content)
+		if isSet(choice.Delta.ToolCalls) || isSet(choice.Delta.FunctionCall) {
+			t.toolCalls = true
+		}
+		if choice.FinishReason != nil {
+			t.finished = true
+		}
+	}
+}
+
+// streamed saves a turn with the answer a stream put together, so long as
+// it finished and was only text. Tool calls aren't pieced back together
+// from their deltas, so those turns are left out of the history.
+func (s *Server) streamed(turn *sessionTurn) {
+	if !turn.finished || turn.toolCalls {
+		return
+	}
+	answer, err := json.Marshal(map[string]string{"role": "assistant", "content": turn.content.String()})
+	if err != nil {
+		return
+	}
+	s.saveSession(turn, answer)
+}
+
+func (s *Server) getSession(c *gin.Context) {
+	id := c.Param("id")
+	if !validSessionID(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found", "code": "SESSION_NOT_FOUND"})
+		return
+	}
+	messages, err := s.sessions.Load(c.Request.Context(), sessionName(c.GetHeader("Authorization"), id))
+	if err != nil {
+		s.logger.Printf("Error loading session from SESSION_STORE: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error": "Session store unavailable",
+			"code":  "SESSION_STORE_ERROR",
+		})
+		return
+	}
+	if len(messages) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found", "code": "SESSION_NOT_FOUND"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": id, "messages": messages})
+}
+
+func (s *Server) deleteSession(c *gin.Context) {
+	id := c.Param("id")
+	if !validSessionID(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found", "code": "SESSION_NOT_FOUND"})
+		return
+	}
+	if err := s.sessions.Delete(c.Request.Context(), sessionName(c.GetHeader("Authorization"), id)); err != nil {
+		s.logger.Printf("Error deleting session from SESSION_STORE: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error": "Session store unavailable",
+			"code":  "SESSION_STORE_ERROR",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Session deleted"})
+}
+
+// sessionName keys a session by the API key together with the id the
+// client gave it, so one key can never reach another's sessions. It starts
+// with the key's usage ID, for a deletion request to find the sessions of
+// a tenant's keys.
+func sessionName(authorization, id string) string {
+	token := strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+	hash := sha256.Sum256([]byte(token + "\x00" + id))
+	return usage.KeyID(authorization) + "-" + hex.EncodeToString(hash[:])
+}
+
+func validSessionID(id string) bool {
+	if id == "" || len(id) > maxSessionIDLength {
+		return false
+	}
+	for _, r := range id {
+		if r < 0x21 || r > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func isSystemRole(role string) bool {
+	return role == "system" || role == "developer"
+}
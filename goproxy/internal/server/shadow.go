@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/openai"
+	"goproxyai/internal/proxy"
+	"goproxyai/internal/shadow"
+)
+
+// Endpoints whose answers are shadowed and compared
+var shadowPaths = map[string]bool{
+	"/v1/chat/completions": true,
+	"/v1/completions":      true,
+	"/v1/responses":        true,
+}
+
+// mirror sends a copy of a request the primary upstream has answered to
+// the shadow upstream or model in the background, and records how the two
+// answers compare. Requests are sampled at SHADOW_SAMPLE_RATE and dropped
+// while SHADOW_MAX_IN_FLIGHT shadows are already running, so the shadow
+// never holds up or piles onto the primary traffic.
+func (s *Server) mirror(path string, headers http.Header, body []byte, primaryModel string, primaryStatus int, primaryBody []byte, primaryLatency time.Duration) {
+	if s.config.ShadowSampleRate < 1 && rand.Float64() >= s.config.ShadowSampleRate {
+		return
+	}
+	select {
+	case s.shadowSlots <- struct{}{}:
+	default:
+		s.shadows.RecordDropped()
+		return
+	}
+
+	// The request and response buffers are reused once the handler returns
+	body = append([]byte(nil), body...)
+	primaryBody = append([]byte(nil), primaryBody...)
+	headers = headers.Clone()
+
+	go func() {
+		defer func() { <-s.shadowSlots }()
+		s.compareShadow(path, headers, body, primaryModel, primaryStatus, primaryBody, primaryLatency)
+	}()
+}
+
+func (s *Server) compareShadow(path string, headers http.Header, body []byte, primaryModel string, primaryStatus int, primaryBody []byte, primaryLatency time.Duration) {
+	comparison := shadow.Comparison{
+		Path:           path,
+		PrimaryModel:   primaryModel,
+		ShadowModel:    primaryModel,
+		PrimaryStatus:  primaryStatus,
+		PrimaryText:    strings.Join(openai.ExtractOutputText(primaryBody), "\n"),
+		PrimaryLatency: primaryLatency,
+	}
+
+	shadowBody := body
+	if s.config.ShadowModel != "" {
+		comparison.ShadowModel = s.config.ShadowModel
+		var err error
+		if shadowBody, err = openai.SetField(body, "model", s.config.ShadowModel); err != nil {
+			return
+		}
+	}
+	shadowHeaders := headers
+	if s.config.ShadowAPIKey != "" {
+		shadowHeaders = headers.Clone()
+		shadowHeaders.Set("Authorization", "Bearer "+s.config.ShadowAPIKey)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.RequestTimeout)
+	defer cancel()
+
+	start := time.Now()
+	resp, err := s.shadowClient.Forward(ctx, &proxy.ProxyRequest{
+		Method:  http.MethodPost,
+		Path:    path,
+		Headers: shadowHeaders,
+		Body:    shadowBody,
+	})
+	comparison.ShadowLatency = time.Since(start)
+	if err != nil {
+		s.logger.Printf("Shadow %s for %s failed: %v", path, comparison.ShadowModel, err)
+		comparison.ShadowError = err.Error()
+		s.shadows.Record(comparison)
+		return
+	}
+	comparison.ShadowStatus = resp.StatusCode
+	comparison.ShadowText = strings.Join(openai.ExtractOutputText(resp.Body), "\n")
+
+	if comparison.PrimaryStatus == http.StatusOK && comparison.ShadowStatus == http.StatusOK {
+		comparison.Similarity = s.similarity(ctx, headers, comparison.PrimaryText, comparison.ShadowText)
+		primaryCost, primaryPriced := s.responseCost(primaryModel, primaryBody)
+		shadowCost, shadowPriced := s.responseCost(comparison.ShadowModel, resp.Body)
+		if primaryPriced && shadowPriced {
+			comparison.PrimaryCost, comparison.ShadowCost, comparison.Priced = primaryCost, shadowCost, true
+		}
+	}
+	s.shadows.Record(comparison)
+}
+
+// similarity compares two answers by their embeddings when
+// SHADOW_SIMILARITY_MODEL is set, and by their words otherwise or when the
+// embeddings can't be had
+func (s *Server) similarity(ctx context.Context, headers http.Header, a, b string) float64 {
+	if s.config.ShadowSimilarityModel == "" || a == "" || b == "" {
+		return shadow.LexicalSimilarity(a, b)
+	}
+
+	embeddings, err := s.embed(ctx, headers, []string{a, b})
+	if err != nil {
+		s.logger.Printf("Shadow similarity embeddings failed, comparing words instead: %v", err)
+		return shadow.LexicalSimilarity(a, b)
+	}
+	return shadow.Cosine(embeddings[0], embeddings[1])
+}
+
+func (s *Server) embed(ctx context.Context, headers http.Header, inputs []string) ([][]float64, error) {
+	body, err := json.Marshal(map[string]interface{}{"model": s.config.ShadowSimilarityModel, "input": inputs})
+	if err != nil {
+		return nil, err
+	}
+	embedHeaders := http.Header{
+		"Authorization": headers.Values("Authorization"),
+		"Content-Type":  {"application/json"},
+	}
+	resp, err := s.proxyClient.Forward(ctx, &proxy.ProxyRequest{
+		Method:  http.MethodPost,
+		Path:    "/v1/embeddings",
+		Headers: embedHeaders,
+		Body:    body,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("embeddings returned %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(resp.Body, &result); err != nil {
+		return nil, err
+	}
+	if len(result.Data) != len(inputs) {
+		return nil, errors.New("embeddings response has the wrong number of vectors")
+	}
+	embeddings := make([][]float64, len(inputs))
+	for _, item := range result.Data {
+		if item.Index < 0 || item.Index >= len(inputs) {
+			return nil, errors.New("embeddings response has an out of range index")
+		}
+		embeddings[item.Index] = item.Embedding
+	}
+	return embeddings, nil
+}
+
+// responseCost prices a response's usage, preferring the model the
+// response says answered it
+func (s *Server) responseCost(model string, body []byte) (float64, bool) {
+	tokens, ok := openai.ParseUsage(body)
+	if !ok {
+		return 0, false
+	}
+	if answered := openai.ParseObject(body).Model; answered != "" {
+		model = answered
+	}
+	return s.pricing.Cost(model, int64(tokens.PromptTokens), int64(tokens.CompletionTokens))
+}
+
+func (s *Server) getShadowReports(c *gin.Context) {
+	if s.shadows == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Shadow traffic is not enabled",
+			"code":  "SHADOW_DISABLED",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"current": s.shadows.Current(),
+		"reports": s.shadows.Reports(),
+	})
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/tenant"
+)
+
+// shedLoad turns a request away with 503 while the process is over its
+// memory or goroutine threshold. High-priority tenants are never shed and
+// low-priority ones always are; everyone else is only shed for requests the
+// cache could never answer, such as streams and uploads.
+func (s *Server) shedLoad(c *gin.Context, method, path string, cacheable bool) bool {
+	if s.load == nil {
+		return false
+	}
+	reason, overloaded := s.load.Overloaded()
+	if !overloaded {
+		return false
+	}
+
+	switch s.priority(c) {
+	case tenant.PriorityHigh:
+		return false
+	case tenant.PriorityLow:
+	default:
+		if cacheable {
+			return false
+		}
+	}
+
+	s.load.RecordShed()
+	s.logger.Printf("Shed %s %s: %s", method, path, reason)
+	c.Header("Retry-After", "5")
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"error": "The proxy is overloaded. Please retry shortly.",
+		"code":  "OVERLOADED",
+	})
+	return true
+}
+
+func (s *Server) priority(c *gin.Context) string {
+	t, found := s.tenants.Tenant(c.GetString(ctxTenantID))
+	if !found || t.Priority == "" {
+		return tenant.PriorityNormal
+	}
+	return t.Priority
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+
+	"goproxyai/internal/proxy"
+)
+
+// Set on requests refused because the proxy is shutting down
+const ctxShutDown = "shut_down"
+
+// draining counts the /v1 requests open while the proxy shuts down, and how
+// they ended
+type draining struct {
+	started   atomic.Bool
+	open      atomic.Int64
+	drained   atomic.Int64 // answered before the proxy stopped
+	cancelled atomic.Int64 // refused before going upstream
+}
+
+// drainRequests refuses /v1 requests with a retriable 503 once the proxy
+// is shutting down, and counts how the ones it was already answering
+// ended. It runs ahead of the pipeline, so requests still being checked
+// are counted too.
+func (s *Server) drainRequests() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s.draining.open.Add(1)
+		defer s.draining.open.Add(-1)
+		if s.draining.started.Load() {
+			s.draining.cancelled.Add(1)
+			s.shuttingDown(c)
+			c.Abort()
+			return
+		}
+		c.Request = c.Request.WithContext(proxy.TrackForwarded(c.Request.Context()))
+
+		c.Next()
+
+		if !s.draining.started.Load() {
+			return
+		}
+		if c.GetBool(ctxShutDown) {
+			s.draining.cancelled.Add(1)
+		} else {
+			s.draining.drained.Add(1)
+		}
+	}
+}
+
+// awaitDrained waits for the /v1 requests still open to finish, until ctx
+// is done
+func (s *Server) awaitDrained(ctx context.Context) {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for s.draining.open.Load() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Server) shuttingDown(c *gin.Context) {
+	c.Set(ctxShutDown, true)
+	c.Header("Retry-After", "1")
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"error": "The proxy is restarting. Please retry.",
+		"code":  "SHUTTING_DOWN",
+	})
+}
+
+// shutdown stops taking connections and drains the proxy. Requests that
+// haven't gone upstream yet, including those queued for a concurrency
+// slot, are refused with a retriable 503, while those upstream is
+// answering and open streams get SHUTDOWN_TIMEOUT to finish. Connections
+// still open then are closed. HTTP/3 can't be shut down gracefully, so its
+// connections are closed once every /v1 request has finished.
+func (s *Server) shutdown(httpServer *http.Server, grpcServer *grpc.Server, h3Server http3Server) {
+	s.draining.started.Store(true)
+	s.proxyClient.Drain()
+	s.logger.Printf("Draining %d requests for up to %v", s.draining.open.Load(), s.config.ShutdownTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	if grpcServer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stopped := make(chan struct{})
+			go func() {
+				grpcServer.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-ctx.Done():
+				grpcServer.Stop()
+			}
+		}()
+	}
+	if err := httpServer.Shutdown(ctx); err != nil {
+		httpServer.Close()
+	}
+	wg.Wait()
+	if h3Server != nil {
+		s.awaitDrained(ctx)
+		h3Server.Close()
+	}
+
+	s.logger.Printf("Shut down: %d requests drained, %d cancelled, %d cut off at SHUTDOWN_TIMEOUT",
+		s.draining.drained.Load(), s.draining.cancelled.Load(), s.draining.open.Load())
+	if s.journal != nil {
+		if err := s.journal.Close(); err != nil {
+			s.logger.Printf("Failed to close journal: %v", err)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/clock"
+	"goproxyai/internal/dryrun"
+	"goproxyai/internal/openai"
+	"goproxyai/internal/proxy"
+)
+
+// Slow requests kept for /admin/slow
+const slowRequestLimit = 100
+
+// Set by the slow log to the upstream timing of a request, and by
+// proxyHandler to the excerpt of its prompt once upstream was slow
+const (
+	ctxSlowTiming  = "slow_timing"
+	ctxSlowExcerpt = "slow_excerpt"
+)
+
+// What's taken out of prompt excerpts and captured bodies: credentials
+// first, as they may contain digits, then email addresses and long numbers
+// such as card, phone and account numbers
+var textRedactions = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`(?i)bearer\s+\S+`), "[secret]"},
+	{regexp.MustCompile(`\b[a-z]{2,4}[-_][A-Za-z0-9_-]{16,}`), "[secret]"},
+	{regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`), "[email]"},
+	{regexp.MustCompile(`\+?\d[\d ().-]{6,}\d`), "[number]"},
+}
+
+// slowRequest is a request upstream was slow to answer
+type slowRequest struct {
+	Timestamp         time.Time `json:"timestamp"`
+	Method            string    `json:"method"`
+	Path              string    `json:"path"`
+	Status            int       `json:"status"`
+	Stream            bool      `json:"stream"`
+	Tenant            string    `json:"tenant,omitempty"`
+	Key               string    `json:"key"`
+	User              string    `json:"user,omitempty"`
+	Model             string    `json:"model,omitempty"`
+	UpstreamLatency   int64     `json:"upstream_ms"`
+	UpstreamRequests  int       `json:"upstream_requests"`
+	Duration          int64     `json:"duration_ms"`
+	PromptTokens      int64     `json:"prompt_tokens"`
+	CompletionTokens  int64     `json:"completion_tokens"`
+	Excerpt           string    `json:"prompt_excerpt,omitempty"`
+	UpstreamRequestID string    `json:"upstream_request_id,omitempty"`
+}
+
+// slowRequests keeps the latest slow requests, and appends every one to
+// SLOW_LOG_FILE when it's set
+type slowRequests struct {
+	mutex  sync.Mutex
+	recent []slowRequest
+	file   *os.File
+}
+
+func newSlowRequests(path string) (*slowRequests, error) {
+	l := &slowRequests{}
+	if path == "" {
+		return l, nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	l.file = file
+	return l, nil
+}
+
+func (l *slowRequests) add(record slowRequest) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.recent = append(l.recent, record)
+	if len(l.recent) > slowRequestLimit {
+		l.recent = l.recent[len(l.recent)-slowRequestLimit:]
+	}
+	if l.file == nil {
+		return nil
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = l.file.Write(append(line, '\n'))
+	return err
+}
+
+// list returns the latest slow requests, newest first
+func (l *slowRequests) list() []slowRequest {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	records := make([]slowRequest, len(l.recent))
+	for i, record := range l.recent {
+		records[len(l.recent)-1-i] = record
+	}
+	return records
+}
+
+// remove drops the slow requests kept in memory that match, returning how
+// many it dropped. Lines already in the file stay.
+func (l *slowRequests) remove(match func(slowRequest) bool) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	kept := l.recent[:0]
+	for _, record := range l.recent {
+		if !match(record) {
+			kept = append(kept, record)
+		}
+	}
+	removed := len(l.recent) - len(kept)
+	l.recent = kept
+	return removed
+}
+
+// logSlowRequests logs the /v1 requests upstream took SLOW_LOG_THRESHOLD
+// or longer to answer, over all the upstream requests they took: for a
+// stream, until its headers arrived. Like the journal, it runs ahead of
+// the pipeline. Dry runs never reach upstream.
+func (s *Server) logSlowRequests() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if dryrun.From(c.Request.Context()) != nil {
+			c.Next()
+			return
+		}
+		start := clock.Now()
+		ctx, timing := proxy.WithTiming(c.Request.Context())
+		c.Request = c.Request.WithContext(ctx)
+		c.Set(ctxSlowTiming, timing)
+
+		c.Next()
+
+		latency, requests := timing.Total()
+		if latency < s.config.SlowLogThreshold {
+			return
+		}
+		u := usageOf(c)
+		record := slowRequest{
+			Timestamp:         start.UTC(),
+			Method:            c.Request.Method,
+			Path:              c.Request.URL.Path,
+			Status:            c.Writer.Status(),
+			Stream:            strings.HasPrefix(c.Writer.Header().Get("Content-Type"), "text/event-stream"),
+			Tenant:            u.tenant,
+			Key:               u.key,
+			User:              u.user,
+			Model:             u.model,
+			UpstreamLatency:   latency.Milliseconds(),
+			UpstreamRequests:  requests,
+			Duration:          clock.Since(start).Milliseconds(),
+			PromptTokens:      u.promptTokens,
+			CompletionTokens:  u.completionTokens,
+			Excerpt:           c.GetString(ctxSlowExcerpt),
+			UpstreamRequestID: c.Writer.Header().Get("X-Request-Id"),
+		}
+		if err := s.slowRequests.add(record); err != nil {
+			s.logger.Printf("Error writing SLOW_LOG_FILE: %v", err)
+		}
+	}
+}
+
+// excerptSlowPrompt keeps a redacted excerpt of the prompt of a request
+// upstream was slow to answer. It's taken before the body goes back to
+// the pool, and only once a request is known to be slow.
+func (s *Server) excerptSlowPrompt(c *gin.Context, body []byte) {
+	timing, _ := c.Value(ctxSlowTiming).(*proxy.Timing)
+	if timing == nil {
+		return
+	}
+	if latency, _ := timing.Total(); latency < s.config.SlowLogThreshold {
+		return
+	}
+	if excerpt := promptExcerpt(body, s.config.SlowLogExcerpt); excerpt != "" {
+		c.Set(ctxSlowExcerpt, excerpt)
+	}
+}
+
+// promptExcerpt is the start of the latest text a request sends, such as
+// its last message, with credentials, email addresses and long numbers
+// taken out
+func promptExcerpt(body []byte, length int) string {
+	texts := openai.ExtractText(body)
+	if len(texts) == 0 || length <= 0 {
+		return ""
+	}
+	excerpt := redactText(strings.Join(strings.Fields(texts[len(texts)-1]), " "))
+	if runes := []rune(excerpt); len(runes) > length {
+		excerpt = string(runes[:length]) + "…"
+	}
+	return excerpt
+}
+
+// redactText takes credentials, email addresses and long numbers out of
+// text
+func redactText(text string) string {
+	for _, redaction := range textRedactions {
+		text = redaction.pattern.ReplaceAllString(text, redaction.replacement)
+	}
+	return text
+}
+
+func (s *Server) getSlowRequests(c *gin.Context) {
+	if s.slowRequests == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "The slow log is not enabled",
+			"code":  "SLOW_LOG_DISABLED",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"threshold": s.config.SlowLogThreshold.String(),
+		"requests":  s.slowRequests.list(),
+	})
+}
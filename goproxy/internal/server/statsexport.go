@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/clock"
+	"goproxyai/internal/metrics"
+)
+
+// Pushgateway job the proxy's metrics are pushed under
+const pushgatewayJob = "goproxyai"
+
+// statsSnapshot is one line of a STATS_EXPORT file
+type statsSnapshot struct {
+	Timestamp time.Time              `json:"timestamp"`
+	Proxy     string                 `json:"proxy,omitempty"`
+	Stats     gin.H                  `json:"stats"`
+	Traffic   map[string]interface{} `json:"traffic"`
+}
+
+// statsExport returns what exports a snapshot to the STATS_EXPORT location:
+// a file:// path each snapshot is appended to as a JSON line, or the
+// http:// or https:// address of a Prometheus Pushgateway
+func (s *Server) statsExport(location string) (func() error, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file":
+		if u.Path == "" {
+			return nil, fmt.Errorf("%s names no file", location)
+		}
+		if err := os.MkdirAll(filepath.Dir(u.Path), 0o755); err != nil {
+			return nil, err
+		}
+		return func() error { return s.appendStats(u.Path) }, nil
+	case "http", "https":
+		if u.Host == "" {
+			return nil, fmt.Errorf("%s names no host", location)
+		}
+		// PROXY_ID, the host name unless it's set, tells instances apart
+		target := strings.TrimSuffix(u.String(), "/") + "/metrics/job/" + pushgatewayJob + "/instance/" + url.PathEscape(s.config.ProxyID)
+		client := &http.Client{Timeout: 10 * time.Second}
+		return func() error { return s.pushStats(client, target) }, nil
+	default:
+		return nil, fmt.Errorf("unsupported stats export %q, expected file://, http:// or https://", location)
+	}
+}
+
+// watchStatsExport exports a snapshot every interval
+func (s *Server) watchStatsExport(export func() error, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := export(); err != nil {
+				s.logger.Printf("Error exporting stats to STATS_EXPORT: %v", err)
+			}
+		}
+	}()
+}
+
+// appendStats appends a snapshot to file, opening it each time so it can
+// be rotated underneath the proxy
+func (s *Server) appendStats(file string) error {
+	line, err := json.Marshal(statsSnapshot{
+		Timestamp: clock.Now().UTC(),
+		Proxy:     s.config.ProxyID,
+		Stats:     s.stats(),
+		Traffic:   s.metrics.Stats(),
+	})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// pushStats replaces the proxy's metrics on a Pushgateway with what
+// /metrics serves now
+func (s *Server) pushStats(client *http.Client, target string) error {
+	var body bytes.Buffer
+	s.writeMetrics(&body)
+	req, err := http.NewRequest(http.MethodPut, target, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", metrics.PrometheusContentType)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("pushgateway returned %d", resp.StatusCode)
+	}
+	return nil
+}
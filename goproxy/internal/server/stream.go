@@ -0,0 +1,399 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/openai"
+	"goproxyai/internal/proxy"
+	"goproxyai/internal/usage"
+)
+
+// streamHandler relays server-sent events for "stream": true requests as
+// they arrive, flushing after each event. Events are inspected on the way
+// through for token usage and run lifecycle changes. Streams bypass the
+// cache.
+func (s *Server) streamHandler(c *gin.Context, path string, headers http.Header, upstreamHeaders map[string]string, body []byte, tenantID, keyID string, info openai.RequestInfo) {
+	method := c.Request.Method
+	release, ok := s.acquireStream(c, tenantID, keyID)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// Only the wait for response headers is bounded by the request timeout;
+	// the stream itself runs for as long as upstream keeps it open
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	timer := time.AfterFunc(s.requestTimeout(c), cancel)
+	resp, err := s.proxyClient.Stream(ctx, &proxy.ProxyRequest{
+		Method:  method,
+		Path:    path,
+		Headers: withUpstreamHeaders(headers, upstreamHeaders),
+		Body:    body,
+	})
+	timer.Stop()
+	if err != nil {
+		s.logger.Printf("Error forwarding request: %v", err)
+		c.Error(err)
+		s.forwardFailed(c, err)
+		return
+	}
+	defer resp.Body.Close()
+	resp.Headers = s.checkDeprecation(c, tenantID, keyID, info.Model, resp.Headers)
+
+	// Errors come back as a plain JSON body rather than an event stream
+	if !strings.HasPrefix(http.Header(resp.Headers).Get("Content-Type"), "text/event-stream") {
+		if s.config.ResponseNormalization {
+			resp = s.normalizeError(resp)
+		}
+		captured, written, err := s.relay(c, resp, "BYPASS", s.cache.EntryLimit(path))
+		if err != nil {
+			s.logger.Printf("Error reading response for %s %s: %v", method, path, err)
+			c.Error(err)
+			return
+		}
+		if respBody, ok := captured.complete(); ok {
+			s.recordResponse(c, tenantID, keyID, info, respBody)
+			s.checkDeprecatedError(c, tenantID, keyID, info.Model, resp.StatusCode, respBody)
+		}
+		s.logger.Printf("%s %s -> %d (%d bytes)", method, path, resp.StatusCode, written)
+		return
+	}
+
+	s.copyHeaders(c, resp.Headers)
+	c.Header("X-Cache", "BYPASS")
+	c.Header("X-Proxy", "goproxyai")
+	s.provenanceHeaders(c)
+	count := s.countStream(c, path)
+	c.Status(resp.StatusCode)
+	if count != nil {
+		defer s.finishStreamCount(c, count, tenantID, keyID, info, body)
+	}
+
+	done := s.streams.Start("events", tenantID, method+" "+path, c.ClientIP())
+	defer done()
+
+	source := newEventSource(ctx, cancel, resp)
+	defer func() { source.close() }()
+	recovery := s.newStreamRecovery(c, path, body)
+
+	// Heartbeats keep intermediaries from dropping the client connection
+	// while upstream is quiet, e.g. during a long reasoning pause
+	var heartbeats <-chan time.Time
+	var heartbeatTimer *time.Timer
+	if s.config.SSEHeartbeatInterval > 0 {
+		heartbeatTimer = time.NewTimer(s.config.SSEHeartbeatInterval)
+		defer heartbeatTimer.Stop()
+		heartbeats = heartbeatTimer.C
+	}
+	// The idle timeout bounds the gap between upstream chunks rather than
+	// the stream as a whole
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	if s.config.SSEIdleTimeout > 0 {
+		idleTimer = time.NewTimer(s.config.SSEIdleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	events := 0
+	midEvent := false
+	normalize := s.config.ResponseNormalization && normalizedPaths[path]
+	legacy := c.GetBool(ctxLegacyFunctions)
+	turn, _ := c.Value(ctxSession).(*sessionTurn)
+	hooked := s.hookStream(path, info.Model, tenantID)
+
+	// resume carries on from a continuation when upstream drops a stream
+	// that STREAM_RECOVERY can pick up, reporting whether it did
+	resume := func(reason error) bool {
+		if !recovery.canResume(s.config.StreamRecoveryMaxAttempts) {
+			return false
+		}
+		next := s.resumeStream(c, path, headers, upstreamHeaders, body, info, recovery)
+		if next == nil {
+			return false
+		}
+		s.logger.Printf("Resuming %s %s after %d events, attempt %d: %v", method, path, events, recovery.attempts, reason)
+		source.close()
+		source = next
+		if midEvent {
+			// Only whole lines are relayed while a stream can be resumed,
+			// so ending the event leaves it well-formed
+			if hooked != nil {
+				c.Writer.Write(hooked.line([]byte("\n")))
+			} else {
+				c.Writer.WriteString("\n")
+			}
+			midEvent = false
+			events++
+		}
+		c.Writer.Flush()
+		return true
+	}
+
+	for {
+		select {
+		case <-heartbeats:
+			heartbeatTimer.Reset(s.config.SSEHeartbeatInterval) // already drained
+			// Only between events, where a comment can't end one early
+			if midEvent {
+				continue
+			}
+			heartbeat := []byte(": heartbeat\n\n")
+			if keepalive := hooked.keepalive(); keepalive != nil {
+				heartbeat = keepalive
+			}
+			if _, err := c.Writer.Write(heartbeat); err != nil {
+				s.logger.Printf("Client went away during %s %s after %d events", method, path, events)
+				return
+			}
+			c.Writer.Flush()
+			continue
+
+		case <-idle:
+			err := fmt.Errorf("no data from upstream for %v", s.config.SSEIdleTimeout)
+			if resume(err) {
+				idleTimer.Reset(s.config.SSEIdleTimeout) // already drained
+				continue
+			}
+			s.logger.Printf("Error streaming %s %s after %d events: %v", method, path, events, err)
+			c.Error(err)
+			if hooked != nil {
+				// The hooks hold the unfinished event, so the client hasn't
+				// seen any of it
+				hooked.event, midEvent = nil, false
+			}
+			if !midEvent {
+				c.Writer.Write(streamErrorEvent(err.Error(), "upstream_idle_timeout"))
+			}
+			c.Writer.Flush()
+			s.logger.Printf("%s %s -> %d (%d events, streamed)", method, path, resp.StatusCode, events)
+			return
+
+		case next := <-source.lines:
+			if idleTimer != nil {
+				resetTimer(idleTimer, s.config.SSEIdleTimeout)
+			}
+			line, err := next.data, next.err
+			if err != nil && !bytes.HasSuffix(line, []byte("\n")) && recovery.canResume(s.config.StreamRecoveryMaxAttempts) {
+				// A line cut off partway can't be finished by a continuation
+				line = nil
+			}
+			if recovery != nil && recovery.attempts > 0 {
+				line = recovery.stitch(line)
+			}
+			if normalize {
+				line = normalizeEvent(line)
+			}
+			if legacy {
+				line = legacyEvent(line)
+			}
+			if len(line) > 0 {
+				// Usage, recovery and sessions follow the stream as upstream
+				// sent it, whatever the hooks relay in its place
+				relayed := line
+				if hooked != nil {
+					relayed = hooked.line(line)
+				}
+				if _, writeErr := c.Writer.Write(relayed); writeErr != nil {
+					s.logger.Printf("Client went away during %s %s after %d events", method, path, events)
+					return
+				}
+				if heartbeatTimer != nil && len(relayed) > 0 {
+					resetTimer(heartbeatTimer, s.config.SSEHeartbeatInterval)
+				}
+
+				trimmed := bytes.TrimSpace(line)
+				if data, found := bytes.CutPrefix(trimmed, []byte("data:")); found {
+					if data = bytes.TrimSpace(data); !bytes.Equal(data, []byte("[DONE]")) {
+						s.recordResponse(c, tenantID, keyID, info, data)
+					}
+					if recovery != nil {
+						recovery.observe(data)
+					}
+					if count != nil {
+						count.observe(data)
+					}
+					if turn != nil {
+						turn.observe(data)
+					}
+				}
+				midEvent = len(trimmed) > 0
+				if !midEvent {
+					c.Writer.Flush()
+					events++
+				}
+			}
+			if err == nil {
+				continue
+			}
+			reason := err
+			if err == io.EOF {
+				reason = io.ErrUnexpectedEOF
+			}
+			if resume(reason) {
+				continue
+			}
+			if err != io.EOF {
+				s.logger.Printf("Error streaming %s %s after %d events: %v", method, path, events, err)
+				c.Error(err)
+			}
+			if hooked != nil {
+				c.Writer.Write(hooked.flush())
+			}
+			c.Writer.Flush()
+		}
+		break
+	}
+
+	if turn != nil {
+		s.streamed(turn)
+	}
+	s.logger.Printf("%s %s -> %d (%d events, streamed)", method, path, resp.StatusCode, events)
+}
+
+// recordResponse records token usage from a response body or stream event,
+// in the usage tracker and for the request it answers, and follows
+// Assistants API runs and Responses API responses through their lifecycle
+func (s *Server) recordResponse(c *gin.Context, tenantID, keyID string, info openai.RequestInfo, body []byte) {
+	obj := openai.ParseObject(body)
+	switch obj.Object {
+	case "thread.run", "response":
+		// Runs and responses carry their usage every time they're polled
+		// once finished, so it's only counted the first time the proxy sees
+		// them finished
+		if !s.runs.Observe(tenantID, obj.ID, obj.Status) {
+			return
+		}
+		if info.Model == "" {
+			info.Model = obj.Model
+		}
+	case "thread.run.step":
+		// Step usage is already included in the run's
+		return
+	}
+
+	if tokens, ok := openai.ParseUsage(body); ok {
+		s.recordUsage(c, tenantID, keyID, info, tokens)
+	}
+}
+
+// recordUsage records the tokens a request was billed, in the usage
+// tracker, the token histograms and for the request itself
+func (s *Server) recordUsage(c *gin.Context, tenantID, keyID string, info openai.RequestInfo, tokens *openai.Usage) {
+	histograms := s.metrics.Histograms()
+	histograms.PromptTokens.Observe(info.Model, float64(tokens.PromptTokens))
+	histograms.CompletionTokens.Observe(info.Model, float64(tokens.CompletionTokens))
+	s.usage.Record(usage.Record{
+		Tenant:           tenantID,
+		Key:              keyID,
+		User:             info.User,
+		Model:            info.Model,
+		PromptTokens:     tokens.PromptTokens,
+		CompletionTokens: tokens.CompletionTokens,
+		TotalTokens:      tokens.TotalTokens,
+	})
+	addRequestUsage(c, tenantID, keyID, info, tokens)
+}
+
+// Set to the usage upstream answered a request with so far, for the
+// journal and the slow log
+const ctxRequestUsage = "request_usage"
+
+// requestUsage is who a request was billed to and for which tokens. A
+// request retried upstream is billed for every answer.
+type requestUsage struct {
+	tenant, key, user, model                    string
+	promptTokens, completionTokens, totalTokens int64
+}
+
+func addRequestUsage(c *gin.Context, tenantID, keyID string, info openai.RequestInfo, tokens *openai.Usage) {
+	u, _ := c.Value(ctxRequestUsage).(*requestUsage)
+	if u == nil {
+		u = &requestUsage{}
+		c.Set(ctxRequestUsage, u)
+	}
+	u.tenant, u.key, u.user, u.model = tenantID, keyID, info.User, info.Model
+	u.promptTokens += int64(tokens.PromptTokens)
+	u.completionTokens += int64(tokens.CompletionTokens)
+	u.totalTokens += int64(tokens.TotalTokens)
+}
+
+// usageOf returns a request's usage once it's answered, with who made it
+// and for which model taken from the request itself when upstream billed
+// it nothing
+func usageOf(c *gin.Context) requestUsage {
+	var u requestUsage
+	if recorded, _ := c.Value(ctxRequestUsage).(*requestUsage); recorded != nil {
+		u = *recorded
+	}
+	if u.tenant == "" {
+		u.tenant = c.GetString(ctxTenantID)
+	}
+	if u.key == "" {
+		u.key = usage.KeyID(c.GetHeader("Authorization"))
+	}
+	if u.user == "" {
+		u.user = c.GetString(ctxUser)
+	}
+	if u.model == "" {
+		u.model = c.GetString(ctxModel)
+	}
+	return u
+}
+
+type streamLine struct {
+	data []byte
+	err  error
+}
+
+// readStreamLines feeds lines from an upstream event stream into lines until
+// the stream ends or ctx is done, so the relay loop can wait on upstream and
+// its timers at once
+func readStreamLines(ctx context.Context, reader *bufio.Reader, lines chan<- streamLine, done chan<- struct{}) {
+	defer close(done)
+	for {
+		line, err := reader.ReadBytes('\n')
+		select {
+		case lines <- streamLine{data: line, err: err}:
+		case <-ctx.Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// streamErrorEvent builds a data event in the shape OpenAI uses for errors
+// raised mid-stream, which the SDKs surface as API errors
+func streamErrorEvent(message, code string) []byte {
+	encoded, _ := json.Marshal(gin.H{"error": gin.H{
+		"message": message,
+		"type":    "proxy_error",
+		"code":    code,
+	}})
+	return append(append([]byte("data: "), encoded...), '\n', '\n')
+}
+
+// resetTimer restarts a timer that may have fired without being received
+// from, so a stale tick can't be mistaken for a new one
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"bytes"
+
+	"goproxyai/streamhooks"
+)
+
+// hookedStream collects a stream's lines into whole events and runs the
+// STREAM_HOOKS on each before it's relayed
+type hookedStream struct {
+	s      *Server
+	stream *streamhooks.Stream
+	event  []byte // the lines of the event so far
+}
+
+func (s *Server) hookStream(path, model, tenantID string) *hookedStream {
+	if len(s.streamHooks) == 0 {
+		return nil
+	}
+	return &hookedStream{s: s, stream: &streamhooks.Stream{Path: path, Model: model, Tenant: tenantID}}
+}
+
+// line adds a line of the stream, returning what the client gets: nothing
+// until the line ends an event, then the event as the hooks left it
+func (h *hookedStream) line(line []byte) []byte {
+	h.event = append(h.event, line...)
+	if len(bytes.TrimSpace(line)) > 0 {
+		return nil
+	}
+	return h.flush()
+}
+
+// flush runs the hooks on the event collected so far, with or without the
+// blank line that ends it. An event they leave alone is relayed byte for
+// byte as it came; one they change is encoded afresh, and always ended.
+func (h *hookedStream) flush() []byte {
+	raw := h.event
+	h.event = nil
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return raw
+	}
+	event := streamhooks.Parse(raw)
+	events, err := h.s.streamHooks.Event(h.stream, event)
+	if err != nil {
+		h.s.logger.Printf("Stream hooks failed on %s, relaying the event as it came: %v", h.stream.Path, err)
+		return raw
+	}
+	if len(events) == 1 && events[0].Equal(event) {
+		return raw
+	}
+	var out []byte
+	for _, event := range events {
+		out = append(out, event.Bytes()...)
+	}
+	return out
+}
+
+// keepalive returns the events the hooks send in place of a heartbeat, or
+// nil when none of them do
+func (h *hookedStream) keepalive() []byte {
+	if h == nil {
+		return nil
+	}
+	var out []byte
+	for _, event := range h.s.streamHooks.Keepalive(h.stream) {
+		out = append(out, event.Bytes()...)
+	}
+	return out
+}
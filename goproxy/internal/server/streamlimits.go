@@ -0,0 +1,114 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/dryrun"
+)
+
+// streamLimits counts the streaming responses open for each key and
+// tenant, so one client can't hold every upstream connection
+type streamLimits struct {
+	mutex   sync.Mutex
+	keys    map[string]int
+	tenants map[string]int
+}
+
+func newStreamLimits() *streamLimits {
+	return &streamLimits{keys: make(map[string]int), tenants: make(map[string]int)}
+}
+
+// acquire takes one of a key's streams and one of its tenant's, returning
+// the function that gives them back, or which of the two is at its limit
+func (l *streamLimits) acquire(keyID string, keyLimit int, tenantID string, tenantLimit int) (func(), string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if full := l.full(keyID, keyLimit, tenantID, tenantLimit); full != "" {
+		return nil, full
+	}
+	l.keys[keyID]++
+	if tenantID != "" {
+		l.tenants[tenantID]++
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { l.release(keyID, tenantID) })
+	}, ""
+}
+
+// full returns "key" or "tenant" for the first of the two at its limit
+func (l *streamLimits) full(keyID string, keyLimit int, tenantID string, tenantLimit int) string {
+	if keyLimit > 0 && l.keys[keyID] >= keyLimit {
+		return "key"
+	}
+	if tenantID != "" && tenantLimit > 0 && l.tenants[tenantID] >= tenantLimit {
+		return "tenant"
+	}
+	return ""
+}
+
+func (l *streamLimits) release(keyID, tenantID string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.keys[keyID]--; l.keys[keyID] <= 0 {
+		delete(l.keys, keyID)
+	}
+	if tenantID == "" {
+		return
+	}
+	if l.tenants[tenantID]--; l.tenants[tenantID] <= 0 {
+		delete(l.tenants, tenantID)
+	}
+}
+
+// open returns how many streams a key and a tenant have open
+func (l *streamLimits) open(keyID, tenantID string) (int, int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.keys[keyID], l.tenants[tenantID]
+}
+
+// acquireStream takes a stream slot for a request under its key's
+// max_streams, or STREAM_MAX_PER_KEY, and its tenant's max_streams. When
+// either is used up it answers the request itself and returns false. A
+// dry run only reports the slots in use.
+func (s *Server) acquireStream(c *gin.Context, tenantID, keyID string) (func(), bool) {
+	keyLimit := s.config.StreamMaxPerKey
+	if key, _, found := s.tenants.Lookup(c.GetHeader("Authorization")); found && key.MaxStreams > 0 {
+		keyLimit = key.MaxStreams
+	}
+	var tenantLimit int
+	if t, found := s.tenants.Tenant(tenantID); found {
+		tenantLimit = t.MaxStreams
+	}
+	if keyLimit == 0 && tenantLimit == 0 {
+		return func() {}, true
+	}
+
+	if trace := dryrun.From(c.Request.Context()); trace != nil {
+		keyOpen, tenantOpen := s.streamLimits.open(keyID, tenantID)
+		trace.Add("streams", "%d streams open for the key (limit %d), %d for the tenant (limit %d)", keyOpen, keyLimit, tenantOpen, tenantLimit)
+		return func() {}, true
+	}
+
+	release, full := s.streamLimits.acquire(keyID, keyLimit, tenantID, tenantLimit)
+	if full == "" {
+		return release, true
+	}
+	message := fmt.Sprintf("Too many concurrent streams for this API key (limit %d). Close one before opening another.", keyLimit)
+	if full == "tenant" {
+		message = fmt.Sprintf("Too many concurrent streams for this tenant (limit %d). Close one before opening another.", tenantLimit)
+	}
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error": message,
+		"code":  "STREAM_LIMIT_EXCEEDED",
+	})
+	return nil, false
+}
@@ -0,0 +1,230 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/openai"
+	"goproxyai/internal/proxy"
+)
+
+// eventSource reads the lines of one upstream event stream in the
+// background, so the relay loop can wait on upstream and its timers at once
+type eventSource struct {
+	resp   *proxy.StreamResponse
+	reader *bufio.Reader
+	lines  chan streamLine
+	done   chan struct{}
+	cancel context.CancelFunc
+}
+
+func newEventSource(ctx context.Context, cancel context.CancelFunc, resp *proxy.StreamResponse) *eventSource {
+	source := &eventSource{
+		resp:   resp,
+		reader: eventReaders.Get().(*bufio.Reader),
+		lines:  make(chan streamLine),
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+	source.reader.Reset(resp.Body)
+	go readStreamLines(ctx, source.reader, source.lines, source.done)
+	return source
+}
+
+// close stops the reader before handing its buffer back to the pool
+func (e *eventSource) close() {
+	e.cancel()
+	e.resp.Body.Close()
+	<-e.done
+	e.reader.Reset(nil)
+	eventReaders.Put(e.reader)
+}
+
+// streamRecovery follows a chat completion stream closely enough to resume
+// it if upstream drops it: the content so far, the chunk id to carry on
+// with, and whether the stream has anything in it a continuation couldn't
+// reproduce, such as tool calls or several choices
+type streamRecovery struct {
+	content     strings.Builder
+	id          string
+	finished    bool
+	unsupported bool
+	attempts    int
+}
+
+// newStreamRecovery returns nil unless STREAM_RECOVERY is on and the
+// request is a single-choice chat completion that didn't ask for no retries
+func (s *Server) newStreamRecovery(c *gin.Context, path string, body []byte) *streamRecovery {
+	if !s.config.StreamRecovery || path != "/v1/chat/completions" || c.GetBool(ctxNoRetry) {
+		return nil
+	}
+	var request struct {
+		N        *int            `json:"n"`
+		Messages json.RawMessage `json:"messages"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil || len(request.Messages) == 0 || request.N != nil && *request.N != 1 {
+		return nil
+	}
+	return &streamRecovery{}
+}
+
+// observe follows one data event of the stream
+func (r *streamRecovery) observe(data []byte) {
+	if bytes.Equal(data, []byte("[DONE]")) {
+		r.finished = true
+		return
+	}
+	var chunk struct {
+		ID      string `json:"id"`
+		Choices []struct {
+			Index int `json:"index"`
+			Delta struct {
+				Content      string          `json:"content"`
+				ToolCalls    json.RawMessage `json:"tool_calls"`
+				FunctionCall json.RawMessage `json:"function_call"`
+				Audio        json.RawMessage `json:"audio"`
+			} `json:"delta"`
+			FinishReason *string `json:"finish_reason"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return
+	}
+	if r.id == "" {
+		r.id = chunk.ID
+	}
+	for _, choice := range chunk.Choices {
+		delta := choice.Delta
+		if choice.Index != 0 || isSet(delta.ToolCalls) || isSet(delta.FunctionCall) || isSet(delta.Audio) {
+			r.unsupported = true
+		}
+		r.content.WriteString(delta.Content)
+		if choice.FinishReason != nil {
+			r.finished = true
+		}
+	}
+}
+
+// canResume reports whether the stream is one a continuation can finish
+func (r *streamRecovery) canResume(maxAttempts int) bool {
+	return r != nil && !r.finished && !r.unsupported && r.attempts < maxAttempts
+}
+
+// continuationBody asks for the rest of the answer: the partial answer goes
+// back as the assistant's message, followed by prompt, with the output
+// token limit lowered by what's been generated already. With nothing
+// generated yet the original request is simply sent again.
+func continuationBody(body []byte, model, partial, prompt string) ([]byte, error) {
+	if partial == "" {
+		return body, nil
+	}
+	var request map[string]json.RawMessage
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, err
+	}
+	var messages []json.RawMessage
+	if err := json.Unmarshal(request["messages"], &messages); err != nil {
+		return nil, err
+	}
+	for _, message := range []map[string]string{
+		{"role": "assistant", "content": partial},
+		{"role": "user", "content": prompt},
+	} {
+		encoded, err := json.Marshal(message)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, encoded)
+	}
+	encoded, err := json.Marshal(messages)
+	if err != nil {
+		return nil, err
+	}
+	request["messages"] = encoded
+
+	generated := openai.CountTokens(model, []string{partial})
+	for _, field := range []string{"max_tokens", "max_completion_tokens"} {
+		var limit int
+		if json.Unmarshal(request[field], &limit) != nil || limit == 0 {
+			continue
+		}
+		request[field], _ = json.Marshal(max(limit-generated, 1))
+	}
+	return json.Marshal(request)
+}
+
+// resumeStream asks upstream to continue a chat completion stream it
+// dropped, returning the continuation's events or nil if it can't be had
+func (s *Server) resumeStream(c *gin.Context, path string, headers http.Header, upstreamHeaders map[string]string, body []byte, info openai.RequestInfo, recovery *streamRecovery) *eventSource {
+	recovery.attempts++
+	continuation, err := continuationBody(body, info.Model, recovery.content.String(), s.config.StreamRecoveryPrompt)
+	if err != nil {
+		s.logger.Printf("Can't resume stream for %s: %v", path, err)
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	timer := time.AfterFunc(s.requestTimeout(c), cancel)
+	resp, err := s.proxyClient.Stream(ctx, &proxy.ProxyRequest{
+		Method:  http.MethodPost,
+		Path:    path,
+		Headers: withUpstreamHeaders(headers, upstreamHeaders),
+		Body:    continuation,
+	})
+	timer.Stop()
+	if err != nil {
+		cancel()
+		s.logger.Printf("Resuming stream for %s failed: %v", path, err)
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(http.Header(resp.Headers).Get("Content-Type"), "text/event-stream") {
+		cancel()
+		resp.Body.Close()
+		s.logger.Printf("Resuming stream for %s failed: upstream returned %d", path, resp.StatusCode)
+		return nil
+	}
+	return newEventSource(ctx, cancel, resp)
+}
+
+// stitch rewrites a data event of a continuation to read as part of the
+// stream it continues: the original chunk id, and no second assistant role
+func (r *streamRecovery) stitch(line []byte) []byte {
+	data, found := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:"))
+	if !found || bytes.Equal(bytes.TrimSpace(data), []byte("[DONE]")) {
+		return line
+	}
+	var chunk map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&chunk); err != nil {
+		return line
+	}
+	if r.id != "" {
+		chunk["id"] = r.id
+	}
+	if choices, ok := chunk["choices"].([]interface{}); ok {
+		for _, choice := range choices {
+			if choice, ok := choice.(map[string]interface{}); ok {
+				if delta, ok := choice["delta"].(map[string]interface{}); ok {
+					delete(delta, "role")
+				}
+			}
+		}
+	}
+	encoded, err := json.Marshal(chunk)
+	if err != nil {
+		return line
+	}
+	return append(append([]byte("data: "), encoded...), '\n')
+}
+
+func isSet(raw json.RawMessage) bool {
+	return len(raw) > 0 && string(raw) != "null"
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/openai"
+)
+
+// Endpoints whose streams STREAM_USAGE_COUNTING counts
+var countedStreamPaths = map[string]bool{
+	"/v1/chat/completions": true,
+	"/v1/completions":      true,
+	"/v1/responses":        true,
+}
+
+// streamCount follows a stream's deltas, so it can be billed by the tokens
+// it generated when upstream doesn't report its usage, as other
+// OpenAI-compatible backends and streams without
+// stream_options.include_usage don't
+type streamCount struct {
+	generated strings.Builder
+	upstream  *openai.Usage // the usage upstream reported, if it did
+}
+
+// countStream starts counting a stream with STREAM_USAGE_COUNTING, before
+// its headers are written so the usage trailer can be announced
+func (s *Server) countStream(c *gin.Context, path string) *streamCount {
+	if !s.config.StreamUsageCounting || !countedStreamPaths[path] {
+		return nil
+	}
+	if report := s.config.StreamUsageReport; report == "trailer" || report == "both" {
+		c.Header("Trailer", "X-Proxy-Usage")
+	}
+	return &streamCount{}
+}
+
+// observe follows one data event of the stream: the text, refusal and tool
+// call arguments it generates, or the usage upstream reports in it
+func (n *streamCount) observe(data []byte) {
+	if tokens, ok := openai.ParseUsage(data); ok {
+		n.upstream = tokens
+		return
+	}
+	var chunk struct {
+		Choices []struct {
+			Text  string `json:"text"`
+			Delta struct {
+				Content   string `json:"content"`
+				Refusal   string `json:"refusal"`
+				ToolCalls []struct {
+					Function struct {
+						Arguments string `json:"arguments"`
+					} `json:"function"`
+				} `json:"tool_calls"`
+			} `json:"delta"`
+		} `json:"choices"`
+		// Responses API events carry their text deltas as a string
+		Type  string          `json:"type"`
+		Delta json.RawMessage `json:"delta"`
+	}
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return
+	}
+	for _, choice := range chunk.Choices {
+		n.generated.WriteString(choice.Text)
+		n.generated.WriteString(choice.Delta.Content)
+		n.generated.WriteString(choice.Delta.Refusal)
+		for _, call := range choice.Delta.ToolCalls {
+			n.generated.WriteString(call.Function.Arguments)
+		}
+	}
+	var delta string
+	if strings.HasSuffix(chunk.Type, ".delta") && json.Unmarshal(chunk.Delta, &delta) == nil {
+		n.generated.WriteString(delta)
+	}
+}
+
+// finishStreamCount bills a stream upstream reported no usage for by the
+// tokens of its request and of what it generated, and reports the
+// stream's usage to the client: in a closing comment, which clients
+// ignore, and the X-Proxy-Usage trailer, as STREAM_USAGE_REPORT says
+func (s *Server) finishStreamCount(c *gin.Context, n *streamCount, tenantID, keyID string, info openai.RequestInfo, body []byte) {
+	tokens, counted := n.upstream, "upstream"
+	if tokens == nil {
+		prompt := openai.CountPromptTokens(body)
+		completion := openai.CountTokens(info.Model, []string{n.generated.String()})
+		tokens = &openai.Usage{PromptTokens: prompt, CompletionTokens: completion, TotalTokens: prompt + completion}
+		counted = "proxy"
+		s.recordUsage(c, tenantID, keyID, info, tokens)
+	}
+
+	report := s.config.StreamUsageReport
+	if report == "comment" || report == "both" {
+		encoded, _ := json.Marshal(struct {
+			PromptTokens     int    `json:"prompt_tokens"`
+			CompletionTokens int    `json:"completion_tokens"`
+			TotalTokens      int    `json:"total_tokens"`
+			CountedBy        string `json:"counted_by"`
+		}{tokens.PromptTokens, tokens.CompletionTokens, tokens.TotalTokens, counted})
+		c.Writer.WriteString(": usage " + string(encoded) + "\n\n")
+		c.Writer.Flush()
+	}
+	if report == "trailer" || report == "both" {
+		c.Writer.Header().Set("X-Proxy-Usage", fmt.Sprintf("prompt_tokens=%d, completion_tokens=%d, total_tokens=%d, counted_by=%s",
+			tokens.PromptTokens, tokens.CompletionTokens, tokens.TotalTokens, counted))
+	}
+}
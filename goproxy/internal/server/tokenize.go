@@ -0,0 +1,74 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/openai"
+)
+
+type tokenizeRequest struct {
+	Model    string          `json:"model"`
+	Input    json.RawMessage `json:"input"`
+	Messages json.RawMessage `json:"messages"`
+}
+
+// tokenize counts tokens with the same tokenizer the proxy enforces context
+// limits with, so clients can size prompts without a round trip upstream.
+// input may be a string or an array of strings, counted one by one;
+// messages is a chat messages array, counted with the chat format's
+// per-message overhead.
+func (s *Server) tokenize(c *gin.Context) {
+	var req tokenizeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(c.Writer, c.Request.Body, s.config.MaxUploadSize*1024*1024)).Decode(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if req.Model == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	}
+	if len(req.Input) == 0 && len(req.Messages) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "input or messages is required"})
+		return
+	}
+
+	response := gin.H{
+		"object":   "tokenize",
+		"model":    req.Model,
+		"encoding": openai.EncodingName(req.Model),
+	}
+
+	var tokens int
+	if len(req.Input) > 0 {
+		var text string
+		var texts []string
+		if err := json.Unmarshal(req.Input, &text); err == nil {
+			tokens += openai.CountTokens(req.Model, []string{text})
+		} else if err := json.Unmarshal(req.Input, &texts); err == nil {
+			counts := make([]int, len(texts))
+			for i, text := range texts {
+				counts[i] = openai.CountTokens(req.Model, []string{text})
+				tokens += counts[i]
+			}
+			response["counts"] = counts
+		} else {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "input must be a string or an array of strings"})
+			return
+		}
+	}
+	if len(req.Messages) > 0 {
+		var messages []json.RawMessage
+		if err := json.Unmarshal(req.Messages, &messages); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "messages must be an array"})
+			return
+		}
+		body, _ := json.Marshal(map[string]interface{}{"model": req.Model, "messages": req.Messages})
+		tokens += openai.CountPromptTokens(body)
+	}
+
+	response["tokens"] = tokens
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/dryrun"
+	"goproxyai/internal/openai"
+	"goproxyai/internal/schema"
+)
+
+// Function names upstream accepts
+var functionName = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// enforceTools holds the tools a request declares to its key's allowlist,
+// refusing the request or, for keys with strip_tools, dropping the tools
+// it doesn't allow. With TOOL_VALIDATION on, function definitions are
+// checked too, so a broken schema is refused before it reaches a model.
+func (s *Server) enforceTools() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method != http.MethodPost || !isJSONBody(c.GetHeader("Content-Type")) {
+			c.Next()
+			return
+		}
+		body, ok := peekBody(c)
+		if !ok {
+			return
+		}
+		tools := openai.ParseTools(body)
+		if len(tools) == 0 {
+			c.Next()
+			return
+		}
+		trace := dryrun.From(c.Request.Context())
+
+		if s.config.ToolValidation {
+			if param, err := checkTool(tools); err != nil {
+				trace.Add("tools", "body refused: %s: %s", param, err.Message)
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": fmt.Sprintf("Invalid tool definition: %s: %s", param, err.Message),
+					"code":  "INVALID_TOOL",
+					"param": param,
+				})
+				c.Abort()
+				return
+			}
+		}
+
+		key, _, found := s.tenants.Lookup(c.GetHeader("Authorization"))
+		if !found || len(key.Tools) == 0 {
+			c.Next()
+			return
+		}
+		if forced := openai.ForcedTool(body); forced != "" && !key.AllowsTool(forced) {
+			s.refuseTool(c, forced, "tool_choice")
+			return
+		}
+
+		remove := make(map[string]bool)
+		var removed []string
+		for _, tool := range tools {
+			if key.AllowsTool(tool.Name) {
+				continue
+			}
+			if !key.StripTools {
+				s.refuseTool(c, tool.Name, tool.Param)
+				return
+			}
+			remove[tool.Param] = true
+			removed = append(removed, tool.Name)
+		}
+		if len(removed) > 0 {
+			stripped, err := openai.RemoveTools(body, remove)
+			if err != nil {
+				// Upstream says what's wrong with it
+				c.Next()
+				return
+			}
+			c.Request.Body = io.NopCloser(bytes.NewReader(stripped))
+			c.Request.ContentLength = int64(len(stripped))
+			c.Request.Header.Set("Content-Length", strconv.Itoa(len(stripped)))
+			c.Header("X-Tools-Stripped", strings.Join(removed, ", "))
+			trace.Add("tools", "stripped %s, not allowed for key %q", strings.Join(removed, ", "), key.Name)
+			transformed(c, "tools")
+		}
+		c.Next()
+	}
+}
+
+func (s *Server) refuseTool(c *gin.Context, name, param string) {
+	dryrun.From(c.Request.Context()).Add("tools", "refused: %s declares %q", param, name)
+	c.JSON(http.StatusForbidden, gin.H{
+		"error": fmt.Sprintf("Tool %q is not allowed for this key", name),
+		"code":  "TOOL_NOT_ALLOWED",
+		"param": param,
+	})
+	c.Abort()
+}
+
+// checkTool returns where the first broken function definition among tools
+// breaks, and how
+func checkTool(tools []openai.Tool) (string, *schema.Error) {
+	for _, tool := range tools {
+		if tool.Type != "function" && tool.Type != "custom" {
+			continue
+		}
+		if !functionName.MatchString(tool.Name) {
+			return tool.Definition + ".name", &schema.Error{Message: "must be 1 to 64 letters, digits, underscores or dashes"}
+		}
+		if tool.Type == "custom" || !isSet(tool.Parameters) {
+			continue
+		}
+		if err := schema.CheckParameters(tool.Parameters, tool.Strict); err != nil {
+			param := tool.Definition + ".parameters"
+			if err.Param != "" {
+				param += "." + err.Param
+			}
+			return param, err
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tunnelHandler serves CONNECT requests for allowlisted destinations by
+// splicing the client connection to the destination, so clients that must
+// do their own TLS can still route egress through the proxy host. Anything
+// else goes to next.
+func (s *Server) tunnelHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		destination := r.Host
+		if _, _, err := net.SplitHostPort(destination); err != nil {
+			destination = net.JoinHostPort(destination, "443")
+		}
+
+		if !s.tunnelAuthorized(r) {
+			w.Header().Set("Proxy-Authenticate", `Basic realm="goproxyai"`)
+			http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+			return
+		}
+		if s.config.UpstreamMode == "mock" || s.config.UpstreamMode == "replay" {
+			http.Error(w, "Tunneling is disabled in "+s.config.UpstreamMode+" mode", http.StatusServiceUnavailable)
+			return
+		}
+		if !tunnelAllowed(s.config.TunnelAllowlist, destination) {
+			s.logger.Printf("Tunnel to %s from %s denied: not allowlisted", destination, r.RemoteAddr)
+			http.Error(w, "Destination not allowed", http.StatusForbidden)
+			return
+		}
+
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "Tunneling is only supported over HTTP/1.1", http.StatusHTTPVersionNotSupported)
+			return
+		}
+
+		upstream, err := net.DialTimeout("tcp", destination, s.config.RequestTimeout)
+		if err != nil {
+			s.logger.Printf("Tunnel to %s failed: %v", destination, err)
+			http.Error(w, "Failed to reach destination", http.StatusBadGateway)
+			return
+		}
+
+		client, buffered, err := hijacker.Hijack()
+		if err != nil {
+			upstream.Close()
+			s.logger.Printf("Tunnel to %s failed to take over connection: %v", destination, err)
+			return
+		}
+		if _, err := client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+			client.Close()
+			upstream.Close()
+			return
+		}
+
+		s.logger.Printf("Tunnel opened from %s to %s", r.RemoteAddr, destination)
+		done := s.streams.Start("tunnel", "", destination, r.RemoteAddr)
+		start := time.Now()
+		sent, received := splice(client, buffered, upstream)
+		done()
+		s.logger.Printf("Tunnel from %s to %s closed after %v (%d bytes sent, %d received)",
+			r.RemoteAddr, destination, time.Since(start).Round(time.Millisecond), sent, received)
+	})
+}
+
+// tunnelAuthorized checks Proxy-Authorization against TUNNEL_TOKEN, as a
+// bearer token or the password of basic credentials
+func (s *Server) tunnelAuthorized(r *http.Request) bool {
+	authorization := r.Header.Get("Proxy-Authorization")
+	provided := strings.TrimPrefix(authorization, "Bearer ")
+	if encoded, found := strings.CutPrefix(authorization, "Basic "); found {
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return false
+		}
+		_, provided, _ = strings.Cut(string(decoded), ":")
+	}
+	return subtle.ConstantTimeCompare([]byte(provided), []byte(s.config.TunnelToken)) == 1
+}
+
+// tunnelAllowed matches a host:port against allowlist entries of the form
+// host[:port]. A leading "*." matches any subdomain, and a missing port
+// means 443.
+func tunnelAllowed(allowlist []string, destination string) bool {
+	host, port, err := net.SplitHostPort(destination)
+	if err != nil {
+		return false
+	}
+	host = strings.ToLower(host)
+
+	for _, entry := range allowlist {
+		allowedHost, allowedPort, err := net.SplitHostPort(entry)
+		if err != nil {
+			allowedHost, allowedPort = entry, "443"
+		}
+		if allowedPort != port {
+			continue
+		}
+
+		allowedHost = strings.ToLower(allowedHost)
+		if suffix, found := strings.CutPrefix(allowedHost, "*"); found {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if host == allowedHost {
+			return true
+		}
+	}
+	return false
+}
+
+// splice copies in both directions until either side closes, returning the
+// bytes sent to and received from upstream
+func splice(client net.Conn, buffered io.Reader, upstream net.Conn) (int64, int64) {
+	var sent, received int64
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		sent, _ = io.Copy(upstream, buffered)
+		closeWrite(upstream)
+	}()
+	go func() {
+		defer wg.Done()
+		received, _ = io.Copy(client, upstream)
+		closeWrite(client)
+	}()
+
+	wg.Wait()
+	client.Close()
+	upstream.Close()
+	return sent, received
+}
+
+// closeWrite half-closes TCP connections so the other side sees EOF while
+// replies can still flow back
+func closeWrite(conn net.Conn) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+		return
+	}
+	conn.Close()
+}
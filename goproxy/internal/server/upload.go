@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/proxy"
+)
+
+var uploadPaths = []string{
+	"/v1/files",
+	"/v1/audio/transcriptions",
+	"/v1/audio/translations",
+}
+
+func isMultipartUpload(path, contentType string) bool {
+	if !strings.HasPrefix(strings.ToLower(contentType), "multipart/form-data") {
+		return false
+	}
+	if isUploadPartPath(path) {
+		return true
+	}
+	for _, uploadPath := range uploadPaths {
+		if path == uploadPath {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadHandler streams multipart uploads and raw binary bodies straight
+// through to upstream instead of reading them into memory, and relays the
+// response the same way. They bypass the cache entirely.
+func (s *Server) uploadHandler(c *gin.Context, path string) {
+	maxBytes := s.config.MaxUploadSize * 1024 * 1024
+	if c.Request.ContentLength > maxBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error": fmt.Sprintf("Upload exceeds the %d MB limit", s.config.MaxUploadSize),
+			"code":  "UPLOAD_TOO_LARGE",
+		})
+		return
+	}
+
+	headers := outgoingHeaders(c.Request)
+	upstreamHeaders, _ := c.Value(ctxUpstreamHeaders).(map[string]string)
+
+	proxyReq := &proxy.ProxyRequest{
+		Method:        c.Request.Method,
+		Path:          path,
+		Headers:       withUpstreamHeaders(headers, upstreamHeaders),
+		BodyStream:    http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes),
+		ContentLength: c.Request.ContentLength,
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), s.requestTimeout(c))
+	defer cancel()
+	resp, err := s.proxyClient.Stream(ctx, proxyReq)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+				"error": fmt.Sprintf("Upload exceeds the %d MB limit", s.config.MaxUploadSize),
+				"code":  "UPLOAD_TOO_LARGE",
+			})
+			return
+		}
+
+		s.logger.Printf("Error forwarding upload: %v", err)
+		c.Error(err)
+		s.forwardFailed(c, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	_, written, err := s.relay(c, resp, "BYPASS", 0)
+	if err != nil {
+		s.logger.Printf("Error relaying %s %s (upload) after %d bytes: %v", c.Request.Method, path, written, err)
+		c.Error(err)
+		return
+	}
+
+	s.logger.Printf("%s %s (upload) -> %d (%d bytes)", c.Request.Method, path, resp.StatusCode, written)
+}
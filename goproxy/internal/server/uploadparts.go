@@ -0,0 +1,283 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/clock"
+	"goproxyai/internal/dryrun"
+	"goproxyai/internal/proxy"
+)
+
+// How long the response to a part upload is remembered for retries of the
+// same part; upstream uploads expire after an hour
+const uploadPartTTL = time.Hour
+
+// Largest part response kept for replay; part objects are tiny
+const maxPartResponseSize = 64 * 1024
+
+// isUploadPartPath matches /v1/uploads/{upload_id}/parts
+func isUploadPartPath(path string) bool {
+	rest, found := strings.CutPrefix(path, "/v1/uploads/")
+	if !found {
+		return false
+	}
+	id, suffix, found := strings.Cut(rest, "/")
+	return found && id != "" && suffix == "parts"
+}
+
+// isUploadFinishPath matches the requests that complete or cancel an
+// upload, after which its parts can't be sent again
+func isUploadFinishPath(method, path string) bool {
+	if method != http.MethodPost || !strings.HasPrefix(path, "/v1/uploads/") {
+		return false
+	}
+	return strings.HasSuffix(path, "/complete") || strings.HasSuffix(path, "/cancel")
+}
+
+// uploadID extracts the upload ID from any /v1/uploads/{upload_id}/... path
+func uploadID(path string) string {
+	rest, _ := strings.CutPrefix(path, "/v1/uploads/")
+	id, _, _ := strings.Cut(rest, "/")
+	return id
+}
+
+// partResponse is an upstream part response remembered for replay
+type partResponse struct {
+	statusCode int
+	headers    http.Header
+	body       []byte
+	created    time.Time
+}
+
+// uploadParts remembers which parts of which uploads have been accepted
+// upstream, keyed by upload ID and a hash of the part's data, so a client
+// that lost the response can send the part again without creating a
+// duplicate
+type uploadParts struct {
+	mutex sync.Mutex
+	parts map[string]map[string]*partResponse
+}
+
+func newUploadParts() *uploadParts {
+	return &uploadParts{parts: make(map[string]map[string]*partResponse)}
+}
+
+func (u *uploadParts) get(upload, hash string) (*partResponse, bool) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	part, found := u.parts[upload][hash]
+	if !found || clock.Since(part.created) > uploadPartTTL {
+		return nil, false
+	}
+	return part, true
+}
+
+func (u *uploadParts) put(upload, hash string, part *partResponse) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	for id, parts := range u.parts {
+		for h, p := range parts {
+			if clock.Since(p.created) > uploadPartTTL {
+				delete(parts, h)
+			}
+		}
+		if len(parts) == 0 {
+			delete(u.parts, id)
+		}
+	}
+
+	if u.parts[upload] == nil {
+		u.parts[upload] = make(map[string]*partResponse)
+	}
+	u.parts[upload][hash] = part
+}
+
+// forget drops an upload's parts once it's completed or cancelled
+func (u *uploadParts) forget(upload string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	delete(u.parts, upload)
+}
+
+// uploadPartHandler spools an Uploads API part to disk before sending it
+// upstream, so a flaky upstream connection is retried from the spooled copy
+// instead of failing the client's upload. A part whose data was already
+// accepted for the same upload gets the original response again.
+func (s *Server) uploadPartHandler(c *gin.Context, path string) {
+	maxBytes := s.config.MaxUploadSize * 1024 * 1024
+	if c.Request.ContentLength > maxBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error": fmt.Sprintf("Upload exceeds the %d MB limit", s.config.MaxUploadSize),
+			"code":  "UPLOAD_TOO_LARGE",
+		})
+		return
+	}
+
+	spool, err := os.CreateTemp(s.config.UploadSpoolDir, "goproxyai-part-*")
+	if err != nil {
+		s.logger.Printf("Error creating upload spool file: %v", err)
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to buffer upload part",
+			"code":  "UPLOAD_SPOOL_FAILED",
+		})
+		return
+	}
+	defer func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}()
+
+	size, err := io.Copy(spool, http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+				"error": fmt.Sprintf("Upload exceeds the %d MB limit", s.config.MaxUploadSize),
+				"code":  "UPLOAD_TOO_LARGE",
+			})
+			return
+		}
+		s.logger.Printf("Error reading upload part for %s: %v", path, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	upload := uploadID(path)
+	hash, err := partDataHash(spool, c.GetHeader("Content-Type"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid multipart body: " + err.Error()})
+		return
+	}
+	if part, found := s.uploadParts.get(upload, hash); found {
+		s.logger.Printf("%s %s (upload part) replayed for a retried part", c.Request.Method, path)
+		s.copyHeaders(c, part.headers)
+		c.Header("X-Upload-Part-Replayed", "true")
+		c.Data(part.statusCode, part.headers.Get("Content-Type"), part.body)
+		return
+	}
+
+	headers := outgoingHeaders(c.Request)
+	upstreamHeaders, _ := c.Value(ctxUpstreamHeaders).(map[string]string)
+	headers = withUpstreamHeaders(headers, upstreamHeaders)
+
+	retries := s.config.UploadPartRetries
+	if c.GetBool(ctxNoRetry) {
+		retries = 0
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), s.requestTimeout(c)*time.Duration(retries+1))
+	defer cancel()
+	resp, attempts, err := s.sendUploadPart(ctx, path, headers, spool, size, retries)
+	if err != nil {
+		s.logger.Printf("Error forwarding upload part for %s after %d attempts: %v", path, attempts, err)
+		c.Error(err)
+		s.forwardFailed(c, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	captured, written, err := s.relay(c, resp, "BYPASS", maxPartResponseSize)
+	if err != nil {
+		s.logger.Printf("Error relaying %s %s (upload part) after %d bytes: %v", c.Request.Method, path, written, err)
+		c.Error(err)
+		return
+	}
+	if body, ok := captured.complete(); ok && resp.StatusCode == http.StatusOK {
+		s.uploadParts.put(upload, hash, &partResponse{
+			statusCode: resp.StatusCode,
+			headers:    http.Header(resp.Headers).Clone(),
+			body:       append([]byte(nil), body...),
+			created:    clock.Now(),
+		})
+	}
+
+	s.logger.Printf("%s %s (upload part) -> %d (%d bytes sent, %d attempts)", c.Request.Method, path, resp.StatusCode, size, attempts)
+}
+
+// sendUploadPart sends the spooled part upstream, starting over from the
+// spool after connection failures, 429s and 5xx responses, up to retries
+// times
+func (s *Server) sendUploadPart(ctx context.Context, path string, headers http.Header, spool *os.File, size int64, retries int) (*proxy.StreamResponse, int, error) {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return nil, attempt, err
+		}
+		resp, err := s.proxyClient.Stream(ctx, &proxy.ProxyRequest{
+			Method:        http.MethodPost,
+			Path:          path,
+			Headers:       headers,
+			BodyStream:    io.NopCloser(spool),
+			ContentLength: size,
+		})
+
+		retryable := err != nil && ctx.Err() == nil && !errors.Is(err, proxy.ErrOverloaded) && !errors.Is(err, dryrun.ErrDryRun)
+		if err == nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500) {
+			retryable = true
+		}
+		if !retryable || attempt > retries {
+			return resp, attempt, err
+		}
+
+		if err != nil {
+			s.logger.Printf("Upload part for %s failed on attempt %d, retrying in %v: %v", path, attempt, backoff, err)
+		} else {
+			s.logger.Printf("Upload part for %s got %d on attempt %d, retrying in %v", path, resp.StatusCode, attempt, backoff)
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		select {
+		case <-ctx.Done():
+			return nil, attempt, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// partDataHash hashes the data field of a spooled part upload. Clients
+// build a new multipart boundary each time they send a body, so the raw
+// body can't identify a retried part.
+func partDataHash(spool *os.File, contentType string) (string, error) {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil || params["boundary"] == "" {
+		return "", errors.New("missing boundary")
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	reader := multipart.NewReader(spool, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return "", errors.New("no data field")
+		}
+		if err != nil {
+			return "", err
+		}
+		if part.FormName() != "data" {
+			continue
+		}
+		digest := sha256.New()
+		if _, err := copyBuffered(digest, part); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(digest.Sum(nil)), nil
+	}
+}
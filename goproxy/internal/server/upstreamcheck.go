@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"goproxyai/internal/dryrun"
+	"goproxyai/internal/proxy"
+)
+
+// upstreamCheck is the startup check of an API key against an upstream it's
+// configured for: whether the key can list the models there
+type upstreamCheck struct {
+	Upstream string   `json:"upstream"`
+	URL      string   `json:"url"`
+	Key      string   `json:"key"`
+	For      []string `json:"for"`
+	OK       bool     `json:"ok"`
+	Status   int      `json:"status,omitempty"`
+	Models   int      `json:"models,omitempty"`
+	Error    string   `json:"error,omitempty"`
+
+	client  *proxy.Client
+	headers http.Header
+}
+
+// upstreamChecks lists a check for each API key and upstream it's used
+// with: OPENAI_API_KEY at OPENAI_API_URL, each tenant's upstream key where
+// its traffic goes, the keys of TENANTS_FILE sent upstream as they are, and
+// SHADOW_API_KEY at SHADOW_URL. Keys used the same way twice are checked
+// once.
+func (s *Server) upstreamChecks() []*upstreamCheck {
+	var checks []*upstreamCheck
+	seen := make(map[string]*upstreamCheck)
+	add := func(client *proxy.Client, upstream, url, key, org, project, usedBy string) {
+		if key == "" {
+			// Clients' own keys are sent upstream, nothing to check
+			return
+		}
+		id := strings.Join([]string{url, key, org, project}, "\x00")
+		if check, found := seen[id]; found {
+			check.For = append(check.For, usedBy)
+			return
+		}
+		headers := http.Header{"Authorization": {"Bearer " + key}}
+		if org != "" {
+			headers.Set("Openai-Organization", org)
+		}
+		if project != "" {
+			headers.Set("Openai-Project", project)
+		}
+		check := &upstreamCheck{Upstream: upstream, URL: url, Key: dryrun.Mask(key), For: []string{usedBy}, client: client, headers: headers}
+		seen[id] = check
+		checks = append(checks, check)
+	}
+	target := func(name string) (string, string) {
+		if name == "" {
+			return "default", s.config.OpenAIAPIURL
+		}
+		return name, s.upstreamTargets[name]
+	}
+
+	add(s.proxyClient, "default", s.config.OpenAIAPIURL, s.config.UpstreamAPIKey, "", "", "OPENAI_API_KEY")
+	for _, t := range s.tenants.Tenants() {
+		key := t.UpstreamAPIKey
+		if key == "" {
+			key = s.config.UpstreamAPIKey
+		}
+		name, url := target(t.Upstream)
+		add(s.proxyClient, name, url, key, t.Organization, t.Project, "tenant "+t.ID)
+	}
+	for _, k := range s.tenants.Keys() {
+		t, found := s.tenants.Tenant(k.Tenant)
+		if !found {
+			continue
+		}
+		upstream := t.Upstream
+		if upstream == "" {
+			upstream = k.Upstream
+		}
+		name, url := target(upstream)
+		switch {
+		case !k.Virtual:
+			// The key is sent upstream as it is
+			add(s.proxyClient, name, url, k.Key, t.Organization, t.Project, "key "+k.Masked())
+		case upstream != t.Upstream:
+			key := t.UpstreamAPIKey
+			if key == "" {
+				key = s.config.UpstreamAPIKey
+			}
+			add(s.proxyClient, name, url, key, t.Organization, t.Project, "key "+k.Masked())
+		}
+	}
+	if s.shadowClient != nil && s.config.ShadowURL != "" {
+		add(s.shadowClient, "shadow", s.config.ShadowURL, s.config.ShadowAPIKey, "", "", "SHADOW_API_KEY")
+	}
+	return checks
+}
+
+// verifyUpstreams runs the startup checks at once, logging how each went
+func (s *Server) verifyUpstreams() {
+	checks := s.upstreamChecks()
+	var wg sync.WaitGroup
+	for _, check := range checks {
+		wg.Add(1)
+		go func(check *upstreamCheck) {
+			defer wg.Done()
+			s.runUpstreamCheck(check)
+		}(check)
+	}
+	wg.Wait()
+
+	for _, check := range checks {
+		if check.OK {
+			s.logger.Printf("Upstream %s (%s) accepts key %s for %s: %d models", check.Upstream, check.URL, check.Key, strings.Join(check.For, ", "), check.Models)
+		} else {
+			s.logger.Printf("Upstream %s (%s) refused key %s for %s: %s", check.Upstream, check.URL, check.Key, strings.Join(check.For, ", "), check.Error)
+		}
+	}
+	s.upstreamChecked = checks
+}
+
+func (s *Server) runUpstreamCheck(check *upstreamCheck) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.VerifyUpstreamTimeout)
+	defer cancel()
+	if check.client == s.proxyClient {
+		ctx = proxy.WithUpstream(ctx, check.URL)
+	}
+	resp, err := check.client.Forward(ctx, &proxy.ProxyRequest{
+		Method:  http.MethodGet,
+		Path:    "/v1/models",
+		Headers: check.headers,
+	})
+	if err != nil {
+		check.Error = err.Error()
+		return
+	}
+	check.Status = resp.StatusCode
+	if resp.StatusCode != http.StatusOK {
+		check.Error = fmt.Sprintf("returned %d", resp.StatusCode)
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			check.Error += ", the key isn't valid there"
+		}
+		return
+	}
+	var models struct {
+		Data []json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(resp.Body, &models); err != nil {
+		check.Error = "returned no model list"
+		return
+	}
+	check.OK, check.Models = true, len(models.Data)
+}
+
+// failedUpstreamChecks are the keys that failed their startup check
+func (s *Server) failedUpstreamChecks() []*upstreamCheck {
+	var failed []*upstreamCheck
+	for _, check := range s.upstreamChecked {
+		if !check.OK {
+			failed = append(failed, check)
+		}
+	}
+	return failed
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"mime"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/dryrun"
+)
+
+// validateRequest refuses JSON request bodies that break the schema of
+// their endpoint, naming the offending field, so they never cost an
+// upstream round trip. Endpoints without a schema pass through unchecked.
+func (s *Server) validateRequest() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sch := s.schemas[c.Request.URL.Path]
+		if sch == nil || c.Request.Method != http.MethodPost || !isJSONBody(c.GetHeader("Content-Type")) {
+			c.Next()
+			return
+		}
+
+		body, ok := peekBody(c)
+		if !ok {
+			return
+		}
+		if err := sch.Validate(body); err != nil {
+			if t := dryrun.From(c.Request.Context()); t != nil {
+				t.Add("validation", "body refused: %s", err)
+			}
+			var param interface{}
+			if err.Param != "" {
+				param = err.Param
+			}
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid request body: " + err.Error(),
+				"code":  "INVALID_REQUEST_BODY",
+				"param": param,
+			})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// isJSONBody reports whether a body of this Content-Type is JSON, which
+// clients that leave the header out mean too
+func isJSONBody(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "application/json"
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+const vectorStoresPath = "/v1/vector_stores"
+
+// vectorStoreObject is the part of a vector store, or of a deleted one,
+// storage accounting reads
+type vectorStoreObject struct {
+	ID         string `json:"id"`
+	Object     string `json:"object"`
+	UsageBytes int64  `json:"usage_bytes"`
+	Deleted    bool   `json:"deleted"`
+}
+
+// trackVectorStores counts the storage of the vector stores in an upstream
+// response to /v1/vector_stores towards the tenant, and stops counting
+// deleted ones. Only the stores themselves report their total, so storage
+// is as of the last time a store was created, fetched or listed.
+func (s *Server) trackVectorStores(method, tenantID string, body []byte) {
+	var page struct {
+		Object string              `json:"object"`
+		Data   []vectorStoreObject `json:"data"`
+	}
+	if json.Unmarshal(body, &page) != nil {
+		return
+	}
+	stores := page.Data
+	if page.Object != "list" {
+		var store vectorStoreObject
+		if json.Unmarshal(body, &store) != nil {
+			return
+		}
+		stores = []vectorStoreObject{store}
+	}
+
+	for _, store := range stores {
+		switch {
+		case store.ID == "":
+		case store.Object == "vector_store.deleted" && store.Deleted && method == http.MethodDelete:
+			s.usage.ForgetVectorStore(store.ID)
+		case store.Object == "vector_store":
+			s.usage.RecordVectorStore(tenantID, store.ID, store.UsageBytes)
+		}
+	}
+}
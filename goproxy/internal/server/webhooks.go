@@ -0,0 +1,53 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"goproxyai/internal/webhooks"
+)
+
+// Webhook events are small JSON documents; anything bigger isn't one
+const maxWebhookSize = 1 << 20
+
+// receiveOpenAIWebhook verifies an inbound OpenAI webhook, logs it and fans
+// it out to the configured internal endpoints, so teams don't each have to
+// verify signatures themselves
+func (s *Server) receiveOpenAIWebhook(c *gin.Context) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxWebhookSize))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	if err := webhooks.Verify(s.config.WebhookSecret, c.Request.Header, body, time.Now()); err != nil {
+		s.logger.Printf("Rejected webhook %s from %s: %v", c.GetHeader("Webhook-Id"), c.ClientIP(), err)
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": err.Error(),
+			"code":  "WEBHOOK_SIGNATURE_INVALID",
+		})
+		return
+	}
+
+	var event struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+		Data struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil || event.Type == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Webhook body is not an event"})
+		return
+	}
+
+	s.fineTuneWebhook(event.Type, event.Data.ID)
+	targets := s.webhooks.Dispatch(event.Type, c.Request.Header, body)
+	s.logger.Printf("Webhook %s: %s for %s, forwarded to %d endpoints", event.ID, event.Type, event.Data.ID, targets)
+
+	c.JSON(http.StatusOK, gin.H{"received": true})
+}
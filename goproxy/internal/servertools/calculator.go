@@ -0,0 +1,242 @@
+package servertools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Longest expression the calculator takes, so a model can't keep it busy
+const maxExpressionLength = 1000
+
+// Calculator evaluates arithmetic, which models are unreliable at: + - * /
+// % and ^, parentheses, and the functions and constants in mathFunctions
+// and mathConstants
+type Calculator struct{}
+
+var mathFunctions = map[string]func(float64) float64{
+	"abs": math.Abs, "sqrt": math.Sqrt, "cbrt": math.Cbrt,
+	"floor": math.Floor, "ceil": math.Ceil, "round": math.Round,
+	"exp": math.Exp, "ln": math.Log, "log": math.Log10, "log2": math.Log2,
+	"sin": math.Sin, "cos": math.Cos, "tan": math.Tan,
+	"asin": math.Asin, "acos": math.Acos, "atan": math.Atan,
+}
+
+var mathConstants = map[string]float64{"pi": math.Pi, "e": math.E}
+
+func (Calculator) Name() string { return "calculator" }
+
+func (Calculator) Definition() json.RawMessage {
+	return definition("calculator",
+		"Evaluate an arithmetic expression exactly, e.g. (17.5 * 3) / 4 or sqrt(2) ^ 3. "+
+			"Supports + - * / % ^, parentheses and the functions abs, sqrt, cbrt, floor, ceil, round, "+
+			"exp, ln, log, log2, sin, cos, tan, asin, acos, atan, and the constants pi and e.",
+		json.RawMessage(`{"type":"object","properties":{"expression":{"type":"string"}},"required":["expression"],"additionalProperties":false}`))
+}
+
+func (Calculator) Call(ctx context.Context, arguments json.RawMessage) (string, error) {
+	var args struct {
+		Expression string `json:"expression"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return "", fmt.Errorf("invalid arguments: %w", err)
+	}
+	if len(args.Expression) > maxExpressionLength {
+		return "", fmt.Errorf("expression longer than %d characters", maxExpressionLength)
+	}
+	value, err := Evaluate(args.Expression)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64), nil
+}
+
+// Evaluate works out an arithmetic expression. ^ binds tighter than unary
+// minus and groups to the right, so -2^2 is -4 and 2^3^2 is 512.
+func Evaluate(expression string) (float64, error) {
+	p := &parser{input: expression}
+	value, err := p.sum()
+	if err != nil {
+		return 0, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return 0, fmt.Errorf("unexpected %q at position %d", p.input[p.pos], p.pos+1)
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("result is not a finite number")
+	}
+	return value, nil
+}
+
+type parser struct {
+	input string
+	pos   int
+}
+
+func (p *parser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+// next consumes the next character if it's one of chars
+func (p *parser) next(chars string) (byte, bool) {
+	p.skipSpace()
+	if p.pos < len(p.input) && strings.IndexByte(chars, p.input[p.pos]) >= 0 {
+		p.pos++
+		return p.input[p.pos-1], true
+	}
+	return 0, false
+}
+
+func (p *parser) sum() (float64, error) {
+	value, err := p.product()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op, ok := p.next("+-")
+		if !ok {
+			return value, nil
+		}
+		right, err := p.product()
+		if err != nil {
+			return 0, err
+		}
+		if op == '+' {
+			value += right
+		} else {
+			value -= right
+		}
+	}
+}
+
+func (p *parser) product() (float64, error) {
+	value, err := p.unary()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op, ok := p.next("*/%")
+		if !ok {
+			return value, nil
+		}
+		right, err := p.unary()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case '*':
+			value *= right
+		case '/':
+			if right == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			value /= right
+		default:
+			if right == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			value = math.Mod(value, right)
+		}
+	}
+}
+
+func (p *parser) unary() (float64, error) {
+	if op, ok := p.next("+-"); ok {
+		value, err := p.unary()
+		if op == '-' {
+			value = -value
+		}
+		return value, err
+	}
+	return p.power()
+}
+
+func (p *parser) power() (float64, error) {
+	base, err := p.operand()
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := p.next("^"); !ok {
+		return base, nil
+	}
+	exponent, err := p.unary()
+	if err != nil {
+		return 0, err
+	}
+	return math.Pow(base, exponent), nil
+}
+
+func (p *parser) operand() (float64, error) {
+	if _, ok := p.next("("); ok {
+		value, err := p.sum()
+		if err != nil {
+			return 0, err
+		}
+		if _, ok := p.next(")"); !ok {
+			return 0, fmt.Errorf("missing ) at position %d", p.pos+1)
+		}
+		return value, nil
+	}
+
+	p.skipSpace()
+	start := p.pos
+	if p.pos < len(p.input) && unicode.IsLetter(rune(p.input[p.pos])) {
+		for p.pos < len(p.input) && (unicode.IsLetter(rune(p.input[p.pos])) || unicode.IsDigit(rune(p.input[p.pos]))) {
+			p.pos++
+		}
+		name := strings.ToLower(p.input[start:p.pos])
+		if value, found := mathConstants[name]; found {
+			return value, nil
+		}
+		function, found := mathFunctions[name]
+		if !found {
+			return 0, fmt.Errorf("unknown name %q", name)
+		}
+		if _, ok := p.next("("); !ok {
+			return 0, fmt.Errorf("%s needs an argument in parentheses", name)
+		}
+		argument, err := p.sum()
+		if err != nil {
+			return 0, err
+		}
+		if _, ok := p.next(")"); !ok {
+			return 0, fmt.Errorf("missing ) at position %d", p.pos+1)
+		}
+		return function(argument), nil
+	}
+
+	for p.pos < len(p.input) && (p.input[p.pos] >= '0' && p.input[p.pos] <= '9' || p.input[p.pos] == '.' || p.input[p.pos] == '_') {
+		p.pos++
+	}
+	// Exponents, as in 1.5e3
+	if p.pos > start && p.pos < len(p.input) && (p.input[p.pos] == 'e' || p.input[p.pos] == 'E') {
+		end := p.pos + 1
+		if end < len(p.input) && (p.input[end] == '+' || p.input[end] == '-') {
+			end++
+		}
+		if end < len(p.input) && p.input[end] >= '0' && p.input[end] <= '9' {
+			for end < len(p.input) && p.input[end] >= '0' && p.input[end] <= '9' {
+				end++
+			}
+			p.pos = end
+		}
+	}
+	if p.pos == start {
+		if p.pos >= len(p.input) {
+			return 0, fmt.Errorf("unexpected end of expression")
+		}
+		return 0, fmt.Errorf("unexpected %q at position %d", p.input[p.pos], p.pos+1)
+	}
+	value, err := strconv.ParseFloat(strings.ReplaceAll(p.input[start:p.pos], "_", ""), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", p.input[start:p.pos])
+	}
+	return value, nil
+}
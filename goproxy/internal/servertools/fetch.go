@@ -0,0 +1,157 @@
+package servertools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// How much of a fetched page the model is given unless max_bytes says
+// otherwise
+const defaultFetchBytes = 64 << 10
+
+// FetchConfig enables http_fetch for the URLs starting with one of Allow,
+// compared by scheme, host and path prefix
+type FetchConfig struct {
+	Allow    []string `json:"allow"`
+	MaxBytes int64    `json:"max_bytes,omitempty"`
+}
+
+// Fetch GETs allowlisted URLs for the model. Redirects are only followed
+// within the allowlist.
+type Fetch struct {
+	allow    []*url.URL
+	maxBytes int64
+	client   *http.Client
+}
+
+func NewFetch(config FetchConfig, timeout time.Duration) (*Fetch, error) {
+	if len(config.Allow) == 0 {
+		return nil, errors.New("allow lists no URLs")
+	}
+	f := &Fetch{maxBytes: config.MaxBytes}
+	if f.maxBytes <= 0 {
+		f.maxBytes = defaultFetchBytes
+	}
+	for _, prefix := range config.Allow {
+		u, err := url.Parse(prefix)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid allowed URL %q, expected http:// or https:// with a host", prefix)
+		}
+		f.allow = append(f.allow, u)
+	}
+	f.client = &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			if !f.allowed(req.URL) {
+				return fmt.Errorf("redirect to %s is not allowed", req.URL.Redacted())
+			}
+			return nil
+		},
+	}
+	return f, nil
+}
+
+func (f *Fetch) Name() string { return "http_fetch" }
+
+func (f *Fetch) Definition() json.RawMessage {
+	allowed := make([]string, len(f.allow))
+	for i, u := range f.allow {
+		allowed[i] = u.String()
+	}
+	return definition("http_fetch",
+		"Fetch a web page or API response with GET and return its status and body. "+
+			"Only URLs starting with one of these are allowed: "+strings.Join(allowed, ", "),
+		json.RawMessage(`{"type":"object","properties":{"url":{"type":"string"}},"required":["url"],"additionalProperties":false}`))
+}
+
+func (f *Fetch) Call(ctx context.Context, arguments json.RawMessage) (string, error) {
+	var args struct {
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return "", fmt.Errorf("invalid arguments: %w", err)
+	}
+	u, err := url.Parse(args.URL)
+	if err != nil || !f.allowed(u) {
+		return "", fmt.Errorf("URL %q is not allowed", args.URL)
+	}
+	// Sent as checked, so the server can't resolve the path differently
+	u.Path, u.RawPath = cleanPath(u.Path), ""
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	return readResult(resp, f.maxBytes)
+}
+
+// allowed reports whether u starts with one of the allowed URLs. Paths are
+// cleaned first, so /docs/../admin can't get out of /docs/.
+func (f *Fetch) allowed(u *url.URL) bool {
+	if u.User != nil {
+		return false
+	}
+	path := cleanPath(u.Path)
+	for _, prefix := range f.allow {
+		if u.Scheme == prefix.Scheme && strings.EqualFold(u.Host, prefix.Host) && strings.HasPrefix(path, prefix.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+func cleanPath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	var parts []string
+	for _, part := range strings.Split(path, "/") {
+		switch part {
+		case ".":
+		case "..":
+			if len(parts) > 1 {
+				parts = parts[:len(parts)-1]
+			}
+		default:
+			parts = append(parts, part)
+		}
+	}
+	cleaned := strings.Join(parts, "/")
+	if !strings.HasPrefix(cleaned, "/") {
+		cleaned = "/" + cleaned
+	}
+	return cleaned
+}
+
+// readResult renders a response for the model: its status, then its body
+// up to maxBytes
+func readResult(resp *http.Response, maxBytes int64) (string, error) {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return "", err
+	}
+	truncated := int64(len(body)) > maxBytes
+	if truncated {
+		body = body[:maxBytes]
+	}
+	result := fmt.Sprintf("HTTP %d\n\n%s", resp.StatusCode, body)
+	if truncated {
+		result += fmt.Sprintf("\n\n[truncated after %d bytes]", maxBytes)
+	}
+	return result, nil
+}
@@ -0,0 +1,153 @@
+package servertools
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Placeholders in a lookup's URL, filled in from the arguments
+var placeholder = regexp.MustCompile(`\{([a-zA-Z0-9_]+)\}`)
+
+// LookupConfig describes an internal API the model can query. Arguments
+// named in URL placeholders such as {id} are filled into the path; the
+// rest are sent as the query of a GET or the JSON body of a POST. Header
+// values may refer to environment variables as ${NAME}, keeping secrets
+// out of the file.
+type LookupConfig struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	URL         string            `json:"url"`
+	Method      string            `json:"method,omitempty"` // GET, the default, or POST
+	Headers     map[string]string `json:"headers,omitempty"`
+	// Parameters is the arguments' JSON schema; unset takes each
+	// placeholder as a required string
+	Parameters json.RawMessage `json:"parameters,omitempty"`
+	MaxBytes   int64           `json:"max_bytes,omitempty"`
+}
+
+// Lookup calls an internal API for the model
+type Lookup struct {
+	config       LookupConfig
+	placeholders []string
+	headers      http.Header
+	client       *http.Client
+}
+
+func NewLookup(config LookupConfig, timeout time.Duration) (*Lookup, error) {
+	if config.Name == "" || config.Name == "calculator" || config.Name == "http_fetch" {
+		return nil, errors.New("needs a name other than calculator and http_fetch")
+	}
+	u, err := url.Parse(config.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid url %q, expected http:// or https:// with a host", config.URL)
+	}
+	switch config.Method {
+	case "":
+		config.Method = http.MethodGet
+	case http.MethodGet, http.MethodPost:
+	default:
+		return nil, fmt.Errorf("method %q, expected GET or POST", config.Method)
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = defaultFetchBytes
+	}
+
+	l := &Lookup{config: config, headers: make(http.Header), client: &http.Client{Timeout: timeout}}
+	for _, match := range placeholder.FindAllStringSubmatch(config.URL, -1) {
+		l.placeholders = append(l.placeholders, match[1])
+	}
+	for name, value := range config.Headers {
+		l.headers.Set(name, os.ExpandEnv(value))
+	}
+	if len(config.Parameters) == 0 {
+		properties := make(map[string]interface{}, len(l.placeholders))
+		for _, name := range l.placeholders {
+			properties[name] = map[string]string{"type": "string"}
+		}
+		l.config.Parameters, _ = json.Marshal(map[string]interface{}{
+			"type":       "object",
+			"properties": properties,
+			"required":   append([]string{}, l.placeholders...),
+		})
+	}
+	return l, nil
+}
+
+func (l *Lookup) Name() string { return l.config.Name }
+
+func (l *Lookup) Definition() json.RawMessage {
+	return definition(l.config.Name, l.config.Description, l.config.Parameters)
+}
+
+func (l *Lookup) Call(ctx context.Context, arguments json.RawMessage) (string, error) {
+	var args map[string]interface{}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return "", fmt.Errorf("invalid arguments: %w", err)
+	}
+
+	target := l.config.URL
+	for _, name := range l.placeholders {
+		value, set := args[name]
+		if !set || value == nil {
+			return "", fmt.Errorf("missing argument %q", name)
+		}
+		target = strings.ReplaceAll(target, "{"+name+"}", url.PathEscape(argumentString(value)))
+		delete(args, name)
+	}
+
+	var body []byte
+	if l.config.Method == http.MethodPost {
+		body, _ = json.Marshal(args)
+	} else if len(args) > 0 {
+		u, err := url.Parse(target)
+		if err != nil {
+			return "", err
+		}
+		query := u.Query()
+		names := make([]string, 0, len(args))
+		for name := range args {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			query.Set(name, argumentString(args[name]))
+		}
+		u.RawQuery = query.Encode()
+		target = u.String()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, l.config.Method, target, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header = l.headers.Clone()
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	return readResult(resp, l.config.MaxBytes)
+}
+
+// argumentString renders an argument for a URL: strings as they are,
+// anything else as JSON
+func argumentString(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
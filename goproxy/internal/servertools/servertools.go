@@ -0,0 +1,117 @@
+// Package servertools holds the tools the proxy runs itself when a model
+// calls them, so a simple agent can be run entirely behind the proxy: a
+// calculator, HTTP fetches of allowlisted URLs, and lookups against
+// internal APIs described in SERVER_TOOLS_FILE
+package servertools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// Tool is a tool the proxy can call on a model's behalf
+type Tool interface {
+	Name() string
+	// Definition is the tool as a chat completion request declares it
+	Definition() json.RawMessage
+	// Call runs the tool with the arguments the model gave, returning what
+	// the model is told it answered
+	Call(ctx context.Context, arguments json.RawMessage) (string, error)
+}
+
+type fileFormat struct {
+	Calculator bool           `json:"calculator"`
+	Fetch      *FetchConfig   `json:"fetch"`
+	Lookups    []LookupConfig `json:"lookups"`
+}
+
+// Registry holds the tools SERVER_TOOLS_FILE enables, by name
+type Registry struct {
+	tools map[string]Tool
+}
+
+// Load reads the tools to enable from a JSON file:
+//
+//	{
+//	  "calculator": true,
+//	  "fetch": {"allow": ["https://docs.example.com/"]},
+//	  "lookups": [{"name": "get_order", "url": "http://orders.internal/orders/{id}", ...}]
+//	}
+//
+// An empty path enables none, returning a nil registry.
+func Load(path string, timeout time.Duration) (*Registry, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file fileFormat
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	registry := &Registry{tools: make(map[string]Tool)}
+	add := func(tool Tool) error {
+		if _, exists := registry.tools[tool.Name()]; exists {
+			return fmt.Errorf("parse %s: tool %q defined twice", path, tool.Name())
+		}
+		registry.tools[tool.Name()] = tool
+		return nil
+	}
+	if file.Calculator {
+		_ = add(Calculator{})
+	}
+	if file.Fetch != nil {
+		fetch, err := NewFetch(*file.Fetch, timeout)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: fetch: %w", path, err)
+		}
+		if err := add(fetch); err != nil {
+			return nil, err
+		}
+	}
+	for _, config := range file.Lookups {
+		lookup, err := NewLookup(config, timeout)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: lookup %q: %w", path, config.Name, err)
+		}
+		if err := add(lookup); err != nil {
+			return nil, err
+		}
+	}
+	return registry, nil
+}
+
+func (r *Registry) Get(name string) (Tool, bool) {
+	tool, found := r.tools[name]
+	return tool, found
+}
+
+// Names lists the registered tools in order
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.tools))
+	for name := range r.tools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// definition declares a function tool
+func definition(name, description string, parameters json.RawMessage) json.RawMessage {
+	encoded, _ := json.Marshal(map[string]interface{}{
+		"type": "function",
+		"function": map[string]interface{}{
+			"name":        name,
+			"description": description,
+			"parameters":  parameters,
+		},
+	})
+	return encoded
+}
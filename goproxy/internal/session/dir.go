@@ -0,0 +1,159 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"goproxyai/internal/clock"
+	"goproxyai/internal/encryption"
+)
+
+// Dir keeps sessions as JSON files in a local directory, one per session,
+// expiring the TTL after each was last written. With a sealer the files
+// are encrypted.
+type Dir struct {
+	root   string
+	ttl    time.Duration
+	sealer *encryption.Sealer
+}
+
+// NewDir opens a directory store, creating the directory if need be
+func NewDir(root string, ttl time.Duration, sealer *encryption.Sealer) (*Dir, error) {
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return nil, err
+	}
+	return &Dir{root: root, ttl: ttl, sealer: sealer}, nil
+}
+
+func (d *Dir) Load(ctx context.Context, name string) ([]json.RawMessage, error) {
+	path, err := d.path(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if clock.Since(info.ModTime()) >= d.ttl {
+		os.Remove(path)
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = d.sealer.Open(data); err != nil {
+		return nil, fmt.Errorf("session %s: %w", name, err)
+	}
+	var messages []json.RawMessage
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return nil, fmt.Errorf("parse session %s: %w", name, err)
+	}
+	return messages, nil
+}
+
+// Save writes a session, replacing the file atomically so readers never see
+// part of one
+func (d *Dir) Save(ctx context.Context, name string, messages []json.RawMessage) error {
+	path, err := d.path(name)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(messages)
+	if err != nil {
+		return err
+	}
+	if data, err = d.sealer.Seal(data); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(d.root, ".session-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// The modification time is what the TTL counts from
+	now := clock.Now()
+	if err := os.Chtimes(tmp.Name(), now, now); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (d *Dir) Delete(ctx context.Context, name string) error {
+	path, err := d.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (d *Dir) DeletePrefix(ctx context.Context, prefix string) (int, error) {
+	return d.remove(func(name string, info os.FileInfo) bool {
+		return strings.HasPrefix(name, prefix)
+	})
+}
+
+func (d *Dir) Expire(ctx context.Context) error {
+	_, err := d.remove(func(name string, info os.FileInfo) bool {
+		return clock.Since(info.ModTime()) >= d.ttl
+	})
+	return err
+}
+
+// remove deletes the sessions match selects by name and file
+func (d *Dir) remove(match func(name string, info os.FileInfo) bool) (int, error) {
+	entries, err := os.ReadDir(d.root)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, entry := range entries {
+		name, isSession := strings.CutSuffix(entry.Name(), ".json")
+		if !isSession || entry.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return removed, err
+		}
+		if !match(name, info) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(d.root, entry.Name())); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// path rejects names that would reach outside the store
+func (d *Dir) path(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid session name %q", name)
+	}
+	return filepath.Join(d.root, name+".json"), nil
+}
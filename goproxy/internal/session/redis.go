@@ -0,0 +1,262 @@
+package session
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"goproxyai/internal/encryption"
+	"goproxyai/internal/tlspolicy"
+)
+
+// Keys sessions are kept under in Redis, followed by their name
+const redisKeyPrefix = "goproxy:session:"
+
+// How long a Redis command may take when the context sets no deadline
+const redisTimeout = 5 * time.Second
+
+type RedisOptions struct {
+	Addr     string // host:port
+	Username string // for Redis 6 ACLs, empty for the default user
+	Password string
+	DB       int
+	TLS      bool
+}
+
+// Redis keeps sessions in Redis, with the TTL set on each key so the server
+// expires them itself, and encrypted with a sealer. It speaks just enough
+// of the protocol for that, over one connection at a time, reconnecting
+// after any error.
+type Redis struct {
+	opts   RedisOptions
+	ttl    time.Duration
+	sealer *encryption.Sealer
+
+	mutex  sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func NewRedis(opts RedisOptions, ttl time.Duration, sealer *encryption.Sealer) *Redis {
+	return &Redis{opts: opts, ttl: ttl, sealer: sealer}
+}
+
+func (r *Redis) Load(ctx context.Context, name string) ([]json.RawMessage, error) {
+	reply, err := r.do(ctx, "GET", redisKeyPrefix+name)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	data, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("redis GET returned %T", reply)
+	}
+	if data, err = r.sealer.Open(data); err != nil {
+		return nil, fmt.Errorf("session %s: %w", name, err)
+	}
+	var messages []json.RawMessage
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return nil, fmt.Errorf("parse session %s: %w", name, err)
+	}
+	return messages, nil
+}
+
+func (r *Redis) Save(ctx context.Context, name string, messages []json.RawMessage) error {
+	data, err := json.Marshal(messages)
+	if err != nil {
+		return err
+	}
+	if data, err = r.sealer.Seal(data); err != nil {
+		return err
+	}
+	_, err = r.do(ctx, "SET", redisKeyPrefix+name, string(data), "PX", strconv.FormatInt(r.ttl.Milliseconds(), 10))
+	return err
+}
+
+func (r *Redis) Delete(ctx context.Context, name string) error {
+	_, err := r.do(ctx, "DEL", redisKeyPrefix+name)
+	return err
+}
+
+// DeletePrefix finds the sessions with SCAN, so the server isn't held up
+// the way KEYS would hold it up, and deletes them a page at a time
+func (r *Redis) DeletePrefix(ctx context.Context, prefix string) (int, error) {
+	pattern := redisKeyPrefix + globEscaper.Replace(prefix) + "*"
+	deleted := 0
+	cursor := "0"
+	for {
+		reply, err := r.do(ctx, "SCAN", cursor, "MATCH", pattern, "COUNT", "100")
+		if err != nil {
+			return deleted, err
+		}
+		page, ok := reply.([]interface{})
+		if !ok || len(page) != 2 {
+			return deleted, fmt.Errorf("redis SCAN returned %T", reply)
+		}
+		next, _ := page[0].([]byte)
+		keys, _ := page[1].([]interface{})
+		if len(keys) > 0 {
+			args := []string{"DEL"}
+			for _, key := range keys {
+				if name, ok := key.([]byte); ok {
+					args = append(args, string(name))
+				}
+			}
+			count, err := r.do(ctx, args...)
+			if err != nil {
+				return deleted, err
+			}
+			if n, ok := count.(int64); ok {
+				deleted += int(n)
+			}
+		}
+		if cursor = string(next); cursor == "0" || cursor == "" {
+			return deleted, nil
+		}
+	}
+}
+
+// Expire has nothing to do, the server expiring keys itself
+func (r *Redis) Expire(ctx context.Context) error {
+	return nil
+}
+
+// Characters that mean something in a SCAN MATCH pattern
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// do sends a command and reads its reply: a string, []byte, int64, nil or
+// an []interface{} of those
+func (r *Redis) do(ctx context.Context, args ...string) (interface{}, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.conn == nil {
+		if err := r.connect(ctx); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := r.command(ctx, args...)
+	var serverErr redisError
+	if err != nil && !errors.As(err, &serverErr) {
+		// The connection may be out of step with the replies now
+		r.conn.Close()
+		r.conn = nil
+	}
+	return reply, err
+}
+
+func (r *Redis) connect(ctx context.Context) error {
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var conn net.Conn
+	var err error
+	if r.opts.TLS {
+		host, _, _ := net.SplitHostPort(r.opts.Addr)
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlspolicy.ClientConfig(host)}).DialContext(ctx, "tcp", r.opts.Addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", r.opts.Addr)
+	}
+	if err != nil {
+		return err
+	}
+	r.conn, r.reader = conn, bufio.NewReader(conn)
+
+	var setup [][]string
+	if r.opts.Password != "" {
+		if r.opts.Username != "" {
+			setup = append(setup, []string{"AUTH", r.opts.Username, r.opts.Password})
+		} else {
+			setup = append(setup, []string{"AUTH", r.opts.Password})
+		}
+	}
+	if r.opts.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(r.opts.DB)})
+	}
+	for _, args := range setup {
+		if _, err := r.command(ctx, args...); err != nil {
+			conn.Close()
+			r.conn = nil
+			return fmt.Errorf("redis %s: %w", args[0], err)
+		}
+	}
+	return nil
+}
+
+func (r *Redis) command(ctx context.Context, args ...string) (interface{}, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(redisTimeout)
+	}
+	r.conn.SetDeadline(deadline)
+
+	request := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, arg := range args {
+		request += "$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n"
+	}
+	if _, err := io.WriteString(r.conn, request); err != nil {
+		return nil, err
+	}
+	return readReply(r.reader)
+}
+
+// redisError is an error the server replied with, after which the
+// connection is still good
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func readReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed redis reply %q", line)
+	}
+	kind, value := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return value, nil
+	case '-':
+		return nil, redisError(value)
+	case ':':
+		return strconv.ParseInt(value, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	case '*':
+		count, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			if items[i], err = readReply(reader); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("unexpected redis reply %q", line)
+	}
+}
@@ -0,0 +1,190 @@
+// Package session keeps the conversations of clients that name one with
+// X-Session-ID, so the proxy can send each turn along with the history
+// before it and thin clients don't have to keep it themselves
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"goproxyai/internal/clock"
+	"goproxyai/internal/encryption"
+	"goproxyai/internal/openai"
+)
+
+// Store keeps each session's messages, by name, for the TTL it was opened
+// with since the session was last saved
+type Store interface {
+	// Load returns a session's messages, none when it's unknown or expired
+	Load(ctx context.Context, name string) ([]json.RawMessage, error)
+	Save(ctx context.Context, name string, messages []json.RawMessage) error
+	Delete(ctx context.Context, name string) error
+	// DeletePrefix deletes every session whose name starts with prefix,
+	// returning how many it deleted
+	DeletePrefix(ctx context.Context, prefix string) (int, error)
+	// Expire deletes the sessions past their TTL, which Load already
+	// ignores, so they don't linger in the store
+	Expire(ctx context.Context) error
+}
+
+// Open returns the store a location names: memory, file:///dir for a local
+// directory, or redis://[user:password@]host:port[/db] (rediss:// for TLS).
+// Sessions kept outside the proxy's memory are encrypted with sealer when
+// it's set.
+func Open(location string, ttl time.Duration, sealer *encryption.Sealer) (Store, error) {
+	if location == "memory" {
+		return NewMemory(ttl), nil
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file":
+		if u.Path == "" {
+			return nil, fmt.Errorf("%s names no directory", location)
+		}
+		return NewDir(u.Path, ttl, sealer)
+	case "redis", "rediss":
+		if u.Host == "" {
+			return nil, fmt.Errorf("%s names no host", location)
+		}
+		opts := RedisOptions{Addr: u.Host, TLS: u.Scheme == "rediss"}
+		if u.Port() == "" {
+			opts.Addr += ":6379"
+		}
+		if u.User != nil {
+			if password, set := u.User.Password(); set {
+				opts.Username, opts.Password = u.User.Username(), password
+			} else {
+				// redis://secret@host is the password alone
+				opts.Password = u.User.Username()
+			}
+		}
+		if db := strings.Trim(u.Path, "/"); db != "" {
+			if opts.DB, err = strconv.Atoi(db); err != nil {
+				return nil, fmt.Errorf("%s names an invalid database %q", location, db)
+			}
+		}
+		return NewRedis(opts, ttl, sealer), nil
+	default:
+		return nil, fmt.Errorf("unsupported session store %q, expected memory, file:// or redis://", location)
+	}
+}
+
+// Window keeps the newest messages that fit in maxTokens as model counts
+// them. It starts at a user message, so the history never opens with an
+// answer or a tool result whose call was cut off.
+func Window(model string, messages []json.RawMessage, maxTokens int) []json.RawMessage {
+	start := len(messages)
+	tokens := 0
+	for i := len(messages) - 1; i >= 0; i-- {
+		tokens += messageTokens(model, messages[i])
+		if tokens > maxTokens {
+			break
+		}
+		start = i
+	}
+	for ; start < len(messages); start++ {
+		if Role(messages[start]) == "user" {
+			break
+		}
+	}
+	return messages[start:]
+}
+
+func messageTokens(model string, message json.RawMessage) int {
+	body, err := json.Marshal(map[string]interface{}{"model": model, "messages": []json.RawMessage{message}})
+	if err != nil {
+		return 0
+	}
+	return openai.CountPromptTokens(body)
+}
+
+// Role is a message's role, empty when it has none
+func Role(message json.RawMessage) string {
+	var m struct {
+		Role string `json:"role"`
+	}
+	_ = json.Unmarshal(message, &m)
+	return m.Role
+}
+
+// Memory keeps sessions in the proxy's memory, lost when it restarts
+type Memory struct {
+	mutex    sync.Mutex
+	ttl      time.Duration
+	sessions map[string]memorySession
+}
+
+type memorySession struct {
+	messages []json.RawMessage
+	expires  time.Time
+}
+
+func NewMemory(ttl time.Duration) *Memory {
+	return &Memory{ttl: ttl, sessions: make(map[string]memorySession)}
+}
+
+func (m *Memory) Load(ctx context.Context, name string) ([]json.RawMessage, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	session, found := m.sessions[name]
+	if !found || !clock.Now().Before(session.expires) {
+		return nil, nil
+	}
+	return append([]json.RawMessage(nil), session.messages...), nil
+}
+
+func (m *Memory) Save(ctx context.Context, name string, messages []json.RawMessage) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := clock.Now()
+	m.expire(now)
+	m.sessions[name] = memorySession{
+		messages: append([]json.RawMessage(nil), messages...),
+		expires:  now.Add(m.ttl),
+	}
+	return nil
+}
+
+func (m *Memory) Delete(ctx context.Context, name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.sessions, name)
+	return nil
+}
+
+func (m *Memory) DeletePrefix(ctx context.Context, prefix string) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	deleted := 0
+	for name := range m.sessions {
+		if strings.HasPrefix(name, prefix) {
+			delete(m.sessions, name)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (m *Memory) Expire(ctx context.Context) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.expire(clock.Now())
+	return nil
+}
+
+func (m *Memory) expire(now time.Time) {
+	for name, session := range m.sessions {
+		if !now.Before(session.expires) {
+			delete(m.sessions, name)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package shadow
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// Reports kept in memory once their window has closed
+	maxReports = 24
+
+	// Least similar pairs of answers kept per report for a closer look
+	maxExamples = 3
+
+	// Characters of each answer kept in an example
+	exampleLength = 300
+
+	similarityBuckets = 10
+)
+
+// Comparison is one request answered by both the primary upstream and the
+// shadow. Costs are only meaningful when Priced is set.
+type Comparison struct {
+	Path         string
+	PrimaryModel string
+	ShadowModel  string
+
+	PrimaryStatus int
+	ShadowStatus  int
+	ShadowError   string // set when the shadow request failed outright
+
+	PrimaryText string
+	ShadowText  string
+	Similarity  float64 // from 0 to 1
+
+	PrimaryLatency time.Duration
+	ShadowLatency  time.Duration
+
+	PrimaryCost float64
+	ShadowCost  float64
+	Priced      bool
+}
+
+// Example is a pair of answers that differed the most
+type Example struct {
+	Similarity float64 `json:"similarity"`
+	Primary    string  `json:"primary"`
+	Shadow     string  `json:"shadow"`
+}
+
+// PairReport summarises the comparisons for one endpoint and pair of models
+type PairReport struct {
+	Path         string `json:"path"`
+	PrimaryModel string `json:"primary_model"`
+	ShadowModel  string `json:"shadow_model"`
+
+	Requests         int64 `json:"requests"`
+	ShadowErrors     int64 `json:"shadow_errors"`
+	StatusMismatches int64 `json:"status_mismatches"`
+
+	// Similarity of the answers to requests both sides answered with 200,
+	// with a histogram of tenths from 0-0.1 up to 0.9-1
+	Compared          int64                    `json:"compared"`
+	SimilarityAvg     float64                  `json:"similarity_avg"`
+	SimilarityMin     float64                  `json:"similarity_min"`
+	SimilarityBuckets [similarityBuckets]int64 `json:"similarity_buckets"`
+
+	PrimaryLengthAvg float64 `json:"primary_length_avg"`
+	ShadowLengthAvg  float64 `json:"shadow_length_avg"`
+
+	PrimaryLatencyAvgMS float64 `json:"primary_latency_avg_ms"`
+	ShadowLatencyAvgMS  float64 `json:"shadow_latency_avg_ms"`
+
+	// Costs cover the compared requests both models have a price for
+	Priced         int64   `json:"priced"`
+	PrimaryCostUSD float64 `json:"primary_cost_usd"`
+	ShadowCostUSD  float64 `json:"shadow_cost_usd"`
+
+	LeastSimilar []Example `json:"least_similar,omitempty"`
+}
+
+// Report covers the comparisons made in one window
+type Report struct {
+	Start      time.Time     `json:"start"`
+	End        time.Time     `json:"end"`
+	Similarity string        `json:"similarity"` // how similarity was measured
+	Dropped    int64         `json:"dropped"`    // requests not shadowed because too many were in flight
+	Pairs      []*PairReport `json:"pairs"`
+}
+
+type pairStats struct {
+	report *PairReport
+
+	similarity     float64
+	primaryLength  int64
+	shadowLength   int64
+	primaryLatency time.Duration
+	shadowLatency  time.Duration
+}
+
+// Comparator aggregates comparisons into windowed reports
+type Comparator struct {
+	mutex      sync.Mutex
+	similarity string
+	start      time.Time
+	dropped    int64
+	pairs      map[string]*pairStats
+	reports    []*Report
+}
+
+// NewComparator starts the first window. similarity names how comparisons'
+// similarity is measured, for the reports.
+func NewComparator(similarity string) *Comparator {
+	return &Comparator{
+		similarity: similarity,
+		start:      time.Now().UTC(),
+		pairs:      make(map[string]*pairStats),
+	}
+}
+
+// Record adds a comparison to the current window
+func (c *Comparator) Record(comparison Comparison) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := comparison.Path + " " + comparison.PrimaryModel + " " + comparison.ShadowModel
+	stats, found := c.pairs[key]
+	if !found {
+		stats = &pairStats{report: &PairReport{
+			Path:          comparison.Path,
+			PrimaryModel:  comparison.PrimaryModel,
+			ShadowModel:   comparison.ShadowModel,
+			SimilarityMin: 1,
+		}}
+		c.pairs[key] = stats
+	}
+	report := stats.report
+
+	report.Requests++
+	if comparison.ShadowError != "" {
+		report.ShadowErrors++
+		return
+	}
+	if comparison.PrimaryStatus != comparison.ShadowStatus {
+		report.StatusMismatches++
+	}
+	if comparison.PrimaryStatus != 200 || comparison.ShadowStatus != 200 {
+		return
+	}
+
+	report.Compared++
+	stats.similarity += comparison.Similarity
+	report.SimilarityMin = math.Min(report.SimilarityMin, comparison.Similarity)
+	report.SimilarityBuckets[min(int(comparison.Similarity*similarityBuckets), similarityBuckets-1)]++
+	stats.primaryLength += int64(len(comparison.PrimaryText))
+	stats.shadowLength += int64(len(comparison.ShadowText))
+	stats.primaryLatency += comparison.PrimaryLatency
+	stats.shadowLatency += comparison.ShadowLatency
+	if comparison.Priced {
+		report.Priced++
+		report.PrimaryCostUSD += comparison.PrimaryCost
+		report.ShadowCostUSD += comparison.ShadowCost
+	}
+
+	if len(report.LeastSimilar) < maxExamples || comparison.Similarity < report.LeastSimilar[len(report.LeastSimilar)-1].Similarity {
+		example := Example{
+			Similarity: comparison.Similarity,
+			Primary:    truncate(comparison.PrimaryText),
+			Shadow:     truncate(comparison.ShadowText),
+		}
+		report.LeastSimilar = append(report.LeastSimilar, example)
+		sort.SliceStable(report.LeastSimilar, func(i, j int) bool {
+			return report.LeastSimilar[i].Similarity < report.LeastSimilar[j].Similarity
+		})
+		if len(report.LeastSimilar) > maxExamples {
+			report.LeastSimilar = report.LeastSimilar[:maxExamples]
+		}
+	}
+}
+
+// RecordDropped counts a request that wasn't shadowed
+func (c *Comparator) RecordDropped() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.dropped++
+}
+
+// Current reports on the window still open
+func (c *Comparator) Current() *Report {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.snapshot(time.Now().UTC())
+}
+
+// Reports returns the reports of closed windows, oldest first
+func (c *Comparator) Reports() []*Report {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]*Report{}, c.reports...)
+}
+
+// rotate closes the current window and starts the next
+func (c *Comparator) rotate() *Report {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now().UTC()
+	report := c.snapshot(now)
+	c.reports = append(c.reports, report)
+	if len(c.reports) > maxReports {
+		c.reports = c.reports[len(c.reports)-maxReports:]
+	}
+	c.start = now
+	c.dropped = 0
+	c.pairs = make(map[string]*pairStats)
+	return report
+}
+
+func (c *Comparator) snapshot(end time.Time) *Report {
+	report := &Report{
+		Start:      c.start,
+		End:        end,
+		Similarity: c.similarity,
+		Dropped:    c.dropped,
+		Pairs:      make([]*PairReport, 0, len(c.pairs)),
+	}
+	for _, stats := range c.pairs {
+		pair := *stats.report
+		pair.LeastSimilar = append([]Example(nil), stats.report.LeastSimilar...)
+		if pair.Compared > 0 {
+			count := float64(pair.Compared)
+			pair.SimilarityAvg = stats.similarity / count
+			pair.PrimaryLengthAvg = float64(stats.primaryLength) / count
+			pair.ShadowLengthAvg = float64(stats.shadowLength) / count
+			pair.PrimaryLatencyAvgMS = float64(stats.primaryLatency.Milliseconds()) / count
+			pair.ShadowLatencyAvgMS = float64(stats.shadowLatency.Milliseconds()) / count
+		} else {
+			pair.SimilarityMin = 0
+		}
+		report.Pairs = append(report.Pairs, &pair)
+	}
+	sort.Slice(report.Pairs, func(i, j int) bool {
+		return report.Pairs[i].Requests > report.Pairs[j].Requests
+	})
+	return report
+}
+
+// StartSchedule closes a window every interval, logging a summary of its
+// report and, when dir is set, writing it there as JSON
+func (c *Comparator) StartSchedule(interval time.Duration, dir string, logger *log.Logger) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			report := c.rotate()
+			for _, pair := range report.Pairs {
+				logger.Printf("Shadow report for %s %s -> %s: %d requests, %d compared, similarity %.2f avg %.2f min, latency %.0fms -> %.0fms, cost $%.4f -> $%.4f, %d shadow errors, %d status mismatches",
+					pair.Path, pair.PrimaryModel, pair.ShadowModel, pair.Requests, pair.Compared,
+					pair.SimilarityAvg, pair.SimilarityMin, pair.PrimaryLatencyAvgMS, pair.ShadowLatencyAvgMS,
+					pair.PrimaryCostUSD, pair.ShadowCostUSD, pair.ShadowErrors, pair.StatusMismatches)
+			}
+			if dir == "" || len(report.Pairs) == 0 {
+				continue
+			}
+			if err := writeReport(dir, report); err != nil {
+				logger.Printf("Failed to write shadow report: %v", err)
+			}
+		}
+	}()
+}
+
+func writeReport(dir string, report *Report) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("shadow-%s.json", report.Start.Format("2006-01-02T15-04-05Z"))
+	return os.WriteFile(filepath.Join(dir, name), data, 0o644)
+}
+
+// LexicalSimilarity is the cosine similarity of the word counts of a and b:
+// 1 for the same words in any order, 0 for no words in common. It needs no
+// model, but doesn't recognise paraphrases.
+func LexicalSimilarity(a, b string) float64 {
+	wordsA, wordsB := countWords(a), countWords(b)
+	if len(wordsA) == 0 && len(wordsB) == 0 {
+		return 1
+	}
+
+	var dot, normA, normB float64
+	for word, count := range wordsA {
+		normA += float64(count * count)
+		dot += float64(count * wordsB[word])
+	}
+	for _, count := range wordsB {
+		normB += float64(count * count)
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(normA*normB)
+}
+
+func countWords(text string) map[string]int {
+	counts := make(map[string]int)
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		counts[word]++
+	}
+	return counts
+}
+
+// Cosine is the cosine similarity of two embeddings, clamped to 0 to 1
+func Cosine(a, b []float64) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += a[i] * b[i]
+		normA += a[i] * a[i]
+		normB += b[i] * b[i]
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return math.Max(0, math.Min(1, dot/math.Sqrt(normA*normB)))
+}
+
+func truncate(text string) string {
+	if len(text) <= exampleLength {
+		return text
+	}
+	cut := exampleLength
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return text[:cut] + "…"
+}
@@ -0,0 +1,529 @@
+package tenant
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"goproxyai/internal/clock"
+)
+
+var (
+	ErrUnknownTenant    = errors.New("unknown tenant")
+	ErrUnknownAlert     = errors.New("unknown alert")
+	ErrScopeNotAllowed  = errors.New("scope not allowed for tenant")
+	ErrRateLimitTooHigh = errors.New("rate limit exceeds tenant limit")
+	ErrUpstreamPinned   = errors.New("tenant is pinned to another upstream")
+)
+
+// Tenant priorities for load shedding
+const (
+	PriorityLow    = "low"
+	PriorityNormal = "normal"
+	PriorityHigh   = "high"
+)
+
+type Tenant struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name,omitempty"`
+	AdminToken string   `json:"admin_token,omitempty"`
+	RateLimit  int      `json:"rate_limit,omitempty"` // requests per minute per key, 0 uses the global limit
+	Scopes     []string `json:"scopes,omitempty"`     // allowed path prefixes, empty allows all
+
+	// Priority decides who is turned away first when the proxy sheds load:
+	// "low", "high", or empty for normal
+	Priority string `json:"priority,omitempty"`
+
+	// MaxStreams caps the streaming responses open at once across all of
+	// the tenant's keys, 0 for no cap
+	MaxStreams int `json:"max_streams,omitempty"`
+
+	// MaxKeyLifetime caps how long the tenant's virtual keys stay valid
+	// after creation, e.g. "2160h"
+	MaxKeyLifetime string `json:"max_key_lifetime,omitempty"`
+	maxKeyLifetime time.Duration
+
+	Alerts []Alert `json:"alerts,omitempty"`
+
+	// Upstream OpenAI organization, project and API key used for this
+	// tenant's traffic, isolating billing across OpenAI orgs
+	Organization   string `json:"organization,omitempty"`
+	Project        string `json:"project,omitempty"`
+	UpstreamAPIKey string `json:"upstream_api_key,omitempty"`
+	// Upstream pins the tenant's traffic to one of UPSTREAM_TARGETS, such
+	// as an EU-only Azure deployment, for data residency. Pinned traffic is
+	// never sent to any other upstream.
+	Upstream string `json:"upstream,omitempty"`
+
+	Features Features `json:"features"`
+}
+
+// Features toggles proxy behaviour per tenant, so new capabilities can be
+// rolled out to specific teams first
+type Features struct {
+	Streaming          *bool `json:"streaming,omitempty"` // default allowed
+	Caching            *bool `json:"caching,omitempty"`   // default enabled
+	ModerationRequired bool  `json:"moderation_required,omitempty"`
+	MaxContextTokens   int   `json:"max_context_tokens,omitempty"` // 0 means unlimited
+}
+
+func (f Features) StreamingAllowed() bool {
+	return f.Streaming == nil || *f.Streaming
+}
+
+func (f Features) CachingEnabled() bool {
+	return f.Caching == nil || *f.Caching
+}
+
+// Alert notifies the tenant when its usage within a window crosses a threshold
+type Alert struct {
+	ID        string  `json:"id"`
+	Metric    string  `json:"metric"` // requests, tokens or cost_usd
+	Threshold float64 `json:"threshold"`
+	Window    string  `json:"window"` // day or month
+	Webhook   string  `json:"webhook,omitempty"`
+	Email     string  `json:"email,omitempty"`
+}
+
+// Key maps an API key presented by clients to the tenant it belongs to.
+// Virtual keys are issued by the proxy and replaced with the upstream API
+// key before forwarding; other keys are passed through unchanged.
+type Key struct {
+	Key       string     `json:"key"`
+	Tenant    string     `json:"tenant"`
+	Name      string     `json:"name,omitempty"`
+	Virtual   bool       `json:"virtual,omitempty"`
+	Scopes    []string   `json:"scopes,omitempty"`
+	RateLimit int        `json:"rate_limit,omitempty"`
+	CreatedAt time.Time  `json:"created_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// Overrides lists the X-Proxy-* request overrides the key may use, e.g.
+	// "timeout" or "cache_ttl"; unset falls back to PROXY_OVERRIDES
+	Overrides []string `json:"overrides,omitempty"`
+	// CacheMaxTTL caps the seconds X-Proxy-Cache may ask responses to be
+	// cached for; unset allows up to CACHE_TTL
+	CacheMaxTTL int `json:"cache_max_ttl,omitempty"`
+	// Defaults are body parameters filled in for requests that leave them
+	// out, by route, e.g. {"/v1/chat/completions": {"temperature": 0.2}}
+	Defaults map[string]map[string]json.RawMessage `json:"defaults,omitempty"`
+	// Tools lists the tools requests made with the key may declare:
+	// function names, or built-in tool types such as "web_search", with a
+	// trailing * matching any suffix; unset or empty allows any
+	Tools []string `json:"tools,omitempty"`
+	// StripTools drops the tools outside Tools from requests instead of
+	// refusing the request
+	StripTools bool `json:"strip_tools,omitempty"`
+	// MaxStreams caps the streaming responses open at once with the key;
+	// unset falls back to STREAM_MAX_PER_KEY
+	MaxStreams int `json:"max_streams,omitempty"`
+	// Upstream sends the key's traffic to one of UPSTREAM_TARGETS instead
+	// of the default upstream, such as a team's own model server. Keys of
+	// a tenant pinned to an upstream can only name that one.
+	Upstream string `json:"upstream,omitempty"`
+}
+
+type fileFormat struct {
+	Tenants []*Tenant `json:"tenants"`
+	Keys    []*Key    `json:"keys"`
+}
+
+type Registry struct {
+	path    string
+	tenants map[string]*Tenant
+	keys    map[string]*Key
+	mutex   sync.RWMutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		tenants: make(map[string]*Tenant),
+		keys:    make(map[string]*Key),
+	}
+}
+
+// Load reads tenants and their keys from a JSON file. An empty path yields an
+// empty registry, in which case every request is unassigned.
+func Load(path string) (*Registry, error) {
+	registry := NewRegistry()
+	if path == "" {
+		return registry, nil
+	}
+	registry.path = path
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file fileFormat
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	for _, t := range file.Tenants {
+		if t.ID == "" {
+			return nil, fmt.Errorf("parse %s: tenant without id", path)
+		}
+		if t.MaxKeyLifetime != "" {
+			lifetime, err := time.ParseDuration(t.MaxKeyLifetime)
+			if err != nil {
+				return nil, fmt.Errorf("parse %s: tenant %s max_key_lifetime: %w", path, t.ID, err)
+			}
+			t.maxKeyLifetime = lifetime
+		}
+		switch t.Priority {
+		case "", PriorityLow, PriorityNormal, PriorityHigh:
+		default:
+			return nil, fmt.Errorf("parse %s: tenant %s priority %q, expected low, normal or high", path, t.ID, t.Priority)
+		}
+		registry.tenants[t.ID] = t
+	}
+	for _, k := range file.Keys {
+		if _, exists := registry.tenants[k.Tenant]; !exists {
+			return nil, fmt.Errorf("parse %s: key %q references unknown tenant %q", path, k.Name, k.Tenant)
+		}
+		registry.keys[k.Key] = k
+	}
+
+	return registry, nil
+}
+
+// Lookup resolves the key and tenant for an Authorization header value
+func (r *Registry) Lookup(authorization string) (*Key, *Tenant, bool) {
+	token := bearerToken(authorization)
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	key, exists := r.keys[token]
+	if !exists {
+		return nil, nil, false
+	}
+	t, exists := r.tenants[key.Tenant]
+	return key, t, exists
+}
+
+// LookupAdmin resolves the tenant whose admin token is presented
+func (r *Registry) LookupAdmin(authorization string) (*Tenant, bool) {
+	token := bearerToken(authorization)
+	if token == "" {
+		return nil, false
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for _, t := range r.tenants {
+		if t.AdminToken != "" && subtle.ConstantTimeCompare([]byte(t.AdminToken), []byte(token)) == 1 {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+func (r *Registry) Tenants() []Tenant {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	tenants := make([]Tenant, 0, len(r.tenants))
+	for _, t := range r.tenants {
+		tenants = append(tenants, *t)
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].ID < tenants[j].ID })
+	return tenants
+}
+
+// Keys returns a snapshot of all registered keys
+func (r *Registry) Keys() []Key {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	keys := make([]Key, 0, len(r.keys))
+	for _, k := range r.keys {
+		keys = append(keys, *k)
+	}
+	return keys
+}
+
+// Tenant returns a snapshot of a single tenant
+func (r *Registry) Tenant(id string) (Tenant, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	t, exists := r.tenants[id]
+	if !exists {
+		return Tenant{}, false
+	}
+	return *t, true
+}
+
+// Mint issues a new virtual key for a tenant. Scopes and rate limit must stay
+// within the tenant's own limits; unset values are inherited from it.
+func (r *Registry) Mint(tenantID, name string, scopes []string, rateLimit int, lifetime time.Duration, defaults map[string]map[string]json.RawMessage, tools []string, stripTools bool, upstream string) (*Key, error) {
+	token, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	t, exists := r.tenants[tenantID]
+	if !exists {
+		return nil, ErrUnknownTenant
+	}
+
+	if len(scopes) == 0 {
+		scopes = t.Scopes
+	}
+	for _, scope := range scopes {
+		if !scopeAllowed(t.Scopes, scope) {
+			return nil, fmt.Errorf("%w: %s", ErrScopeNotAllowed, scope)
+		}
+	}
+
+	if rateLimit == 0 {
+		rateLimit = t.RateLimit
+	}
+	if t.RateLimit > 0 && rateLimit > t.RateLimit {
+		return nil, ErrRateLimitTooHigh
+	}
+	if upstream != "" && t.Upstream != "" && upstream != t.Upstream {
+		return nil, fmt.Errorf("%w %q", ErrUpstreamPinned, t.Upstream)
+	}
+
+	now := clock.Now().UTC()
+	expiresAt := now.Add(lifetime)
+	key := &Key{
+		Key:        token,
+		Tenant:     tenantID,
+		Name:       name,
+		Virtual:    true,
+		Scopes:     scopes,
+		RateLimit:  rateLimit,
+		CreatedAt:  now,
+		ExpiresAt:  &expiresAt,
+		Defaults:   defaults,
+		Tools:      tools,
+		StripTools: stripTools,
+		Upstream:   upstream,
+	}
+
+	r.keys[token] = key
+	if err := r.save(); err != nil {
+		delete(r.keys, token)
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// MaxLifetime returns the stricter of the tenant's and the global maximum
+// key lifetime, or zero if neither is set
+func (t *Tenant) MaxLifetime(global time.Duration) time.Duration {
+	if t.maxKeyLifetime > 0 && (global == 0 || t.maxKeyLifetime < global) {
+		return t.maxKeyLifetime
+	}
+	return global
+}
+
+// Allows reports whether the tenant's keys may be used for the request path
+func (t *Tenant) Allows(path string) bool {
+	return scopeAllowed(t.Scopes, path)
+}
+
+func (r *Registry) AddAlert(tenantID string, alert Alert) (*Alert, error) {
+	id, err := generateID()
+	if err != nil {
+		return nil, err
+	}
+	alert.ID = id
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	t, exists := r.tenants[tenantID]
+	if !exists {
+		return nil, ErrUnknownTenant
+	}
+
+	previous := t.Alerts
+	// Copy on write so snapshots handed out by Tenants() stay unchanged
+	t.Alerts = append(append([]Alert{}, previous...), alert)
+	if err := r.save(); err != nil {
+		t.Alerts = previous
+		return nil, err
+	}
+	return &alert, nil
+}
+
+func (r *Registry) RemoveAlert(tenantID, alertID string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	t, exists := r.tenants[tenantID]
+	if !exists {
+		return ErrUnknownTenant
+	}
+
+	previous := t.Alerts
+	alerts := make([]Alert, 0, len(previous))
+	for _, alert := range previous {
+		if alert.ID != alertID {
+			alerts = append(alerts, alert)
+		}
+	}
+	if len(alerts) == len(previous) {
+		return ErrUnknownAlert
+	}
+
+	t.Alerts = alerts
+	if err := r.save(); err != nil {
+		t.Alerts = previous
+		return err
+	}
+	return nil
+}
+
+func (r *Registry) SetFeatures(tenantID string, features Features) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	t, exists := r.tenants[tenantID]
+	if !exists {
+		return ErrUnknownTenant
+	}
+
+	previous := t.Features
+	t.Features = features
+	if err := r.save(); err != nil {
+		t.Features = previous
+		return err
+	}
+	return nil
+}
+
+// Allows reports whether the key may be used for the given request path
+func (k *Key) Allows(path string) bool {
+	return scopeAllowed(k.Scopes, path)
+}
+
+// AllowsTool reports whether requests made with the key may declare the
+// named tool
+func (k *Key) AllowsTool(name string) bool {
+	if len(k.Tools) == 0 {
+		return true
+	}
+	for _, allowed := range k.Tools {
+		if allowed == name || strings.HasSuffix(allowed, "*") && strings.HasPrefix(name, strings.TrimSuffix(allowed, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Expiry returns when the key stops being valid: its explicit expiry or, for
+// virtual keys, creation time plus the maximum lifetime, whichever is first
+func (k *Key) Expiry(maxLifetime time.Duration) (time.Time, bool) {
+	var expiry time.Time
+	if k.ExpiresAt != nil {
+		expiry = *k.ExpiresAt
+	}
+	if k.Virtual && maxLifetime > 0 && !k.CreatedAt.IsZero() {
+		if limit := k.CreatedAt.Add(maxLifetime); expiry.IsZero() || limit.Before(expiry) {
+			expiry = limit
+		}
+	}
+	return expiry, !expiry.IsZero()
+}
+
+// Masked returns the key with its secret part hidden, for listings and logs
+func (k *Key) Masked() string {
+	if len(k.Key) <= 12 {
+		return "****"
+	}
+	return k.Key[:7] + "..." + k.Key[len(k.Key)-4:]
+}
+
+// save persists the registry back to its file so minted keys survive
+// restarts. The file is replaced atomically to avoid partial writes.
+func (r *Registry) save() error {
+	if r.path == "" {
+		return nil
+	}
+
+	file := fileFormat{
+		Tenants: make([]*Tenant, 0, len(r.tenants)),
+		Keys:    make([]*Key, 0, len(r.keys)),
+	}
+	for _, t := range r.tenants {
+		file.Tenants = append(file.Tenants, t)
+	}
+	for _, k := range r.keys {
+		file.Keys = append(file.Keys, k)
+	}
+	sort.Slice(file.Tenants, func(i, j int) bool { return file.Tenants[i].ID < file.Tenants[j].ID })
+	sort.Slice(file.Keys, func(i, j int) bool { return file.Keys[i].CreatedAt.Before(file.Keys[j].CreatedAt) })
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), ".tenants-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), r.path)
+}
+
+func scopeAllowed(allowed []string, path string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, prefix := range allowed {
+		if path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func bearerToken(authorization string) string {
+	return strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+}
+
+func generateID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func generateToken() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "vk-" + hex.EncodeToString(buf), nil
+}
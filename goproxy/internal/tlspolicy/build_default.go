@@ -0,0 +1,6 @@
+//go:build !fips
+
+package tlspolicy
+
+// The policy used when TLS_POLICY is unset
+const buildPolicy = "default"
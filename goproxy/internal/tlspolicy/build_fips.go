@@ -0,0 +1,11 @@
+//go:build fips
+
+package tlspolicy
+
+// Importing fipsonly holds every tls.Config in the process to approved
+// settings, including ones built outside this package. It only exists in a
+// GOEXPERIMENT=boringcrypto toolchain, which the fips build needs anyway.
+import _ "crypto/tls/fipsonly"
+
+// Built with -tags fips, the proxy speaks only the FIPS policy
+const buildPolicy = "fips"
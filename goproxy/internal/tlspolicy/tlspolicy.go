@@ -0,0 +1,153 @@
+// Package tlspolicy restricts the TLS the proxy speaks, on its listener and
+// on its connections to upstream and everything else it calls, for
+// regulated environments that only allow approved cryptography
+package tlspolicy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Policy is the TLS versions, cipher suites and curves connections may use.
+// Empty fields leave Go's defaults.
+type Policy struct {
+	Name         string
+	MinVersion   uint16
+	MaxVersion   uint16
+	CipherSuites []uint16
+	Curves       []tls.CurveID
+}
+
+// Default is Go's own TLS settings
+var Default = &Policy{Name: "default"}
+
+// FIPS allows only what FIPS 140 approves: TLS 1.2 with ECDHE key exchange
+// over the P-256 and P-384 curves and AES-GCM. TLS 1.3 is left out because
+// Go doesn't let its cipher suites be chosen, and one of them is
+// ChaCha20-Poly1305.
+var FIPS = &Policy{
+	Name:       "fips",
+	MinVersion: tls.VersionTLS12,
+	MaxVersion: tls.VersionTLS12,
+	CipherSuites: []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	},
+	Curves: []tls.CurveID{tls.CurveP256, tls.CurveP384},
+}
+
+var (
+	mutex   sync.RWMutex
+	current = Default
+)
+
+// Lookup returns the policy TLS_POLICY names, the one the binary was built
+// with when it's empty. Binaries built with the fips tag allow no other.
+func Lookup(name string) (*Policy, error) {
+	if name == "" {
+		name = buildPolicy
+	}
+	if buildPolicy == FIPS.Name && name != FIPS.Name {
+		return nil, fmt.Errorf("this binary was built with the fips tag and only allows fips, got %q", name)
+	}
+	switch name {
+	case Default.Name:
+		return Default, nil
+	case FIPS.Name:
+		return FIPS, nil
+	default:
+		return nil, fmt.Errorf("unknown policy %q, expected default or fips", name)
+	}
+}
+
+// Use makes p the policy of Current and ClientConfig, and of requests sent
+// with http.DefaultTransport
+func Use(p *Policy) {
+	mutex.Lock()
+	current = p
+	mutex.Unlock()
+	p.Restrict(http.DefaultTransport)
+}
+
+// Current is the policy in use
+func Current() *Policy {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return current
+}
+
+// ClientConfig returns a config for connecting to serverName under the
+// policy in use
+func ClientConfig(serverName string) *tls.Config {
+	config := &tls.Config{ServerName: serverName}
+	Current().Apply(config)
+	return config
+}
+
+// Apply restricts config to the policy
+func (p *Policy) Apply(config *tls.Config) {
+	if p.MinVersion != 0 {
+		config.MinVersion = p.MinVersion
+	}
+	if p.MaxVersion != 0 {
+		config.MaxVersion = p.MaxVersion
+	}
+	if p.CipherSuites != nil {
+		config.CipherSuites = append([]uint16(nil), p.CipherSuites...)
+	}
+	if p.Curves != nil {
+		config.CurvePreferences = append([]tls.CurveID(nil), p.Curves...)
+	}
+}
+
+// Restrict applies the policy to the connections transport makes, when
+// it's an *http.Transport; other round trippers, such as cassettes, make
+// none of their own
+func (p *Policy) Restrict(transport http.RoundTripper) {
+	t, ok := transport.(*http.Transport)
+	if !ok || p.isDefault() {
+		return
+	}
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	p.Apply(t.TLSClientConfig)
+}
+
+// String describes the policy for the startup log
+func (p *Policy) String() string {
+	if p.isDefault() {
+		return p.Name + " (Go's default versions, cipher suites and curves)"
+	}
+	var parts []string
+	switch {
+	case p.MinVersion != 0 && p.MinVersion == p.MaxVersion:
+		parts = append(parts, tls.VersionName(p.MinVersion)+" only")
+	case p.MinVersion != 0:
+		parts = append(parts, tls.VersionName(p.MinVersion)+" and later")
+	}
+	if p.CipherSuites != nil {
+		names := make([]string, len(p.CipherSuites))
+		for i, suite := range p.CipherSuites {
+			names[i] = tls.CipherSuiteName(suite)
+		}
+		parts = append(parts, "cipher suites "+strings.Join(names, ", "))
+	}
+	if p.Curves != nil {
+		names := make([]string, len(p.Curves))
+		for i, curve := range p.Curves {
+			names[i] = curve.String()
+		}
+		parts = append(parts, "curves "+strings.Join(names, ", "))
+	}
+	return p.Name + " (" + strings.Join(parts, "; ") + ")"
+}
+
+func (p *Policy) isDefault() bool {
+	return p.MinVersion == 0 && p.MaxVersion == 0 && p.CipherSuites == nil && p.Curves == nil
+}
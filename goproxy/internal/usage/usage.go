@@ -0,0 +1,357 @@
+package usage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"goproxyai/internal/clock"
+)
+
+const dayLayout = "2006-01-02"
+
+type Tracker struct {
+	entries      map[entryKey]*Totals
+	rateLimited  map[userKey]int64
+	vectorStores map[string]*vectorStore
+	mutex        sync.RWMutex
+}
+
+// Record describes the usage of a single proxied request
+type Record struct {
+	Tenant           string
+	Key              string
+	User             string
+	Model            string
+	PromptTokens     int
+	CompletionTokens int
+	TotalTokens      int
+}
+
+// vectorStore is a vector store's storage as upstream last reported it,
+// and the tenant it was first seen by
+type vectorStore struct {
+	tenant string
+	bytes  int64
+}
+
+// Storage is a tenant's vector store storage
+type Storage struct {
+	VectorStores int64 `json:"vector_stores"`
+	UsageBytes   int64 `json:"usage_bytes"`
+}
+
+type Totals struct {
+	Requests         int64 `json:"requests"`
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+	TotalTokens      int64 `json:"total_tokens"`
+}
+
+// Breakdown aggregates usage over a date range along each dimension
+type Breakdown struct {
+	From        string                      `json:"from,omitempty"`
+	To          string                      `json:"to,omitempty"`
+	Total       Totals                      `json:"total"`
+	ByTenant    map[string]*Totals          `json:"by_tenant"`
+	ByKey       map[string]*Totals          `json:"by_key"`
+	ByUser      map[string]*Totals          `json:"by_user"`
+	ByModel     map[string]*Totals          `json:"by_model"`
+	RateLimited map[string]map[string]int64 `json:"rate_limited_users"` // by tenant, then user
+
+	// Storage is current rather than for the date range
+	Storage map[string]*Storage `json:"vector_store_storage_by_tenant"`
+}
+
+// userKey is an end user within a tenant, since user IDs are the client's
+// own and tenants can pick the same ones
+type userKey struct {
+	tenant string
+	user   string
+}
+
+type entryKey struct {
+	day    string
+	tenant string
+	key    string
+	user   string
+	model  string
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{
+		entries:      make(map[entryKey]*Totals),
+		rateLimited:  make(map[userKey]int64),
+		vectorStores: make(map[string]*vectorStore),
+	}
+}
+
+// KeyID derives a stable, non-reversible identifier for an API key so usage
+// can be attributed to callers without keeping their credentials in memory
+func KeyID(authorization string) string {
+	token := strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+	if token == "" {
+		return "anonymous"
+	}
+	hash := sha256.Sum256([]byte(token))
+	return "key-" + hex.EncodeToString(hash[:6])
+}
+
+func (t *Tracker) Record(record Record) {
+	key := entryKey{
+		day:    clock.Now().UTC().Format(dayLayout),
+		tenant: record.Tenant,
+		key:    record.Key,
+		user:   record.User,
+		model:  record.Model,
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	totals, exists := t.entries[key]
+	if !exists {
+		totals = &Totals{}
+		t.entries[key] = totals
+	}
+	totals.Add(Totals{
+		Requests:         1,
+		PromptTokens:     int64(record.PromptTokens),
+		CompletionTokens: int64(record.CompletionTokens),
+		TotalTokens:      int64(record.TotalTokens),
+	})
+}
+
+func (t *Tracker) RecordRateLimited(tenant, user string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.rateLimited[userKey{tenant: tenant, user: user}]++
+}
+
+// RecordVectorStore notes the storage a vector store uses. A store stays
+// attributed to the tenant it was first seen by.
+func (t *Tracker) RecordVectorStore(tenant, id string, bytes int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	store, exists := t.vectorStores[id]
+	if !exists {
+		store = &vectorStore{tenant: tenant}
+		t.vectorStores[id] = store
+	}
+	store.bytes = bytes
+}
+
+// ForgetVectorStore stops counting a deleted vector store
+func (t *Tracker) ForgetVectorStore(id string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.vectorStores, id)
+}
+
+// Purge drops the usage of days before the one before falls on, returning
+// how many records it dropped
+func (t *Tracker) Purge(before time.Time) int {
+	cutoff := before.UTC().Format(dayLayout)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	purged := 0
+	for key := range t.entries {
+		if key.day < cutoff {
+			delete(t.entries, key)
+			purged++
+		}
+	}
+	return purged
+}
+
+// Delete drops the usage of a tenant, of an end user, or of a user within
+// a tenant when both are given, returning how many records it dropped. A
+// user's rate-limited count goes with their usage.
+func (t *Tracker) Delete(tenant, user string) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	deleted := 0
+	for key := range t.entries {
+		if (tenant == "" || key.tenant == tenant) && (user == "" || key.user == user) {
+			delete(t.entries, key)
+			deleted++
+		}
+	}
+	for key := range t.rateLimited {
+		if (tenant == "" || key.tenant == tenant) && (user == "" || key.user == user) {
+			delete(t.rateLimited, key)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// Breakdown aggregates usage for days in [from, to]. Zero times leave the
+// range open on that side.
+func (t *Tracker) Breakdown(from, to time.Time) *Breakdown {
+	result := &Breakdown{
+		ByTenant:    make(map[string]*Totals),
+		ByKey:       make(map[string]*Totals),
+		ByUser:      make(map[string]*Totals),
+		ByModel:     make(map[string]*Totals),
+		RateLimited: make(map[string]map[string]int64),
+		Storage:     make(map[string]*Storage),
+	}
+	result.From, result.To = formatRange(from, to)
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	for key, totals := range t.entries {
+		if !inRange(key.day, result.From, result.To) {
+			continue
+		}
+
+		result.Total.Add(*totals)
+		addTo(result.ByTenant, key.tenant, *totals)
+		addTo(result.ByKey, key.key, *totals)
+		addTo(result.ByModel, key.model, *totals)
+		if key.user != "" {
+			addTo(result.ByUser, key.user, *totals)
+		}
+	}
+
+	for key, count := range t.rateLimited {
+		byUser, exists := result.RateLimited[key.tenant]
+		if !exists {
+			byUser = make(map[string]int64)
+			result.RateLimited[key.tenant] = byUser
+		}
+		byUser[key.user] = count
+	}
+
+	for _, store := range t.vectorStores {
+		storage, exists := result.Storage[store.tenant]
+		if !exists {
+			storage = &Storage{}
+			result.Storage[store.tenant] = storage
+		}
+		storage.VectorStores++
+		storage.UsageBytes += store.bytes
+	}
+
+	return result
+}
+
+// TenantModelTotals aggregates usage for days in [from, to] per tenant and
+// model, which is the granularity pricing is applied at
+func (t *Tracker) TenantModelTotals(from, to time.Time) map[string]map[string]*Totals {
+	fromDay, toDay := formatRange(from, to)
+	result := make(map[string]map[string]*Totals)
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	for key, totals := range t.entries {
+		if !inRange(key.day, fromDay, toDay) {
+			continue
+		}
+
+		byModel, exists := result[key.tenant]
+		if !exists {
+			byModel = make(map[string]*Totals)
+			result[key.tenant] = byModel
+		}
+		addTo(byModel, key.model, *totals)
+	}
+
+	return result
+}
+
+// TenantTotals aggregates a single tenant's usage for days in [from, to]
+func (t *Tracker) TenantTotals(tenant string, from, to time.Time) Totals {
+	fromDay, toDay := formatRange(from, to)
+	var result Totals
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	for key, totals := range t.entries {
+		if key.tenant == tenant && inRange(key.day, fromDay, toDay) {
+			result.Add(*totals)
+		}
+	}
+
+	return result
+}
+
+// TenantDays aggregates usage from the day of from on per day and tenant,
+// as a cluster shares it with the other replicas
+func (t *Tracker) TenantDays(from time.Time) map[string]map[string]Totals {
+	fromDay, _ := formatRange(from, time.Time{})
+	result := make(map[string]map[string]Totals)
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	for key, totals := range t.entries {
+		if !inRange(key.day, fromDay, "") {
+			continue
+		}
+
+		byTenant, exists := result[key.day]
+		if !exists {
+			byTenant = make(map[string]Totals)
+			result[key.day] = byTenant
+		}
+		sum := byTenant[key.tenant]
+		sum.Add(*totals)
+		byTenant[key.tenant] = sum
+	}
+
+	return result
+}
+
+func formatRange(from, to time.Time) (string, string) {
+	var fromDay, toDay string
+	if !from.IsZero() {
+		fromDay = from.UTC().Format(dayLayout)
+	}
+	if !to.IsZero() {
+		toDay = to.UTC().Format(dayLayout)
+	}
+	return fromDay, toDay
+}
+
+func inRange(day, fromDay, toDay string) bool {
+	if fromDay != "" && day < fromDay {
+		return false
+	}
+	if toDay != "" && day > toDay {
+		return false
+	}
+	return true
+}
+
+// Add sums other into the totals
+func (t *Totals) Add(other Totals) {
+	t.Requests += other.Requests
+	t.PromptTokens += other.PromptTokens
+	t.CompletionTokens += other.CompletionTokens
+	t.TotalTokens += other.TotalTokens
+}
+
+func addTo(totals map[string]*Totals, name string, value Totals) {
+	if name == "" {
+		name = "unknown"
+	}
+	existing, exists := totals[name]
+	if !exists {
+		existing = &Totals{}
+		totals[name] = existing
+	}
+	existing.Add(value)
+}
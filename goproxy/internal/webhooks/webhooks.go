@@ -0,0 +1,192 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How far a webhook's timestamp may be from now before it's rejected as a
+// possible replay
+const timestampTolerance = 5 * time.Minute
+
+var (
+	ErrMissingHeaders   = errors.New("missing webhook-id, webhook-timestamp or webhook-signature header")
+	ErrInvalidTimestamp = errors.New("webhook timestamp is invalid or outside the tolerance")
+	ErrInvalidSignature = errors.New("webhook signature does not match")
+)
+
+// Headers carrying the webhook's identity and signature, forwarded as they
+// are so internal endpoints can verify again if they want to
+var signatureHeaders = []string{"Webhook-Id", "Webhook-Timestamp", "Webhook-Signature"}
+
+// Verify checks a webhook signed the way OpenAI signs them, following the
+// Standard Webhooks scheme: an HMAC-SHA256 over "id.timestamp.body" with the
+// base64 secret that follows the "whsec_" prefix
+func Verify(secret string, header http.Header, body []byte, now time.Time) error {
+	id := header.Get("Webhook-Id")
+	timestamp := header.Get("Webhook-Timestamp")
+	signatures := header.Get("Webhook-Signature")
+	if id == "" || timestamp == "" || signatures == "" {
+		return ErrMissingHeaders
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidTimestamp
+	}
+	if drift := now.Sub(time.Unix(seconds, 0)); drift > timestampTolerance || drift < -timestampTolerance {
+		return ErrInvalidTimestamp
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(secret, "whsec_"))
+	if err != nil {
+		return fmt.Errorf("invalid webhook secret: %w", err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(id + "." + timestamp + "."))
+	mac.Write(body)
+	expected := mac.Sum(nil)
+
+	// The header may list several space-separated "v1,<signature>" entries
+	// while secrets are being rotated
+	for _, entry := range strings.Fields(signatures) {
+		version, encoded, found := strings.Cut(entry, ",")
+		if !found || version != "v1" {
+			continue
+		}
+		signature, err := base64.StdEncoding.DecodeString(encoded)
+		if err == nil && hmac.Equal(signature, expected) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+// Target is an internal endpoint that receives events whose type starts
+// with Prefix, or every event when Prefix is empty
+type Target struct {
+	Prefix string
+	URL    string
+}
+
+// ParseTargets reads entries of the form "url" or "event.prefix=url"
+func ParseTargets(entries []string) ([]Target, error) {
+	targets := make([]Target, 0, len(entries))
+	for _, entry := range entries {
+		target := Target{URL: entry}
+		if prefix, url, found := strings.Cut(entry, "="); found {
+			target = Target{Prefix: prefix, URL: url}
+		}
+		if !strings.HasPrefix(target.URL, "http://") && !strings.HasPrefix(target.URL, "https://") {
+			return nil, fmt.Errorf("invalid webhook target %q", entry)
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// Dispatcher fans verified events out to internal endpoints
+type Dispatcher struct {
+	targets    []Target
+	httpClient *http.Client
+	logger     *log.Logger
+}
+
+func NewDispatcher(targets []Target, logger *log.Logger) *Dispatcher {
+	return &Dispatcher{
+		targets:    targets,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		logger:     logger,
+	}
+}
+
+// Dispatch delivers an event to every matching target in the background,
+// retrying failed deliveries a few times with backoff. It returns the
+// number of targets the event is going to.
+func (d *Dispatcher) Dispatch(eventType string, header http.Header, body []byte) int {
+	forwarded := make(http.Header)
+	for _, name := range signatureHeaders {
+		if value := header.Get(name); value != "" {
+			forwarded.Set(name, value)
+		}
+	}
+	forwarded.Set("Content-Type", "application/json")
+	forwarded.Set("X-Webhook-Verified", "true")
+
+	matched := 0
+	for _, target := range d.targets {
+		if !strings.HasPrefix(eventType, target.Prefix) {
+			continue
+		}
+		matched++
+		go d.deliver(target.URL, forwarded, body)
+	}
+	return matched
+}
+
+// Notify delivers an event the proxy raised itself to every matching
+// target, the way Dispatch does, with its id in Webhook-Id. It returns the
+// number of targets the event is going to.
+func (d *Dispatcher) Notify(id, eventType string, body []byte) int {
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+	header.Set("Webhook-Id", id)
+
+	matched := 0
+	for _, target := range d.targets {
+		if !strings.HasPrefix(eventType, target.Prefix) {
+			continue
+		}
+		matched++
+		go d.deliver(target.URL, header, body)
+	}
+	return matched
+}
+
+func (d *Dispatcher) deliver(url string, header http.Header, body []byte) {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := d.send(url, header, body)
+		if err == nil {
+			return
+		}
+		if attempt == 3 {
+			d.logger.Printf("Giving up delivering webhook %s to %s: %v", header.Get("Webhook-Id"), url, err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 4
+	}
+}
+
+func (d *Dispatcher) send(url string, header http.Header, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header = header.Clone()
+
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("endpoint returned %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package postprocess
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"goproxyai/internal/openai"
+)
+
+func init() {
+	Register("strip_markdown", func(func(string) string) (Processor, error) {
+		return ProcessorFunc(stripMarkdown), nil
+	})
+	Register("attribution", func(getenv func(string) string) (Processor, error) {
+		text := getenv("POSTPROCESS_ATTRIBUTION")
+		if text == "" {
+			return nil, errors.New("POSTPROCESS_ATTRIBUTION isn't set")
+		}
+		return ProcessorFunc(func(resp *Response) error {
+			resp.MapText(func(content string) string {
+				return strings.TrimRight(content, "\n") + "\n\n" + text
+			})
+			return nil
+		}), nil
+	})
+	Register("normalize_finish_reason", func(func(string) string) (Processor, error) {
+		return ProcessorFunc(normalizeFinishReasons), nil
+	})
+}
+
+// Markdown syntax and what it's replaced with, in order: code blocks and
+// links first so nothing inside them is taken for emphasis
+var markdown = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile("(?s)```[^\\n]*\\n(.*?)```"), "$1"},
+	{regexp.MustCompile("`([^`\\n]+)`"), "$1"},
+	{regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`), "$1"},
+	{regexp.MustCompile(`\[([^\]]+)\]\([^)]*\)`), "$1"},
+	{regexp.MustCompile(`(?m)^ {0,3}#{1,6}[ \t]+(.*?)[ \t#]*$`), "$1"},
+	{regexp.MustCompile(`(?m)^ {0,3}(?:-{3,}|\*{3,}|_{3,})[ \t]*$\n?`), ""},
+	{regexp.MustCompile(`(?m)^ {0,3}>[ \t]?`), ""},
+	{regexp.MustCompile(`(?m)^([ \t]*)[-*+][ \t]+`), "$1"},
+	{regexp.MustCompile(`\*\*([^*\n]+)\*\*`), "$1"},
+	{regexp.MustCompile(`__([^_\n]+)__`), "$1"},
+	{regexp.MustCompile(`(^|[^\w*])\*([^*\s][^*\n]*)\*`), "$1$2"},
+	{regexp.MustCompile(`(^|[^\w_])_([^_\s][^_\n]*)_([^\w]|$)`), "$1$2$3"},
+	{regexp.MustCompile(`~~([^~\n]+)~~`), "$1"},
+}
+
+// stripMarkdown turns markdown answers into plain text, for clients that
+// display text as it is
+func stripMarkdown(resp *Response) error {
+	resp.MapText(func(content string) string {
+		for _, rule := range markdown {
+			content = rule.pattern.ReplaceAllString(content, rule.replacement)
+		}
+		return content
+	})
+	return nil
+}
+
+// normalizeFinishReasons maps finish reasons to the ones OpenAI uses, so
+// clients written against OpenAI work with other upstreams
+func normalizeFinishReasons(resp *Response) error {
+	for _, choice := range resp.Choices() {
+		reason, ok := choice["finish_reason"].(string)
+		if !ok {
+			continue
+		}
+		choice["finish_reason"] = openai.NormalizeFinishReason(reason)
+	}
+	return nil
+}
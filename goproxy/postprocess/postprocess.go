@@ -0,0 +1,135 @@
+// Package postprocess lets completion responses be inspected and changed
+// before the proxy caches or returns them. Processors register themselves
+// by name, usually from an init function, and POSTPROCESSORS picks which
+// run and in what order:
+//
+//	func init() {
+//		postprocess.Register("redact_emails", func(getenv func(string) string) (postprocess.Processor, error) {
+//			return redactEmails{}, nil
+//		})
+//	}
+//
+// A custom build registers its own processors by adding a file to
+// cmd/server that imports their package for its side effects.
+package postprocess
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Response is a successful, non-streaming chat completion or completion on
+// its way to the client. Processors edit Body in place.
+type Response struct {
+	Path  string // /v1/chat/completions or /v1/completions
+	Model string // the model the request asked for
+
+	// Body is the decoded JSON response, with numbers as json.Number
+	Body map[string]interface{}
+}
+
+// Processor inspects or changes a response. A processor that fails leaves
+// every processor's changes undone, so the client gets the response as
+// upstream sent it.
+type Processor interface {
+	Process(resp *Response) error
+}
+
+// ProcessorFunc adapts a function to a Processor
+type ProcessorFunc func(resp *Response) error
+
+func (f ProcessorFunc) Process(resp *Response) error {
+	return f(resp)
+}
+
+// Factory builds a processor, reading any settings of its own with getenv
+type Factory func(getenv func(key string) string) (Processor, error)
+
+var (
+	mutex     sync.RWMutex
+	factories = make(map[string]Factory)
+)
+
+// Register makes a processor available under name. It panics if the name is
+// already taken, since that's a build mistake.
+func Register(name string, factory Factory) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if _, found := factories[name]; found {
+		panic("postprocess: processor " + name + " registered twice")
+	}
+	factories[name] = factory
+}
+
+// Names lists the registered processors
+func Names() []string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Pipeline runs processors in order
+type Pipeline []Processor
+
+// Build makes the pipeline of the named processors
+func Build(names []string, getenv func(key string) string) (Pipeline, error) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	pipeline := make(Pipeline, 0, len(names))
+	for _, name := range names {
+		factory, found := factories[name]
+		if !found {
+			return nil, fmt.Errorf("unknown processor %q", name)
+		}
+		processor, err := factory(getenv)
+		if err != nil {
+			return nil, fmt.Errorf("processor %s: %w", name, err)
+		}
+		pipeline = append(pipeline, processor)
+	}
+	return pipeline, nil
+}
+
+// Process runs every processor on resp, stopping at the first that fails
+func (p Pipeline) Process(resp *Response) error {
+	for _, processor := range p {
+		if err := processor.Process(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Choices returns the response's choices
+func (r *Response) Choices() []map[string]interface{} {
+	items, _ := r.Body["choices"].([]interface{})
+	choices := make([]map[string]interface{}, 0, len(items))
+	for _, item := range items {
+		if choice, ok := item.(map[string]interface{}); ok {
+			choices = append(choices, choice)
+		}
+	}
+	return choices
+}
+
+// MapText replaces the generated text of every choice, chat message
+// content or completion text, with f applied to it. Choices without text,
+// such as tool calls, are left alone.
+func (r *Response) MapText(f func(string) string) {
+	for _, choice := range r.Choices() {
+		if text, ok := choice["text"].(string); ok {
+			choice["text"] = f(text)
+		}
+		if message, ok := choice["message"].(map[string]interface{}); ok {
+			if content, ok := message["content"].(string); ok && content != "" {
+				message["content"] = f(content)
+			}
+		}
+	}
+}
@@ -0,0 +1,312 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: proxy/v1/proxy.proto
+
+package proxyv1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Proxy_CreateChatCompletion_FullMethodName = "/goproxyai.proxy.v1.Proxy/CreateChatCompletion"
+	Proxy_StreamChatCompletion_FullMethodName = "/goproxyai.proxy.v1.Proxy/StreamChatCompletion"
+	Proxy_CreateCompletion_FullMethodName     = "/goproxyai.proxy.v1.Proxy/CreateCompletion"
+	Proxy_StreamCompletion_FullMethodName     = "/goproxyai.proxy.v1.Proxy/StreamCompletion"
+	Proxy_CreateEmbeddings_FullMethodName     = "/goproxyai.proxy.v1.Proxy/CreateEmbeddings"
+)
+
+// ProxyClient is the client API for Proxy service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ProxyClient interface {
+	CreateChatCompletion(ctx context.Context, in *ChatCompletionRequest, opts ...grpc.CallOption) (*ChatCompletionResponse, error)
+	StreamChatCompletion(ctx context.Context, in *ChatCompletionRequest, opts ...grpc.CallOption) (Proxy_StreamChatCompletionClient, error)
+	CreateCompletion(ctx context.Context, in *CompletionRequest, opts ...grpc.CallOption) (*CompletionResponse, error)
+	StreamCompletion(ctx context.Context, in *CompletionRequest, opts ...grpc.CallOption) (Proxy_StreamCompletionClient, error)
+	CreateEmbeddings(ctx context.Context, in *EmbeddingsRequest, opts ...grpc.CallOption) (*EmbeddingsResponse, error)
+}
+
+type proxyClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewProxyClient(cc grpc.ClientConnInterface) ProxyClient {
+	return &proxyClient{cc}
+}
+
+func (c *proxyClient) CreateChatCompletion(ctx context.Context, in *ChatCompletionRequest, opts ...grpc.CallOption) (*ChatCompletionResponse, error) {
+	out := new(ChatCompletionResponse)
+	err := c.cc.Invoke(ctx, Proxy_CreateChatCompletion_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyClient) StreamChatCompletion(ctx context.Context, in *ChatCompletionRequest, opts ...grpc.CallOption) (Proxy_StreamChatCompletionClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Proxy_ServiceDesc.Streams[0], Proxy_StreamChatCompletion_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &proxyStreamChatCompletionClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Proxy_StreamChatCompletionClient interface {
+	Recv() (*ChatCompletionChunk, error)
+	grpc.ClientStream
+}
+
+type proxyStreamChatCompletionClient struct {
+	grpc.ClientStream
+}
+
+func (x *proxyStreamChatCompletionClient) Recv() (*ChatCompletionChunk, error) {
+	m := new(ChatCompletionChunk)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *proxyClient) CreateCompletion(ctx context.Context, in *CompletionRequest, opts ...grpc.CallOption) (*CompletionResponse, error) {
+	out := new(CompletionResponse)
+	err := c.cc.Invoke(ctx, Proxy_CreateCompletion_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyClient) StreamCompletion(ctx context.Context, in *CompletionRequest, opts ...grpc.CallOption) (Proxy_StreamCompletionClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Proxy_ServiceDesc.Streams[1], Proxy_StreamCompletion_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &proxyStreamCompletionClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Proxy_StreamCompletionClient interface {
+	Recv() (*CompletionResponse, error)
+	grpc.ClientStream
+}
+
+type proxyStreamCompletionClient struct {
+	grpc.ClientStream
+}
+
+func (x *proxyStreamCompletionClient) Recv() (*CompletionResponse, error) {
+	m := new(CompletionResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *proxyClient) CreateEmbeddings(ctx context.Context, in *EmbeddingsRequest, opts ...grpc.CallOption) (*EmbeddingsResponse, error) {
+	out := new(EmbeddingsResponse)
+	err := c.cc.Invoke(ctx, Proxy_CreateEmbeddings_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ProxyServer is the server API for Proxy service.
+// All implementations must embed UnimplementedProxyServer
+// for forward compatibility
+type ProxyServer interface {
+	CreateChatCompletion(context.Context, *ChatCompletionRequest) (*ChatCompletionResponse, error)
+	StreamChatCompletion(*ChatCompletionRequest, Proxy_StreamChatCompletionServer) error
+	CreateCompletion(context.Context, *CompletionRequest) (*CompletionResponse, error)
+	StreamCompletion(*CompletionRequest, Proxy_StreamCompletionServer) error
+	CreateEmbeddings(context.Context, *EmbeddingsRequest) (*EmbeddingsResponse, error)
+	mustEmbedUnimplementedProxyServer()
+}
+
+// UnimplementedProxyServer must be embedded to have forward compatible implementations.
+type UnimplementedProxyServer struct {
+}
+
+func (UnimplementedProxyServer) CreateChatCompletion(context.Context, *ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateChatCompletion not implemented")
+}
+func (UnimplementedProxyServer) StreamChatCompletion(*ChatCompletionRequest, Proxy_StreamChatCompletionServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamChatCompletion not implemented")
+}
+func (UnimplementedProxyServer) CreateCompletion(context.Context, *CompletionRequest) (*CompletionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateCompletion not implemented")
+}
+func (UnimplementedProxyServer) StreamCompletion(*CompletionRequest, Proxy_StreamCompletionServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamCompletion not implemented")
+}
+func (UnimplementedProxyServer) CreateEmbeddings(context.Context, *EmbeddingsRequest) (*EmbeddingsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateEmbeddings not implemented")
+}
+func (UnimplementedProxyServer) mustEmbedUnimplementedProxyServer() {}
+
+// UnsafeProxyServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ProxyServer will
+// result in compilation errors.
+type UnsafeProxyServer interface {
+	mustEmbedUnimplementedProxyServer()
+}
+
+func RegisterProxyServer(s grpc.ServiceRegistrar, srv ProxyServer) {
+	s.RegisterService(&Proxy_ServiceDesc, srv)
+}
+
+func _Proxy_CreateChatCompletion_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ChatCompletionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyServer).CreateChatCompletion(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Proxy_CreateChatCompletion_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyServer).CreateChatCompletion(ctx, req.(*ChatCompletionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Proxy_StreamChatCompletion_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ChatCompletionRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ProxyServer).StreamChatCompletion(m, &proxyStreamChatCompletionServer{stream})
+}
+
+type Proxy_StreamChatCompletionServer interface {
+	Send(*ChatCompletionChunk) error
+	grpc.ServerStream
+}
+
+type proxyStreamChatCompletionServer struct {
+	grpc.ServerStream
+}
+
+func (x *proxyStreamChatCompletionServer) Send(m *ChatCompletionChunk) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Proxy_CreateCompletion_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CompletionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyServer).CreateCompletion(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Proxy_CreateCompletion_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyServer).CreateCompletion(ctx, req.(*CompletionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Proxy_StreamCompletion_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(CompletionRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ProxyServer).StreamCompletion(m, &proxyStreamCompletionServer{stream})
+}
+
+type Proxy_StreamCompletionServer interface {
+	Send(*CompletionResponse) error
+	grpc.ServerStream
+}
+
+type proxyStreamCompletionServer struct {
+	grpc.ServerStream
+}
+
+func (x *proxyStreamCompletionServer) Send(m *CompletionResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Proxy_CreateEmbeddings_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EmbeddingsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyServer).CreateEmbeddings(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Proxy_CreateEmbeddings_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyServer).CreateEmbeddings(ctx, req.(*EmbeddingsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Proxy_ServiceDesc is the grpc.ServiceDesc for Proxy service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Proxy_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "goproxyai.proxy.v1.Proxy",
+	HandlerType: (*ProxyServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "CreateChatCompletion",
+			Handler:    _Proxy_CreateChatCompletion_Handler,
+		},
+		{
+			MethodName: "CreateCompletion",
+			Handler:    _Proxy_CreateCompletion_Handler,
+		},
+		{
+			MethodName: "CreateEmbeddings",
+			Handler:    _Proxy_CreateEmbeddings_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamChatCompletion",
+			Handler:       _Proxy_StreamChatCompletion_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "StreamCompletion",
+			Handler:       _Proxy_StreamCompletion_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "proxy/v1/proxy.proto",
+}
@@ -0,0 +1,276 @@
+// Package proxytest runs the proxy in-process against a programmable
+// upstream, for integration tests of code that embeds or sits behind it.
+//
+//	h := proxytest.New(t, proxytest.WithEnv("CACHE_TTL", "1m"), proxytest.WithFakeClock(time.Now()))
+//	h.Upstream.Enqueue("POST", "/v1/chat/completions", proxytest.Chat("first"), proxytest.Chat("second"))
+//	h.Run(
+//		proxytest.Step{Name: "miss", Path: "/v1/chat/completions", Body: chat, WantStatus: 200, WantHeader: map[string]string{"X-Cache": "MISS"}},
+//		proxytest.Step{Name: "hit", Path: "/v1/chat/completions", Body: chat, WantHeader: map[string]string{"X-Cache": "HIT"}},
+//		proxytest.Step{Name: "expired", Advance: time.Minute, Path: "/v1/chat/completions", Body: chat, WantBody: "second"},
+//	)
+//
+// The server is configured from the same variables as the real one, but
+// only those given with WithEnv and WithFile: the process environment is
+// ignored so tests don't depend on where they run. As with the real server,
+// an invalid configuration exits the process.
+package proxytest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"goproxyai/internal/clock"
+	"goproxyai/internal/config"
+	"goproxyai/internal/server"
+)
+
+// APIKey is sent as the bearer token by the harness's requests unless they
+// set Authorization themselves
+const APIKey = "sk-proxytest"
+
+// Harness is a proxy under test and the upstream behind it
+type Harness struct {
+	URL      string // the proxy's base URL
+	Upstream *Upstream
+	Clock    *FakeClock // nil unless WithFakeClock was given
+	Client   *http.Client
+
+	t testing.TB
+}
+
+type options struct {
+	env   map[string]string
+	files map[string]string
+	clock *FakeClock
+}
+
+// Option configures a harness
+type Option func(*options)
+
+// WithEnv sets a configuration variable, e.g. WithEnv("RATE_LIMIT", "5")
+func WithEnv(key, value string) Option {
+	return func(o *options) {
+		o.env[key] = value
+	}
+}
+
+// WithFile writes contents to a temporary file and points the variable at
+// it, e.g. WithFile("TENANTS_FILE", `{"tenants": [...]}`)
+func WithFile(key, contents string) Option {
+	return func(o *options) {
+		o.files[key] = contents
+	}
+}
+
+// WithFakeClock installs a fake clock stopped at start for the life of the
+// test. The clock is process-wide, so tests using it mustn't run in
+// parallel with other tests of the proxy.
+func WithFakeClock(start time.Time) Option {
+	return func(o *options) {
+		o.clock = NewFakeClock(start)
+	}
+}
+
+// New starts an upstream and a proxy forwarding to it, both shut down when
+// the test ends
+func New(t testing.TB, opts ...Option) *Harness {
+	t.Helper()
+
+	o := &options{env: make(map[string]string), files: make(map[string]string)}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	upstream, err := newUpstream()
+	if err != nil {
+		t.Fatalf("proxytest: start upstream: %v", err)
+	}
+	t.Cleanup(upstream.Close)
+
+	env := map[string]string{"OPENAI_API_URL": upstream.URL()}
+	for key, value := range o.env {
+		env[key] = value
+	}
+	if len(o.files) > 0 {
+		dir := t.TempDir()
+		for key, contents := range o.files {
+			file := filepath.Join(dir, strings.ToLower(key))
+			if err := os.WriteFile(file, []byte(contents), 0o600); err != nil {
+				t.Fatalf("proxytest: write %s: %v", key, err)
+			}
+			env[key] = file
+		}
+	}
+
+	if o.clock != nil {
+		t.Cleanup(clock.Set(o.clock))
+	}
+
+	srv := server.New(config.LoadFrom(func(key string) string { return env[key] }))
+	proxyServer := httptest.NewServer(srv.Handler())
+	t.Cleanup(proxyServer.Close)
+
+	return &Harness{
+		URL:      proxyServer.URL,
+		Upstream: upstream,
+		Clock:    o.clock,
+		Client:   proxyServer.Client(),
+		t:        t,
+	}
+}
+
+// Response is a response from the proxy, read in full
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// JSON decodes the response body into v
+func (r *Response) JSON(v interface{}) error {
+	return json.Unmarshal(r.Body, v)
+}
+
+// Do sends a request to the proxy and reads the response, failing the test
+// if it can't be sent. body may be nil, a string, []byte, or a value to
+// encode as JSON.
+func (h *Harness) Do(method, path string, body interface{}, header http.Header) *Response {
+	h.t.Helper()
+
+	var reader io.Reader
+	switch body := body.(type) {
+	case nil:
+	case string:
+		reader = strings.NewReader(body)
+	case []byte:
+		reader = bytes.NewReader(body)
+	default:
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			h.t.Fatalf("proxytest: encode body: %v", err)
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, h.URL+path, reader)
+	if err != nil {
+		h.t.Fatalf("proxytest: %v", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if req.Header.Get("Authorization") == "" {
+		req.Header.Set("Authorization", "Bearer "+APIKey)
+	}
+	if body != nil && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		h.t.Fatalf("proxytest: %s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		h.t.Fatalf("proxytest: read %s %s: %v", method, path, err)
+	}
+	return &Response{StatusCode: resp.StatusCode, Header: resp.Header, Body: data}
+}
+
+// Get sends a GET to the proxy
+func (h *Harness) Get(path string) *Response {
+	h.t.Helper()
+	return h.Do(http.MethodGet, path, nil, nil)
+}
+
+// Post sends a POST with a JSON body to the proxy
+func (h *Harness) Post(path string, body interface{}) *Response {
+	h.t.Helper()
+	return h.Do(http.MethodPost, path, body, nil)
+}
+
+// Step is one request of a scenario and what its response should be.
+// Unset expectations aren't checked.
+type Step struct {
+	Name string
+
+	// Advance moves the fake clock forward before the request
+	Advance time.Duration
+	// Upstream answers the step's requests upstream, in order, ahead of
+	// anything already programmed
+	Upstream []http.HandlerFunc
+
+	Method string // POST when there's a body, GET otherwise
+	Path   string
+	Body   interface{}
+	Header http.Header
+
+	WantStatus int
+	WantHeader map[string]string // an empty value means the header must be absent
+	WantBody   string            // a substring of the body
+	Check      func(t testing.TB, resp *Response)
+}
+
+// Run runs the steps in order, reporting every expectation a step misses
+// and stopping once the test has failed
+func (h *Harness) Run(steps ...Step) {
+	h.t.Helper()
+	for i, step := range steps {
+		name := step.Name
+		if name == "" {
+			name = fmt.Sprintf("step %d", i+1)
+		}
+		h.runStep(name, step)
+		if h.t.Failed() {
+			h.t.FailNow()
+		}
+	}
+}
+
+func (h *Harness) runStep(name string, step Step) {
+	h.t.Helper()
+
+	if step.Advance != 0 {
+		if h.Clock == nil {
+			h.t.Fatalf("%s: Advance needs a harness created WithFakeClock", name)
+		}
+		h.Clock.Advance(step.Advance)
+	}
+	method := step.Method
+	if method == "" {
+		method = http.MethodGet
+		if step.Body != nil {
+			method = http.MethodPost
+		}
+	}
+	if len(step.Upstream) > 0 {
+		path, _, _ := strings.Cut(step.Path, "?")
+		h.Upstream.enqueueFirst(method, path, step.Upstream)
+	}
+
+	resp := h.Do(method, step.Path, step.Body, step.Header)
+	if step.WantStatus != 0 && resp.StatusCode != step.WantStatus {
+		h.t.Errorf("%s: status %d, want %d; body: %s", name, resp.StatusCode, step.WantStatus, resp.Body)
+	}
+	for header, want := range step.WantHeader {
+		if got := resp.Header.Get(header); got != want {
+			h.t.Errorf("%s: header %s is %q, want %q", name, header, got, want)
+		}
+	}
+	if step.WantBody != "" && !bytes.Contains(resp.Body, []byte(step.WantBody)) {
+		h.t.Errorf("%s: body doesn't contain %q: %s", name, step.WantBody, resp.Body)
+	}
+	if step.Check != nil {
+		step.Check(h.t, resp)
+	}
+}
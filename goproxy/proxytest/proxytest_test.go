@@ -0,0 +1,72 @@
+package proxytest_test
+
+import (
+	"testing"
+	"time"
+
+	"goproxyai/proxytest"
+)
+
+var chat = map[string]interface{}{
+	"model":    "gpt-4o-mini",
+	"messages": []map[string]string{{"role": "user", "content": "Hello"}},
+}
+
+func TestCachedAnswerExpiresWithTheClock(t *testing.T) {
+	h := proxytest.New(t, proxytest.WithEnv("CACHE_TTL", "1m"), proxytest.WithFakeClock(time.Now()))
+	h.Upstream.Enqueue("POST", "/v1/chat/completions", proxytest.Chat("first"), proxytest.Chat("second"))
+
+	h.Run(
+		proxytest.Step{Name: "miss", Path: "/v1/chat/completions", Body: chat, WantStatus: 200,
+			WantHeader: map[string]string{"X-Cache": "MISS"}, WantBody: "first"},
+		proxytest.Step{Name: "hit", Advance: 30 * time.Second, Path: "/v1/chat/completions", Body: chat,
+			WantHeader: map[string]string{"X-Cache": "HIT"}, WantBody: "first"},
+		proxytest.Step{Name: "expired", Advance: time.Minute, Path: "/v1/chat/completions", Body: chat,
+			WantHeader: map[string]string{"X-Cache": "MISS"}, WantBody: "second"},
+	)
+
+	if requests := len(h.Upstream.Requests()); requests != 2 {
+		t.Errorf("upstream got %d requests, want 2", requests)
+	}
+}
+
+func TestChargebackFollowsTheClock(t *testing.T) {
+	h := proxytest.New(t, proxytest.WithFakeClock(time.Date(2025, time.January, 31, 23, 0, 0, 0, time.UTC)))
+	h.Upstream.Handle("POST", "/v1/chat/completions", proxytest.Chat("one two three"))
+
+	h.Run(
+		proxytest.Step{Name: "january", Path: "/v1/chat/completions", Body: chat, WantStatus: 200},
+		proxytest.Step{Name: "february", Advance: 2 * time.Hour, Path: "/v1/chat/completions", Body: chat, WantStatus: 200},
+	)
+
+	for _, tc := range []struct {
+		path  string
+		month string
+	}{
+		{"/admin/reports/chargeback", "2025-02"},
+		{"/admin/reports/chargeback?month=2025-01", "2025-01"},
+	} {
+		var report struct {
+			Month   string `json:"month"`
+			Tenants []struct {
+				Models []struct {
+					Requests         int64 `json:"requests"`
+					CompletionTokens int64 `json:"completion_tokens"`
+				} `json:"models"`
+			} `json:"tenants"`
+		}
+		resp := h.Get(tc.path)
+		if err := resp.JSON(&report); err != nil {
+			t.Fatalf("%s: %v: %s", tc.path, err, resp.Body)
+		}
+		if report.Month != tc.month {
+			t.Errorf("%s: month %q, want %q", tc.path, report.Month, tc.month)
+		}
+		if len(report.Tenants) != 1 || len(report.Tenants[0].Models) != 1 {
+			t.Fatalf("%s: want one tenant and model, got %s", tc.path, resp.Body)
+		}
+		if model := report.Tenants[0].Models[0]; model.Requests != 1 || model.CompletionTokens != 3 {
+			t.Errorf("%s: %d requests and %d completion tokens, want 1 and 3", tc.path, model.Requests, model.CompletionTokens)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package proxytest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"goproxyai/internal/proxy"
+)
+
+// Request is a request the upstream received from the proxy
+type Request struct {
+	Method string
+	Path   string
+	Query  string
+	Header http.Header
+	Body   []byte
+}
+
+// JSON decodes the request body into v
+func (r Request) JSON(v interface{}) error {
+	return json.Unmarshal(r.Body, v)
+}
+
+// Upstream is a programmable stand-in for the OpenAI API. Requests are
+// answered by the responses queued for their method and path, in order, then
+// by the handler set for it, and otherwise by the same canned chat,
+// completion, embedding, moderation and model list responses as
+// UPSTREAM_MODE=mock.
+type Upstream struct {
+	server *httptest.Server
+	mock   *proxy.MockTransport
+
+	mutex    sync.Mutex
+	queued   map[string][]http.HandlerFunc
+	handlers map[string]http.HandlerFunc
+	requests []Request
+}
+
+func newUpstream() (*Upstream, error) {
+	mock, err := proxy.NewMockTransport("", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	u := &Upstream{
+		mock:     mock,
+		queued:   make(map[string][]http.HandlerFunc),
+		handlers: make(map[string]http.HandlerFunc),
+	}
+	u.server = httptest.NewServer(http.HandlerFunc(u.serve))
+	return u, nil
+}
+
+// URL is the upstream's base URL, which the proxy forwards to
+func (u *Upstream) URL() string {
+	return u.server.URL
+}
+
+// Close shuts the upstream down. The harness does so when its test ends.
+func (u *Upstream) Close() {
+	u.server.Close()
+}
+
+// Handle answers every request for method and path with handler, once any
+// queued responses have been used up
+func (u *Upstream) Handle(method, path string, handler http.HandlerFunc) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.handlers[method+" "+path] = handler
+}
+
+// Enqueue answers the next requests for method and path with handlers, one
+// request each, in order
+func (u *Upstream) Enqueue(method, path string, handlers ...http.HandlerFunc) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.queued[method+" "+path] = append(u.queued[method+" "+path], handlers...)
+}
+
+func (u *Upstream) enqueueFirst(method, path string, handlers []http.HandlerFunc) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	key := method + " " + path
+	u.queued[key] = append(append([]http.HandlerFunc{}, handlers...), u.queued[key]...)
+}
+
+// Requests returns the requests received so far, oldest first
+func (u *Upstream) Requests() []Request {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return append([]Request{}, u.requests...)
+}
+
+// LastRequest returns the most recent request received, and false if there
+// hasn't been one
+func (u *Upstream) LastRequest() (Request, bool) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if len(u.requests) == 0 {
+		return Request{}, false
+	}
+	return u.requests[len(u.requests)-1], true
+}
+
+// Reset forgets the received requests and every programmed response
+func (u *Upstream) Reset() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.queued = make(map[string][]http.HandlerFunc)
+	u.handlers = make(map[string]http.HandlerFunc)
+	u.requests = nil
+}
+
+func (u *Upstream) serve(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	key := r.Method + " " + r.URL.Path
+	u.mutex.Lock()
+	u.requests = append(u.requests, Request{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Query:  r.URL.RawQuery,
+		Header: r.Header.Clone(),
+		Body:   body,
+	})
+	handler := u.handlers[key]
+	if queued := u.queued[key]; len(queued) > 0 {
+		handler = queued[0]
+		u.queued[key] = queued[1:]
+	}
+	u.mutex.Unlock()
+
+	if handler != nil {
+		handler(w, r)
+		return
+	}
+	u.serveMock(w, r)
+}
+
+func (u *Upstream) serveMock(w http.ResponseWriter, r *http.Request) {
+	resp, err := u.mock.RoundTrip(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer resp.Body.Close()
+
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	flusher, _ := w.(http.Flusher)
+	buffer := make([]byte, 4096)
+	for {
+		n, err := resp.Body.Read(buffer)
+		if n > 0 {
+			w.Write(buffer[:n])
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// JSON responds with status and v encoded as JSON
+func JSON(status int, v interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+// Error responds with status and an error in the OpenAI format. 429s carry
+// a Retry-After of one second, as OpenAI's do.
+func Error(status int, message, errorType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "1")
+		}
+		JSON(status, map[string]interface{}{"error": map[string]interface{}{
+			"message": message,
+			"type":    errorType,
+			"code":    nil,
+		}})(w, r)
+	}
+}
+
+// Chat answers a chat completion with content, for the model the request
+// asked for, with usage counted one token per word
+func Chat(content string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Model string `json:"model"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		completionTokens := len(strings.Fields(content))
+		JSON(http.StatusOK, map[string]interface{}{
+			"id":      fmt.Sprintf("chatcmpl-test%d", time.Now().UnixNano()),
+			"object":  "chat.completion",
+			"created": time.Now().Unix(),
+			"model":   request.Model,
+			"choices": []map[string]interface{}{{
+				"index":         0,
+				"message":       map[string]interface{}{"role": "assistant", "content": content},
+				"finish_reason": "stop",
+			}},
+			"usage": map[string]interface{}{
+				"prompt_tokens":     10,
+				"completion_tokens": completionTokens,
+				"total_tokens":      10 + completionTokens,
+			},
+		})(w, r)
+	}
+}
+
+// Stream responds with a server-sent event stream of events, each a JSON
+// value or string sent as one data line, ended with [DONE]
+func Stream(events ...interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher, _ := w.(http.Flusher)
+		for _, event := range events {
+			data, ok := event.(string)
+			if !ok {
+				encoded, _ := json.Marshal(event)
+				data = string(encoded)
+			}
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		io.WriteString(w, "data: [DONE]\n\n")
+	}
+}
+
+// Delay waits d, or until the proxy gives up on the request, before
+// handing it to handler. The wait is real time, not the fake clock's.
+func Delay(d time.Duration, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(d):
+		}
+		handler(w, r)
+	}
+}
+
+// Hang never responds, holding the request until the proxy gives up on it
+func Hang() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}
+}
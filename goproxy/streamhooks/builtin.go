@@ -0,0 +1,75 @@
+package streamhooks
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+func init() {
+	Register("censor", func(getenv func(string) string) (Hook, error) {
+		pattern := getenv("STREAM_CENSOR_PATTERN")
+		if pattern == "" {
+			return nil, errors.New("STREAM_CENSOR_PATTERN isn't set")
+		}
+		censored, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("STREAM_CENSOR_PATTERN: %w", err)
+		}
+		replacement := getenv("STREAM_CENSOR_REPLACEMENT")
+		if replacement == "" {
+			replacement = "[censored]"
+		}
+		return HookFunc(func(stream *Stream, event Event) ([]Event, error) {
+			_, err := event.MapText(func(text string) string {
+				return censored.ReplaceAllLiteralString(text, replacement)
+			})
+			return []Event{event}, err
+		}), nil
+	})
+	Register("drop_events", func(getenv func(string) string) (Hook, error) {
+		var types []string
+		for _, name := range strings.Split(getenv("STREAM_DROP_EVENTS"), ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				types = append(types, name)
+			}
+		}
+		if len(types) == 0 {
+			return nil, errors.New("STREAM_DROP_EVENTS isn't set")
+		}
+		return HookFunc(func(stream *Stream, event Event) ([]Event, error) {
+			if matchesType(eventType(event), types) {
+				return nil, nil
+			}
+			return []Event{event}, nil
+		}), nil
+	})
+}
+
+// eventType is an event's event field, or the type its data names, as
+// Responses API events do
+func eventType(event Event) string {
+	if event.Type != "" {
+		return event.Type
+	}
+	if body, ok := event.JSON(); ok {
+		kind, _ := body["type"].(string)
+		return kind
+	}
+	return ""
+}
+
+// matchesType reports whether an event type is one of types, where a type
+// ending in * matches every type it starts
+func matchesType(kind string, types []string) bool {
+	if kind == "" {
+		return false
+	}
+	for _, t := range types {
+		if prefix, wildcard := strings.CutSuffix(t, "*"); wildcard && strings.HasPrefix(kind, prefix) || t == kind {
+			return true
+		}
+	}
+	return false
+}
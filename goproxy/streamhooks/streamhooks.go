@@ -0,0 +1,275 @@
+// Package streamhooks lets server-sent events be rewritten on their way to
+// the client, one whole event at a time, so hooks never have to deal with
+// how events are split into lines and chunks. Hooks register themselves by
+// name, usually from an init function, and STREAM_HOOKS picks which run and
+// in what order:
+//
+//	func init() {
+//		streamhooks.Register("drop_refusals", func(getenv func(string) string) (streamhooks.Hook, error) {
+//			return dropRefusals{}, nil
+//		})
+//	}
+//
+// A custom build registers its own hooks by adding a file to cmd/server
+// that imports their package for its side effects.
+package streamhooks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Event is one server-sent event
+type Event struct {
+	Type     string   // the event field, empty for the default message event
+	ID       string   // the id field
+	Retry    string   // the retry field
+	Data     string   // the data lines, joined by newlines
+	Comments []string // comment lines, without their leading colon
+}
+
+// Stream is the stream events belong to
+type Stream struct {
+	Path   string // such as /v1/chat/completions or /v1/responses
+	Model  string // the model the request asked for
+	Tenant string // the tenant the request was made for, if any
+}
+
+// Hook rewrites a stream's events. Event returns what the client gets in
+// place of event: event itself to pass it on, changed or not, nothing to
+// drop it, or several events to add some around it. A hook that fails
+// leaves the event as upstream sent it.
+type Hook interface {
+	Event(stream *Stream, event Event) ([]Event, error)
+}
+
+// Keepalive is implemented by hooks that send events of their own while
+// upstream is quiet, in place of the heartbeat comment
+// SSE_HEARTBEAT_INTERVAL sends
+type Keepalive interface {
+	Keepalive(stream *Stream) []Event
+}
+
+// HookFunc adapts a function to a Hook
+type HookFunc func(stream *Stream, event Event) ([]Event, error)
+
+func (f HookFunc) Event(stream *Stream, event Event) ([]Event, error) {
+	return f(stream, event)
+}
+
+// Factory builds a hook, reading any settings of its own with getenv
+type Factory func(getenv func(key string) string) (Hook, error)
+
+var (
+	mutex     sync.RWMutex
+	factories = make(map[string]Factory)
+)
+
+// Register makes a hook available under name. It panics if the name is
+// already taken, since that's a build mistake.
+func Register(name string, factory Factory) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if _, found := factories[name]; found {
+		panic("streamhooks: hook " + name + " registered twice")
+	}
+	factories[name] = factory
+}
+
+// Names lists the registered hooks
+func Names() []string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Chain runs hooks in order
+type Chain []Hook
+
+// Build makes the chain of the named hooks
+func Build(names []string, getenv func(key string) string) (Chain, error) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	chain := make(Chain, 0, len(names))
+	for _, name := range names {
+		factory, found := factories[name]
+		if !found {
+			return nil, fmt.Errorf("unknown hook %q", name)
+		}
+		hook, err := factory(getenv)
+		if err != nil {
+			return nil, fmt.Errorf("hook %s: %w", name, err)
+		}
+		chain = append(chain, hook)
+	}
+	return chain, nil
+}
+
+// Event runs event through every hook in turn, each getting the events the
+// one before returned, stopping at the first that fails
+func (c Chain) Event(stream *Stream, event Event) ([]Event, error) {
+	events := []Event{event}
+	for _, hook := range c {
+		var next []Event
+		for _, event := range events {
+			rewritten, err := hook.Event(stream, event)
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, rewritten...)
+		}
+		events = next
+	}
+	return events, nil
+}
+
+// Keepalive returns the events the hooks send while upstream is quiet, or
+// nil when none of them do
+func (c Chain) Keepalive(stream *Stream) []Event {
+	var events []Event
+	for _, hook := range c {
+		if keepalive, ok := hook.(Keepalive); ok {
+			events = append(events, keepalive.Keepalive(stream)...)
+		}
+	}
+	return events
+}
+
+// Parse reads an event from its lines, with or without the blank line that
+// ends it. Fields the event stream format doesn't define are ignored, as
+// clients ignore them.
+func Parse(raw []byte) Event {
+	var event Event
+	var data []string
+	for _, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch name {
+		case "":
+			event.Comments = append(event.Comments, value)
+		case "event":
+			event.Type = value
+		case "id":
+			event.ID = value
+		case "retry":
+			event.Retry = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+	event.Data = strings.Join(data, "\n")
+	return event
+}
+
+// Bytes encodes the event as its lines, and the blank line that ends it
+func (e Event) Bytes() []byte {
+	var buf bytes.Buffer
+	for _, comment := range e.Comments {
+		buf.WriteString(": " + comment + "\n")
+	}
+	for _, field := range []struct{ name, value string }{{"event", e.Type}, {"id", e.ID}, {"retry", e.Retry}} {
+		if field.value != "" {
+			buf.WriteString(field.name + ": " + field.value + "\n")
+		}
+	}
+	if e.Data != "" {
+		for _, line := range strings.Split(e.Data, "\n") {
+			buf.WriteString("data: " + line + "\n")
+		}
+	}
+	buf.WriteString("\n")
+	return buf.Bytes()
+}
+
+// Equal reports whether two events are the same
+func (e Event) Equal(other Event) bool {
+	if e.Type != other.Type || e.ID != other.ID || e.Retry != other.Retry || e.Data != other.Data || len(e.Comments) != len(other.Comments) {
+		return false
+	}
+	for i, comment := range e.Comments {
+		if comment != other.Comments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Done reports whether the event is the [DONE] that ends an OpenAI stream
+func (e Event) Done() bool {
+	return strings.TrimSpace(e.Data) == "[DONE]"
+}
+
+// JSON decodes the event's data, with numbers as json.Number. It returns
+// false when the data isn't a JSON object.
+func (e Event) JSON() (map[string]interface{}, bool) {
+	var body map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(e.Data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&body); err != nil || body == nil {
+		return nil, false
+	}
+	return body, true
+}
+
+// SetJSON replaces the event's data with body encoded on one line
+func (e *Event) SetJSON(body map[string]interface{}) error {
+	var encoded bytes.Buffer
+	encoder := json.NewEncoder(&encoded)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(body); err != nil {
+		return err
+	}
+	e.Data = strings.TrimSuffix(encoded.String(), "\n")
+	return nil
+}
+
+// MapText replaces the generated text an event carries with f applied to
+// it: chat completion deltas, completion text and Responses API text
+// deltas. It reports whether the event changed. Events without text, such
+// as tool call deltas, are left alone.
+func (e *Event) MapText(f func(string) string) (bool, error) {
+	body, ok := e.JSON()
+	if !ok {
+		return false, nil
+	}
+	changed := false
+	mapText := func(fields map[string]interface{}, key string) {
+		if text, ok := fields[key].(string); ok && text != "" {
+			if mapped := f(text); mapped != text {
+				fields[key] = mapped
+				changed = true
+			}
+		}
+	}
+	choices, _ := body["choices"].([]interface{})
+	for _, item := range choices {
+		choice, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		mapText(choice, "text")
+		if delta, ok := choice["delta"].(map[string]interface{}); ok {
+			mapText(delta, "content")
+		}
+	}
+	if kind, _ := body["type"].(string); kind == "response.output_text.delta" {
+		mapText(body, "delta")
+	}
+	if !changed {
+		return false, nil
+	}
+	return true, e.SetJSON(body)
+}